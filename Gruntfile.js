@@ -1,7 +1,7 @@
 module.exports = function (grunt) {
 	grunt.initConfig({
 		clean: {
-			www: ['www']
+			www: ['www/*', '!www/.gitkeep']
 		},
 
 		copy: {
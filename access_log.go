@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/go-martini/martini"
 	"github.com/jmoiron/sqlx"
@@ -23,6 +24,7 @@ type AccessLogEntry struct {
 	Status      int     `db:"status"`
 	Context     *string `db:"context"`
 	RequestBody *string `db:"request_body"`
+	hash        string
 	_db         *sqlx.Tx
 }
 
@@ -31,9 +33,21 @@ func (a *AccessLogEntry) Save() error {
 		return errors.New("Existing access log entries cannot be updated.")
 	}
 
+	a.RequestedAt = databaseNow(a._db)
+	prevHash := accessLogHead(a.Consumer, a._db)
+	a.hash = chainHash(prevHash, accessLogLink{
+		Secret:      a.Secret,
+		Consumer:    a.Consumer,
+		RequestedAt: a.RequestedAt,
+		OriginIp:    a.OriginIp,
+		Status:      a.Status,
+		Context:     a.Context,
+		RequestBody: a.RequestBody,
+	})
+
 	result, err := a._db.Exec(
-		"INSERT INTO `access_log` (`secret_id`, `consumer_id`, `requested_at`, `origin_ip`, `status`, `context`, `request_body`) VALUES (?,?,NOW(),?,?,?,?)",
-		a.Secret, a.Consumer, a.OriginIp, a.Status, a.Context, a.RequestBody,
+		"INSERT INTO `access_log` (`secret_id`, `consumer_id`, `requested_at`, `origin_ip`, `status`, `context`, `request_body`, `prev_hash`, `hash`) VALUES (?,?,?,?,?,?,?,?,?)",
+		a.Secret, a.Consumer, a.RequestedAt, a.OriginIp, a.Status, a.Context, a.RequestBody, prevHash, a.hash,
 	)
 
 	if err != nil {
@@ -66,13 +80,75 @@ func (e *AccessLogEntry) GetConsumer() *Consumer {
 	return findConsumer(*e.Consumer, e._db)
 }
 
+// IssuedSerial is the serial of the certificate a consumer obtained from a certificate authority
+// with this request, if any.
+func (e *AccessLogEntry) IssuedSerial() string {
+	if e.Context == nil {
+		return ""
+	}
+
+	ctx := struct {
+		Certificate issueContext `json:"certificate"`
+	}{}
+
+	json.Unmarshal([]byte(*e.Context), &ctx)
+
+	return ctx.Certificate.Serial
+}
+
+// LeaseUser is the database user a consumer obtained from a dynamic secret with this request, if
+// any.
+func (e *AccessLogEntry) LeaseUser() string {
+	if e.Context == nil {
+		return ""
+	}
+
+	ctx := struct {
+		Lease leaseContext `json:"lease"`
+	}{}
+
+	json.Unmarshal([]byte(*e.Context), &ctx)
+
+	return ctx.Lease.Username
+}
+
+// EncryptedFor is the fingerprint of the key the delivery was encrypted to, if any.
+func (e *AccessLogEntry) EncryptedFor() string {
+	if e.Context == nil {
+		return ""
+	}
+
+	ctx := struct {
+		Encryption encryptionContext `json:"encryption"`
+	}{}
+
+	json.Unmarshal([]byte(*e.Context), &ctx)
+
+	return ctx.Encryption.Fingerprint
+}
+
+// SharedVia is the ID of the one-time link that was used with this request, if any.
+func (e *AccessLogEntry) SharedVia() int {
+	if e.Context == nil {
+		return 0
+	}
+
+	ctx := struct {
+		Share shareContext `json:"share"`
+	}{}
+
+	json.Unmarshal([]byte(*e.Context), &ctx)
+
+	return ctx.Share.Id
+}
+
 type AccessLog interface {
 	FindAll(int, int) []AccessLogEntry
 	Find([]int, []int, []int, int, int) []AccessLogEntry
 	Count([]int, []int, []int) int
 
 	LogNotFound(*Consumer, *Secret, *http.Request)
-	LogAccess(*Consumer, *Secret, *http.Request, int, interface{})
+	LogAccess(*Consumer, *Secret, *http.Request, int, interface{}) int
 }
 
 type accessLogStruct struct {
@@ -116,7 +192,8 @@ func (a *accessLogStruct) LogNotFound(consumer *Consumer, secret *Secret, req *h
 	a.LogAccess(consumer, secret, req, 404, nil)
 }
 
-func (a *accessLogStruct) LogAccess(consumer *Consumer, secret *Secret, req *http.Request, status int, ctx interface{}) {
+// LogAccess writes a new entry and returns its ID.
+func (a *accessLogStruct) LogAccess(consumer *Consumer, secret *Secret, req *http.Request, status int, ctx interface{}) int {
 	entry := AccessLogEntry{}
 	entry.OriginIp = getIP(req)
 	entry.Status = status
@@ -148,10 +225,29 @@ func (a *accessLogStruct) LogAccess(consumer *Consumer, secret *Secret, req *htt
 	if err != nil {
 		panic(err)
 	}
+
+	event := &Event{
+		Time:     time.Now(),
+		Type:     EventTypeAccess,
+		Status:   status,
+		Secret:   entry.Secret,
+		Consumer: entry.Consumer,
+		OriginIp: entry.OriginIp,
+		Hash:     entry.hash,
+	}
+
+	if entry.Context != nil {
+		event.Context = json.RawMessage(*entry.Context)
+	}
+
+	eventBus.Queue(a.db, event)
+	alertRules.Evaluate(&entry, a.db)
+
+	return entry.Id
 }
 
 func (a *accessLogStruct) buildWhereStatement(secretIds []int, consumerIds []int, states []int) string {
-	where := "1"
+	where := "1 = 1"
 
 	if len(secretIds) > 0 {
 		where += fmt.Sprintf(" AND `secret_id` IN (%s)", concatIntList(secretIds))
@@ -175,7 +271,7 @@ func (a *accessLogStruct) buildLimitStatement(limit int, offset int) string {
 	}
 
 	if offset > 0 {
-		return fmt.Sprintf("LIMIT %d,%d", offset, limit)
+		return fmt.Sprintf("LIMIT %d OFFSET %d", limit, offset)
 	}
 
 	return fmt.Sprintf("LIMIT %d", limit)
@@ -272,5 +368,6 @@ func accessLogIndexAction(user *User, req *http.Request, session *Session, db *s
 func setupAccessLogCtrl(app *martini.ClassicMartini) {
 	app.Group("/accesslog", func(r martini.Router) {
 		app.Get("", accessLogIndexAction)
+		app.Get("/volume", sessions.RequireAdmin, accessLogVolumeAction)
 	}, sessions.RequireLogin)
 }
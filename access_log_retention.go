@@ -0,0 +1,366 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// the maximum number of rows pruned in a single run; anything left over is handled in the next run
+const accessLogPruneLimit = 100000
+
+// rows are deleted in chunks to keep the transactions (and locks) short
+const accessLogPruneChunk = 1000
+
+type archivedAccessLogEntry struct {
+	Id          int     `json:"id"`
+	Secret      *int    `json:"secretId"`
+	Consumer    *int    `json:"consumerId"`
+	RequestedAt string  `json:"requestedAt"`
+	OriginIp    string  `json:"originIp"`
+	Status      int     `json:"status"`
+	Context     *string `json:"context"`
+	RequestBody *string `json:"requestBody"`
+}
+
+// AccessLogRetention removes old access log entries, according to the configured maximum age and
+// number of rows per consumer. Before they are deleted, the entries are written to gzipped JSONL
+// files in the archive directory. Deleting without an archive has to be enabled explicitly.
+type AccessLogRetention struct {
+	maxAgeDays         int
+	maxRowsPerConsumer int
+	archiveDirectory   string
+	deleteUnarchived   bool
+}
+
+func NewAccessLogRetention(c *configuration) (*AccessLogRetention, error) {
+	cfg := c.AccessLog
+
+	if cfg.MaxAgeDays < 0 || cfg.MaxRowsPerConsumer < 0 {
+		return nil, errors.New("The access log retention limits cannot be negative.")
+	}
+
+	if cfg.ArchiveDirectory == "" && !cfg.DeleteUnarchived && (cfg.MaxAgeDays > 0 || cfg.MaxRowsPerConsumer > 0) {
+		return nil, errors.New("The access log retention requires an archive directory (or deleteUnarchived to delete entries without archiving them).")
+	}
+
+	if cfg.ArchiveDirectory != "" {
+		info, err := os.Stat(cfg.ArchiveDirectory)
+		if err != nil {
+			return nil, errors.New("Could not use the access log archive directory: " + err.Error())
+		}
+
+		if !info.IsDir() {
+			return nil, errors.New("The access log archive directory '" + cfg.ArchiveDirectory + "' is not a directory.")
+		}
+	}
+
+	return &AccessLogRetention{
+		maxAgeDays:         cfg.MaxAgeDays,
+		maxRowsPerConsumer: cfg.MaxRowsPerConsumer,
+		archiveDirectory:   cfg.ArchiveDirectory,
+		deleteUnarchived:   cfg.DeleteUnarchived,
+	}, nil
+}
+
+func (r *AccessLogRetention) Enabled() bool {
+	return r.maxAgeDays > 0 || r.maxRowsPerConsumer > 0
+}
+
+// Run prunes the access log every interval.
+func (r *AccessLogRetention) Run(database *sqlx.DB, interval time.Duration) {
+	for {
+		pruned, err := r.Prune(database)
+		if err != nil {
+			log.Println("Warning: Pruning the access log failed: " + err.Error())
+		} else if pruned > 0 {
+			log.Printf("Pruned %d access log entries.", pruned)
+		}
+
+		<-time.After(interval)
+	}
+}
+
+// Prune archives and deletes all entries that exceed the retention limits and returns the number
+// of deleted entries. Nothing is deleted if the archive could not be written. Without an archive
+// directory, entries are only deleted if deleteUnarchived is set.
+func (r *AccessLogRetention) Prune(database *sqlx.DB) (int, error) {
+	if !r.Enabled() {
+		return 0, nil
+	}
+
+	if r.archiveDirectory == "" && !r.deleteUnarchived {
+		return 0, errors.New("No archive directory configured, refusing to delete access log entries.")
+	}
+
+	tx, err := database.Beginx()
+	if err != nil {
+		return 0, err
+	}
+
+	ids, err := r.findPrunableIds(tx)
+	tx.Rollback()
+
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	if r.archiveDirectory != "" {
+		err = r.archive(database, ids)
+		if err != nil {
+			return 0, errors.New("Could not archive access log entries: " + err.Error())
+		}
+	}
+
+	err = r.recordPruned(database, ids)
+	if err != nil {
+		return 0, errors.New("Could not record the pruned access log entries: " + err.Error())
+	}
+
+	for start := 0; start < len(ids); start += accessLogPruneChunk {
+		end := start + accessLogPruneChunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		_, err = database.Exec("DELETE FROM `access_log` WHERE `id` IN (" + concatIntList(ids[start:end]) + ")")
+		if err != nil {
+			return start, err
+		}
+	}
+
+	return len(ids), nil
+}
+
+func (r *AccessLogRetention) findPrunableIds(db *sqlx.Tx) ([]int, error) {
+	ids := make([]int, 0)
+	seen := make(map[int]bool)
+
+	add := func(list []int) {
+		for _, id := range list {
+			if !seen[id] && len(ids) < accessLogPruneLimit {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	if r.maxAgeDays > 0 {
+		limit := time.Now().AddDate(0, 0, -r.maxAgeDays).Format("2006-01-02 15:04:05")
+		list := make([]int, 0)
+
+		err := db.Select(&list, fmt.Sprintf("SELECT `id` FROM `access_log` WHERE `requested_at` < ? ORDER BY `id` LIMIT %d", accessLogPruneLimit), limit)
+		if err != nil {
+			return nil, err
+		}
+
+		add(list)
+	}
+
+	if r.maxRowsPerConsumer > 0 {
+		consumers := make([]int, 0)
+
+		err := db.Select(&consumers, "SELECT `consumer_id` FROM `access_log` WHERE `consumer_id` IS NOT NULL GROUP BY `consumer_id` HAVING COUNT(*) > ?", r.maxRowsPerConsumer)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, consumer := range consumers {
+			// the newest entry that is not kept anymore
+			cutoff := 0
+
+			err := db.Get(&cutoff, fmt.Sprintf("SELECT `id` FROM `access_log` WHERE `consumer_id` = ? ORDER BY `id` DESC LIMIT 1 OFFSET %d", r.maxRowsPerConsumer), consumer)
+			if err != nil {
+				return nil, err
+			}
+
+			list := make([]int, 0)
+
+			err = db.Select(&list, fmt.Sprintf("SELECT `id` FROM `access_log` WHERE `consumer_id` = ? AND `id` <= ? ORDER BY `id` LIMIT %d", accessLogPruneLimit), consumer, cutoff)
+			if err != nil {
+				return nil, err
+			}
+
+			add(list)
+		}
+	}
+
+	return ids, nil
+}
+
+// recordPruned stores the newest pruned entry of every chain as a checkpoint, so that the
+// verification can tell a pruned chain from one whose first entries have been deleted.
+func (r *AccessLogRetention) recordPruned(database *sqlx.DB, ids []int) error {
+	newest := make(map[string]logCheckpoint)
+
+	for start := 0; start < len(ids); start += accessLogPruneChunk {
+		end := start + accessLogPruneChunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		entries := make([]chainedAccessLogRow, 0)
+
+		err := database.Select(&entries, "SELECT `id`, `consumer_id`, `hash` FROM `access_log` WHERE `id` IN ("+concatIntList(ids[start:end])+") AND `hash` IS NOT NULL")
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			chain := accessLogChainName(entry.Consumer)
+
+			if entry.Id > newest[chain].EntryId {
+				newest[chain] = logCheckpoint{
+					Log:     chainAccessLog,
+					Chain:   chain,
+					EntryId: entry.Id,
+					Hash:    entry.Hash.String,
+					Pruned:  true,
+				}
+			}
+		}
+	}
+
+	tx, err := database.Beginx()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+
+	for _, marker := range newest {
+		marker.CreatedAt = now
+
+		err = marker.insert(tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// archive writes the given entries to a new gzipped JSONL file. The file is written under a
+// temporary name and only renamed once it is completely on disk.
+func (r *AccessLogRetention) archive(database *sqlx.DB, ids []int) error {
+	name := filepath.Join(r.archiveDirectory, "access_log-"+time.Now().Format("20060102-150405")+".jsonl.gz")
+	tmpName := name + ".tmp"
+
+	file, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = r.writeArchive(file, database, ids)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return os.Rename(tmpName, name)
+}
+
+func (r *AccessLogRetention) writeArchive(file *os.File, database *sqlx.DB, ids []int) error {
+	compressor := gzip.NewWriter(file)
+	encoder := json.NewEncoder(compressor)
+
+	for start := 0; start < len(ids); start += accessLogPruneChunk {
+		end := start + accessLogPruneChunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		entries := make([]AccessLogEntry, 0)
+
+		err := database.Select(&entries, "SELECT `id`, `secret_id`, `consumer_id`, `requested_at`, `origin_ip`, `status`, `context`, `request_body` FROM `access_log` WHERE `id` IN ("+concatIntList(ids[start:end])+") ORDER BY `id`")
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			err = encoder.Encode(archivedAccessLogEntry{
+				Id:          entry.Id,
+				Secret:      entry.Secret,
+				Consumer:    entry.Consumer,
+				RequestedAt: entry.RequestedAt,
+				OriginIp:    entry.OriginIp,
+				Status:      entry.Status,
+				Context:     entry.Context,
+				RequestBody: entry.RequestBody,
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return compressor.Close()
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Log volume controller
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type accessLogMonth struct {
+	Month   string `db:"month"`
+	Entries int    `db:"num"`
+	Percent int
+}
+
+type accessLogVolumeData struct {
+	layoutData
+
+	Months             []accessLogMonth
+	Total              int
+	MaxAgeDays         int
+	MaxRowsPerConsumer int
+	ArchiveDirectory   string
+}
+
+func accessLogVolumeAction(user *User, session *Session, db *sqlx.Tx) response {
+	months := make([]accessLogMonth, 0)
+	db.Select(&months, "SELECT DATE_FORMAT(`requested_at`, '%Y-%m') AS `month`, COUNT(*) AS `num` FROM `access_log` GROUP BY `month` ORDER BY `month` DESC")
+
+	data := &accessLogVolumeData{
+		layoutData:         NewLayoutData("Access Log Volume", "accesslog", user, session.CsrfToken),
+		MaxAgeDays:         config.AccessLog.MaxAgeDays,
+		MaxRowsPerConsumer: config.AccessLog.MaxRowsPerConsumer,
+		ArchiveDirectory:   config.AccessLog.ArchiveDirectory,
+	}
+
+	largest := 0
+
+	for _, month := range months {
+		data.Total += month.Entries
+
+		if month.Entries > largest {
+			largest = month.Entries
+		}
+	}
+
+	for i := range months {
+		months[i].Percent = months[i].Entries * 100 / largest
+	}
+
+	data.Months = months
+
+	return renderTemplate(200, "access_log/volume", data)
+}
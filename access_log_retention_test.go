@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestNewAccessLogRetention(t *testing.T) {
+	c := &configuration{}
+
+	if _, err := NewAccessLogRetention(c); err != nil {
+		t.Errorf("Disabled retention was rejected: %v", err)
+	}
+
+	c.AccessLog.MaxAgeDays = 90
+
+	if _, err := NewAccessLogRetention(c); err == nil {
+		t.Error("Retention without an archive directory was accepted.")
+	}
+
+	c.AccessLog.DeleteUnarchived = true
+
+	if _, err := NewAccessLogRetention(c); err != nil {
+		t.Errorf("Retention with deleteUnarchived was rejected: %v", err)
+	}
+
+	c.AccessLog.DeleteUnarchived = false
+	c.AccessLog.ArchiveDirectory = t.TempDir()
+
+	if _, err := NewAccessLogRetention(c); err != nil {
+		t.Errorf("Retention with an archive directory was rejected: %v", err)
+	}
+
+	c.AccessLog.MaxRowsPerConsumer = -1
+
+	if _, err := NewAccessLogRetention(c); err == nil {
+		t.Error("Negative limits were accepted.")
+	}
+}
+
+// fillAccessLog logs a delivery for each given age (in days) and returns the consumer.
+func fillAccessLog(t *testing.T, db *sqlx.DB, ages ...int) *Consumer {
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := createTestUser(t, "admin", tx)
+	consumer := createTestConsumer(t, "web", user, tx)
+	secret := createTestSecret(t, "password", "hunter2", user, tx, consumer)
+	accessLog := NewAccessLog(tx)
+
+	for _, age := range ages {
+		id := accessLog.LogAccess(consumer, secret, newTestRequest("GET", "/get"), 200, nil)
+		requestedAt := time.Now().AddDate(0, 0, -age).Format("2006-01-02 15:04:05")
+
+		if _, err := tx.Exec("UPDATE `access_log` SET `requested_at` = ? WHERE `id` = ?", requestedAt, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	return consumer
+}
+
+func countAccessLog(t *testing.T, db *sqlx.DB) int {
+	count := 0
+
+	if err := db.Get(&count, "SELECT COUNT(*) FROM `access_log`"); err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestAccessLogRetentionArchivesBeforeDeleting(t *testing.T) {
+	db := newTestDatabase(t)
+	fillAccessLog(t, db, 200, 100, 91, 10, 0)
+
+	config.AccessLog.MaxAgeDays = 90
+	config.AccessLog.ArchiveDirectory = t.TempDir()
+
+	retention, err := NewAccessLogRetention(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := retention.Prune(db)
+	if err != nil || pruned != 3 {
+		t.Fatalf("Expected 3 pruned entries, got %d (%v).", pruned, err)
+	}
+
+	if remaining := countAccessLog(t, db); remaining != 2 {
+		t.Errorf("Expected 2 remaining entries, found %d.", remaining)
+	}
+
+	archives, _ := filepath.Glob(filepath.Join(config.AccessLog.ArchiveDirectory, "access_log-*.jsonl.gz"))
+	if len(archives) != 1 {
+		t.Fatalf("Expected one archive, found %v.", archives)
+	}
+
+	file, err := os.Open(archives[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(reader)
+	archived := 0
+
+	for scanner.Scan() {
+		entry := archivedAccessLogEntry{}
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Status != 200 || entry.Consumer == nil {
+			t.Errorf("Invalid archive line %q (%v).", scanner.Text(), err)
+		}
+
+		archived++
+	}
+
+	if archived != 3 {
+		t.Errorf("Expected 3 archived entries, found %d.", archived)
+	}
+}
+
+func TestAccessLogRetentionPerConsumer(t *testing.T) {
+	db := newTestDatabase(t)
+	fillAccessLog(t, db, 5, 4, 3, 2, 1)
+
+	retention := &AccessLogRetention{maxRowsPerConsumer: 2, deleteUnarchived: true}
+
+	pruned, err := retention.Prune(db)
+	if err != nil || pruned != 3 {
+		t.Fatalf("Expected 3 pruned entries, got %d (%v).", pruned, err)
+	}
+
+	if remaining := countAccessLog(t, db); remaining != 2 {
+		t.Errorf("Expected 2 remaining entries, found %d.", remaining)
+	}
+}
+
+func TestAccessLogRetentionRefusesToDeleteUnarchived(t *testing.T) {
+	db := newTestDatabase(t)
+	fillAccessLog(t, db, 100)
+
+	retention := &AccessLogRetention{maxAgeDays: 90}
+
+	if _, err := retention.Prune(db); err == nil {
+		t.Error("Entries were pruned without an archive.")
+	}
+
+	if remaining := countAccessLog(t, db); remaining != 1 {
+		t.Errorf("Expected the entry to be kept, found %d entries.", remaining)
+	}
+}
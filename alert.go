@@ -0,0 +1,425 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/jmoiron/sqlx"
+)
+
+var alertRules *AlertRules
+
+const (
+	AlertDeniedBurst   = "denied-burst"
+	AlertNewOriginIp   = "new-origin-ip"
+	AlertOffHours      = "off-hours"
+	AlertNotFoundBurst = "not-found-burst"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Alert model
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type Alert struct {
+	Id          int     `db:"id"`
+	Rule        string  `db:"rule"`
+	Subject     string  `db:"subject"`
+	Consumer    *int    `db:"consumer_id"`
+	OriginIp    string  `db:"origin_ip"`
+	Message     string  `db:"message"`
+	CreatedAt   string  `db:"created_at"`
+	DismissedAt *string `db:"dismissed_at"`
+	DismissedBy *int    `db:"dismissed_by"`
+	_db         *sqlx.Tx
+}
+
+func findAlert(id int, db *sqlx.Tx) *Alert {
+	alert := &Alert{}
+	alert._db = db
+
+	db.Get(alert, "SELECT `id`, `rule`, `subject`, `consumer_id`, `origin_ip`, `message`, `created_at`, `dismissed_at`, `dismissed_by` FROM `alert` WHERE `id` = ?", id)
+	if alert.Id == 0 {
+		return nil
+	}
+
+	return alert
+}
+
+func findOpenAlerts(since string, limit int, db *sqlx.Tx) []Alert {
+	list := make([]Alert, 0)
+
+	db.Select(&list, "SELECT `id`, `rule`, `subject`, `consumer_id`, `origin_ip`, `message`, `created_at`, `dismissed_at`, `dismissed_by` FROM `alert` WHERE `dismissed_at` IS NULL AND `created_at` >= ? ORDER BY `id` DESC LIMIT "+strconv.Itoa(limit), since)
+
+	for i := range list {
+		list[i]._db = db
+	}
+
+	return list
+}
+
+func (a *Alert) GetConsumer() *Consumer {
+	if a.Consumer == nil {
+		return nil
+	}
+
+	return findConsumer(*a.Consumer, a._db)
+}
+
+func (a *Alert) Dismiss(user *User) error {
+	_, err := a._db.Exec("UPDATE `alert` SET `dismissed_at` = NOW(), `dismissed_by` = ? WHERE `id` = ?", user.Id, a.Id)
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Alert rules
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type burstRule struct {
+	threshold int
+	window    time.Duration
+}
+
+// AlertRules checks every access log entry as it is written and raises alerts for suspicious
+// patterns. The same alert (rule and subject) is raised at most once per cooldown period.
+type AlertRules struct {
+	deniedBurst   *burstRule
+	notFoundBurst *burstRule
+	newOriginIp   bool
+	offHours      bool
+	usualFrom     int
+	usualTo       int
+	weekends      bool
+	cooldown      time.Duration
+}
+
+func parseBurstRule(threshold int, window string, name string) (*burstRule, error) {
+	if threshold <= 0 {
+		return nil, nil
+	}
+
+	rule := &burstRule{threshold: threshold, window: 10 * time.Minute}
+
+	if window != "" {
+		duration, err := time.ParseDuration(window)
+		if err != nil {
+			return nil, errors.New("Invalid window for the " + name + " alert: " + err.Error())
+		}
+
+		rule.window = duration
+	}
+
+	return rule, nil
+}
+
+// parseClock turns "HH:MM" into minutes since midnight.
+func parseClock(clock string) (int, error) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, errors.New("Invalid time '" + clock + "' configured, use HH:MM.")
+	}
+
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func NewAlertRules(c *configuration) (*AlertRules, error) {
+	cfg := c.Alerts
+	rules := &AlertRules{
+		newOriginIp: cfg.NewOriginIp,
+		offHours:    cfg.OffHours.Enabled,
+		weekends:    cfg.OffHours.Weekends,
+		cooldown:    15 * time.Minute,
+	}
+
+	var err error
+
+	rules.deniedBurst, err = parseBurstRule(cfg.DeniedBurst.Threshold, cfg.DeniedBurst.Window, "denied burst")
+	if err != nil {
+		return nil, err
+	}
+
+	rules.notFoundBurst, err = parseBurstRule(cfg.NotFoundBurst.Threshold, cfg.NotFoundBurst.Window, "404 burst")
+	if err != nil {
+		return nil, err
+	}
+
+	if rules.offHours {
+		rules.usualFrom, err = parseClock(cfg.OffHours.From)
+		if err != nil {
+			return nil, err
+		}
+
+		rules.usualTo, err = parseClock(cfg.OffHours.To)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Cooldown != "" {
+		rules.cooldown, err = time.ParseDuration(cfg.Cooldown)
+		if err != nil {
+			return nil, errors.New("Invalid alert cooldown configured: " + err.Error())
+		}
+	}
+
+	return rules, nil
+}
+
+func (r *AlertRules) Enabled() bool {
+	return r.deniedBurst != nil || r.notFoundBurst != nil || r.newOriginIp || r.offHours
+}
+
+// Evaluate checks the freshly written access log entry. Errors are only logged, as alerting must
+// never interfere with delivering secrets.
+func (r *AlertRules) Evaluate(entry *AccessLogEntry, db *sqlx.Tx) {
+	if r == nil {
+		return
+	}
+
+	err := r.evaluate(entry, time.Now(), db)
+	if err != nil {
+		log.Println("Warning: Could not evaluate alert rules: " + err.Error())
+	}
+}
+
+func (r *AlertRules) evaluate(entry *AccessLogEntry, now time.Time, db *sqlx.Tx) error {
+	var consumer *Consumer
+
+	if entry.Consumer != nil {
+		consumer = findConsumer(*entry.Consumer, db)
+	}
+
+	if r.deniedBurst != nil && entry.Status == 403 && consumer != nil {
+		count := 0
+		since := now.Add(-r.deniedBurst.window).Format("2006-01-02 15:04:05")
+
+		err := db.Get(&count, "SELECT COUNT(*) FROM `access_log` WHERE `consumer_id` = ? AND `status` = 403 AND `requested_at` >= ?", consumer.Id, since)
+		if err != nil {
+			return err
+		}
+
+		if count >= r.deniedBurst.threshold {
+			message := fmt.Sprintf("Consumer %s was denied access %d times within %s.", consumer.Name, count, r.deniedBurst.window)
+
+			err = r.raise(AlertDeniedBurst, "consumer:"+strconv.Itoa(consumer.Id), entry, message, now, db)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.notFoundBurst != nil && entry.Status == 404 {
+		count := 0
+		since := now.Add(-r.notFoundBurst.window).Format("2006-01-02 15:04:05")
+
+		err := db.Get(&count, "SELECT COUNT(*) FROM `access_log` WHERE `origin_ip` = ? AND `status` = 404 AND `requested_at` >= ?", entry.OriginIp, since)
+		if err != nil {
+			return err
+		}
+
+		if count >= r.notFoundBurst.threshold {
+			message := fmt.Sprintf("%s requested %d unknown consumers or secrets within %s; someone might be guessing slugs.", entry.OriginIp, count, r.notFoundBurst.window)
+
+			err = r.raise(AlertNotFoundBurst, "ip:"+entry.OriginIp, entry, message, now, db)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.newOriginIp && consumer != nil {
+		history, err := rowExists(db, "SELECT `id` FROM `access_log` WHERE `consumer_id` = ? AND `id` <> ? LIMIT 1", consumer.Id, entry.Id)
+		if err != nil {
+			return err
+		}
+
+		known, err := rowExists(db, "SELECT `id` FROM `access_log` WHERE `consumer_id` = ? AND `origin_ip` = ? AND `id` <> ? LIMIT 1", consumer.Id, entry.OriginIp, entry.Id)
+		if err != nil {
+			return err
+		}
+
+		// a brand new consumer has to start somewhere
+		if history && !known {
+			message := fmt.Sprintf("Consumer %s made a request from %s, which it has never used before.", consumer.Name, entry.OriginIp)
+
+			err = r.raise(AlertNewOriginIp, "consumer:"+strconv.Itoa(consumer.Id)+":"+entry.OriginIp, entry, message, now, db)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.offHours && consumer != nil && entry.Status == 200 && r.isOffHours(now) {
+		message := fmt.Sprintf("Consumer %s fetched a secret outside of the usual hours (%s).", consumer.Name, now.Format("Mon 15:04"))
+
+		err := r.raise(AlertOffHours, "consumer:"+strconv.Itoa(consumer.Id), entry, message, now, db)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rowExists is a cheaper alternative to COUNT(*) on the large access log.
+func rowExists(db *sqlx.Tx, query string, args ...interface{}) (bool, error) {
+	id := 0
+
+	err := db.Get(&id, query, args...)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (r *AlertRules) isOffHours(now time.Time) bool {
+	if r.weekends && (now.Weekday() == time.Saturday || now.Weekday() == time.Sunday) {
+		return true
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+
+	// the usual hours can span midnight, e.g. 22:00 - 06:00 for night shifts
+	if r.usualFrom <= r.usualTo {
+		return minute < r.usualFrom || minute >= r.usualTo
+	}
+
+	return minute < r.usualFrom && minute >= r.usualTo
+}
+
+func (r *AlertRules) raise(rule string, subject string, entry *AccessLogEntry, message string, now time.Time, db *sqlx.Tx) error {
+	recent := 0
+	since := now.Add(-r.cooldown).Format("2006-01-02 15:04:05")
+
+	err := db.Get(&recent, "SELECT COUNT(*) FROM `alert` WHERE `rule` = ? AND `subject` = ? AND `created_at` >= ?", rule, subject, since)
+	if err != nil || recent > 0 {
+		return err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO `alert` (`rule`, `subject`, `consumer_id`, `origin_ip`, `message`, `created_at`) VALUES (?,?,?,?,?,?)",
+		rule, subject, entry.Consumer, entry.OriginIp, message, now.Format("2006-01-02 15:04:05"),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	eventBus.Queue(db, &Event{
+		Time:     now,
+		Type:     EventTypeAlert,
+		Action:   rule,
+		Consumer: entry.Consumer,
+		OriginIp: entry.OriginIp,
+		Message:  message,
+	})
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Alert notifications
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// AlertSink is an event sink that only cares about alerts and sends them via e-mail and/or
+// webhook.
+type AlertSink struct {
+	recipients []string
+	webhook    *WebhookSink
+}
+
+func NewAlertSink(c *configuration) (*AlertSink, error) {
+	sink := &AlertSink{recipients: c.Alerts.Email}
+
+	if len(sink.recipients) > 0 && c.Smtp.Host == "" {
+		return nil, errors.New("Alert e-mails are configured, but no SMTP server.")
+	}
+
+	if c.Alerts.Webhook != "" {
+		webhook, err := NewWebhookSink(eventSinkConfig{Url: c.Alerts.Webhook})
+		if err != nil {
+			return nil, err
+		}
+
+		sink.webhook = webhook
+	}
+
+	return sink, nil
+}
+
+func (s *AlertSink) GetIdentifier() string {
+	return "alert"
+}
+
+func (s *AlertSink) Send(event *Event) error {
+	if event.Type != EventTypeAlert {
+		return nil
+	}
+
+	errs := make([]string, 0)
+
+	if len(s.recipients) > 0 {
+		body := event.Message + "\n\n" +
+			"Rule:   " + event.Action + "\n" +
+			"Origin: " + event.OriginIp + "\n" +
+			"Time:   " + event.Time.Format("2006-01-02 15:04:05 MST") + "\n\n" +
+			"-- \nRaziel, " + config.Server.BaseUrl + "\n"
+
+		err := sendMail(s.recipients, "[Raziel] Alert: "+event.Message, body)
+		if err != nil {
+			errs = append(errs, "e-mail: "+err.Error())
+		}
+	}
+
+	if s.webhook != nil {
+		err := s.webhook.Send(event)
+		if err != nil {
+			errs = append(errs, "webhook: "+err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+func (s *AlertSink) Close() error {
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// HTTP Handlers
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func alertDismissAction(params martini.Params, user *User, db *sqlx.Tx) response {
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return renderError(400, "Invalid ID given.")
+	}
+
+	alert := findAlert(id, db)
+	if alert == nil {
+		return renderError(404, "Alert could not be found.")
+	}
+
+	if alert.DismissedAt == nil {
+		err = alert.Dismiss(user)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return redirect(302, "/")
+}
+
+func setupAlertCtrl(app *martini.ClassicMartini) {
+	app.Post("/alerts/:id/dismiss", sessions.RequireLogin, sessions.RequireAdmin, sessions.RequireCsrfToken, alertDismissAction)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewAlertRules(t *testing.T) {
+	config = &configuration{}
+
+	rules, err := NewAlertRules(config)
+	if err != nil || rules.Enabled() {
+		t.Errorf("Expected no rules to be enabled by default: %+v (%v)", rules, err)
+	}
+
+	config.Alerts.DeniedBurst.Threshold = 5
+	config.Alerts.OffHours.Enabled = true
+	config.Alerts.OffHours.From = "08:00"
+	config.Alerts.OffHours.To = "18:30"
+
+	rules, err = NewAlertRules(config)
+	if err != nil || !rules.Enabled() {
+		t.Fatalf("The rules were not enabled: %v", err)
+	}
+
+	if rules.deniedBurst.window != 10*time.Minute || rules.cooldown != 15*time.Minute || rules.usualTo != 18*60+30 {
+		t.Errorf("The defaults were not applied: %+v", rules)
+	}
+
+	invalid := []func(c *configuration){
+		func(c *configuration) { c.Alerts.DeniedBurst.Window = "soon" },
+		func(c *configuration) { c.Alerts.NotFoundBurst.Threshold = 1; c.Alerts.NotFoundBurst.Window = "10" },
+		func(c *configuration) { c.Alerts.OffHours.From = "8am" },
+		func(c *configuration) { c.Alerts.OffHours.To = "24:00" },
+		func(c *configuration) { c.Alerts.Cooldown = "forever" },
+	}
+
+	for i, modify := range invalid {
+		c := *config
+		modify(&c)
+
+		if _, err := NewAlertRules(&c); err == nil {
+			t.Errorf("Invalid configuration %d was accepted.", i)
+		}
+	}
+}
+
+func TestAlertRulesIsOffHours(t *testing.T) {
+	day := &AlertRules{usualFrom: 8 * 60, usualTo: 18 * 60, weekends: true}
+	night := &AlertRules{usualFrom: 22 * 60, usualTo: 6 * 60}
+
+	// 2020-01-06 is a Monday
+	testcases := []struct {
+		rules    *AlertRules
+		time     string
+		offHours bool
+	}{
+		{day, "2020-01-06 07:59", true},
+		{day, "2020-01-06 08:00", false},
+		{day, "2020-01-06 17:59", false},
+		{day, "2020-01-06 18:00", true},
+		{day, "2020-01-11 12:00", true},
+		{night, "2020-01-06 23:00", false},
+		{night, "2020-01-06 05:59", false},
+		{night, "2020-01-06 06:00", true},
+		{night, "2020-01-06 21:59", true},
+		{night, "2020-01-11 23:00", false},
+	}
+
+	for _, testcase := range testcases {
+		now, _ := time.Parse("2006-01-02 15:04", testcase.time)
+
+		if testcase.rules.isOffHours(now) != testcase.offHours {
+			t.Errorf("Expected off hours at %s to be %v.", testcase.time, testcase.offHours)
+		}
+	}
+}
+
+func TestAlertRulesEvaluate(t *testing.T) {
+	db := newTestDatabase(t)
+
+	config.Alerts.DeniedBurst.Threshold = 3
+	config.Alerts.DeniedBurst.Window = "1h"
+	config.Alerts.NotFoundBurst.Threshold = 2
+	config.Alerts.NotFoundBurst.Window = "1h"
+	config.Alerts.NewOriginIp = true
+	config.Alerts.Cooldown = "1h"
+
+	rules, err := NewAlertRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := alertRules
+	alertRules = rules
+	defer func() { alertRules = previous }()
+
+	tx, _ := db.Beginx()
+	defer tx.Rollback()
+
+	user := createTestUser(t, "admin", tx)
+	web := createTestConsumer(t, "web", user, tx)
+	fresh := createTestConsumer(t, "fresh", user, tx)
+	secret := createTestSecret(t, "password", "hunter2", user, tx, web)
+
+	accessLog := NewAccessLog(tx)
+	req := newTestRequest("GET", "/")
+
+	raised := func(rule string) []Alert {
+		list := make([]Alert, 0)
+
+		if err := tx.Select(&list, "SELECT `id`, `rule`, `subject`, `consumer_id`, `origin_ip`, `message`, `created_at`, `dismissed_at`, `dismissed_by` FROM `alert` WHERE `rule` = ?", rule); err != nil {
+			t.Fatal(err)
+		}
+
+		return list
+	}
+
+	// the burst is only reached with the third denial and not raised again during the cooldown
+	for i := 1; i <= 4; i++ {
+		accessLog.LogAccess(web, secret, req, 403, nil)
+
+		if expected := i / 3; len(raised(AlertDeniedBurst)) != expected {
+			t.Fatalf("Expected %d denied burst alert(s) after %d denials.", expected, i)
+		}
+	}
+
+	alert := raised(AlertDeniedBurst)[0]
+	if alert.Subject != "consumer:"+strconv.Itoa(web.Id) || *alert.Consumer != web.Id || alert.OriginIp != "192.0.2.1" {
+		t.Errorf("Unexpected alert: %+v", alert)
+	}
+
+	accessLog.LogNotFound(nil, nil, req)
+	accessLog.LogNotFound(nil, nil, req)
+
+	if alerts := raised(AlertNotFoundBurst); len(alerts) != 1 || alerts[0].Subject != "ip:192.0.2.1" || alerts[0].Consumer != nil {
+		t.Errorf("Expected one 404 burst alert, got %+v.", alerts)
+	}
+
+	// a consumer's first request cannot come from an unusual address
+	other := newTestRequest("GET", "/")
+	other.RemoteAddr = "198.51.100.7:1234"
+
+	accessLog.LogAccess(fresh, nil, other, 404, nil)
+	accessLog.LogAccess(web, secret, other, 200, nil)
+	accessLog.LogAccess(web, secret, other, 200, nil)
+
+	if alerts := raised(AlertNewOriginIp); len(alerts) != 1 || alerts[0].Subject != "consumer:"+strconv.Itoa(web.Id)+":198.51.100.7" {
+		t.Errorf("Expected one new origin alert for web, got %+v.", alerts)
+	}
+
+	if alerts := findOpenAlerts("2000-01-01", 10, tx); len(alerts) != 3 {
+		t.Fatalf("Expected three open alerts, got %d.", len(alerts))
+	}
+
+	if err := findAlert(alert.Id, tx).Dismiss(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if alerts := findOpenAlerts("2000-01-01", 10, tx); len(alerts) != 2 {
+		t.Errorf("The dismissed alert is still open.")
+	}
+}
+
+func TestAlertRulesOffHours(t *testing.T) {
+	db := newTestDatabase(t)
+
+	rules := &AlertRules{offHours: true, usualFrom: 8 * 60, usualTo: 18 * 60, cooldown: time.Hour}
+
+	tx, _ := db.Beginx()
+	defer tx.Rollback()
+
+	user := createTestUser(t, "admin", tx)
+	consumer := createTestConsumer(t, "web", user, tx)
+
+	countAlerts := func() int {
+		count := 0
+		tx.Get(&count, "SELECT COUNT(*) FROM `alert` WHERE `rule` = ?", AlertOffHours)
+
+		return count
+	}
+
+	evaluate := func(status int, clock string) {
+		now, _ := time.Parse("2006-01-02 15:04", clock)
+		entry := &AccessLogEntry{Id: 1, Consumer: &consumer.Id, OriginIp: "192.0.2.1", Status: status}
+
+		if err := rules.evaluate(entry, now, tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evaluate(200, "2020-01-06 12:00")
+	evaluate(403, "2020-01-06 23:00")
+
+	if count := countAlerts(); count != 0 {
+		t.Errorf("Expected no alerts during the usual hours or for denied requests, got %d.", count)
+	}
+
+	evaluate(200, "2020-01-06 23:00")
+	evaluate(200, "2020-01-06 23:30")
+
+	if count := countAlerts(); count != 1 {
+		t.Errorf("Expected one alert during the cooldown, got %d.", count)
+	}
+
+	evaluate(200, "2020-01-07 00:30")
+
+	if count := countAlerts(); count != 2 {
+		t.Errorf("Expected another alert after the cooldown, got %d.", count)
+	}
+}
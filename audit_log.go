@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/go-martini/martini"
 	"github.com/jmoiron/sqlx"
@@ -59,6 +61,63 @@ func (e *AuditLogEntry) GetCreator() *User {
 	return findUser(e.CreatedBy, false, e._db)
 }
 
+func (e *AuditLogEntry) IsScheduledRotation() bool {
+	if e.Action != "secret-rotated" || e.Context == nil {
+		return false
+	}
+
+	ctx := rotationContext{}
+	e.Context.Unpack(&ctx)
+
+	return ctx.Scheduled
+}
+
+func (e *AuditLogEntry) RevokedSerial() string {
+	if e.Action != "certificate-revoked" || e.Context == nil {
+		return ""
+	}
+
+	ctx := revocationContext{}
+	e.Context.Unpack(&ctx)
+
+	return ctx.Serial
+}
+
+func (e *AuditLogEntry) RevokedLease() string {
+	if e.Action != "lease-revoked" || e.Context == nil {
+		return ""
+	}
+
+	ctx := leaseRevocationContext{}
+	e.Context.Unpack(&ctx)
+
+	return ctx.Username
+}
+
+// RemovedSecret is the name of the deleted or unassigned secret, which might not exist anymore.
+func (e *AuditLogEntry) RemovedSecret() string {
+	if (e.Action != "secret-deleted" && e.Action != "secret-unassigned") || e.Context == nil {
+		return ""
+	}
+
+	ctx := removalContext{}
+	e.Context.Unpack(&ctx)
+
+	return ctx.Name
+}
+
+// ShareExpiry is when the one-time link created with this entry expires.
+func (e *AuditLogEntry) ShareExpiry() string {
+	if e.Action != "secret-shared" || e.Context == nil {
+		return ""
+	}
+
+	ctx := shareContext{}
+	e.Context.Unpack(&ctx)
+
+	return ctx.ExpiresAt
+}
+
 type AuditLog interface {
 	FindAll(int, int) []AuditLogEntry
 	FindBySecrets([]int, int, int) []AuditLogEntry
@@ -81,14 +140,33 @@ type AuditLog interface {
 	LogUserCreated(int, int)
 	LogUserUpdated(int, int)
 	LogUserDeleted(int, int)
+	LogUserProvisioned(int, string)
+	LogUserDeprovisioned(int, string)
+	LogUserLinked(int, string)
+	LogPasswordResetIssued(int, int)
+	LogPasswordResetUsed(int)
 	LogSecretCreated(int, int)
 	LogSecretUpdated(int, int)
-	LogSecretDeleted(int, int)
+	LogSecretDeleted(*Secret, []int, int)
+	LogSecretRevealed(int, int)
+	LogSecretImported(int, int, int, string, bool)
+	LogSecretRotated(int, int, bool)
+	LogSecretGranted(int, int, int)
+	LogSecretUnassigned(*Secret, int, int)
+	LogCertificateRevoked(int, int, int, string)
+	LogLeaseRevoked(int, int, int, string)
+	LogSecretShared(int, int, int, int, string)
+	LogShareUsed(int, int, int, int)
+	LogShareExpired(int, int, int, int)
 	LogConsumerCreated(int, int)
 	LogConsumerUpdated(int, int)
 	LogConsumerDeleted(int, int)
 }
 
+type backendContext struct {
+	Backend string `json:"backend"`
+}
+
 type auditLogStruct struct {
 	db  *sqlx.Tx
 	req *http.Request
@@ -197,6 +275,26 @@ func (a *auditLogStruct) LogUserDeleted(editorId int, deletedUserId int) {
 	a.logAction(-1, -1, deletedUserId, editorId, "user-deleted", nil)
 }
 
+func (a *auditLogStruct) LogUserProvisioned(userId int, backend string) {
+	a.logAction(-1, -1, userId, userId, "user-provisioned", backendContext{backend})
+}
+
+func (a *auditLogStruct) LogUserDeprovisioned(userId int, backend string) {
+	a.logAction(-1, -1, userId, userId, "user-deprovisioned", backendContext{backend})
+}
+
+func (a *auditLogStruct) LogUserLinked(userId int, backend string) {
+	a.logAction(-1, -1, userId, userId, "user-linked", backendContext{backend})
+}
+
+func (a *auditLogStruct) LogPasswordResetIssued(creatorId int, userId int) {
+	a.logAction(-1, -1, userId, creatorId, "user-reset-issued", nil)
+}
+
+func (a *auditLogStruct) LogPasswordResetUsed(userId int) {
+	a.logAction(-1, -1, userId, userId, "user-reset-used", nil)
+}
+
 func (a *auditLogStruct) LogSecretCreated(secretId int, userId int) {
 	a.logAction(secretId, -1, -1, userId, "secret-created", nil)
 }
@@ -205,8 +303,78 @@ func (a *auditLogStruct) LogSecretUpdated(secretId int, userId int) {
 	a.logAction(secretId, -1, -1, userId, "secret-updated", nil)
 }
 
-func (a *auditLogStruct) LogSecretDeleted(secretId int, userId int) {
-	a.logAction(secretId, -1, -1, userId, "secret-deleted", nil)
+// removalContext names the secret a consumer does not receive anymore. Entries of deleted
+// secrets cannot refer to them and instead list the consumers that had them.
+type removalContext struct {
+	Slug      string `json:"slug"`
+	Name      string `json:"name"`
+	Consumers []int  `json:"consumers,omitempty"`
+}
+
+// LogSecretDeleted has to be called after the secret has been deleted, as the deletion would take
+// all entries referring to it along.
+func (a *auditLogStruct) LogSecretDeleted(secret *Secret, consumerIds []int, userId int) {
+	a.logAction(-1, -1, -1, userId, "secret-deleted", removalContext{secret.Slug, secret.Name, consumerIds})
+}
+
+func (a *auditLogStruct) LogSecretRevealed(secretId int, userId int) {
+	a.logAction(secretId, -1, -1, userId, "secret-revealed", nil)
+}
+
+type importContext struct {
+	Format      string `json:"format"`
+	Overwritten bool   `json:"overwritten"`
+}
+
+func (a *auditLogStruct) LogSecretImported(secretId int, consumerId int, userId int, format string, overwritten bool) {
+	a.logAction(secretId, consumerId, -1, userId, "secret-imported", importContext{format, overwritten})
+}
+
+type rotationContext struct {
+	Scheduled bool `json:"scheduled"`
+}
+
+// LogSecretRotated records a new generated value. Scheduled rotations are attributed to the
+// secret's owner.
+func (a *auditLogStruct) LogSecretRotated(secretId int, userId int, scheduled bool) {
+	a.logAction(secretId, -1, -1, userId, "secret-rotated", rotationContext{scheduled})
+}
+
+func (a *auditLogStruct) LogSecretGranted(secretId int, consumerId int, userId int) {
+	a.logAction(secretId, consumerId, -1, userId, "secret-granted", nil)
+}
+
+func (a *auditLogStruct) LogSecretUnassigned(secret *Secret, consumerId int, userId int) {
+	a.logAction(secret.Id, consumerId, -1, userId, "secret-unassigned", removalContext{Slug: secret.Slug, Name: secret.Name})
+}
+
+type revocationContext struct {
+	Serial string `json:"serial"`
+}
+
+func (a *auditLogStruct) LogCertificateRevoked(secretId int, consumerId int, userId int, serial string) {
+	a.logAction(secretId, consumerId, -1, userId, "certificate-revoked", revocationContext{serial})
+}
+
+type leaseRevocationContext struct {
+	Username string `json:"username"`
+}
+
+func (a *auditLogStruct) LogLeaseRevoked(secretId int, consumerId int, userId int, username string) {
+	a.logAction(secretId, consumerId, -1, userId, "lease-revoked", leaseRevocationContext{username})
+}
+
+func (a *auditLogStruct) LogSecretShared(secretId int, consumerId int, userId int, shareId int, expiresAt string) {
+	a.logAction(secretId, consumerId, -1, userId, "secret-shared", shareContext{Id: shareId, ExpiresAt: expiresAt})
+}
+
+// LogShareUsed and LogShareExpired are attributed to the user that created the share.
+func (a *auditLogStruct) LogShareUsed(secretId int, consumerId int, creatorId int, shareId int) {
+	a.logAction(secretId, consumerId, -1, creatorId, "share-used", shareContext{Id: shareId})
+}
+
+func (a *auditLogStruct) LogShareExpired(secretId int, consumerId int, creatorId int, shareId int) {
+	a.logAction(secretId, consumerId, -1, creatorId, "share-expired", shareContext{Id: shareId})
 }
 
 func (a *auditLogStruct) LogConsumerCreated(consumerId int, userId int) {
@@ -245,23 +413,66 @@ func (a *auditLogStruct) logAction(secretId int, consumerId int, userId, creator
 	}
 
 	var userAgent *string = nil
+	originIp := ""
 
-	if ua := a.req.UserAgent(); len(ua) > 0 {
-		userAgent = &ua
+	// background jobs have no request to take the origin from
+	if a.req != nil {
+		if ua := a.req.UserAgent(); len(ua) > 0 {
+			userAgent = &ua
+		}
+
+		originIp = getIP(a.req)
 	}
 
+	link := auditLogLink{
+		Secret:    secret,
+		Consumer:  consumer,
+		User:      user,
+		Action:    action,
+		CreatedAt: databaseNow(a.db),
+		CreatedBy: creatorId,
+		OriginIp:  originIp,
+		UserAgent: userAgent,
+	}
+
+	if ctx != nil {
+		str := string(ctx)
+		link.Context = &str
+	}
+
+	prevHash := auditLogHead(a.db)
+	hash := chainHash(prevHash, link)
+
 	_, err := a.db.Exec(
-		"INSERT INTO `audit_log` (`secret_id`, `consumer_id`, `user_id`, `action`, `created_at`, `created_by`, `origin_ip`, `user_agent`, `context`) VALUES (?,?,?,?,NOW(),?,?,?,?)",
-		secret, consumer, user, action, creatorId, getIP(a.req), userAgent, ctx,
+		"INSERT INTO `audit_log` (`secret_id`, `consumer_id`, `user_id`, `action`, `created_at`, `created_by`, `origin_ip`, `user_agent`, `context`, `prev_hash`, `hash`) VALUES (?,?,?,?,?,?,?,?,?,?,?)",
+		secret, consumer, user, action, link.CreatedAt, creatorId, originIp, userAgent, ctx, prevHash, hash,
 	)
 
 	if err != nil {
 		panic(err)
 	}
+
+	eventBus.Queue(a.db, &Event{
+		Time:      time.Now(),
+		Type:      EventTypeAudit,
+		Action:    action,
+		Secret:    secret,
+		Consumer:  consumer,
+		User:      user,
+		CreatedBy: &creatorId,
+		OriginIp:  originIp,
+		UserAgent: userAgent,
+		Context:   json.RawMessage(ctx),
+		Hash:      hash,
+	})
+
+	if notifiableActions[action] {
+		notifySubscribers(action, secretId, consumerId, creatorId, a.db)
+	}
 }
 
 func (a *auditLogStruct) buildWhereStatement(secretIds []int, consumerIds []int, userIds []int, creatorIds []int, actions []string) string {
-	where := "1"
+	where := "1 = 1"
 
 	if len(secretIds) > 0 {
 		where += fmt.Sprintf(" AND `secret_id` IN (%s)", concatIntList(secretIds))
@@ -304,7 +515,7 @@ func (a *auditLogStruct) buildLimitStatement(limit int, offset int) string {
 	}
 
 	if offset > 0 {
-		return fmt.Sprintf("LIMIT %d,%d", offset, limit)
+		return fmt.Sprintf("LIMIT %d OFFSET %d", limit, offset)
 	}
 
 	return fmt.Sprintf("LIMIT %d", limit)
@@ -432,5 +643,6 @@ func auditLogIndexAction(user *User, req *http.Request, session *Session, db *sq
 func setupAuditLogCtrl(app *martini.ClassicMartini) {
 	app.Group("/auditlog", func(r martini.Router) {
 		app.Get("", auditLogIndexAction)
+		app.Get("/verify", sessions.RequireAdmin, logVerificationAction)
 	}, sessions.RequireLogin)
 }
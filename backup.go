@@ -0,0 +1,1272 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// A backup archive consists of a plain JSON header line, followed by the gzipped stream of
+// records, which is split into chunks that are encrypted and authenticated with NaCl secretbox.
+// Every chunk nonce contains the chunk's position and a flag for the final chunk, so chunks
+// cannot be reordered, dropped or cut off without the archive being rejected. The header is
+// bound to the chunks by including its hash in the nonces as well.
+//
+// Secrets are stored in plain text inside the archive and re-encrypted with the master key of the
+// instance they are restored into, so an archive does not depend on the original master key.
+
+const (
+	backupFormat    = "raziel-backup"
+	backupVersion   = 1
+	backupChunkSize = 64 * 1024
+
+	BackupPassphrase = "passphrase"
+	BackupPublicKey  = "publickey"
+)
+
+var (
+	backupCmd            = kingpin.Command("backup", "Export and restore encrypted backups")
+	backupPassphraseFile = backupCmd.Flag("passphrase-file", "File containing the backup passphrase (asked for if not given)").String()
+	backupIdentity       = backupCmd.Flag("identity", "Private key file, for archives encrypted to a public key").String()
+	backupExportCmd      = backupCmd.Command("export", "Write all users, secrets, consumers, restrictions and assignments into an encrypted archive")
+	backupExportOutput   = backupExportCmd.Flag("output", "Archive file to write (default: stdout)").Short('o').String()
+	backupRecipient      = backupExportCmd.Flag("recipient", "Public key file to encrypt the archive for, instead of a passphrase").String()
+	backupVerifyCmd      = backupCmd.Command("verify", "Check the integrity of an archive without restoring it")
+	backupVerifyFile     = backupVerifyCmd.Arg("archive", "Archive file").Required().ExistingFile()
+	backupRestoreCmd     = backupCmd.Command("restore", "Restore an archive into an empty database")
+	backupRestoreFile    = backupRestoreCmd.Arg("archive", "Archive file").Required().ExistingFile()
+	backupKeygenCmd      = backupCmd.Command("keygen", "Create a key pair for public key encrypted backups")
+	backupKeygenFile     = backupKeygenCmd.Arg("file", "Private key file to create; the public key is written to <file>.pub").Required().String()
+)
+
+type backupHeader struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	Schema     string `json:"schema"`
+	CreatedAt  string `json:"createdAt"`
+	Encryption string `json:"encryption"`
+	Salt       []byte `json:"salt,omitempty"`
+	SealedKey  []byte `json:"sealedKey,omitempty"`
+}
+
+// backupRecord is one line of the archive; Data holds one of the backup* structs below.
+type backupRecord struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type backupUser struct {
+	Id          int     `db:"id" json:"id"`
+	LoginName   string  `db:"login" json:"login"`
+	Password    *string `db:"password" json:"password"`
+	Name        *string `db:"name" json:"name"`
+	Role        string  `db:"role" json:"role"`
+	Backend     string  `db:"backend" json:"backend"`
+	ExternalId  *string `db:"external_id" json:"externalId"`
+	Email       *string `db:"email" json:"email"`
+	OidcSubject *string `db:"oidc_subject" json:"oidcSubject"`
+	LastLoginAt *string `db:"last_login_at" json:"lastLoginAt"`
+	Deleted     *string `db:"deleted" json:"deleted"`
+}
+
+type backupSecret struct {
+	Id        int     `db:"id" json:"id"`
+	Slug      string  `db:"slug" json:"slug"`
+	Name      string  `db:"name" json:"name"`
+	Secret    []byte  `db:"secret" json:"secret"` // plain text
+	CreatedAt string  `db:"created_at" json:"createdAt"`
+	UpdatedAt *string `db:"updated_at" json:"updatedAt"`
+	CreatedBy int     `db:"created_by" json:"createdBy"`
+	UpdatedBy *int    `db:"updated_by" json:"updatedBy"`
+
+	Generator    *string `db:"generator" json:"generator"`
+	RotationDays *int    `db:"rotation_days" json:"rotationDays"`
+	RotateAt     *string `db:"rotate_at" json:"rotateAt"`
+	RotatedAt    *string `db:"rotated_at" json:"rotatedAt"`
+}
+
+type backupSecretVersion struct {
+	SecretId  int    `db:"secret_id" json:"secretId"`
+	Secret    []byte `db:"secret" json:"secret"` // plain text
+	CreatedAt string `db:"created_at" json:"createdAt"`
+	CreatedBy *int   `db:"created_by" json:"createdBy"`
+}
+
+type backupConsumer struct {
+	Id        int     `db:"id" json:"id"`
+	Name      string  `db:"name" json:"name"`
+	Enabled   bool    `db:"enabled" json:"enabled"`
+	InfoToken *string `db:"info_token" json:"infoToken"`
+	CreatedAt string  `db:"created_at" json:"createdAt"`
+	UpdatedAt *string `db:"updated_at" json:"updatedAt"`
+	CreatedBy int     `db:"created_by" json:"createdBy"`
+	UpdatedBy *int    `db:"updated_by" json:"updatedBy"`
+	Deleted   bool    `db:"deleted" json:"deleted"`
+}
+
+type backupRestriction struct {
+	ConsumerId int    `db:"consumer_id" json:"consumerId"`
+	Type       string `db:"type" json:"type"`
+	Context    []byte `db:"context" json:"context"`
+	Enabled    bool   `db:"enabled" json:"enabled"`
+}
+
+type backupConsumerKey struct {
+	ConsumerId  int    `db:"consumer_id" json:"consumerId"`
+	Kind        string `db:"kind" json:"kind"`
+	PublicKey   string `db:"public_key" json:"publicKey"`
+	Fingerprint string `db:"fingerprint" json:"fingerprint"`
+	Required    bool   `db:"required" json:"required"`
+}
+
+type backupAssignment struct {
+	ConsumerId int `db:"consumer_id" json:"consumerId"`
+	SecretId   int `db:"secret_id" json:"secretId"`
+}
+
+type backupAuthority struct {
+	SecretId       int    `db:"secret_id" json:"secretId"`
+	Kind           string `db:"kind" json:"kind"`
+	Ttl            string `db:"ttl" json:"ttl"`
+	AllowedNames   string `db:"allowed_names" json:"allowedNames"`
+	AllowWildcards bool   `db:"allow_wildcards" json:"allowWildcards"`
+}
+
+type backupIssuedCertificate struct {
+	SecretId   int     `db:"secret_id" json:"secretId"`
+	ConsumerId *int    `db:"consumer_id" json:"consumerId"`
+	Serial     string  `db:"serial" json:"serial"`
+	Subject    string  `db:"subject" json:"subject"`
+	Sans       string  `db:"sans" json:"sans"`
+	NotAfter   string  `db:"not_after" json:"notAfter"`
+	IssuedAt   string  `db:"issued_at" json:"issuedAt"`
+	RevokedAt  *string `db:"revoked_at" json:"revokedAt"`
+	RevokedBy  *int    `db:"revoked_by" json:"revokedBy"`
+}
+
+type backupDynamicCredential struct {
+	SecretId   int    `db:"secret_id" json:"secretId"`
+	Ttl        string `db:"ttl" json:"ttl"`
+	Creation   string `db:"creation" json:"creation"`
+	Revocation string `db:"revocation" json:"revocation"`
+}
+
+type backupLease struct {
+	SecretId   int     `db:"secret_id" json:"secretId"`
+	ConsumerId *int    `db:"consumer_id" json:"consumerId"`
+	Username   string  `db:"username" json:"username"`
+	CreatedAt  string  `db:"created_at" json:"createdAt"`
+	ExpiresAt  string  `db:"expires_at" json:"expiresAt"`
+	RevokedAt  *string `db:"revoked_at" json:"revokedAt"`
+	RevokedBy  *int    `db:"revoked_by" json:"revokedBy"`
+	LastError  *string `db:"last_error" json:"lastError"`
+}
+
+// backupSummary is the last record of every archive.
+type backupSummary struct {
+	Counts map[string]int `json:"counts"`
+}
+
+// the record types in the order they are written and restored
+var backupRecordTypes = []string{"user", "secret", "version", "consumer", "restriction", "key", "assignment", "authority", "issued", "dynamic", "lease"}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Encryption
+
+func newBackupNonce(headerHash []byte, counter uint64, final bool) *[24]byte {
+	nonce := [24]byte{}
+
+	copy(nonce[:15], headerHash)
+	binary.BigEndian.PutUint64(nonce[15:23], counter)
+
+	if final {
+		nonce[23] = 1
+	}
+
+	return &nonce
+}
+
+// backupWriter encrypts everything written to it in chunks. Close must be called to write the
+// final chunk.
+type backupWriter struct {
+	out        io.Writer
+	key        *[32]byte
+	headerHash []byte
+	buffer     []byte
+	counter    uint64
+}
+
+func (w *backupWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		n := backupChunkSize - len(w.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+
+		w.buffer = append(w.buffer, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(w.buffer) == backupChunkSize {
+			err := w.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (w *backupWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *backupWriter) seal(final bool) error {
+	sealed := secretbox.Seal(nil, w.buffer, newBackupNonce(w.headerHash, w.counter, final), w.key)
+	length := [4]byte{}
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+
+	_, err := w.out.Write(append(length[:], sealed...))
+	if err != nil {
+		return err
+	}
+
+	w.buffer = w.buffer[:0]
+	w.counter++
+
+	return nil
+}
+
+// backupReader decrypts and authenticates the chunks written by backupWriter.
+type backupReader struct {
+	in         io.Reader
+	key        *[32]byte
+	headerHash []byte
+	buffer     []byte
+	counter    uint64
+	final      bool
+}
+
+var errBackupCorrupted = errors.New("The archive is corrupted or the passphrase/key is wrong.")
+
+func (r *backupReader) Read(p []byte) (int, error) {
+	for len(r.buffer) == 0 {
+		if r.final {
+			return 0, io.EOF
+		}
+
+		err := r.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buffer)
+	r.buffer = r.buffer[n:]
+
+	return n, nil
+}
+
+func (r *backupReader) open() error {
+	length := [4]byte{}
+
+	_, err := io.ReadFull(r.in, length[:])
+	if err != nil {
+		return errors.New("The archive is truncated.")
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > backupChunkSize+secretbox.Overhead {
+		return errBackupCorrupted
+	}
+
+	sealed := make([]byte, size)
+
+	_, err = io.ReadFull(r.in, sealed)
+	if err != nil {
+		return errors.New("The archive is truncated.")
+	}
+
+	// the final flag is not known in advance, so try both
+	plain, ok := secretbox.Open(nil, sealed, newBackupNonce(r.headerHash, r.counter, false), r.key)
+	if !ok {
+		plain, ok = secretbox.Open(nil, sealed, newBackupNonce(r.headerHash, r.counter, true), r.key)
+		if !ok {
+			return errBackupCorrupted
+		}
+
+		r.final = true
+
+		// nothing may follow the final chunk
+		extra, _ := r.in.Read(length[:1])
+		if extra > 0 {
+			return errors.New("The archive contains data after its end.")
+		}
+	}
+
+	r.buffer = plain
+	r.counter++
+
+	return nil
+}
+
+func backupPassphraseKey(passphrase string, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	key := [32]byte{}
+	copy(key[:], derived)
+
+	return &key, nil
+}
+
+// the passphrase is remembered, as a restore reads the archive twice
+var backupPassphrase string
+
+// readBackupPassphrase reads the passphrase from the --passphrase-file or asks for it.
+func readBackupPassphrase() (string, error) {
+	if backupPassphrase != "" {
+		return backupPassphrase, nil
+	}
+
+	if *backupPassphraseFile == "" {
+		passphrase, err := readPassphrase()
+		if err != nil {
+			return "", err
+		}
+
+		backupPassphrase = passphrase
+
+		return passphrase, nil
+	}
+
+	content, err := ioutil.ReadFile(*backupPassphraseFile)
+	if err != nil {
+		return "", err
+	}
+
+	passphrase := strings.TrimSpace(string(content))
+	if len(passphrase) == 0 {
+		return "", errors.New("The passphrase file is empty.")
+	}
+
+	backupPassphrase = passphrase
+
+	return passphrase, nil
+}
+
+// readBackupKey reads a base64 encoded Curve25519 key.
+func readBackupKey(filename string) (*[32]byte, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(decoded) != 32 {
+		return nil, errors.New("The file '" + filename + "' does not contain a valid backup key.")
+	}
+
+	key := [32]byte{}
+	copy(key[:], decoded)
+
+	return &key, nil
+}
+
+func hashBackupHeader(line []byte) []byte {
+	hash := sha256.Sum256(line)
+	return hash[:]
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Export
+
+func runBackupExport(database *sqlx.DB) int {
+	header := backupHeader{
+		Format:    backupFormat,
+		Version:   backupVersion,
+		Schema:    SchemaVersion(),
+		CreatedAt: time.Now().Format("2006-01-02 15:04:05"),
+	}
+
+	key := [32]byte{}
+
+	if *backupRecipient != "" {
+		recipient, err := readBackupKey(*backupRecipient)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+
+		_, err = rand.Read(key[:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+
+		header.Encryption = BackupPublicKey
+		header.SealedKey, err = box.SealAnonymous(nil, key[:], recipient, rand.Reader)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+	} else {
+		passphrase, err := readBackupPassphrase()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+
+		header.Encryption = BackupPassphrase
+		header.Salt = make([]byte, 16)
+
+		_, err = rand.Read(header.Salt)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+
+		derived, err := backupPassphraseKey(passphrase, header.Salt)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+
+		key = *derived
+	}
+
+	var out io.Writer = os.Stdout
+
+	if *backupExportOutput != "" {
+		file, err := os.OpenFile(*backupExportOutput, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		defer file.Close()
+
+		out = file
+	}
+
+	summary, err := writeBackup(database, header, &key, out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not export the backup: "+err.Error())
+
+		if *backupExportOutput != "" {
+			os.Remove(*backupExportOutput)
+		}
+
+		return 1
+	}
+
+	printBackupSummary("Exported", summary)
+
+	return 0
+}
+
+func writeBackup(database *sqlx.DB, header backupHeader, key *[32]byte, out io.Writer) (*backupSummary, error) {
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	line = append(line, '\n')
+
+	_, err = out.Write(line)
+	if err != nil {
+		return nil, err
+	}
+
+	// a single transaction gives us a consistent snapshot; PostgreSQL needs to be told so
+	tx, err := database.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if dialect.Name() == "postgres" {
+		_, err = tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	encrypted := &backupWriter{out: out, key: key, headerHash: hashBackupHeader(line)}
+	compressed := gzip.NewWriter(encrypted)
+	encoder := json.NewEncoder(compressed)
+	summary := &backupSummary{Counts: make(map[string]int)}
+
+	write := func(recordType string, data interface{}) error {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+
+		summary.Counts[recordType]++
+
+		return encoder.Encode(backupRecord{recordType, encoded})
+	}
+
+	users := make([]backupUser, 0)
+	err = tx.Select(&users, "SELECT `id`, `login`, `password`, `name`, `role`, `backend`, `external_id`, `email`, `oidc_subject`, `last_login_at`, `deleted` FROM `user` ORDER BY `id`")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		if err := write("user", user); err != nil {
+			return nil, err
+		}
+	}
+
+	secrets := make([]backupSecret, 0)
+	err = tx.Select(&secrets, "SELECT `id`, `slug`, `name`, `secret`, `created_at`, `updated_at`, `created_by`, `updated_by`, `generator`, `rotation_days`, `rotate_at`, `rotated_at` FROM `secret` ORDER BY `id`")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, secret := range secrets {
+		secret.Secret, err = Decrypt(secret.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decrypt secret %s: %s", secret.Slug, err)
+		}
+
+		if err := write("secret", secret); err != nil {
+			return nil, err
+		}
+	}
+
+	versions := make([]backupSecretVersion, 0)
+	err = tx.Select(&versions, "SELECT `secret_id`, `secret`, `created_at`, `created_by` FROM `secret_version` ORDER BY `id`")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range versions {
+		version.Secret, err = Decrypt(version.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decrypt a version of secret %d: %s", version.SecretId, err)
+		}
+
+		if err := write("version", version); err != nil {
+			return nil, err
+		}
+	}
+
+	consumers := make([]backupConsumer, 0)
+	err = tx.Select(&consumers, "SELECT `id`, `name`, `enabled`, `info_token`, `created_at`, `updated_at`, `created_by`, `updated_by`, `deleted` FROM `consumer` ORDER BY `id`")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, consumer := range consumers {
+		if err := write("consumer", consumer); err != nil {
+			return nil, err
+		}
+	}
+
+	restrictions := make([]backupRestriction, 0)
+	err = tx.Select(&restrictions, "SELECT `consumer_id`, `type`, `context`, `enabled` FROM `restriction` ORDER BY `consumer_id`, `type`")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, restriction := range restrictions {
+		if err := write("restriction", restriction); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]backupConsumerKey, 0)
+	err = tx.Select(&keys, "SELECT `consumer_id`, `kind`, `public_key`, `fingerprint`, `required` FROM `consumer_key` ORDER BY `consumer_id`")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if err := write("key", key); err != nil {
+			return nil, err
+		}
+	}
+
+	assignments := make([]backupAssignment, 0)
+	err = tx.Select(&assignments, "SELECT `consumer_id`, `secret_id` FROM `consumer_secret` ORDER BY `consumer_id`, `secret_id`")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, assignment := range assignments {
+		if err := write("assignment", assignment); err != nil {
+			return nil, err
+		}
+	}
+
+	authorities := make([]backupAuthority, 0)
+	err = tx.Select(&authorities, "SELECT `secret_id`, `kind`, `ttl`, `allowed_names`, `allow_wildcards` FROM `certificate_authority` ORDER BY `secret_id`")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, authority := range authorities {
+		if err := write("authority", authority); err != nil {
+			return nil, err
+		}
+	}
+
+	// issued certificates are needed for the revocation lists
+	issued := make([]backupIssuedCertificate, 0)
+	err = tx.Select(&issued, "SELECT `secret_id`, `consumer_id`, `serial`, `subject`, `sans`, `not_after`, `issued_at`, `revoked_at`, `revoked_by` FROM `issued_certificate` ORDER BY `id`")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cert := range issued {
+		if err := write("issued", cert); err != nil {
+			return nil, err
+		}
+	}
+
+	dynamics := make([]backupDynamicCredential, 0)
+	err = tx.Select(&dynamics, "SELECT `secret_id`, `ttl`, `creation`, `revocation` FROM `dynamic_credential` ORDER BY `secret_id`")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dynamic := range dynamics {
+		if err := write("dynamic", dynamic); err != nil {
+			return nil, err
+		}
+	}
+
+	// leases are needed to drop the users once they expire
+	leases := make([]backupLease, 0)
+	err = tx.Select(&leases, "SELECT `secret_id`, `consumer_id`, `username`, `created_at`, `expires_at`, `revoked_at`, `revoked_by`, `last_error` FROM `lease` ORDER BY `id`")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lease := range leases {
+		if err := write("lease", lease); err != nil {
+			return nil, err
+		}
+	}
+
+	encoded, err := json.Marshal(summary)
+	if err != nil {
+		return nil, err
+	}
+
+	err = encoder.Encode(backupRecord{"end", encoded})
+	if err != nil {
+		return nil, err
+	}
+
+	err = compressed.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, encrypted.Close()
+}
+
+func printBackupSummary(verb string, summary *backupSummary) {
+	parts := make([]string, 0, len(backupRecordTypes))
+
+	for _, recordType := range backupRecordTypes {
+		parts = append(parts, fmt.Sprintf("%d %s(s)", summary.Counts[recordType], recordType))
+	}
+
+	fmt.Fprintf(os.Stderr, "%s %s.\n", verb, strings.Join(parts, ", "))
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Verify and restore
+
+// openBackup reads the header and returns a reader for the decrypted records.
+func openBackup(file *os.File) (*backupHeader, io.Reader, error) {
+	in := bufio.NewReader(file)
+
+	line, err := in.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, errors.New("This is not a Raziel backup archive.")
+	}
+
+	header := &backupHeader{}
+
+	err = json.Unmarshal(line, header)
+	if err != nil || header.Format != backupFormat {
+		return nil, nil, errors.New("This is not a Raziel backup archive.")
+	}
+
+	if header.Version != backupVersion {
+		return nil, nil, fmt.Errorf("Unsupported archive version %d.", header.Version)
+	}
+
+	var key *[32]byte
+
+	switch header.Encryption {
+	case BackupPassphrase:
+		passphrase, err := readBackupPassphrase()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key, err = backupPassphraseKey(passphrase, header.Salt)
+		if err != nil {
+			return nil, nil, err
+		}
+
+	case BackupPublicKey:
+		if *backupIdentity == "" {
+			return nil, nil, errors.New("The archive is encrypted to a public key; use --identity to give the private key.")
+		}
+
+		private, err := readBackupKey(*backupIdentity)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		public, err := curve25519.X25519(private[:], curve25519.Basepoint)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		publicKey := [32]byte{}
+		copy(publicKey[:], public)
+
+		opened, ok := box.OpenAnonymous(nil, header.SealedKey, &publicKey, private)
+		if !ok || len(opened) != 32 {
+			return nil, nil, errors.New("The archive was not encrypted for this private key.")
+		}
+
+		key = &[32]byte{}
+		copy(key[:], opened)
+
+	default:
+		return nil, nil, errors.New("Unknown archive encryption '" + header.Encryption + "'.")
+	}
+
+	decrypted := &backupReader{in: in, key: key, headerHash: hashBackupHeader(line)}
+
+	decompressed, err := gzip.NewReader(decrypted)
+	if err != nil {
+		if err == errBackupCorrupted {
+			return nil, nil, err
+		}
+
+		return nil, nil, errBackupCorrupted
+	}
+
+	return header, decompressed, nil
+}
+
+// readBackup calls handle for every record in the archive and makes sure that the archive is
+// complete.
+func readBackup(records io.Reader, handle func(recordType string, data json.RawMessage) error) (*backupSummary, error) {
+	decoder := json.NewDecoder(records)
+	counts := make(map[string]int)
+
+	for {
+		record := backupRecord{}
+
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return nil, errors.New("The archive ends before its summary.")
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if record.Type == "end" {
+			summary := &backupSummary{}
+
+			err = json.Unmarshal(record.Data, summary)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, recordType := range backupRecordTypes {
+				if summary.Counts[recordType] != counts[recordType] {
+					return nil, fmt.Errorf("The archive should contain %d %s(s), but contains %d.", summary.Counts[recordType], recordType, counts[recordType])
+				}
+			}
+
+			// make sure that the decompressed stream is complete as well
+			_, err = io.Copy(ioutil.Discard, records)
+			if err != nil {
+				return nil, err
+			}
+
+			return summary, nil
+		}
+
+		counts[record.Type]++
+
+		err = handle(record.Type, record.Data)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// checkBackup reads the whole archive and validates all records, including that all
+// references point to records within the archive.
+func checkBackup(filename string) (*backupHeader, *backupSummary, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	header, records, err := openBackup(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	users := make(map[int]bool)
+	secrets := make(map[int]bool)
+	consumers := make(map[int]bool)
+
+	summary, err := readBackup(records, func(recordType string, data json.RawMessage) error {
+		switch recordType {
+		case "user":
+			user := backupUser{}
+			if err := json.Unmarshal(data, &user); err != nil {
+				return err
+			}
+
+			users[user.Id] = true
+
+		case "secret":
+			secret := backupSecret{}
+			if err := json.Unmarshal(data, &secret); err != nil {
+				return err
+			}
+
+			if !users[secret.CreatedBy] || (secret.UpdatedBy != nil && !users[*secret.UpdatedBy]) {
+				return errors.New("The secret " + secret.Slug + " references an unknown user.")
+			}
+
+			secrets[secret.Id] = true
+
+		case "version":
+			version := backupSecretVersion{}
+			if err := json.Unmarshal(data, &version); err != nil {
+				return err
+			}
+
+			if !secrets[version.SecretId] || (version.CreatedBy != nil && !users[*version.CreatedBy]) {
+				return errors.New("A secret version references an unknown secret or user.")
+			}
+
+		case "consumer":
+			consumer := backupConsumer{}
+			if err := json.Unmarshal(data, &consumer); err != nil {
+				return err
+			}
+
+			if !users[consumer.CreatedBy] || (consumer.UpdatedBy != nil && !users[*consumer.UpdatedBy]) {
+				return errors.New("The consumer " + consumer.Name + " references an unknown user.")
+			}
+
+			consumers[consumer.Id] = true
+
+		case "restriction":
+			restriction := backupRestriction{}
+			if err := json.Unmarshal(data, &restriction); err != nil {
+				return err
+			}
+
+			if !consumers[restriction.ConsumerId] {
+				return errors.New("A restriction references an unknown consumer.")
+			}
+
+		case "key":
+			key := backupConsumerKey{}
+			if err := json.Unmarshal(data, &key); err != nil {
+				return err
+			}
+
+			if !consumers[key.ConsumerId] {
+				return errors.New("An encryption key references an unknown consumer.")
+			}
+
+		case "assignment":
+			assignment := backupAssignment{}
+			if err := json.Unmarshal(data, &assignment); err != nil {
+				return err
+			}
+
+			if !consumers[assignment.ConsumerId] || !secrets[assignment.SecretId] {
+				return errors.New("A secret assignment references an unknown consumer or secret.")
+			}
+
+		case "authority":
+			authority := backupAuthority{}
+			if err := json.Unmarshal(data, &authority); err != nil {
+				return err
+			}
+
+			if !secrets[authority.SecretId] {
+				return errors.New("A certificate authority references an unknown secret.")
+			}
+
+		case "issued":
+			cert := backupIssuedCertificate{}
+			if err := json.Unmarshal(data, &cert); err != nil {
+				return err
+			}
+
+			if !secrets[cert.SecretId] || (cert.ConsumerId != nil && !consumers[*cert.ConsumerId]) || (cert.RevokedBy != nil && !users[*cert.RevokedBy]) {
+				return errors.New("An issued certificate references an unknown secret, consumer or user.")
+			}
+
+		case "dynamic":
+			dynamic := backupDynamicCredential{}
+			if err := json.Unmarshal(data, &dynamic); err != nil {
+				return err
+			}
+
+			if !secrets[dynamic.SecretId] {
+				return errors.New("A dynamic credential references an unknown secret.")
+			}
+
+		case "lease":
+			lease := backupLease{}
+			if err := json.Unmarshal(data, &lease); err != nil {
+				return err
+			}
+
+			if !secrets[lease.SecretId] || (lease.ConsumerId != nil && !consumers[*lease.ConsumerId]) || (lease.RevokedBy != nil && !users[*lease.RevokedBy]) {
+				return errors.New("A lease references an unknown secret, consumer or user.")
+			}
+
+		default:
+			return errors.New("The archive contains an unknown record type '" + recordType + "'.")
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return header, summary, nil
+}
+
+func runBackupVerify() int {
+	header, summary, err := checkBackup(*backupVerifyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "The archive from %s (schema version %s) is intact.\n", header.CreatedAt, header.Schema)
+	printBackupSummary("It contains", summary)
+
+	return 0
+}
+
+func runBackupRestore(database *sqlx.DB) int {
+	// never touch the database before the whole archive has been checked
+	header, _, err := checkBackup(*backupRestoreFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	if compareVersions(header.Schema, SchemaVersion()) > 0 {
+		fmt.Fprintf(os.Stderr, "The archive was created with schema version %s, but this Raziel only knows %s.\n", header.Schema, SchemaVersion())
+		return 1
+	}
+
+	if _, err := databaseVersion(database); err != nil {
+		err = createSchema(database)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+	}
+
+	err = migrateDatabase(database)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	err = verifyMasterPassword(database, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	file, err := os.Open(*backupRestoreFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer file.Close()
+
+	_, records, err := openBackup(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	var summary *backupSummary
+
+	code := runInTransaction(database, func(tx *sqlx.Tx) error {
+		for _, table := range []string{"user", "secret", "consumer"} {
+			count := 0
+
+			err := tx.Get(&count, "SELECT COUNT(*) FROM `"+table+"`")
+			if err != nil {
+				return err
+			}
+
+			if count > 0 {
+				return errors.New("The database is not empty; backups can only be restored into a new database.")
+			}
+		}
+
+		summary, err = readBackup(records, func(recordType string, data json.RawMessage) error {
+			return restoreBackupRecord(recordType, data, tx)
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return resetSequences(tx)
+	})
+
+	if code == 0 {
+		printBackupSummary("Restored", summary)
+	}
+
+	return code
+}
+
+func restoreBackupRecord(recordType string, data json.RawMessage, tx *sqlx.Tx) error {
+	var err error
+
+	switch recordType {
+	case "user":
+		u := backupUser{}
+		if err = json.Unmarshal(data, &u); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO `user` (`id`, `login`, `password`, `name`, `role`, `backend`, `external_id`, `email`, `oidc_subject`, `last_login_at`, `deleted`) VALUES (?,?,?,?,?,?,?,?,?,?,?)",
+			u.Id, u.LoginName, u.Password, u.Name, u.Role, u.Backend, u.ExternalId, u.Email, u.OidcSubject, u.LastLoginAt, u.Deleted,
+		)
+
+	case "secret":
+		s := backupSecret{}
+		if err = json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+
+		encrypted, err := Encrypt(s.Secret)
+		if err != nil {
+			return errors.New("Could not encrypt secret: " + err.Error())
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO `secret` (`id`, `slug`, `name`, `secret`, `created_at`, `updated_at`, `created_by`, `updated_by`, `generator`, `rotation_days`, `rotate_at`, `rotated_at`) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)",
+			s.Id, s.Slug, s.Name, encrypted, s.CreatedAt, s.UpdatedAt, s.CreatedBy, s.UpdatedBy, s.Generator, s.RotationDays, s.RotateAt, s.RotatedAt,
+		)
+
+		return err
+
+	case "version":
+		v := backupSecretVersion{}
+		if err = json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+
+		encrypted, err := Encrypt(v.Secret)
+		if err != nil {
+			return errors.New("Could not encrypt secret: " + err.Error())
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO `secret_version` (`secret_id`, `secret`, `created_at`, `created_by`) VALUES (?,?,?,?)",
+			v.SecretId, encrypted, v.CreatedAt, v.CreatedBy,
+		)
+
+		return err
+
+	case "consumer":
+		c := backupConsumer{}
+		if err = json.Unmarshal(data, &c); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO `consumer` (`id`, `name`, `enabled`, `info_token`, `created_at`, `updated_at`, `created_by`, `updated_by`, `deleted`) VALUES (?,?,?,?,?,?,?,?,?)",
+			c.Id, c.Name, c.Enabled, c.InfoToken, c.CreatedAt, c.UpdatedAt, c.CreatedBy, c.UpdatedBy, c.Deleted,
+		)
+
+	case "restriction":
+		r := backupRestriction{}
+		if err = json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO `restriction` (`consumer_id`, `type`, `context`, `enabled`) VALUES (?,?,?,?)",
+			r.ConsumerId, r.Type, r.Context, r.Enabled,
+		)
+
+	case "key":
+		k := backupConsumerKey{}
+		if err = json.Unmarshal(data, &k); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO `consumer_key` (`consumer_id`, `kind`, `public_key`, `fingerprint`, `required`) VALUES (?,?,?,?,?)",
+			k.ConsumerId, k.Kind, k.PublicKey, k.Fingerprint, k.Required,
+		)
+
+	case "assignment":
+		a := backupAssignment{}
+		if err = json.Unmarshal(data, &a); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO `consumer_secret` (`consumer_id`, `secret_id`) VALUES (?,?)", a.ConsumerId, a.SecretId)
+
+	case "authority":
+		a := backupAuthority{}
+		if err = json.Unmarshal(data, &a); err != nil {
+			return err
+		}
+
+		// archives from before SSH authorities only contain X.509 ones
+		if a.Kind == "" {
+			a.Kind = AuthorityX509
+		}
+
+		_, err = tx.Exec("INSERT INTO `certificate_authority` (`secret_id`, `kind`, `ttl`, `allowed_names`, `allow_wildcards`) VALUES (?,?,?,?,?)", a.SecretId, a.Kind, a.Ttl, a.AllowedNames, a.AllowWildcards)
+
+	case "issued":
+		c := backupIssuedCertificate{}
+		if err = json.Unmarshal(data, &c); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO `issued_certificate` (`secret_id`, `consumer_id`, `serial`, `subject`, `sans`, `not_after`, `issued_at`, `revoked_at`, `revoked_by`) VALUES (?,?,?,?,?,?,?,?,?)",
+			c.SecretId, c.ConsumerId, c.Serial, c.Subject, c.Sans, c.NotAfter, c.IssuedAt, c.RevokedAt, c.RevokedBy,
+		)
+
+	case "dynamic":
+		d := backupDynamicCredential{}
+		if err = json.Unmarshal(data, &d); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO `dynamic_credential` (`secret_id`, `ttl`, `creation`, `revocation`) VALUES (?,?,?,?)", d.SecretId, d.Ttl, d.Creation, d.Revocation)
+
+	case "lease":
+		l := backupLease{}
+		if err = json.Unmarshal(data, &l); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO `lease` (`secret_id`, `consumer_id`, `username`, `created_at`, `expires_at`, `revoked_at`, `revoked_by`, `last_error`) VALUES (?,?,?,?,?,?,?,?)",
+			l.SecretId, l.ConsumerId, l.Username, l.CreatedAt, l.ExpiresAt, l.RevokedAt, l.RevokedBy, l.LastError,
+		)
+	}
+
+	return err
+}
+
+// resetSequences makes PostgreSQL continue after the restored IDs; MySQL and SQLite do this on
+// their own.
+func resetSequences(tx *sqlx.Tx) error {
+	if dialect.Name() != "postgres" {
+		return nil
+	}
+
+	for _, table := range []string{"user", "secret", "consumer"} {
+		_, err := tx.Exec("SELECT setval(pg_get_serial_sequence('\"" + table + "\"', 'id'), COALESCE((SELECT MAX(`id`) FROM `" + table + "`), 0) + 1, false)")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Key generation
+
+func runBackupKeygen() int {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	err = writeNewFile(*backupKeygenFile, base64.StdEncoding.EncodeToString(private[:])+"\n", 0600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	err = writeNewFile(*backupKeygenFile+".pub", base64.StdEncoding.EncodeToString(public[:])+"\n", 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "Keep %s offline; use %s.pub with `backup export --recipient`.\n", *backupKeygenFile, *backupKeygenFile)
+
+	return 0
+}
+
+// writeNewFile refuses to overwrite existing files, so keys are never lost by accident.
+func writeNewFile(filename string, content string, mode os.FileMode) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(content)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
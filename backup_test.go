@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// writeTestBackup exports the database into a passphrase encrypted archive and returns its content.
+func writeTestBackup(t *testing.T, database *sqlx.DB, passphrase string) []byte {
+	t.Helper()
+
+	header := backupHeader{
+		Format:     backupFormat,
+		Version:    backupVersion,
+		Schema:     SchemaVersion(),
+		CreatedAt:  "2020-01-01 00:00:00",
+		Encryption: BackupPassphrase,
+		Salt:       []byte("0123456789abcdef"),
+	}
+
+	key, err := backupPassphraseKey(passphrase, header.Salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := &bytes.Buffer{}
+
+	if _, err := writeBackup(database, header, key, archive); err != nil {
+		t.Fatalf("Could not export the backup: %v", err)
+	}
+
+	return archive.Bytes()
+}
+
+// saveTestBackup writes the archive into a temporary file and returns its name.
+func saveTestBackup(t *testing.T, archive []byte) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "raziel.backup")
+
+	if err := ioutil.WriteFile(filename, archive, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	source := newTestDatabase(t)
+
+	tx, _ := source.Beginx()
+	user := createTestUser(t, "admin", tx)
+	consumer := createTestConsumer(t, "web", user, tx)
+	createTestSecret(t, "db", "hunter2", user, tx, consumer)
+	createTestSecret(t, "unassigned", "correct horse", user, tx)
+	tx.Commit()
+
+	backupPassphrase = "backup passphrase"
+	defer func() { backupPassphrase = "" }()
+
+	filename := saveTestBackup(t, writeTestBackup(t, source, backupPassphrase))
+
+	_, summary, err := checkBackup(filename)
+	if err != nil {
+		t.Fatalf("The archive was not intact: %v", err)
+	}
+
+	if summary.Counts["user"] != 1 || summary.Counts["consumer"] != 1 || summary.Counts["secret"] != 2 || summary.Counts["assignment"] != 1 {
+		t.Errorf("The archive does not contain everything: %v", summary.Counts)
+	}
+
+	// the archive must not depend on the master key it was exported with
+	target := newTestDatabase(t)
+	masterPassword = []byte("another master password")
+
+	previous := *backupRestoreFile
+	*backupRestoreFile = filename
+	defer func() { *backupRestoreFile = previous }()
+
+	if code := runBackupRestore(target); code != 0 {
+		t.Fatalf("The restore failed with exit code %d.", code)
+	}
+
+	// a second restore would duplicate everything
+	if code := runBackupRestore(target); code == 0 {
+		t.Error("The archive was restored into a database that is not empty.")
+	}
+
+	tx, _ = target.Beginx()
+	defer tx.Rollback()
+
+	secret := findSecretBySlug("db", true, tx)
+	if secret == nil {
+		t.Fatal("The secret was not restored.")
+	}
+
+	plain, err := Decrypt(secret.Secret)
+	if err != nil || string(plain) != "hunter2" {
+		t.Errorf("The secret was not re-encrypted with the new master key: %q (%v)", plain, err)
+	}
+
+	if restored := findConsumer(consumer.Id, tx); restored == nil || restored.Name != "web" {
+		t.Errorf("The consumer was not restored: %+v", restored)
+	}
+
+	if consumers := findSecretConsumers(secret.Id, tx); len(consumers) != 1 {
+		t.Error("The assignment was not restored.")
+	}
+}
+
+func TestBackupRejectsModifiedArchives(t *testing.T) {
+	database := newTestDatabase(t)
+
+	// random data does not compress, so the archive is made of more than one chunk
+	filler := make([]byte, backupChunkSize)
+	rand.Read(filler)
+
+	tx, _ := database.Beginx()
+	user := createTestUser(t, "admin", tx)
+	createTestSecret(t, "large", base64.StdEncoding.EncodeToString(filler), user, tx)
+	tx.Commit()
+
+	backupPassphrase = "backup passphrase"
+	defer func() { backupPassphrase = "" }()
+
+	archive := writeTestBackup(t, database, backupPassphrase)
+
+	headerLength := bytes.IndexByte(archive, '\n') + 1
+	firstChunk := headerLength + 4 + int(binary.BigEndian.Uint32(archive[headerLength:]))
+
+	if firstChunk >= len(archive) {
+		t.Fatal("The archive consists of a single chunk.")
+	}
+
+	modify := func(change func(archive []byte) []byte) []byte {
+		return change(append([]byte{}, archive...))
+	}
+
+	corrupted := errBackupCorrupted.Error()
+
+	testcases := []struct {
+		name     string
+		archive  []byte
+		expected string
+	}{
+		{"flipped bit", modify(func(a []byte) []byte {
+			a[len(a)/2] ^= 1
+			return a
+		}), corrupted},
+		{"changed header", modify(func(a []byte) []byte {
+			return bytes.Replace(a, []byte("2020-01-01"), []byte("2021-01-01"), 1)
+		}), corrupted},
+		{"swapped chunks", modify(func(a []byte) []byte {
+			return append(append(a[:headerLength], archive[firstChunk:]...), archive[headerLength:firstChunk]...)
+		}), corrupted},
+		{"truncated chunk", archive[:len(archive)-10], "The archive is truncated."},
+		{"dropped final chunk", archive[:firstChunk], "The archive is truncated."},
+		{"appended data", modify(func(a []byte) []byte {
+			return append(a, archive[headerLength:firstChunk]...)
+		}), "The archive contains data after its end."},
+	}
+
+	for _, testcase := range testcases {
+		_, _, err := checkBackup(saveTestBackup(t, testcase.archive))
+		if err == nil || err.Error() != testcase.expected {
+			t.Errorf("%s: expected %q, got %v.", testcase.name, testcase.expected, err)
+		}
+	}
+
+	backupPassphrase = "wrong passphrase"
+
+	if _, _, err := checkBackup(saveTestBackup(t, archive)); err != errBackupCorrupted {
+		t.Errorf("Expected the wrong passphrase to be rejected, got %v.", err)
+	}
+}
+
+func TestBackupForPublicKey(t *testing.T) {
+	database := newTestDatabase(t)
+
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, stranger, _ := box.GenerateKey(rand.Reader)
+
+	key := [32]byte{}
+	rand.Read(key[:])
+
+	sealed, err := box.SealAnonymous(nil, key[:], public, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := backupHeader{Format: backupFormat, Version: backupVersion, Schema: SchemaVersion(), Encryption: BackupPublicKey, SealedKey: sealed}
+	archive := &bytes.Buffer{}
+
+	if _, err := writeBackup(database, header, &key, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := saveTestBackup(t, archive.Bytes())
+	dir := t.TempDir()
+
+	previous := *backupIdentity
+	defer func() { *backupIdentity = previous }()
+
+	for identity, valid := range map[*[32]byte]bool{private: true, stranger: false} {
+		*backupIdentity = filepath.Join(dir, "identity")
+		os.Remove(*backupIdentity)
+
+		if err := writeNewFile(*backupIdentity, base64.StdEncoding.EncodeToString(identity[:])+"\n", 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err := checkBackup(filename)
+		if (err == nil) != valid {
+			t.Errorf("Expected valid=%v, got %v.", valid, err)
+		}
+
+		if !valid && (err == nil || !strings.Contains(err.Error(), "not encrypted for this private key")) {
+			t.Errorf("Expected the stranger's key to be rejected, got %v.", err)
+		}
+	}
+}
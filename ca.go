@@ -0,0 +1,752 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/ssh"
+)
+
+// the lifetime of a CRL; clients should fetch a new one before it runs out
+const crlLifetime = 24 * time.Hour
+
+const (
+	AuthorityX509 = "x509"
+	AuthoritySsh  = "ssh"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Certificate authority model
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// CertificateAuthority is the issuing policy of a secret that holds a CA certificate and its key.
+// Consumers that have been granted access to such a secret can have certificates signed for names
+// matching the AllowedNames patterns (one per line); wildcard certificates are only issued if
+// AllowWildcards is set. SSH authorities hold just a private key and leave the policy to the
+// consumers' SSH certificate restriction, so Ttl and AllowedNames are empty.
+type CertificateAuthority struct {
+	SecretId       int    `db:"secret_id"`
+	Kind           string `db:"kind"`
+	Ttl            string `db:"ttl"`
+	AllowedNames   string `db:"allowed_names"`
+	AllowWildcards bool   `db:"allow_wildcards"`
+
+	_db *sqlx.Tx
+}
+
+func findCertificateAuthority(secretId int, db *sqlx.Tx) *CertificateAuthority {
+	ca := &CertificateAuthority{}
+	ca._db = db
+
+	db.Get(ca, "SELECT `secret_id`, `kind`, `ttl`, `allowed_names`, `allow_wildcards` FROM `certificate_authority` WHERE `secret_id` = ?", secretId)
+	if ca.SecretId == 0 {
+		return nil
+	}
+
+	return ca
+}
+
+func (s *Secret) GetCertificateAuthority() *CertificateAuthority {
+	return findCertificateAuthority(s.Id, s._db)
+}
+
+// setCertificateAuthority stores the issuing policy; nil turns the secret back into a regular one.
+func (s *Secret) setCertificateAuthority(ca *CertificateAuthority) error {
+	_, err := s._db.Exec("DELETE FROM `certificate_authority` WHERE `secret_id` = ?", s.Id)
+	if err != nil || ca == nil {
+		return err
+	}
+
+	ca.SecretId = s.Id
+	ca._db = s._db
+
+	_, err = s._db.Exec("INSERT INTO `certificate_authority` (`secret_id`, `kind`, `ttl`, `allowed_names`, `allow_wildcards`) VALUES (?,?,?,?,?)", ca.SecretId, ca.Kind, ca.Ttl, ca.AllowedNames, ca.AllowWildcards)
+
+	return err
+}
+
+func (ca *CertificateAuthority) MaxTtl() time.Duration {
+	ttl, err := time.ParseDuration(ca.Ttl)
+	if err != nil {
+		return 0
+	}
+
+	return ttl
+}
+
+func (ca *CertificateAuthority) Patterns() []string {
+	return strings.Split(ca.AllowedNames, "\n")
+}
+
+// Allows checks a DNS name or IP address against the patterns. "*.example.com" matches exactly one
+// additional label, IP addresses can be allowed by CIDR ranges. A wildcard name is only allowed if
+// the authority allows wildcards and lists the very same name as a pattern.
+func (ca *CertificateAuthority) Allows(name string) bool {
+	ip := net.ParseIP(name)
+	name = strings.ToLower(name)
+	wildcard := strings.HasPrefix(name, "*.")
+
+	if ip == nil {
+		if wildcard && !ca.AllowWildcards {
+			return false
+		}
+
+		if !validDnsName(strings.TrimPrefix(name, "*.")) {
+			return false
+		}
+	}
+
+	for _, pattern := range ca.Patterns() {
+		if ip != nil {
+			if _, network, err := net.ParseCIDR(pattern); err == nil && network.Contains(ip) {
+				return true
+			}
+
+			if patternIp := net.ParseIP(pattern); patternIp != nil && patternIp.Equal(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		if wildcard {
+			if name == pattern {
+				return true
+			}
+		} else if strings.HasPrefix(pattern, "*.") {
+			label := strings.TrimSuffix(name, pattern[1:])
+			if label != name && label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newCertificateAuthority validates a policy as entered by a user.
+func newCertificateAuthority(ttl string, allowedNames string, allowWildcards bool) (*CertificateAuthority, error) {
+	duration, err := time.ParseDuration(strings.TrimSpace(ttl))
+	if err != nil || duration < time.Minute {
+		return nil, errors.New("The TTL must be a duration like 24h or 30m, at least one minute.")
+	}
+
+	patterns := []string{}
+
+	for _, line := range strings.Split(allowedNames, "\n") {
+		pattern := strings.ToLower(strings.TrimSpace(line))
+		if pattern == "" {
+			continue
+		}
+
+		_, _, cidrErr := net.ParseCIDR(pattern)
+		if cidrErr != nil && net.ParseIP(pattern) == nil && !validNamePattern(pattern) {
+			return nil, errors.New("'" + pattern + "' is neither a DNS name (optionally starting with '*.'), an IP address nor a CIDR range.")
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	if len(patterns) == 0 {
+		return nil, errors.New("At least one allowed name must be given.")
+	}
+
+	return &CertificateAuthority{
+		Kind:           AuthorityX509,
+		Ttl:            duration.String(),
+		AllowedNames:   strings.Join(patterns, "\n"),
+		AllowWildcards: allowWildcards,
+	}, nil
+}
+
+// CheckBody makes sure a secret's body can be used by this authority.
+func (ca *CertificateAuthority) CheckBody(body []byte) error {
+	var err error
+
+	if ca.Kind == AuthoritySsh {
+		_, err = loadSshSigner(body)
+	} else {
+		_, _, err = loadIssuer(body)
+	}
+
+	return err
+}
+
+// PublicPart strips the private key from a secret's body, as the key of a certificate authority
+// never leaves Raziel.
+func (ca *CertificateAuthority) PublicPart(body []byte) []byte {
+	if ca.Kind != AuthoritySsh {
+		return certificatesOnly(body)
+	}
+
+	signer, err := loadSshSigner(body)
+	if err != nil {
+		return nil
+	}
+
+	return ssh.MarshalAuthorizedKey(signer.PublicKey())
+}
+
+func validNamePattern(pattern string) bool {
+	return validDnsName(strings.TrimPrefix(pattern, "*."))
+}
+
+// validDnsName checks for a lowercase host name made of letters, digits and hyphens, with labels of
+// 1 to 63 bytes that neither start nor end with a hyphen.
+func validDnsName(name string) bool {
+	if len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		if strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// loadIssuer takes the CA certificate and its key from a secret's body.
+func loadIssuer(body []byte) (*x509.Certificate, crypto.Signer, error) {
+	var cert *x509.Certificate
+	var signer crypto.Signer
+
+	rest := body
+
+	for {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		switch {
+		case block.Type == "CERTIFICATE" && cert == nil:
+			parsed, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, errors.New("The CA certificate could not be parsed: " + err.Error())
+			}
+
+			cert = parsed
+
+		case strings.HasSuffix(block.Type, "PRIVATE KEY") && signer == nil:
+			key, err := parsePrivateKey(block)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			signer = key
+		}
+	}
+
+	if cert == nil || !cert.IsCA {
+		return nil, nil, errors.New("The secret does not contain a CA certificate.")
+	}
+
+	if cert.KeyUsage&x509.KeyUsageCertSign == 0 || cert.KeyUsage&x509.KeyUsageCRLSign == 0 || len(cert.SubjectKeyId) == 0 {
+		return nil, nil, errors.New("The CA certificate must allow signing certificates and CRLs and have a subject key identifier.")
+	}
+
+	if signer == nil {
+		return nil, nil, errors.New("The secret does not contain the CA's (unencrypted) private key.")
+	}
+
+	if !publicKeysEqual(signer.Public(), cert.PublicKey) {
+		return nil, nil, errors.New("The private key does not belong to the CA certificate.")
+	}
+
+	return cert, signer, nil
+}
+
+// certificatesOnly strips everything but the certificates from a PEM body.
+func certificatesOnly(body []byte) []byte {
+	var out bytes.Buffer
+
+	rest := body
+
+	for {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		if block.Type == "CERTIFICATE" {
+			pem.Encode(&out, block)
+		}
+	}
+
+	return out.Bytes()
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Issued certificates
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type IssuedCertificate struct {
+	Id         int     `db:"id"`
+	SecretId   int     `db:"secret_id"`
+	ConsumerId *int    `db:"consumer_id"`
+	Serial     string  `db:"serial"`
+	Subject    string  `db:"subject"`
+	Sans       string  `db:"sans"`
+	NotAfter   string  `db:"not_after"`
+	IssuedAt   string  `db:"issued_at"`
+	RevokedAt  *string `db:"revoked_at"`
+	RevokedBy  *int    `db:"revoked_by"`
+
+	_db *sqlx.Tx
+}
+
+const issuedCertificateColumns = "`id`, `secret_id`, `consumer_id`, `serial`, `subject`, `sans`, `not_after`, `issued_at`, `revoked_at`, `revoked_by`"
+
+func findIssuedCertificates(secretId int, limit int, db *sqlx.Tx) []IssuedCertificate {
+	list := make([]IssuedCertificate, 0)
+
+	db.Select(&list, "SELECT "+issuedCertificateColumns+" FROM `issued_certificate` WHERE `secret_id` = ? ORDER BY `id` DESC LIMIT ?", secretId, limit)
+
+	for i := range list {
+		list[i]._db = db
+	}
+
+	return list
+}
+
+func findIssuedCertificate(id int, db *sqlx.Tx) *IssuedCertificate {
+	cert := &IssuedCertificate{}
+	cert._db = db
+
+	db.Get(cert, "SELECT "+issuedCertificateColumns+" FROM `issued_certificate` WHERE `id` = ?", id)
+	if cert.Id == 0 {
+		return nil
+	}
+
+	return cert
+}
+
+// findRevokedCertificates returns the revoked certificates that have not expired yet, as only
+// those need to be listed in the CRL.
+func findRevokedCertificates(secretId int, db *sqlx.Tx) []IssuedCertificate {
+	list := make([]IssuedCertificate, 0)
+
+	db.Select(&list, "SELECT "+issuedCertificateColumns+" FROM `issued_certificate` WHERE `secret_id` = ? AND `revoked_at` IS NOT NULL AND `not_after` > NOW() ORDER BY `id`", secretId)
+
+	return list
+}
+
+func (c *IssuedCertificate) GetConsumer() *Consumer {
+	if c.ConsumerId == nil {
+		return nil
+	}
+
+	return findConsumer(*c.ConsumerId, c._db)
+}
+
+func (c *IssuedCertificate) Expired() bool {
+	notAfter, err := time.ParseInLocation("2006-01-02 15:04:05", c.NotAfter, time.Local)
+
+	return err == nil && notAfter.Before(time.Now())
+}
+
+func (c *IssuedCertificate) Revoke(userId int) error {
+	now := time.Now().Format("2006-01-02 15:04:05")
+
+	_, err := c._db.Exec("UPDATE `issued_certificate` SET `revoked_at` = ?, `revoked_by` = ? WHERE `id` = ?", now, userId, c.Id)
+	if err != nil {
+		return err
+	}
+
+	c.RevokedAt = &now
+	c.RevokedBy = &userId
+
+	return nil
+}
+
+// issueContext is stored in the access log for every issuing attempt.
+type issueContext struct {
+	Type     string   `json:"type,omitempty"`
+	Serial   string   `json:"serial,omitempty"`
+	NotAfter string   `json:"notAfter,omitempty"`
+	Names    []string `json:"names,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// certificateRequest is what a consumer asks for: either a CSR or just the names, in which case a
+// key is generated, too.
+type certificateRequest struct {
+	csr   *x509.CertificateRequest
+	names []string
+	ttl   time.Duration
+}
+
+func parseCertificateRequest(req *http.Request) (*certificateRequest, error) {
+	result := &certificateRequest{}
+
+	if ttl := strings.TrimSpace(req.FormValue("ttl")); ttl != "" {
+		duration, err := time.ParseDuration(ttl)
+		if err != nil || duration <= 0 {
+			return nil, errors.New("Invalid TTL given.")
+		}
+
+		result.ttl = duration
+	}
+
+	if csr := strings.TrimSpace(req.FormValue("csr")); csr != "" {
+		block, _ := pem.Decode([]byte(csr))
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			return nil, errors.New("The CSR must be PEM encoded.")
+		}
+
+		parsed, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			return nil, errors.New("The CSR could not be parsed: " + err.Error())
+		}
+
+		if err := parsed.CheckSignature(); err != nil {
+			return nil, errors.New("The CSR's signature is invalid.")
+		}
+
+		if len(parsed.EmailAddresses) > 0 || len(parsed.URIs) > 0 {
+			return nil, errors.New("Only DNS names and IP addresses can be requested.")
+		}
+
+		result.csr = parsed
+		result.names = append(result.names, parsed.DNSNames...)
+
+		for _, ip := range parsed.IPAddresses {
+			result.names = append(result.names, ip.String())
+		}
+
+		if len(result.names) == 0 && parsed.Subject.CommonName != "" {
+			result.names = []string{parsed.Subject.CommonName}
+		}
+	} else {
+		for _, name := range strings.FieldsFunc(req.FormValue("names"), func(r rune) bool { return r == ',' || r == ' ' || r == '\n' }) {
+			result.names = append(result.names, strings.ToLower(name))
+		}
+	}
+
+	if len(result.names) == 0 {
+		return nil, errors.New("Either a CSR or the names to issue a certificate for must be given.")
+	}
+
+	return result, nil
+}
+
+// Issue signs a certificate for the request and records it. The returned PEM contains the
+// certificate, the CA certificate and, if no CSR was given, the generated private key.
+func (ca *CertificateAuthority) Issue(secret *Secret, consumer *Consumer, request *certificateRequest) ([]byte, *IssuedCertificate, error) {
+	for _, name := range request.names {
+		if !ca.Allows(name) {
+			return nil, nil, errors.New("The name '" + name + "' is not allowed by this CA.")
+		}
+	}
+
+	body, err := Decrypt(secret.Secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	issuer, signer, err := loadIssuer(body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var publicKey crypto.PublicKey
+	var keyPem []byte
+
+	if request.csr != nil {
+		publicKey = request.csr.PublicKey
+	} else {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		publicKey = key.Public()
+		keyPem = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+
+	ttl := ca.MaxTtl()
+	if request.ttl > 0 && request.ttl < ttl {
+		ttl = request.ttl
+	}
+
+	now := time.Now()
+	notAfter := now.Add(ttl)
+
+	if notAfter.After(issuer.NotAfter) {
+		notAfter = issuer.NotAfter
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: request.names[0]},
+		NotBefore:    now.Add(-1 * time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if _, ok := publicKey.(*rsa.PublicKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	for _, name := range request.names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	if config.Server.BaseUrl != "" {
+		template.CRLDistributionPoints = []string{strings.TrimRight(config.Server.BaseUrl, "/") + "/crl/" + secret.Slug}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, publicKey, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	issued := &IssuedCertificate{
+		SecretId: secret.Id,
+		Serial:   serial.Text(16),
+		Subject:  template.Subject.String(),
+		Sans:     strings.Join(request.names, ", "),
+		NotAfter: notAfter.Format("2006-01-02 15:04:05"),
+		IssuedAt: now.Format("2006-01-02 15:04:05"),
+		_db:      secret._db,
+	}
+
+	if consumer != nil {
+		issued.ConsumerId = &consumer.Id
+	}
+
+	result, err := secret._db.Exec(
+		"INSERT INTO `issued_certificate` (`secret_id`, `consumer_id`, `serial`, `subject`, `sans`, `not_after`, `issued_at`, `revoked_at`, `revoked_by`) VALUES (?,?,?,?,?,?,?,NULL,NULL)",
+		issued.SecretId, issued.ConsumerId, issued.Serial, issued.Subject, issued.Sans, issued.NotAfter, issued.IssuedAt,
+	)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	issued.Id = int(id)
+
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuer.Raw})...)
+	bundle = append(bundle, keyPem...)
+
+	return bundle, issued, nil
+}
+
+// CreateCrl signs a new revocation list. The CRL number is the current time, so it increases
+// without having to be stored.
+func (ca *CertificateAuthority) CreateCrl(secret *Secret) ([]byte, error) {
+	body, err := Decrypt(secret.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer, signer, err := loadIssuer(body)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	revoked := []pkix.RevokedCertificate{}
+
+	for _, cert := range findRevokedCertificates(secret.Id, ca._db) {
+		serial, ok := new(big.Int).SetString(cert.Serial, 16)
+		if !ok {
+			continue
+		}
+
+		revokedAt, err := time.ParseInLocation("2006-01-02 15:04:05", *cert.RevokedAt, time.Local)
+		if err != nil {
+			revokedAt = now
+		}
+
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: revokedAt})
+	}
+
+	template := &x509.RevocationList{
+		Number:              big.NewInt(now.Unix()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(crlLifetime),
+		RevokedCertificates: revoked,
+	}
+
+	return x509.CreateRevocationList(rand.Reader, template, issuer, signer)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// HTTP Handlers
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func issueCertificateAction(params martini.Params, req *http.Request, db *sqlx.Tx) response {
+	accessLog := NewAccessLog(db)
+	consumer, secret, contexts, accessGranted := checkDelivery(params, req, db)
+
+	var ca *CertificateAuthority
+
+	if secret != nil {
+		ca = findCertificateAuthority(secret.Id, db)
+	}
+
+	// only secrets that are X.509 certificate authorities can issue certificates
+	if consumer == nil || secret == nil || ca == nil || ca.Kind != AuthorityX509 {
+		accessLog.LogNotFound(consumer, secret, req)
+		countDelivery(404, consumer, secret)
+
+		return newResponse(404, "Not Found.")
+	}
+
+	// issued private keys are encrypted to the consumer's key, like any other delivery
+	key, allowed := deliveryKey(consumer, req, contexts, db)
+
+	// unlike plain deliveries, issuing requires the secret to be assigned to the consumer
+	if !accessGranted || !allowed || !consumer.HasSecret(secret.Id) {
+		accessLog.LogAccess(consumer, secret, req, 403, contexts)
+		countDelivery(403, consumer, secret)
+
+		return newResponse(403, "Nope.")
+	}
+
+	request, err := parseCertificateRequest(req)
+
+	var bundle []byte
+	var issued *IssuedCertificate
+
+	if err == nil {
+		secret = findSecret(secret.Id, true, db)
+		bundle, issued, err = ca.Issue(secret, consumer, request)
+	}
+
+	if err != nil {
+		contexts["certificate"] = issueContext{Error: err.Error()}
+		accessLog.LogAccess(consumer, secret, req, 400, contexts)
+		countDelivery(400, consumer, secret)
+
+		return newResponse(400, err.Error())
+	}
+
+	contexts["certificate"] = issueContext{
+		Serial:   issued.Serial,
+		NotAfter: issued.NotAfter,
+		Names:    request.names,
+	}
+
+	sealed, err := sealDelivery(key, bundle, contexts)
+	if err != nil {
+		accessLog.LogAccess(consumer, secret, req, 500, contexts)
+		countDelivery(500, consumer, secret)
+
+		return newResponse(500, "Nope.")
+	}
+
+	accessLog.LogAccess(consumer, secret, req, 200, contexts)
+	countDelivery(200, consumer, secret)
+
+	return newResponse(200, string(sealed))
+}
+
+func crlAction(params martini.Params, db *sqlx.Tx) response {
+	secret := findSecretBySlug(params["secret"], true, db)
+	if secret == nil {
+		return newResponse(404, "Not Found.")
+	}
+
+	ca := secret.GetCertificateAuthority()
+	if ca == nil || ca.Kind != AuthorityX509 {
+		return newResponse(404, "Not Found.")
+	}
+
+	crl, err := ca.CreateCrl(secret)
+	if err != nil {
+		return newResponse(500, "Nope.")
+	}
+
+	return response{200, string(crl), "application/pkix-crl"}
+}
+
+func secretsRevokeCertificateAction(params martini.Params, req *http.Request, user *User, db *sqlx.Tx) response {
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return renderError(400, "Invalid ID given.")
+	}
+
+	certId, err := strconv.Atoi(params["cert"])
+	if err != nil {
+		return renderError(400, "Invalid certificate ID given.")
+	}
+
+	cert := findIssuedCertificate(certId, db)
+	if cert == nil || cert.SecretId != id {
+		return renderError(404, "Certificate could not be found.")
+	}
+
+	if cert.RevokedAt == nil {
+		err = cert.Revoke(user.Id)
+		if err != nil {
+			panic(err)
+		}
+
+		consumerId := -1
+		if cert.ConsumerId != nil {
+			consumerId = *cert.ConsumerId
+		}
+
+		auditLog := NewAuditLog(db, req)
+		auditLog.LogCertificateRevoked(cert.SecretId, consumerId, user.Id, cert.Serial)
+	}
+
+	return redirect(302, "/secrets/"+strconv.Itoa(id))
+}
+
+func setupCertificateAuthorityCtrl(app *martini.ClassicMartini) {
+	app.Post("/issue/:consumer/:secret", issueCertificateAction)
+	app.Get("/crl/:secret", crlAction)
+	app.Post("/ssh/:consumer/:secret", signSshCertificateAction)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCertificateAuthorityAllows(t *testing.T) {
+	ca, err := newCertificateAuthority("24h", "*.internal.example.com\nexample.com\n*.wild.example.com\n10.0.0.0/8\n192.0.2.1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := map[string]bool{
+		"app.internal.example.com":                        true,
+		"APP.internal.example.com":                        true,
+		"a-b.internal.example.com":                        true,
+		"example.com":                                     true,
+		"10.1.2.3":                                        true,
+		"192.0.2.1":                                       true,
+		"internal.example.com":                            false,
+		"a.b.internal.example.com":                        false,
+		"www.example.com":                                 false,
+		"192.0.2.2":                                       false,
+		"*.internal.example.com":                          false,
+		"*.wild.example.com":                              false,
+		"-app.internal.example.com":                       false,
+		"app-.internal.example.com":                       false,
+		"app_1.internal.example.com":                      false,
+		"app .internal.example.com":                       false,
+		".internal.example.com":                           false,
+		"example.com.":                                    false,
+		strings.Repeat("a", 64) + ".internal.example.com": false,
+		strings.Repeat("a", 63) + ".internal.example.com": true,
+	}
+
+	for name, allowed := range testcases {
+		if ca.Allows(name) != allowed {
+			t.Errorf("Expected Allows(%q) to be %v.", name, allowed)
+		}
+	}
+}
+
+func TestCertificateAuthorityAllowsWildcards(t *testing.T) {
+	ca, err := newCertificateAuthority("24h", "*.internal.example.com\nexample.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := map[string]bool{
+		"*.internal.example.com":     true,
+		"app.internal.example.com":   true,
+		"*.app.internal.example.com": false,
+		"*.example.com":              false,
+		"*.*.internal.example.com":   false,
+	}
+
+	for name, allowed := range testcases {
+		if ca.Allows(name) != allowed {
+			t.Errorf("Expected Allows(%q) to be %v.", name, allowed)
+		}
+	}
+}
+
+func TestNewCertificateAuthority(t *testing.T) {
+	invalid := []string{
+		"",
+		"*.",
+		"*",
+		"*.*.example.com",
+		"app.*.example.com",
+		"-app.example.com",
+		"app..example.com",
+		"app_1.example.com",
+		strings.Repeat("a", 64) + ".example.com",
+		"10.0.0.0/33",
+	}
+
+	for _, names := range invalid {
+		if _, err := newCertificateAuthority("24h", names, false); err == nil {
+			t.Errorf("The allowed names %q were accepted.", names)
+		}
+	}
+
+	ca, err := newCertificateAuthority(" 1h ", " *.Example.com \n\n10.0.0.0/8\n", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ca.Ttl != "1h0m0s" || ca.AllowedNames != "*.example.com\n10.0.0.0/8" || !ca.AllowWildcards {
+		t.Errorf("The policy was not normalized: %+v", ca)
+	}
+
+	if _, err := newCertificateAuthority("30s", "example.com", false); err == nil {
+		t.Error("A TTL below one minute was accepted.")
+	}
+}
+
+func TestCertificateAuthorityRoundTrip(t *testing.T) {
+	tx := newTestTx(t)
+
+	user := createTestUser(t, "admin", tx)
+	secret := createTestSecret(t, "ca", "", user, tx)
+
+	ca, _ := newCertificateAuthority("24h", "*.example.com", true)
+	if err := secret.setCertificateAuthority(ca); err != nil {
+		t.Fatal(err)
+	}
+
+	found := secret.GetCertificateAuthority()
+	if found == nil || !found.AllowWildcards || found.AllowedNames != "*.example.com" {
+		t.Errorf("The policy was not stored: %+v", found)
+	}
+}
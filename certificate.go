@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	PrivateKeyNone      = "none"
+	PrivateKeyMatch     = "match"
+	PrivateKeyMismatch  = "mismatch"
+	PrivateKeyEncrypted = "encrypted"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Certificate model
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// SecretCertificate holds the metadata of a secret whose body is a PEM certificate (or chain),
+// optionally accompanied by its private key. It is derived from the body whenever that changes.
+type SecretCertificate struct {
+	SecretId    int    `db:"secret_id"`
+	Subject     string `db:"subject"`
+	Issuer      string `db:"issuer"`
+	Sans        string `db:"sans"`
+	Serial      string `db:"serial"`
+	NotBefore   string `db:"not_before"`
+	NotAfter    string `db:"not_after"`
+	KeyType     string `db:"key_type"`
+	PrivateKey  string `db:"private_key"`
+	ChainLength int    `db:"chain_length"`
+	WarnedDays  *int   `db:"warned_days"`
+
+	_db *sqlx.Tx
+}
+
+const certificateColumns = "`secret_id`, `subject`, `issuer`, `sans`, `serial`, `not_before`, `not_after`, `key_type`, `private_key`, `chain_length`, `warned_days`"
+
+func findCertificate(secretId int, db *sqlx.Tx) *SecretCertificate {
+	cert := &SecretCertificate{}
+	cert._db = db
+
+	db.Get(cert, "SELECT "+certificateColumns+" FROM `secret_certificate` WHERE `secret_id` = ?", secretId)
+	if cert.SecretId == 0 {
+		return nil
+	}
+
+	return cert
+}
+
+// findExpiringCertificates returns the certificates expiring within the given number of days
+// (including expired ones), the most urgent first.
+func findExpiringCertificates(days int, limit int, db *sqlx.Tx) []SecretCertificate {
+	list := make([]SecretCertificate, 0)
+	until := time.Now().AddDate(0, 0, days).Format("2006-01-02 15:04:05")
+
+	db.Select(&list, "SELECT "+certificateColumns+" FROM `secret_certificate` WHERE `not_after` <= ? ORDER BY `not_after` LIMIT ?", until, limit)
+
+	for i := range list {
+		list[i]._db = db
+	}
+
+	return list
+}
+
+func (s *Secret) GetCertificate() *SecretCertificate {
+	return findCertificate(s.Id, s._db)
+}
+
+func (c *SecretCertificate) GetSecret() *Secret {
+	return findSecret(c.SecretId, false, c._db)
+}
+
+// DaysLeft is the number of started days until the certificate expires; 0 or less means it has
+// expired.
+func (c *SecretCertificate) DaysLeft() int {
+	notAfter, err := time.ParseInLocation("2006-01-02 15:04:05", c.NotAfter, time.Local)
+	if err != nil {
+		return 0
+	}
+
+	return int(math.Ceil(time.Until(notAfter).Hours() / 24))
+}
+
+// Severity maps the remaining lifetime to a Bootstrap context class.
+func (c *SecretCertificate) Severity() string {
+	switch days := c.DaysLeft(); {
+	case days <= 7:
+		return "danger"
+	case days <= 30:
+		return "warning"
+	}
+
+	return "success"
+}
+
+func (c *SecretCertificate) SanList() []string {
+	if c.Sans == "" {
+		return []string{}
+	}
+
+	return strings.Split(c.Sans, ", ")
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Parsing
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// parseCertificateBundle extracts the metadata from a PEM body. It returns nil (and no error) if
+// the body contains no certificate at all. The first certificate is considered the leaf, all
+// following ones its chain.
+func parseCertificateBundle(body []byte) (*SecretCertificate, error) {
+	var certs []*x509.Certificate
+	var keyBlock *pem.Block
+
+	rest := body
+
+	for {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Certificate #%d could not be parsed: %s", len(certs)+1, err)
+			}
+
+			certs = append(certs, cert)
+
+		case strings.HasSuffix(block.Type, "PRIVATE KEY") && keyBlock == nil:
+			keyBlock = block
+		}
+	}
+
+	if len(certs) == 0 {
+		if bytes.Contains(body, []byte("-----BEGIN CERTIFICATE-----")) {
+			return nil, errors.New("The certificate is not valid PEM.")
+		}
+
+		return nil, nil
+	}
+
+	leaf := certs[0]
+
+	info := &SecretCertificate{
+		Subject:     leaf.Subject.String(),
+		Issuer:      leaf.Issuer.String(),
+		Sans:        strings.Join(certificateNames(leaf), ", "),
+		Serial:      leaf.SerialNumber.Text(16),
+		NotBefore:   leaf.NotBefore.Local().Format("2006-01-02 15:04:05"),
+		NotAfter:    leaf.NotAfter.Local().Format("2006-01-02 15:04:05"),
+		KeyType:     describePublicKey(leaf.PublicKey),
+		PrivateKey:  PrivateKeyNone,
+		ChainLength: len(certs) - 1,
+	}
+
+	if keyBlock != nil {
+		status, err := matchPrivateKey(keyBlock, leaf)
+		if err != nil {
+			return nil, err
+		}
+
+		info.PrivateKey = status
+	}
+
+	return info, nil
+}
+
+// checkCertificateBundle rejects bodies with broken certificates or a private key that does not
+// belong to the certificate. Anything else is accepted as it is.
+func checkCertificateBundle(body []byte) error {
+	info, err := parseCertificateBundle(body)
+	if err != nil {
+		return err
+	}
+
+	if info != nil && info.PrivateKey == PrivateKeyMismatch {
+		return errors.New("The private key does not belong to the certificate.")
+	}
+
+	return nil
+}
+
+func certificateNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	names = append(names, cert.EmailAddresses...)
+
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func describePublicKey(key crypto.PublicKey) string {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+
+	return "unknown"
+}
+
+func matchPrivateKey(block *pem.Block, cert *x509.Certificate) (string, error) {
+	// legacy encrypted PEM blocks (Proc-Type header) cannot be parsed, but are allowed
+	if block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block) {
+		return PrivateKeyEncrypted, nil
+	}
+
+	signer, err := parsePrivateKey(block)
+	if err != nil {
+		return "", err
+	}
+
+	// e.g. OpenSSH keys, which are not meant for TLS anyway
+	if signer == nil {
+		return PrivateKeyNone, nil
+	}
+
+	if !publicKeysEqual(signer.Public(), cert.PublicKey) {
+		return PrivateKeyMismatch, nil
+	}
+
+	return PrivateKeyMatch, nil
+}
+
+// parsePrivateKey returns nil (and no error) for block types that are no X.509 private keys.
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	var key crypto.PrivateKey
+	var err error
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.New("The private key could not be parsed: " + err.Error())
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Unsupported private key type.")
+	}
+
+	return signer, nil
+}
+
+func publicKeysEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	public, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+
+	return ok && public.Equal(b)
+}
+
+// refreshCertificate updates the metadata after the secret's body changed. Warnings that were
+// already sent are kept as long as it is still the same certificate.
+func refreshCertificate(secretId int, body []byte, db *sqlx.Tx) error {
+	info, err := parseCertificateBundle(body)
+	existing := findCertificate(secretId, db)
+
+	if err != nil || info == nil {
+		if existing != nil {
+			_, err = db.Exec("DELETE FROM `secret_certificate` WHERE `secret_id` = ?", secretId)
+			return err
+		}
+
+		return nil
+	}
+
+	if existing != nil && existing.Issuer == info.Issuer && existing.Serial == info.Serial {
+		_, err = db.Exec(
+			"UPDATE `secret_certificate` SET `subject` = ?, `sans` = ?, `not_before` = ?, `not_after` = ?, `key_type` = ?, `private_key` = ?, `chain_length` = ? WHERE `secret_id` = ?",
+			info.Subject, info.Sans, info.NotBefore, info.NotAfter, info.KeyType, info.PrivateKey, info.ChainLength, secretId,
+		)
+
+		return err
+	}
+
+	if existing != nil {
+		_, err = db.Exec("DELETE FROM `secret_certificate` WHERE `secret_id` = ?", secretId)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO `secret_certificate` (`secret_id`, `subject`, `issuer`, `sans`, `serial`, `not_before`, `not_after`, `key_type`, `private_key`, `chain_length`, `warned_days`) VALUES (?,?,?,?,?,?,?,?,?,?,NULL)",
+		secretId, info.Subject, info.Issuer, info.Sans, info.Serial, info.NotBefore, info.NotAfter, info.KeyType, info.PrivateKey, info.ChainLength,
+	)
+
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Expiry warnings
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// CertificateMonitor warns the owners and subscribers of a certificate when it is about to
+// expire, once for every configured threshold.
+type CertificateMonitor struct {
+	interval time.Duration
+	warnDays []int // descending
+}
+
+func NewCertificateMonitor(c *configuration) (*CertificateMonitor, error) {
+	m := &CertificateMonitor{
+		interval: 1 * time.Hour,
+		warnDays: []int{30, 14, 7},
+	}
+
+	if c.Certificates.CheckInterval != "" {
+		interval, err := time.ParseDuration(c.Certificates.CheckInterval)
+		if err != nil {
+			return nil, errors.New("Invalid certificate check interval configured: " + err.Error())
+		}
+
+		m.interval = interval
+	}
+
+	if len(c.Certificates.WarnDays) > 0 {
+		m.warnDays = append([]int{}, c.Certificates.WarnDays...)
+
+		for _, days := range m.warnDays {
+			if days <= 0 {
+				return nil, errors.New("Certificate warnings must be configured as a positive number of days.")
+			}
+		}
+
+		sort.Sort(sort.Reverse(sort.IntSlice(m.warnDays)))
+	}
+
+	return m, nil
+}
+
+// Run first derives the metadata for all secrets, so that certificates stored before this
+// feature existed (or restored from a backup) are tracked as well, then checks regularly.
+func (m *CertificateMonitor) Run(database *sqlx.DB) {
+	err := m.Scan(database)
+	if err != nil {
+		log.Println("Warning: Scanning secrets for certificates failed: " + err.Error())
+	}
+
+	for {
+		warned, err := m.Warn(database)
+		if err != nil {
+			log.Println("Warning: Checking certificates for expiry failed: " + err.Error())
+		} else if warned > 0 {
+			log.Printf("Sent expiry warnings for %d certificate(s).", warned)
+		}
+
+		<-time.After(m.interval)
+	}
+}
+
+func (m *CertificateMonitor) Scan(database *sqlx.DB) error {
+	tx, err := database.Beginx()
+	if err != nil {
+		return err
+	}
+
+	for _, secret := range findAllSecrets(true, tx) {
+		body, err := Decrypt(secret.Secret)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Could not decrypt secret %s: %s", secret.Slug, err)
+		}
+
+		err = refreshCertificate(secret.Id, body, tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// threshold returns the smallest warning threshold the remaining days fall into, or 0 if no
+// warning is due yet.
+func (m *CertificateMonitor) threshold(daysLeft int) int {
+	result := 0
+
+	for _, days := range m.warnDays {
+		if daysLeft <= days {
+			result = days
+		}
+	}
+
+	return result
+}
+
+// Warn queues the warnings that are due and returns the number of affected certificates.
+func (m *CertificateMonitor) Warn(database *sqlx.DB) (int, error) {
+	tx, err := database.Beginx()
+	if err != nil {
+		return 0, err
+	}
+
+	warned := 0
+
+	for _, cert := range findExpiringCertificates(m.warnDays[0], math.MaxInt32, tx) {
+		threshold := m.threshold(cert.DaysLeft())
+		if threshold == 0 || (cert.WarnedDays != nil && *cert.WarnedDays <= threshold) {
+			continue
+		}
+
+		secret := cert.GetSecret()
+		if secret == nil {
+			continue
+		}
+
+		secretId := secret.Id
+		item := notificationItem{
+			Action:     "certificate-expiring",
+			Time:       time.Now().Format("2006-01-02 15:04:05"),
+			Actor:      "Raziel",
+			SecretId:   &secretId,
+			SecretName: secret.Name,
+			ExpiresAt:  cert.NotAfter,
+		}
+
+		queueForSubscribers(item, secret.Id, -1, -1, tx)
+		notifyOwners(secret, item, -1, tx)
+
+		_, err = tx.Exec("UPDATE `secret_certificate` SET `warned_days` = ? WHERE `secret_id` = ?", threshold, cert.SecretId)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		warned++
+	}
+
+	return warned, tx.Commit()
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	changesDefaultWait = 30 * time.Second
+	changesMaxWait     = 2 * time.Minute
+	changesPageSize    = 500
+)
+
+// changeActions are the audit log actions that change what a consumer receives for a secret.
+// Grants and unassignments only count for the consumer named in the entry.
+var changeActions = map[string]bool{
+	"secret-updated":    true,
+	"secret-rotated":    true,
+	"secret-imported":   true,
+	"secret-granted":    true,
+	"secret-unassigned": true,
+	"secret-deleted":    true,
+}
+
+// removalActions take the secret away from the consumer. Entries of deleted secrets do not refer
+// to the secret anymore; they name it and its consumers in their context instead.
+var removalActions = map[string]bool{
+	"secret-unassigned": true,
+	"secret-deleted":    true,
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Change feed
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// ChangeFeed lets consumers wait for changes to their secrets. The changes are read from the audit
+// log; the feed is also an event sink, so waiting requests are woken up as soon as a change has
+// been committed.
+type ChangeFeed struct {
+	db   *sqlx.DB
+	wake chan struct{}
+	lock sync.Mutex
+}
+
+func NewChangeFeed(db *sqlx.DB) *ChangeFeed {
+	return &ChangeFeed{
+		db:   db,
+		wake: make(chan struct{}),
+	}
+}
+
+func (f *ChangeFeed) GetIdentifier() string {
+	return "change feed"
+}
+
+func (f *ChangeFeed) Send(event *Event) error {
+	if event.Type == EventTypeAudit && changeActions[event.Action] {
+		f.lock.Lock()
+		close(f.wake)
+		f.wake = make(chan struct{})
+		f.lock.Unlock()
+	}
+
+	return nil
+}
+
+func (f *ChangeFeed) Close() error {
+	return nil
+}
+
+// waiter returns a channel that is closed with the next change.
+func (f *ChangeFeed) waiter() <-chan struct{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.wake
+}
+
+type secretChange struct {
+	Secret  string `json:"secret"`
+	Version int    `json:"version"`
+	Action  string `json:"action,omitempty"`
+	Removed bool   `json:"removed,omitempty"`
+}
+
+type changeSet struct {
+	Cursor  int            `json:"cursor"`
+	Changes []secretChange `json:"changes"`
+}
+
+// changesSince returns the secrets of the consumer that changed after the cursor (an audit log
+// ID), each with its latest change. Secrets that have been unassigned or deleted are marked as
+// removed. IDs alone would not guarantee that no change shows up behind the cursor later on, as
+// auto-incremented IDs are assigned on insert, not on commit. But writing to the audit log is
+// serialised (see auditLogHead): a transaction can only insert once the previous one has
+// committed, so entries are committed in the order of their IDs.
+func changesSince(consumerId int, cursor int, db *sqlx.Tx) changeSet {
+	rows := make([]struct {
+		Id      int      `db:"id"`
+		Action  string   `db:"action"`
+		Slug    *string  `db:"slug"`
+		Context *Context `db:"context"`
+	}, 0)
+
+	err := db.Select(
+		&rows,
+		"SELECT a.`id`, a.`action`, s.`slug`, a.`context` FROM `audit_log` a "+
+			"LEFT JOIN `consumer_secret` cs ON cs.`secret_id` = a.`secret_id` AND cs.`consumer_id` = ? "+
+			"LEFT JOIN `secret` s ON s.`id` = a.`secret_id` "+
+			"WHERE a.`id` > ? AND a.`action` IN ("+changeActionList()+") AND ("+
+			"(a.`action` IN ('secret-granted', 'secret-unassigned') AND a.`consumer_id` = ?) OR "+
+			"(a.`action` NOT IN ('secret-granted', 'secret-unassigned', 'secret-deleted') AND cs.`consumer_id` IS NOT NULL) OR "+
+			"a.`action` = 'secret-deleted') "+
+			"ORDER BY a.`id` ASC LIMIT "+strconv.Itoa(changesPageSize),
+		consumerId, cursor, consumerId,
+	)
+
+	if err != nil {
+		panic(err)
+	}
+
+	set := changeSet{Cursor: cursor, Changes: make([]secretChange, 0)}
+	seen := make(map[string]int)
+
+	for _, row := range rows {
+		set.Cursor = row.Id
+		slug := ""
+
+		if row.Slug != nil {
+			slug = *row.Slug
+		}
+
+		if removalActions[row.Action] && row.Context != nil {
+			ctx := removalContext{}
+			row.Context.Unpack(&ctx)
+
+			// deletions are logged once for all consumers
+			if row.Action == "secret-deleted" {
+				recipient := false
+
+				for _, id := range ctx.Consumers {
+					recipient = recipient || id == consumerId
+				}
+
+				if !recipient {
+					continue
+				}
+			}
+
+			slug = ctx.Slug
+		}
+
+		change := secretChange{slug, row.Id, row.Action, removalActions[row.Action]}
+
+		if idx, ok := seen[slug]; ok {
+			set.Changes[idx] = change
+			continue
+		}
+
+		seen[slug] = len(set.Changes)
+		set.Changes = append(set.Changes, change)
+	}
+
+	return set
+}
+
+// deletionRecipients returns the consumers that have to learn from the change feed that the secret
+// has been deleted: those it is assigned to, and those it has been unassigned from, as deleting
+// the secret takes the entries telling them so along.
+func deletionRecipients(secretId int, db *sqlx.Tx) []int {
+	ids := make([]int, 0)
+
+	err := db.Select(
+		&ids,
+		"SELECT `consumer_id` FROM `consumer_secret` WHERE `secret_id` = ? UNION "+
+			"SELECT `consumer_id` FROM `audit_log` WHERE `secret_id` = ? AND `action` = 'secret-unassigned' AND `consumer_id` IS NOT NULL "+
+			"ORDER BY `consumer_id`",
+		secretId, secretId,
+	)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return ids
+}
+
+// currentVersions lists all secrets of the consumer with their latest change (0 if there is none)
+// and the current end of the audit log as the cursor.
+func currentVersions(consumerId int, db *sqlx.Tx) changeSet {
+	set := changeSet{Changes: make([]secretChange, 0)}
+
+	err := db.Get(&set.Cursor, "SELECT COALESCE(MAX(`id`), 0) FROM `audit_log`")
+	if err != nil {
+		panic(err)
+	}
+
+	err = db.Select(
+		&set.Changes,
+		"SELECT s.`slug` AS `secret`, COALESCE(MAX(a.`id`), 0) AS `version` FROM `consumer_secret` cs "+
+			"INNER JOIN `secret` s ON s.`id` = cs.`secret_id` "+
+			"LEFT JOIN `audit_log` a ON a.`secret_id` = s.`id` AND a.`id` <= ? AND a.`action` IN ("+changeActionList()+") AND (a.`action` NOT IN ('secret-granted', 'secret-unassigned') OR a.`consumer_id` = cs.`consumer_id`) "+
+			"WHERE cs.`consumer_id` = ? GROUP BY s.`id`, s.`slug` ORDER BY s.`slug`",
+		set.Cursor, consumerId,
+	)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return set
+}
+
+func changeActionList() string {
+	actions := make([]string, 0, len(changeActions))
+
+	for action := range changeActions {
+		actions = append(actions, "'"+action+"'")
+	}
+
+	return strings.Join(actions, ", ")
+}
+
+// transaction runs the function in its own transaction, like the middleware does for regular
+// requests. Long-polling requests must not keep a transaction open while they wait.
+func (f *ChangeFeed) transaction(fn func(tx *sqlx.Tx)) {
+	tx, err := f.db.Beginx()
+	if err != nil {
+		metricTransactionFailures.WithLabelValues("begin").Inc()
+		panic(err)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			metricTransactionFailures.WithLabelValues("rollback").Inc()
+			eventBus.Discard(tx)
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+
+	fn(tx)
+
+	if err := tx.Commit(); err != nil {
+		metricTransactionFailures.WithLabelValues("commit").Inc()
+		panic(err)
+	}
+
+	eventBus.Flush(tx)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// HTTP Handlers
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Handler serves GET /changes/:consumer?cursor=<id>&wait=<duration>. It has to run before the
+// transaction middleware, which would otherwise hold a transaction for as long as the request
+// waits. Without a cursor, all secrets of the consumer are listed with their current version.
+// With a cursor, the request returns as soon as any of them changed, or with an empty list once
+// the wait time is over.
+func (f *ChangeFeed) Handler() martini.Handler {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" || !strings.HasPrefix(req.URL.Path, "/changes/") {
+			return
+		}
+
+		identifier := strings.TrimPrefix(req.URL.Path, "/changes/")
+		cursor := -1
+		wait := changesDefaultWait
+
+		if value := req.FormValue("cursor"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				writeChangesResponse(res, newResponse(400, "Invalid cursor."))
+				return
+			}
+
+			cursor = parsed
+		}
+
+		if value := req.FormValue("wait"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < 0 || parsed > changesMaxWait {
+				writeChangesResponse(res, newResponse(400, fmt.Sprintf("The wait time must be between 0s and %s.", changesMaxWait)))
+				return
+			}
+
+			wait = parsed
+		}
+
+		// listen before looking, so that no change can slip through in between
+		wake := f.waiter()
+
+		var consumer *Consumer
+		var set changeSet
+
+		status := 200
+
+		f.transaction(func(tx *sqlx.Tx) {
+			accessLog := NewAccessLog(tx)
+			consumer = findConsumer(DecodeConsumerIdentifier(identifier), tx)
+
+			if consumer == nil {
+				accessLog.LogNotFound(nil, nil, req)
+				status = 404
+				return
+			}
+
+			contexts, accessGranted := checkConsumer(consumer, req)
+			if !accessGranted {
+				accessLog.LogAccess(consumer, nil, req, 403, contexts)
+				status = 403
+				return
+			}
+
+			if cursor < 0 {
+				set = currentVersions(consumer.Id, tx)
+			} else {
+				set = changesSince(consumer.Id, cursor, tx)
+			}
+		})
+
+		switch status {
+		case 404:
+			writeChangesResponse(res, newResponse(404, "Not Found."))
+			return
+
+		case 403:
+			writeChangesResponse(res, newResponse(403, "Nope."))
+			return
+		}
+
+		deadline := time.NewTimer(wait)
+		defer deadline.Stop()
+
+		for waiting := cursor >= 0; waiting && len(set.Changes) == 0; {
+			select {
+			case <-wake:
+				wake = f.waiter()
+
+			case <-deadline.C:
+				// look one last time, changes made on other instances do not wake us up
+				waiting = false
+
+			case <-req.Context().Done():
+				return
+			}
+
+			f.transaction(func(tx *sqlx.Tx) {
+				set = changesSince(consumer.Id, set.Cursor, tx)
+			})
+		}
+
+		encoded, err := json.Marshal(set)
+		if err != nil {
+			panic(err)
+		}
+
+		writeChangesResponse(res, response{200, string(encoded), "application/json"})
+	}
+}
+
+func writeChangesResponse(res http.ResponseWriter, resp response) {
+	contentType := resp.ContentType
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+
+	res.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	res.WriteHeader(resp.Status)
+	res.Write([]byte(resp.Content))
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// lastAuditId returns the ID of the newest audit log entry, which is the version of a change.
+func lastAuditId(t *testing.T, tx *sqlx.Tx) int {
+	t.Helper()
+
+	id := 0
+	if err := tx.Get(&id, "SELECT MAX(`id`) FROM `audit_log`"); err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func TestChangesSince(t *testing.T) {
+	tx := newTestTx(t)
+
+	user := createTestUser(t, "admin", tx)
+	web := createTestConsumer(t, "web", user, tx)
+	other := createTestConsumer(t, "other", user, tx)
+	a := createTestSecret(t, "a", "a", user, tx, web, other)
+	b := createTestSecret(t, "b", "b", user, tx, web, other)
+	c := createTestSecret(t, "c", "c", user, tx, other)
+
+	auditLog := NewAuditLog(tx, newTestRequest("POST", "/secrets"))
+	start := currentVersions(web.Id, tx).Cursor
+
+	auditLog.LogSecretUpdated(a.Id, user.Id)
+	auditLog.LogSecretGranted(b.Id, other.Id, user.Id)
+	auditLog.LogSecretUpdated(c.Id, user.Id)
+	auditLog.LogSecretRevealed(b.Id, user.Id)
+	auditLog.LogSecretRotated(a.Id, user.Id, false)
+	rotated := lastAuditId(t, tx)
+	auditLog.LogSecretGranted(b.Id, web.Id, user.Id)
+	granted := lastAuditId(t, tx)
+
+	expected := []secretChange{{"a", rotated, "secret-rotated", false}, {"b", granted, "secret-granted", false}}
+
+	set := changesSince(web.Id, start, tx)
+	if set.Cursor != granted || !changesEqual(set.Changes, expected) {
+		t.Errorf("Expected %+v up to #%d, got %+v", expected, granted, set)
+	}
+
+	set = changesSince(web.Id, granted, tx)
+	if set.Cursor != granted || len(set.Changes) != 0 {
+		t.Errorf("Expected no changes after the cursor, got %+v", set)
+	}
+
+	auditLog.LogLogin(user.Id)
+
+	set = currentVersions(web.Id, tx)
+	expected = []secretChange{{"a", rotated, "", false}, {"b", granted, "", false}}
+
+	if set.Cursor != lastAuditId(t, tx) || !changesEqual(set.Changes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, set)
+	}
+}
+
+func TestChangesReportRemovedSecrets(t *testing.T) {
+	tx := newTestTx(t)
+
+	user := createTestUser(t, "admin", tx)
+	web := createTestConsumer(t, "web", user, tx)
+	other := createTestConsumer(t, "other", user, tx)
+	bystander := createTestConsumer(t, "bystander", user, tx)
+	a := createTestSecret(t, "a", "a", user, tx, web, other)
+	b := createTestSecret(t, "b", "b", user, tx, web)
+
+	auditLog := NewAuditLog(tx, newTestRequest("POST", "/consumers"))
+	start := currentVersions(web.Id, tx).Cursor
+
+	// web loses access to a, which is deleted afterwards, and b is deleted
+	if _, err := tx.Exec("DELETE FROM `consumer_secret` WHERE `consumer_id` = ? AND `secret_id` = ?", web.Id, a.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	auditLog.LogSecretUnassigned(a, web.Id, user.Id)
+	unassigned := lastAuditId(t, tx)
+
+	set := changesSince(web.Id, start, tx)
+	expected := []secretChange{{"a", unassigned, "secret-unassigned", true}}
+
+	if !changesEqual(set.Changes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, set.Changes)
+	}
+
+	if set := changesSince(other.Id, start, tx); len(set.Changes) != 0 {
+		t.Errorf("Another consumer was told about the unassignment: %+v", set.Changes)
+	}
+
+	for _, secret := range []*Secret{a, b} {
+		recipients := deletionRecipients(secret.Id, tx)
+
+		if err := secret.Delete(); err != nil {
+			t.Fatal(err)
+		}
+
+		auditLog.LogSecretDeleted(secret, recipients, user.Id)
+	}
+
+	deleted := lastAuditId(t, tx)
+
+	// the unassignment went away with the secret, but its deletion is reported instead
+	set = changesSince(web.Id, start, tx)
+	expected = []secretChange{{"a", deleted - 1, "secret-deleted", true}, {"b", deleted, "secret-deleted", true}}
+
+	if set.Cursor != deleted || !changesEqual(set.Changes, expected) {
+		t.Errorf("Expected %+v up to #%d, got %+v", expected, deleted, set)
+	}
+
+	set = changesSince(other.Id, start, tx)
+	expected = []secretChange{{"a", deleted - 1, "secret-deleted", true}}
+
+	if !changesEqual(set.Changes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, set.Changes)
+	}
+
+	if set := changesSince(bystander.Id, start, tx); len(set.Changes) != 0 || set.Cursor != deleted {
+		t.Errorf("A consumer without the secrets was told about their deletion: %+v", set)
+	}
+
+	entries := auditLog.FindByActions([]string{"secret-deleted"}, 10, 0)
+	if len(entries) != 2 || entries[0].RemovedSecret() != "b" {
+		t.Errorf("The deleted secret is not named in the audit log: %+v", entries)
+	}
+}
+
+func changesEqual(a []secretChange, b []secretChange) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestChangeFeedHandler(t *testing.T) {
+	db := newTestDatabase(t)
+
+	tx, _ := db.Beginx()
+	user := createTestUser(t, "admin", tx)
+	consumer := createTestConsumer(t, "web", user, tx)
+	secret := createTestSecret(t, "password", "hunter2", user, tx, consumer)
+	tx.Commit()
+
+	feed := NewChangeFeed(db)
+	handler := feed.Handler().(func(http.ResponseWriter, *http.Request))
+
+	get := func(query string) (int, changeSet) {
+		res := httptest.NewRecorder()
+		handler(res, newTestRequest("GET", "/changes/"+consumer.GetIdentifier()+query))
+
+		set := changeSet{}
+		json.Unmarshal(res.Body.Bytes(), &set)
+
+		return res.Code, set
+	}
+
+	status, current := get("")
+	if status != 200 || len(current.Changes) != 1 || current.Changes[0].Version != 0 {
+		t.Fatalf("The current versions were not listed: %d %+v", status, current)
+	}
+
+	cursor := strconv.Itoa(current.Cursor)
+
+	if status, set := get("?cursor=" + cursor + "&wait=0s"); status != 200 || len(set.Changes) != 0 || set.Cursor != current.Cursor {
+		t.Errorf("Expected no changes, got %d %+v", status, set)
+	}
+
+	for _, query := range []string{"?cursor=-1", "?cursor=x", "?wait=1h", "?wait=-1s"} {
+		if status, _ := get(query); status != 400 {
+			t.Errorf("%s: expected 400, got %d.", query, status)
+		}
+	}
+
+	res := httptest.NewRecorder()
+	handler(res, newTestRequest("GET", "/changes/nope"))
+
+	if res.Code != 404 {
+		t.Errorf("An unknown consumer got %d.", res.Code)
+	}
+
+	// a waiting request is woken up by the change
+	done := make(chan changeSet)
+
+	go func() {
+		_, set := get("?cursor=" + cursor + "&wait=1m")
+		done <- set
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	tx, _ = db.Beginx()
+	NewAuditLog(tx, newTestRequest("POST", "/secrets")).LogSecretUpdated(secret.Id, user.Id)
+	tx.Commit()
+
+	feed.Send(&Event{Type: EventTypeAudit, Action: "secret-updated"})
+
+	select {
+	case set := <-done:
+		if len(set.Changes) != 1 || set.Changes[0].Secret != "password" || set.Cursor <= current.Cursor {
+			t.Errorf("Expected the update, got %+v", set)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("The waiting request was not woken up.")
+	}
+}
+
+func TestAuditLogWritesAreSerialised(t *testing.T) {
+	tx := newTestTx(t)
+
+	user := createTestUser(t, "admin", tx)
+
+	if _, err := tx.Exec("DELETE FROM `config` WHERE `key` = 'audit_log_lock'"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("The audit log was written without taking the lock.")
+		}
+	}()
+
+	NewAuditLog(tx, newTestRequest("POST", "/login")).LogLogin(user.Id)
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Administrative commands. All of them work directly on the database, so they are meant for
+// bootstrapping a new installation and for emergencies when the web interface is not available.
+var (
+	initDbCmd      = kingpin.Command("init-db", "Create the database schema and store the master key marker")
+	checkConfigCmd = kingpin.Command("check-config", "Validate the configuration, TLS setup, database and master key, then exit")
+
+	userCmd            = kingpin.Command("user", "Manage local users")
+	userActor          = userCmd.Flag("as", "Login of the admin to record as the actor in the audit log").String()
+	userCreateCmd      = userCmd.Command("create", "Create a local user, asking for the passphrase")
+	userCreateLogin    = userCreateCmd.Arg("login", "Login name").Required().String()
+	userCreateName     = userCreateCmd.Flag("name", "Display name (defaults to the login name)").String()
+	userCreateEmail    = userCreateCmd.Flag("email", "E-mail address").String()
+	userCreateRole     = userCreateCmd.Flag("role", "Role of the new user").Default(RoleAdmin).Enum(RoleAdmin, RoleUser)
+	userResetCmd       = userCmd.Command("reset-password", "Set a new passphrase for a local user")
+	userResetLogin     = userResetCmd.Arg("login", "Login name").Required().String()
+	secretCmd          = kingpin.Command("secret", "Break-glass access to secrets")
+	secretActor        = secretCmd.Flag("as", "Login of the user to record as the actor in the audit log").Required().String()
+	secretGetCmd       = secretCmd.Command("get", "Print a secret to stdout")
+	secretGetSlug      = secretGetCmd.Arg("slug", "Slug of the secret").Required().String()
+	secretPutCmd       = secretCmd.Command("put", "Create or update a secret, reading the body from stdin")
+	secretPutSlug      = secretPutCmd.Arg("slug", "Slug of the secret").Required().String()
+	secretPutName      = secretPutCmd.Flag("name", "Name for a new secret (defaults to the slug)").String()
+	consumerCmd        = kingpin.Command("consumer", "Inspect consumers")
+	consumerListCmd    = consumerCmd.Command("list", "List all consumers and their secrets")
+	consumerListFormat = consumerListCmd.Flag("format", "Output format").Default("table").Enum("table", "tsv")
+)
+
+// runAdminCommand executes one of the commands above that need a fully set up database. It
+// returns false if the command is not an admin command.
+func runAdminCommand(command string, database *sqlx.DB) (int, bool) {
+	var action func(tx *sqlx.Tx) error
+
+	switch command {
+	case userCreateCmd.FullCommand():
+		action = userCreateCommand
+	case userResetCmd.FullCommand():
+		action = userResetPasswordCommand
+	case secretGetCmd.FullCommand():
+		action = secretGetCommand
+	case secretPutCmd.FullCommand():
+		action = secretPutCommand
+	case consumerListCmd.FullCommand():
+		action = consumerListCommand
+	default:
+		return 0, false
+	}
+
+	code := runInTransaction(database, action)
+
+	// wait for the audit events to be shipped
+	eventBus.Close()
+
+	return code, true
+}
+
+func runInTransaction(database *sqlx.DB, action func(tx *sqlx.Tx) error) int {
+	tx, err := database.Beginx()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	err = action(tx)
+	if err != nil {
+		eventBus.Discard(tx)
+		tx.Rollback()
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		eventBus.Discard(tx)
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	eventBus.Flush(tx)
+
+	return 0
+}
+
+// findActor returns the user that is responsible for a command line action.
+func findActor(login string, db *sqlx.Tx) (*User, error) {
+	user := findUserByLogin(login, false, db)
+	if user == nil {
+		return nil, errors.New("The user '" + login + "' does not exist.")
+	}
+
+	return user, nil
+}
+
+// readPassphrase asks for a passphrase twice if stdin is a terminal; otherwise the first line
+// of stdin is used, so the command can be scripted.
+func readPassphrase() (string, error) {
+	fd := int(os.Stdin.Fd())
+
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return "", errors.New("Could not read the passphrase from stdin.")
+		}
+
+		return strings.TrimSpace(line), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	first, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	second, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(first) != string(second) {
+		return "", errors.New("The passphrases do not match.")
+	}
+
+	return strings.TrimSpace(string(first)), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// init-db
+
+func schemaFile(d Dialect) string {
+	switch d.Name() {
+	case "postgres":
+		return "resources/schema.postgres.sql"
+	case "sqlite":
+		return "resources/schema.sqlite.sql"
+	}
+
+	return "resources/schema.sql"
+}
+
+// splitStatements splits a schema file into single statements, as the drivers can only execute
+// one statement at a time.
+func splitStatements(script string) []string {
+	lines := make([]string, 0)
+
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+
+	statements := make([]string, 0)
+
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";\n") {
+		statement = strings.TrimSuffix(strings.TrimSpace(statement), ";")
+
+		if len(statement) > 0 {
+			statements = append(statements, statement)
+		}
+	}
+
+	return statements
+}
+
+func runInitDb(database *sqlx.DB) int {
+	if version, err := databaseVersion(database); err == nil {
+		fmt.Fprintf(os.Stderr, "The database has already been initialized (schema version %s).\n", version)
+		return 1
+	}
+
+	err := createSchema(database)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	err = verifyMasterPassword(database, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	fmt.Printf("The database has been initialized (schema version %s).\n", SchemaVersion())
+	fmt.Println("Use `raziel user create <login>` to create the first administrator.")
+
+	return 0
+}
+
+// createSchema applies the schema file for the configured database server.
+func createSchema(database *sqlx.DB) error {
+	script, err := embeddedSchemas.ReadFile(schemaFile(dialect))
+	if err != nil {
+		return err
+	}
+
+	// session variables like FOREIGN_KEY_CHECKS only apply to a single connection
+	conn, err := database.Connx(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, statement := range splitStatements(string(script)) {
+		_, err := conn.ExecContext(context.Background(), statement)
+		if err != nil {
+			return errors.New("Could not create the schema: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// verifyMasterPassword checks the master key against the teststring. If the database is new, the
+// teststring is stored if initialize is set. Unlike validateMasterPassword, it reports problems
+// instead of panicking.
+func verifyMasterPassword(database *sqlx.DB, initialize bool) (err error) {
+	defer func() {
+		// reading the password file panics if it is not usable
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	c := dbConfig{}
+
+	err = database.Get(&c, "SELECT `key`, `value` FROM `config` WHERE `key` = 'teststring'")
+	if err != nil {
+		return errors.New("Could not read the teststring from the config table: " + err.Error())
+	}
+
+	if len(c.Value) == 0 {
+		if !initialize {
+			return errors.New("The master key has not been stored yet; run `raziel init-db` or start the server.")
+		}
+
+		ciphertext, err := Encrypt([]byte(TestString))
+		if err != nil {
+			return err
+		}
+
+		_, err = database.Exec("UPDATE `config` SET `value` = ? WHERE `key` = ?", ciphertext, c.Key)
+		if err != nil {
+			return errors.New("Could not write initial password marker: " + err.Error())
+		}
+
+		return nil
+	}
+
+	plaintext, err := Decrypt(c.Value)
+	if err != nil || TestString != string(plaintext) {
+		return errors.New("The configured password is not usable for the configured database.")
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// check-config
+
+type configCheck struct {
+	name  string
+	check func() error
+}
+
+func runCheckConfig() int {
+	var database *sqlx.DB
+
+	checks := []configCheck{
+		{"TLS certificate", checkTlsCertificate},
+		{"TLS ciphers", func() error {
+			config.CipherSuites()
+			return nil
+		}},
+		{"session lifetime", func() error {
+			_, err := time.ParseDuration(config.Session.Lifetime)
+			return err
+		}},
+		{"password policy", func() error {
+			_, err := NewPasswordPolicy(config)
+			return err
+		}},
+		{"alert rules", func() error {
+			_, err := NewAlertRules(config)
+			return err
+		}},
+		{"access log retention", func() error {
+			_, err := NewAccessLogRetention(config)
+			return err
+		}},
+		{"notifications", func() error {
+			_, err := NewNotificationQueue(config)
+			return err
+		}},
+		{"secret rotation", func() error {
+			_, err := NewSecretRotator(config)
+			return err
+		}},
+		{"certificate warnings", func() error {
+			_, err := NewCertificateMonitor(config)
+			return err
+		}},
+		{"lease reaper", func() error {
+			_, err := NewLeaseReaper(config)
+			return err
+		}},
+		{"share links", func() error {
+			_, err := NewShareSweeper(config)
+			return err
+		}},
+		{"checkpoint key", func() error {
+			if config.Checkpoints.Key == "" {
+				return nil
+			}
+
+			_, err := loadCheckpointKey(config.Checkpoints.Key)
+			return err
+		}},
+		{"database connection", func() error {
+			db, d, err := OpenDatabase(config.Database.Source)
+			if err != nil {
+				return err
+			}
+
+			database = db
+			dialect = d
+
+			return nil
+		}},
+		{"database schema", func() error {
+			if database == nil {
+				return errors.New("No database connection.")
+			}
+
+			pending, current, err := pendingMigrations(database)
+			if err != nil {
+				return err
+			}
+
+			if len(pending) > 0 {
+				return fmt.Errorf("Schema version %s needs %d migration(s), run `raziel migrate`.", current, len(pending))
+			}
+
+			return nil
+		}},
+		{"master key", func() error {
+			if database == nil {
+				return errors.New("No database connection.")
+			}
+
+			return verifyMasterPassword(database, false)
+		}},
+	}
+
+	code := 0
+
+	for _, c := range checks {
+		err := runConfigCheck(c)
+		if err != nil {
+			fmt.Printf("%-22s FAILED: %s\n", c.name, err)
+			code = 1
+		} else {
+			fmt.Printf("%-22s OK\n", c.name)
+		}
+	}
+
+	return code
+}
+
+// runConfigCheck turns the panics of the configuration helpers into errors.
+func runConfigCheck(c configCheck) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	return c.check()
+}
+
+func checkTlsCertificate() error {
+	pair, err := tls.LoadX509KeyPair(config.Server.Certificate, config.Server.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	if now.Before(cert.NotBefore) {
+		return errors.New("The certificate is not valid before " + cert.NotBefore.Format("2006-01-02 15:04:05") + ".")
+	}
+
+	if now.After(cert.NotAfter) {
+		return errors.New("The certificate expired on " + cert.NotAfter.Format("2006-01-02 15:04:05") + ".")
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// user create / reset-password
+
+func userCreateCommand(db *sqlx.Tx) error {
+	login, err := validateSafeString(*userCreateLogin, "login")
+	if err != nil {
+		return err
+	}
+
+	if findUserByLogin(login, false, db) != nil {
+		return errors.New("This login is already in use.")
+	}
+
+	email, err := validateEmail(strings.TrimSpace(*userCreateEmail), 0, db)
+	if err != nil {
+		return err
+	}
+
+	var actor *User
+
+	if *userActor != "" {
+		actor, err = findActor(*userActor, db)
+		if err != nil {
+			return err
+		}
+	}
+
+	name := strings.TrimSpace(*userCreateName)
+	if len(name) == 0 {
+		name = login
+	}
+
+	password, err := readPassphrase()
+	if err != nil {
+		return err
+	}
+
+	err = passwordPolicy.Check(password, login, nil, db)
+	if err != nil {
+		return err
+	}
+
+	hashed := string(HashBcrypt(password))
+	user := &User{
+		Id:        -1,
+		Name:      name,
+		LoginName: login,
+		Password:  &hashed,
+		Email:     email,
+		Role:      *userCreateRole,
+		Backend:   BackendLocal,
+		_db:       db,
+	}
+
+	err = user.Save()
+	if err != nil {
+		return err
+	}
+
+	err = user.RememberPassword()
+	if err != nil {
+		return err
+	}
+
+	// the very first admin has nobody else to be created by
+	creator := user.Id
+	if actor != nil {
+		creator = actor.Id
+	}
+
+	NewAuditLog(db, nil).LogUserCreated(creator, user.Id)
+
+	fmt.Fprintf(os.Stderr, "The %s '%s' has been created.\n", user.Role, user.LoginName)
+
+	return nil
+}
+
+func userResetPasswordCommand(db *sqlx.Tx) error {
+	user := findUserByLogin(*userResetLogin, true, db)
+	if user == nil {
+		return errors.New("The user '" + *userResetLogin + "' does not exist.")
+	}
+
+	if user.IsExternal() {
+		return errors.New("This user is managed by an external directory and has no local passphrase.")
+	}
+
+	editor := user.Id
+
+	if *userActor != "" {
+		actor, err := findActor(*userActor, db)
+		if err != nil {
+			return err
+		}
+
+		editor = actor.Id
+	}
+
+	password, err := readPassphrase()
+	if err != nil {
+		return err
+	}
+
+	err = passwordPolicy.Check(password, user.LoginName, user, db)
+	if err != nil {
+		return err
+	}
+
+	hashed := string(HashBcrypt(password))
+	user.Password = &hashed
+
+	err = user.Save()
+	if err != nil {
+		return err
+	}
+
+	err = user.RememberPassword()
+	if err != nil {
+		return err
+	}
+
+	NewAuditLog(db, nil).LogUserUpdated(editor, user.Id)
+
+	fmt.Fprintf(os.Stderr, "The passphrase of '%s' has been changed.\n", user.LoginName)
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// secret get / put
+
+func secretGetCommand(db *sqlx.Tx) error {
+	actor, err := findActor(*secretActor, db)
+	if err != nil {
+		return err
+	}
+
+	secret := findSecretBySlug(strings.ToLower(*secretGetSlug), true, db)
+	if secret == nil {
+		return errors.New("The secret '" + *secretGetSlug + "' does not exist.")
+	}
+
+	plaintext, err := Decrypt(secret.Secret)
+	if err != nil {
+		return errors.New("Could not decrypt secret: " + err.Error())
+	}
+
+	NewAuditLog(db, nil).LogSecretRevealed(secret.Id, actor.Id)
+
+	_, err = os.Stdout.Write(plaintext)
+
+	return err
+}
+
+func secretPutCommand(db *sqlx.Tx) error {
+	actor, err := findActor(*secretActor, db)
+	if err != nil {
+		return err
+	}
+
+	slug, err := validateSafeString(*secretPutSlug, "slug")
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	body = []byte(strings.TrimSpace(string(body)))
+
+	if len(body) == 0 {
+		return errors.New("The body cannot be empty.")
+	}
+
+	err = checkCertificateBundle(body)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := Encrypt(body)
+	if err != nil {
+		return errors.New("Could not encrypt secret: " + err.Error())
+	}
+
+	auditLog := NewAuditLog(db, nil)
+	secret := findSecretBySlug(slug, false, db)
+
+	if secret == nil {
+		name := strings.TrimSpace(*secretPutName)
+		if len(name) == 0 {
+			name = slug
+		}
+
+		secret = &Secret{
+			Id:        -1,
+			Name:      name,
+			Slug:      slug,
+			Secret:    encrypted,
+			CreatedBy: actor.Id,
+			_db:       db,
+		}
+
+		err = secret.Save()
+		if err != nil {
+			return err
+		}
+
+		auditLog.LogSecretCreated(secret.Id, actor.Id)
+		fmt.Fprintf(os.Stderr, "The secret '%s' has been created.\n", slug)
+
+		return nil
+	}
+
+	if name := strings.TrimSpace(*secretPutName); len(name) > 0 {
+		secret.Name = name
+	}
+
+	err = secret.replaceValue(encrypted, &actor.Id)
+	if err != nil {
+		return err
+	}
+
+	secret.UpdatedBy = &actor.Id
+
+	err = secret.Save()
+	if err != nil {
+		return err
+	}
+
+	auditLog.LogSecretUpdated(secret.Id, actor.Id)
+	fmt.Fprintf(os.Stderr, "The secret '%s' has been updated.\n", slug)
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// consumer list
+
+func consumerListCommand(db *sqlx.Tx) error {
+	var out io.Writer = os.Stdout
+	var table *tabwriter.Writer
+
+	if *consumerListFormat == "table" {
+		table = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		out = table
+
+		fmt.Fprintln(out, "ID\tNAME\tENABLED\tIDENTIFIER\tSECRETS")
+	}
+
+	for _, consumer := range findAllConsumers(db) {
+		slugs := make([]string, 0)
+
+		for _, secret := range consumer.GetSecrets(false) {
+			slugs = append(slugs, secret.Slug)
+		}
+
+		fmt.Fprintf(out, "%d\t%s\t%v\t%s\t%s\n", consumer.Id, consumer.Name, consumer.Enabled, consumer.GetIdentifier(), strings.Join(slugs, ","))
+	}
+
+	if table != nil {
+		return table.Flush()
+	}
+
+	return nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// withStdin makes the commands read the given input instead of the terminal.
+func withStdin(t *testing.T, input string) {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "stdin")
+	ioutil.WriteFile(filename, []byte(input), 0600)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := os.Stdin
+	os.Stdin = file
+
+	t.Cleanup(func() {
+		os.Stdin = previous
+		file.Close()
+	})
+}
+
+// captureStdout collects everything written to stdout until the returned function is called.
+func captureStdout(t *testing.T) func() string {
+	t.Helper()
+
+	file, err := ioutil.TempFile(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := os.Stdout
+	os.Stdout = file
+
+	return func() string {
+		os.Stdout = previous
+		file.Close()
+
+		content, _ := ioutil.ReadFile(file.Name())
+
+		return string(content)
+	}
+}
+
+// setFlag changes a command line flag for the duration of the test.
+func setFlag(t *testing.T, flag *string, value string) {
+	previous := *flag
+	*flag = value
+
+	t.Cleanup(func() { *flag = previous })
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := "-- a comment; with a semicolon\nCREATE TABLE `a` (\n  `id` INT -- the key\n);\n\n  -- another comment\nINSERT INTO `a` VALUES (1);\nINSERT INTO `a` VALUES (2)"
+	statements := splitStatements(script)
+
+	expected := []string{"CREATE TABLE `a` (\n  `id` INT -- the key\n)", "INSERT INTO `a` VALUES (1)", "INSERT INTO `a` VALUES (2)"}
+
+	if strings.Join(statements, "|") != strings.Join(expected, "|") {
+		t.Errorf("Unexpected statements: %q", statements)
+	}
+}
+
+func TestVerifyMasterPassword(t *testing.T) {
+	db := newTestDatabase(t)
+
+	if err := verifyMasterPassword(db, false); err == nil || !strings.Contains(err.Error(), "has not been stored yet") {
+		t.Errorf("A missing master key marker was not reported: %v", err)
+	}
+
+	if err := verifyMasterPassword(db, true); err != nil {
+		t.Fatalf("The marker could not be stored: %v", err)
+	}
+
+	if err := verifyMasterPassword(db, false); err != nil {
+		t.Errorf("The master key was not accepted: %v", err)
+	}
+
+	masterPassword = []byte("another master password")
+
+	if err := verifyMasterPassword(db, true); err == nil {
+		t.Error("A wrong master key was accepted.")
+	}
+}
+
+func TestRunInTransaction(t *testing.T) {
+	db := newTestDatabase(t)
+
+	bus, _ := NewEventBus(config)
+	sink := &recordingSink{}
+	bus.Subscribe(sink)
+
+	previous := eventBus
+	eventBus = bus
+	defer func() { eventBus = previous }()
+
+	code := runInTransaction(db, func(tx *sqlx.Tx) error {
+		user := createTestUser(t, "jane", tx)
+		NewAuditLog(tx, nil).LogUserCreated(user.Id, user.Id)
+
+		return errors.New("Something failed.")
+	})
+
+	if code != 1 {
+		t.Errorf("Expected exit code 1 for a failed command, got %d.", code)
+	}
+
+	code = runInTransaction(db, func(tx *sqlx.Tx) error {
+		user := createTestUser(t, "admin", tx)
+		NewAuditLog(tx, nil).LogUserCreated(user.Id, user.Id)
+
+		return nil
+	})
+
+	if code != 0 {
+		t.Errorf("Expected exit code 0 for a successful command, got %d.", code)
+	}
+
+	bus.Close()
+
+	tx, _ := db.Beginx()
+	defer tx.Rollback()
+
+	if findUserByLogin("jane", false, tx) != nil || findUserByLogin("admin", false, tx) == nil {
+		t.Error("Only the successful command should have been committed.")
+	}
+
+	if len(sink.events) != 1 {
+		t.Errorf("Expected only the event of the successful command, got %d.", len(sink.events))
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	tx := newTestTx(t)
+	passwordPolicy, _ = NewPasswordPolicy(config)
+
+	setFlag(t, userCreateLogin, "Admin")
+	setFlag(t, userCreateEmail, " admin@example.com ")
+	setFlag(t, userCreateRole, RoleAdmin)
+	setFlag(t, userActor, "")
+
+	withStdin(t, "correct horse battery\n")
+
+	if err := userCreateCommand(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := findUserByLogin("admin", true, tx)
+	if admin == nil || admin.Name != "admin" || *admin.Email != "admin@example.com" || !CompareBcrypt(*admin.Password, "correct horse battery") {
+		t.Fatalf("The admin was not created as expected: %+v", admin)
+	}
+
+	// the first admin created themselves
+	entries := NewAuditLog(tx, nil).FindByActions([]string{"user-created"}, 10, 0)
+	if len(entries) != 1 || entries[0].CreatedBy != admin.Id {
+		t.Errorf("Expected the admin to be logged as their own creator: %+v", entries)
+	}
+
+	setFlag(t, userCreateLogin, "jane")
+	setFlag(t, userCreateEmail, "")
+	setFlag(t, userCreateRole, RoleUser)
+	setFlag(t, userActor, "nobody")
+
+	if err := userCreateCommand(tx); err == nil {
+		t.Error("An unknown actor was accepted.")
+	}
+
+	*userActor = "admin"
+	withStdin(t, "password\n")
+
+	if err := userCreateCommand(tx); err == nil {
+		t.Error("A denied passphrase was accepted.")
+	}
+
+	withStdin(t, "")
+
+	if err := userCreateCommand(tx); err == nil {
+		t.Error("An empty stdin was accepted.")
+	}
+
+	withStdin(t, "blue gecko tangerine")
+
+	if err := userCreateCommand(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	jane := findUserByLogin("jane", false, tx)
+	if jane == nil || jane.Role != RoleUser {
+		t.Fatalf("Jane was not created as a user: %+v", jane)
+	}
+
+	if err := userCreateCommand(tx); err == nil {
+		t.Error("A login was used twice.")
+	}
+
+	setFlag(t, userResetLogin, "jane")
+	withStdin(t, "purple walrus orchard\n")
+
+	if err := userResetPasswordCommand(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	if jane = findUserByLogin("jane", true, tx); !CompareBcrypt(*jane.Password, "purple walrus orchard") {
+		t.Error("The passphrase was not changed.")
+	}
+
+	entries = NewAuditLog(tx, nil).FindByActions([]string{"user-updated"}, 10, 0)
+	if len(entries) != 1 || entries[0].CreatedBy != admin.Id || *entries[0].User != jane.Id {
+		t.Errorf("Expected the admin to be logged as the editor: %+v", entries)
+	}
+
+	ldap := &User{Id: -1, Name: "ldap", LoginName: "ldap", Role: RoleUser, Backend: BackendLdap, _db: tx}
+	ldap.Save()
+
+	*userResetLogin = "ldap"
+
+	if err := userResetPasswordCommand(tx); err == nil {
+		t.Error("The passphrase of an external user was changed.")
+	}
+
+	*userResetLogin = "nobody"
+
+	if err := userResetPasswordCommand(tx); err == nil {
+		t.Error("The passphrase of a missing user was changed.")
+	}
+}
+
+func TestSecretCommands(t *testing.T) {
+	tx := newTestTx(t)
+	admin := createTestUser(t, "admin", tx)
+
+	setFlag(t, secretActor, "admin")
+	setFlag(t, secretPutSlug, "db-password")
+	setFlag(t, secretPutName, "")
+	setFlag(t, secretGetSlug, "DB-Password")
+
+	withStdin(t, "hunter2\n")
+
+	if err := secretPutCommand(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := findSecretBySlug("db-password", false, tx)
+	if secret == nil || secret.Name != "db-password" || secret.CreatedBy != admin.Id {
+		t.Fatalf("The secret was not created: %+v", secret)
+	}
+
+	*secretPutName = "Database"
+	withStdin(t, "correct horse\n")
+
+	if err := secretPutCommand(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	secret = findSecretBySlug("db-password", true, tx)
+	if secret.Name != "Database" || *secret.UpdatedBy != admin.Id || len(findSecretVersions(secret.Id, tx)) != 1 {
+		t.Errorf("The secret was not updated: %+v", secret)
+	}
+
+	stdout := captureStdout(t)
+	err := secretGetCommand(tx)
+
+	if output := stdout(); err != nil || output != "correct horse" {
+		t.Errorf("Expected the secret on stdout, got %q (%v).", output, err)
+	}
+
+	if entries := NewAuditLog(tx, nil).FindByActions([]string{"secret-revealed"}, 10, 0); len(entries) != 1 {
+		t.Errorf("Expected the reveal to be logged, got %d entries.", len(entries))
+	}
+
+	withStdin(t, " \n")
+
+	if err := secretPutCommand(tx); err == nil {
+		t.Error("An empty body was accepted.")
+	}
+
+	*secretGetSlug = "missing"
+
+	if err := secretGetCommand(tx); err == nil {
+		t.Error("A missing secret was printed.")
+	}
+
+	*secretActor = "nobody"
+	*secretGetSlug = "db-password"
+
+	if err := secretGetCommand(tx); err == nil {
+		t.Error("A secret was revealed to an unknown user.")
+	}
+}
+
+func TestConsumerListCommand(t *testing.T) {
+	tx := newTestTx(t)
+	admin := createTestUser(t, "admin", tx)
+	web := createTestConsumer(t, "web", admin, tx)
+	createTestConsumer(t, "idle", admin, tx)
+	createTestSecret(t, "password", "hunter2", admin, tx, web)
+	createTestSecret(t, "token", "abc", admin, tx, web)
+
+	setFlag(t, consumerListFormat, "tsv")
+
+	stdout := captureStdout(t)
+	err := consumerListCommand(tx)
+	output := stdout()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected one line per consumer, got %q.", output)
+	}
+
+	for _, line := range lines {
+		fields := strings.Split(line, "\t")
+
+		if len(fields) != 5 || (fields[1] == "web" && fields[4] != "password,token") || (fields[1] == "idle" && fields[4] != "") {
+			t.Errorf("Unexpected line: %q", line)
+		}
+	}
+
+	*consumerListFormat = "table"
+
+	stdout = captureStdout(t)
+	consumerListCommand(tx)
+
+	if output := stdout(); !strings.HasPrefix(output, "ID  NAME  ENABLED") {
+		t.Errorf("Expected a table with a header, got %q.", output)
+	}
+}
@@ -0,0 +1,331 @@
+// Package client fetches secrets from a Raziel server on behalf of a consumer.
+//
+//	c, err := client.New(client.Options{
+//		BaseUrl:  "https://raziel.example.com:8443",
+//		Consumer: "k5Gd3Xa",
+//		ApiKey:   os.Getenv("RAZIEL_KEY"),
+//		Pin:      "3F:A2:...",
+//	})
+//
+//	password, err := c.Get("database-password")
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRetries = 4
+	DefaultBackoff = time.Second
+	DefaultTimeout = 30 * time.Second
+
+	maxBackoff = 30 * time.Second
+)
+
+// Options configure a Client. BaseUrl and Consumer are required, everything else is optional.
+type Options struct {
+	// BaseUrl is the address of the Raziel server, e.g. "https://raziel.example.com:8443".
+	BaseUrl string
+
+	// Consumer is the consumer identifier as shown on the consumer's page.
+	Consumer string
+
+	// ApiKey is sent in the X-Raziel-Key header for consumers with an API key restriction.
+	ApiKey string
+
+	// Certificate and PrivateKey are PEM files of a client certificate, e.g. one issued by
+	// Raziel's internal CA, for setups that require mutual TLS.
+	Certificate string
+	PrivateKey  string
+
+	// Pin is the SHA-256 fingerprint of the server certificate (hex, colons are optional). If
+	// it is set, the server must present exactly this certificate and the usual chain
+	// verification is skipped, so self-signed certificates work.
+	Pin string
+
+	// Plain asks for plain text even if the consumer has an encryption key (which the server
+	// refuses if the key is required).
+	Plain bool
+
+	// Retries is the number of times a request is repeated after a 5xx response or a network
+	// error (but not a certificate error), waiting Backoff, then twice as long, and so on.
+	// Negative values disable retries.
+	Retries int
+	Backoff time.Duration
+
+	// Timeout limits each request.
+	Timeout time.Duration
+}
+
+// Client fetches secrets. It is safe for concurrent use.
+type Client struct {
+	baseUrl  string
+	consumer string
+	apiKey   string
+	plain    bool
+	retries  int
+	backoff  time.Duration
+	http     *http.Client
+}
+
+// StatusError is returned if the server answered with anything but 200.
+type StatusError struct {
+	Secret string
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	switch e.Status {
+	case http.StatusNotFound:
+		return fmt.Sprintf("Secret '%s' or the consumer does not exist.", e.Secret)
+	case http.StatusForbidden:
+		return fmt.Sprintf("Access to secret '%s' has been denied.", e.Secret)
+	}
+
+	return fmt.Sprintf("Fetching secret '%s' failed with status %d.", e.Secret, e.Status)
+}
+
+// PinError is returned if the server presented a certificate that does not match the pin.
+type PinError struct {
+	Fingerprint string
+}
+
+func (e *PinError) Error() string {
+	return "The server certificate (" + e.Fingerprint + ") does not match the pinned fingerprint."
+}
+
+// New validates the options and creates a client.
+func New(opts Options) (*Client, error) {
+	base, err := url.Parse(strings.TrimRight(opts.BaseUrl, "/"))
+	if err != nil || (base.Scheme != "https" && base.Scheme != "http") || base.Host == "" {
+		return nil, errors.New("The base URL must be an absolute http(s) URL.")
+	}
+
+	if opts.Consumer == "" {
+		return nil, errors.New("No consumer identifier given.")
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if opts.Pin != "" {
+		pin := strings.ToLower(strings.Replace(opts.Pin, ":", "", -1))
+
+		if decoded, err := hex.DecodeString(pin); err != nil || len(decoded) != sha256.Size {
+			return nil, errors.New("The pin must be a SHA-256 fingerprint.")
+		}
+
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("The server did not present a certificate.")
+			}
+
+			fingerprint := Fingerprint(rawCerts[0])
+			if strings.ToLower(strings.Replace(fingerprint, ":", "", -1)) != pin {
+				return &PinError{fingerprint}
+			}
+
+			return nil
+		}
+	}
+
+	if opts.Certificate != "" || opts.PrivateKey != "" {
+		pair, err := tls.LoadX509KeyPair(opts.Certificate, opts.PrivateKey)
+		if err != nil {
+			return nil, errors.New("The client certificate could not be loaded: " + err.Error())
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	} else if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultBackoff
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	return &Client{
+		baseUrl:  base.String(),
+		consumer: opts.Consumer,
+		apiKey:   opts.ApiKey,
+		plain:    opts.Plain,
+		retries:  opts.Retries,
+		backoff:  opts.Backoff,
+		http: &http.Client{
+			Timeout: opts.Timeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}, nil
+}
+
+// Get fetches a secret by its slug.
+func (c *Client) Get(secret string) ([]byte, error) {
+	wait := c.backoff
+
+	for attempt := 0; ; attempt++ {
+		body, retry, err := c.fetch(secret)
+		if err == nil {
+			return body, nil
+		}
+
+		if !retry || attempt >= c.retries {
+			return nil, err
+		}
+
+		time.Sleep(wait)
+
+		wait *= 2
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+}
+
+// fetch makes a single request and tells whether it is worth retrying.
+func (c *Client) fetch(secret string) ([]byte, bool, error) {
+	target := c.baseUrl + "/get/" + url.PathEscape(c.consumer) + "/" + url.PathEscape(secret)
+	if c.plain {
+		target += "?plain=1"
+	}
+
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if c.apiKey != "" {
+		req.Header.Set("X-Raziel-Key", c.apiKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		// a wrong certificate will not get any better by asking again
+		var pinErr *PinError
+		if errors.As(err, &pinErr) {
+			return nil, false, pinErr
+		}
+
+		return nil, !certificateError(err), err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode >= 500, &StatusError{secret, resp.StatusCode}
+	}
+
+	return body, false, nil
+}
+
+// WriteFile fetches a secret and stores it in a file only the current user can read. The file
+// is replaced atomically, so readers never see a partial secret.
+func (c *Client) WriteFile(secret string, filename string) error {
+	body, err := c.Get(secret)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+
+	// TempFile already creates the file with 0600, but be explicit about it
+	err = tmp.Chmod(0600)
+
+	if err == nil {
+		_, err = tmp.Write(body)
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// Environment fetches the secrets for a map of variable names to secret slugs and returns them
+// as "NAME=value" pairs, as used by os/exec. A single trailing newline is removed from each
+// value, as secrets are often stored with one.
+func (c *Client) Environment(vars map[string]string) ([]string, error) {
+	env := make([]string, 0, len(vars))
+
+	for name, secret := range vars {
+		body, err := c.Get(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.IndexByte(body, 0) >= 0 {
+			return nil, fmt.Errorf("Secret '%s' contains a NUL byte and cannot be put into an environment variable.", secret)
+		}
+
+		body = bytes.TrimSuffix(body, []byte("\n"))
+		body = bytes.TrimSuffix(body, []byte("\r"))
+
+		env = append(env, name+"="+string(body))
+	}
+
+	return env, nil
+}
+
+func certificateError(err error) bool {
+	var (
+		verification *tls.CertificateVerificationError
+		authority    x509.UnknownAuthorityError
+		hostname     x509.HostnameError
+		invalid      x509.CertificateInvalidError
+	)
+
+	return errors.As(err, &verification) || errors.As(err, &authority) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
+
+// Fingerprint returns the colon separated SHA-256 fingerprint of a DER certificate, in the same
+// format as "openssl x509 -noout -fingerprint -sha256".
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":")
+}
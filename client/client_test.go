@@ -0,0 +1,226 @@
+package client
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer serves the secrets to the consumer "web" and fails the first few requests.
+func newTestServer(t *testing.T, secrets map[string]string, failures int32) (*httptest.Server, *int32) {
+	t.Helper()
+
+	requests := int32(0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+
+		if r.Header.Get("X-Raziel-Key") != "key" {
+			http.Error(w, "Nope.", 403)
+			return
+		}
+
+		body, ok := secrets[strings.TrimPrefix(r.URL.Path, "/get/web/")]
+		if !ok || !strings.HasPrefix(r.URL.Path, "/get/web/") {
+			http.Error(w, "Not Found.", 404)
+			return
+		}
+
+		if r.URL.Query().Get("plain") == "1" {
+			body = "plain:" + body
+		}
+
+		w.Write([]byte(body))
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func newTestClient(t *testing.T, opts Options) *Client {
+	t.Helper()
+
+	if opts.Consumer == "" {
+		opts.Consumer = "web"
+	}
+
+	if opts.ApiKey == "" {
+		opts.ApiKey = "key"
+	}
+
+	opts.Backoff = time.Millisecond
+
+	c, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestNew(t *testing.T) {
+	invalid := []Options{
+		{BaseUrl: "", Consumer: "web"},
+		{BaseUrl: "raziel.example.com", Consumer: "web"},
+		{BaseUrl: "ftp://raziel.example.com", Consumer: "web"},
+		{BaseUrl: "https://raziel.example.com"},
+		{BaseUrl: "https://raziel.example.com", Consumer: "web", Pin: "3F:A2"},
+		{BaseUrl: "https://raziel.example.com", Consumer: "web", Certificate: "missing.pem", PrivateKey: "missing.key"},
+	}
+
+	for _, opts := range invalid {
+		if _, err := New(opts); err == nil {
+			t.Errorf("%+v was accepted.", opts)
+		}
+	}
+
+	c, err := New(Options{BaseUrl: "https://raziel.example.com:8443/", Consumer: "web", Retries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.baseUrl != "https://raziel.example.com:8443" || c.retries != 0 || c.backoff != DefaultBackoff {
+		t.Errorf("The options were not normalized: %+v", c)
+	}
+}
+
+func TestGet(t *testing.T) {
+	server, requests := newTestServer(t, map[string]string{"db password": "hunter2"}, 2)
+
+	c := newTestClient(t, Options{BaseUrl: server.URL})
+
+	body, err := c.Get("db password")
+	if err != nil || string(body) != "hunter2" {
+		t.Fatalf("The secret was not fetched: %q (%v)", body, err)
+	}
+
+	if *requests != 3 {
+		t.Errorf("Expected two retries, got %d requests.", *requests)
+	}
+
+	// client errors are not retried
+	server, requests = newTestServer(t, map[string]string{"db password": "hunter2"}, 0)
+	c = newTestClient(t, Options{BaseUrl: server.URL})
+
+	_, err = c.Get("missing")
+
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Status != 404 || *requests != 1 {
+		t.Errorf("Expected a single 404, got %v after %d request(s).", err, *requests)
+	}
+
+	_, err = newTestClient(t, Options{BaseUrl: server.URL, ApiKey: "wrong"}).Get("db password")
+	if !errors.As(err, &statusErr) || statusErr.Status != 403 {
+		t.Errorf("Expected 403 for a wrong API key, got %v.", err)
+	}
+
+	if body, _ := newTestClient(t, Options{BaseUrl: server.URL, Plain: true}).Get("db password"); string(body) != "plain:hunter2" {
+		t.Errorf("Plain text was not asked for: %q", body)
+	}
+}
+
+func TestGetGivesUp(t *testing.T) {
+	server, requests := newTestServer(t, map[string]string{"password": "hunter2"}, 100)
+
+	_, err := newTestClient(t, Options{BaseUrl: server.URL, Retries: 2}).Get("password")
+
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Status != 500 {
+		t.Errorf("Expected the last 500 to be returned, got %v.", err)
+	}
+
+	if *requests != 3 {
+		t.Errorf("Expected three attempts, got %d.", *requests)
+	}
+}
+
+func TestPin(t *testing.T) {
+	requests := int32(0)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("hunter2"))
+	}))
+	defer server.Close()
+
+	fingerprint := Fingerprint(server.Certificate().Raw)
+
+	// the test certificate is self-signed, so only the pin makes it acceptable
+	for _, pin := range []string{fingerprint, strings.ToLower(strings.Replace(fingerprint, ":", "", -1))} {
+		if body, err := newTestClient(t, Options{BaseUrl: server.URL, Pin: pin}).Get("password"); err != nil || string(body) != "hunter2" {
+			t.Errorf("The pinned certificate was not accepted: %v", err)
+		}
+	}
+
+	other := strings.Repeat("00:", 31) + "00"
+
+	_, err := newTestClient(t, Options{BaseUrl: server.URL, Pin: other}).Get("password")
+
+	var pinErr *PinError
+	if !errors.As(err, &pinErr) || pinErr.Fingerprint != fingerprint {
+		t.Errorf("Expected a pin error, got %v.", err)
+	}
+
+	before := atomic.LoadInt32(&requests)
+
+	if _, err := newTestClient(t, Options{BaseUrl: server.URL}).Get("password"); err == nil {
+		t.Error("The self-signed certificate was accepted without a pin.")
+	}
+
+	if atomic.LoadInt32(&requests) != before {
+		t.Error("A request was made although the certificate was not trusted.")
+	}
+}
+
+func TestWriteFileAndEnvironment(t *testing.T) {
+	server, _ := newTestServer(t, map[string]string{"password": "hunter2\r\n", "token": "abc\n\n", "binary": "a\x00b"}, 0)
+	c := newTestClient(t, Options{BaseUrl: server.URL})
+
+	filename := filepath.Join(t.TempDir(), "password")
+
+	if err := c.WriteFile("password", filename); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := ioutil.ReadFile(filename)
+	info, _ := os.Stat(filename)
+
+	if string(content) != "hunter2\r\n" || info.Mode().Perm() != 0600 {
+		t.Errorf("The file was not written as expected: %q, %v", content, info.Mode())
+	}
+
+	if err := c.WriteFile("missing", filename); err == nil {
+		t.Error("A missing secret was written.")
+	}
+
+	if content, _ := ioutil.ReadFile(filename); string(content) != "hunter2\r\n" {
+		t.Errorf("A failed fetch changed the file: %q", content)
+	}
+
+	env, err := c.Environment(map[string]string{"DB_PASSWORD": "password", "TOKEN": "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(env)
+
+	if strings.Join(env, "|") != "DB_PASSWORD=hunter2|TOKEN=abc\n" {
+		t.Errorf("Unexpected environment: %q", env)
+	}
+
+	if _, err := c.Environment(map[string]string{"BINARY": "binary"}); err == nil {
+		t.Error("A secret with a NUL byte was put into the environment.")
+	}
+}
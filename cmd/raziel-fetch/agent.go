@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/xrstf/raziel/client"
+)
+
+// notifications older than this are considered replays
+const notificationMaxAge = 5 * time.Minute
+
+type agentConfiguration struct {
+	Directory  string `json:"directory"`
+	AllowDisk  bool   `json:"allowDisk"`
+	Socket     string `json:"socket"`
+	SocketMode string `json:"socketMode"`
+	Interval   string `json:"interval"`
+	Grace      string `json:"grace"`
+
+	Notifications struct {
+		Listen        string `json:"listen"`
+		WebhookSecret string `json:"webhookSecret"`
+	} `json:"notifications"`
+
+	Files []struct {
+		Path     string `json:"path"`
+		Template string `json:"template"`
+		Source   string `json:"source"`
+		Mode     string `json:"mode"`
+	} `json:"files"`
+}
+
+// Agent keeps the consumer's secrets in memory, renders them into files and serves them over a
+// Unix socket, so that local processes neither wait for nor depend on the server.
+type Agent struct {
+	client        *client.Client
+	directory     string
+	socket        string
+	socketMode    os.FileMode
+	interval      time.Duration
+	grace         time.Duration
+	listen        string
+	webhookSecret []byte
+	files         []*agentFile
+	trigger       chan struct{}
+
+	lock        sync.Mutex
+	cache       map[string]*cachedSecret
+	lastRefresh time.Time
+}
+
+type cachedSecret struct {
+	body    []byte
+	fetched time.Time
+	stale   bool
+}
+
+type agentFile struct {
+	path     string
+	mode     os.FileMode
+	template *template.Template
+	content  []byte
+	rendered time.Time
+	err      error
+}
+
+func NewAgent(c *client.Client, filename string) (*Agent, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := agentConfiguration{}
+
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, errors.New("The agent configuration could not be parsed: " + err.Error())
+	}
+
+	a := &Agent{
+		client:     c,
+		directory:  config.Directory,
+		socket:     config.Socket,
+		socketMode: 0600,
+		interval:   5 * time.Minute,
+		grace:      time.Hour,
+		listen:     config.Notifications.Listen,
+		trigger:    make(chan struct{}, 1),
+		cache:      make(map[string]*cachedSecret),
+	}
+
+	if a.directory == "" {
+		return nil, errors.New("No directory configured.")
+	}
+
+	if err := os.MkdirAll(a.directory, 0700); err != nil {
+		return nil, err
+	}
+
+	// rendered secrets must never end up on a disk
+	if !config.AllowDisk {
+		ok, err := onTmpfs(a.directory)
+		if err != nil {
+			return nil, errors.New("Could not determine whether the directory is on a tmpfs (set allowDisk to skip this check): " + err.Error())
+		}
+
+		if !ok {
+			return nil, errors.New("The directory is not on a tmpfs (set allowDisk to write there anyway).")
+		}
+	}
+
+	if a.socket == "" {
+		a.socket = filepath.Join(a.directory, "agent.sock")
+	}
+
+	if config.SocketMode != "" {
+		mode, err := parseMode(config.SocketMode)
+		if err != nil {
+			return nil, errors.New("Invalid socket mode configured.")
+		}
+
+		a.socketMode = mode
+	}
+
+	if config.Interval != "" {
+		interval, err := time.ParseDuration(config.Interval)
+		if err != nil || interval < time.Second {
+			return nil, errors.New("Invalid refresh interval configured, it must be at least one second.")
+		}
+
+		a.interval = interval
+	}
+
+	if config.Grace != "" {
+		grace, err := time.ParseDuration(config.Grace)
+		if err != nil || grace < 0 {
+			return nil, errors.New("Invalid grace period configured.")
+		}
+
+		a.grace = grace
+	}
+
+	if a.listen != "" {
+		if config.Notifications.WebhookSecret == "" {
+			return nil, errors.New("Notifications can only be received with a webhook secret.")
+		}
+
+		a.webhookSecret = []byte(config.Notifications.WebhookSecret)
+	}
+
+	// rendering a file over the socket or another file would break both
+	paths := map[string]bool{filepath.Clean(a.socket): true}
+
+	for idx, f := range config.Files {
+		path := filepath.Clean(f.Path)
+
+		if f.Path == "" || filepath.IsAbs(path) || path == "." || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("File #%d must have a path relative to the directory.", idx+1)
+		}
+
+		text := f.Template
+
+		if f.Source != "" {
+			source, err := ioutil.ReadFile(f.Source)
+			if err != nil {
+				return nil, err
+			}
+
+			text = string(source)
+		}
+
+		file := &agentFile{path: filepath.Join(a.directory, path), mode: 0600}
+
+		if paths[file.path] {
+			return nil, fmt.Errorf("File '%s' is configured twice or is the socket.", f.Path)
+		}
+
+		paths[file.path] = true
+
+		if f.Mode != "" {
+			mode, err := parseMode(f.Mode)
+			if err != nil {
+				return nil, fmt.Errorf("File '%s' has an invalid mode.", f.Path)
+			}
+
+			file.mode = mode
+		}
+
+		// the functions are replaced on every render
+		file.template, err = template.New(path).Funcs(templateFuncs(nil)).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("The template for '%s' could not be parsed: %s", f.Path, err)
+		}
+
+		a.files = append(a.files, file)
+	}
+
+	return a, nil
+}
+
+func parseMode(mode string) (os.FileMode, error) {
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed > 0777 {
+		return 0, errors.New("Invalid mode.")
+	}
+
+	return os.FileMode(parsed), nil
+}
+
+func templateFuncs(secret func(string) (string, error)) template.FuncMap {
+	return template.FuncMap{
+		"secret": secret,
+		"trim":   strings.TrimSpace,
+	}
+}
+
+// Run renders the files, starts serving and refreshes until it is stopped by SIGINT or SIGTERM.
+// SIGHUP refreshes right away.
+func (a *Agent) Run() error {
+	a.Refresh()
+
+	os.Remove(a.socket)
+
+	listener, err := net.Listen("unix", a.socket)
+	if err != nil {
+		return err
+	}
+
+	defer listener.Close()
+
+	if err := os.Chmod(a.socket, a.socketMode); err != nil {
+		return err
+	}
+
+	go http.Serve(listener, a.socketHandler())
+
+	if a.listen != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(a.listen, http.HandlerFunc(a.notificationHandler)))
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	log.Printf("Serving on %s, refreshing every %s.", a.socket, a.interval)
+
+	for {
+		select {
+		case <-ticker.C:
+			a.Refresh()
+
+		case <-a.trigger:
+			a.Refresh()
+
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				a.Refresh()
+				continue
+			}
+
+			log.Printf("Received %s, stopping.", sig)
+			return nil
+		}
+	}
+}
+
+// Trigger schedules a refresh unless one is already pending.
+func (a *Agent) Trigger() {
+	select {
+	case a.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Get returns a secret from the cache, fetching it if it is older than the refresh interval. If
+// the server cannot be reached, the cached copy is used until the grace period has passed since
+// it was last fetched. Secrets the consumer has lost access to are dropped right away.
+func (a *Agent) Get(secret string, maxAge time.Duration) ([]byte, error) {
+	a.lock.Lock()
+	cached := a.cache[secret]
+	a.lock.Unlock()
+
+	now := time.Now()
+
+	if cached != nil && now.Sub(cached.fetched) < maxAge {
+		return cached.body, nil
+	}
+
+	body, err := a.client.Get(secret)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if err == nil {
+		a.cache[secret] = &cachedSecret{body: body, fetched: now}
+		return body, nil
+	}
+
+	if statusErr, ok := err.(*client.StatusError); ok && statusErr.Status < 500 {
+		delete(a.cache, secret)
+		return nil, err
+	}
+
+	if cached != nil && now.Sub(cached.fetched) <= a.grace {
+		if !cached.stale {
+			log.Printf("Warning: serving the cached copy of '%s': %s", secret, err)
+			cached.stale = true
+		}
+
+		return cached.body, nil
+	}
+
+	if cached != nil {
+		log.Printf("The grace period for '%s' has passed, dropping it.", secret)
+		delete(a.cache, secret)
+	}
+
+	return nil, err
+}
+
+// Refresh fetches all cached secrets again and re-renders the files. Files that cannot be
+// rendered anymore are removed.
+func (a *Agent) Refresh() {
+	fetched := make(map[string][]byte)
+	failed := make(map[string]error)
+
+	fetch := func(secret string) ([]byte, error) {
+		if body, ok := fetched[secret]; ok {
+			return body, nil
+		}
+
+		if err, ok := failed[secret]; ok {
+			return nil, err
+		}
+
+		body, err := a.Get(secret, 0)
+		if err != nil {
+			failed[secret] = err
+			return nil, err
+		}
+
+		fetched[secret] = body
+		return body, nil
+	}
+
+	a.lock.Lock()
+	secrets := make([]string, 0, len(a.cache))
+	for secret := range a.cache {
+		secrets = append(secrets, secret)
+	}
+	a.lock.Unlock()
+
+	for _, secret := range secrets {
+		fetch(secret)
+	}
+
+	for _, file := range a.files {
+		a.render(file, fetch)
+	}
+
+	a.lock.Lock()
+	a.lastRefresh = time.Now()
+	a.lock.Unlock()
+}
+
+func (a *Agent) render(file *agentFile, fetch func(string) ([]byte, error)) {
+	out := &bytes.Buffer{}
+
+	tpl, err := file.template.Clone()
+	if err == nil {
+		tpl.Funcs(templateFuncs(func(secret string) (string, error) {
+			body, err := fetch(secret)
+			return string(body), err
+		}))
+
+		err = tpl.Execute(out, nil)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if err != nil {
+		log.Printf("Could not render '%s': %s", file.path, err)
+
+		if file.content != nil {
+			os.Remove(file.path)
+		}
+
+		file.content = nil
+		file.err = err
+		return
+	}
+
+	file.err = nil
+	file.rendered = time.Now()
+
+	if file.content != nil && bytes.Equal(out.Bytes(), file.content) {
+		return
+	}
+
+	if err := writeFile(file.path, out.Bytes(), file.mode); err != nil {
+		log.Printf("Could not write '%s': %s", file.path, err)
+		file.err = err
+		return
+	}
+
+	file.content = append([]byte{}, out.Bytes()...)
+}
+
+// writeFile replaces the file atomically, so readers never see a partial secret.
+func writeFile(filename string, content []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Chmod(mode)
+
+	if err == nil {
+		_, err = tmp.Write(content)
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// HTTP handlers
+
+// socketHandler serves
+//
+//	GET  /secrets/<slug>  the secret
+//	GET  /files/<path>    a rendered file
+//	GET  /status          the cache state as JSON
+//	POST /refresh         trigger a refresh
+func (a *Agent) socketHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/secrets/", func(w http.ResponseWriter, r *http.Request) {
+		secret := strings.TrimPrefix(r.URL.Path, "/secrets/")
+
+		body, err := a.Get(secret, a.interval)
+		if err != nil {
+			status := http.StatusServiceUnavailable
+
+			if statusErr, ok := err.(*client.StatusError); ok && statusErr.Status < 500 {
+				status = statusErr.Status
+			}
+
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(body)
+	})
+
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		path := filepath.Join(a.directory, filepath.Clean("/"+strings.TrimPrefix(r.URL.Path, "/files/")))
+
+		a.lock.Lock()
+		defer a.lock.Unlock()
+
+		for _, file := range a.files {
+			if file.path != path {
+				continue
+			}
+
+			if file.content == nil {
+				http.Error(w, "The file is currently not available.", http.StatusServiceUnavailable)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write(file.content)
+			return
+		}
+
+		http.NotFound(w, r)
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.status())
+	})
+
+	mux.HandleFunc("/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Use POST.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		a.Trigger()
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	return mux
+}
+
+type agentStatus struct {
+	LastRefresh time.Time           `json:"lastRefresh"`
+	Secrets     []agentSecretStatus `json:"secrets"`
+	Files       []agentFileStatus   `json:"files"`
+}
+
+type agentSecretStatus struct {
+	Secret  string    `json:"secret"`
+	Fetched time.Time `json:"fetched"`
+	Stale   bool      `json:"stale"`
+}
+
+type agentFileStatus struct {
+	Path     string    `json:"path"`
+	Rendered time.Time `json:"rendered"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (a *Agent) status() agentStatus {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	status := agentStatus{LastRefresh: a.lastRefresh}
+
+	for secret, cached := range a.cache {
+		status.Secrets = append(status.Secrets, agentSecretStatus{secret, cached.fetched, cached.stale})
+	}
+
+	sort.Slice(status.Secrets, func(i, j int) bool {
+		return status.Secrets[i].Secret < status.Secrets[j].Secret
+	})
+
+	for _, file := range a.files {
+		s := agentFileStatus{Path: file.path, Rendered: file.rendered}
+
+		if file.err != nil {
+			s.Error = file.err.Error()
+		}
+
+		status.Files = append(status.Files, s)
+	}
+
+	return status
+}
+
+// notificationHandler receives Raziel's change notifications (configured as a webhook
+// subscription) and triggers a refresh. Requests must carry a valid signature.
+func (a *Agent) notificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Use POST.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Could not read the request.", http.StatusBadRequest)
+		return
+	}
+
+	timestamp := r.Header.Get("X-Raziel-Timestamp")
+
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)) > notificationMaxAge || time.Until(time.Unix(sent, 0)) > notificationMaxAge {
+		http.Error(w, "Invalid timestamp.", http.StatusForbidden)
+		return
+	}
+
+	mac := hmac.New(sha256.New, a.webhookSecret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Raziel-Signature"))) {
+		http.Error(w, "Invalid signature.", http.StatusForbidden)
+		return
+	}
+
+	a.Trigger()
+	w.WriteHeader(http.StatusNoContent)
+}
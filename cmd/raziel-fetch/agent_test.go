@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAgent writes the configuration and creates an agent rendering into a temporary
+// directory, which is returned as well.
+func newTestAgent(t *testing.T, config map[string]interface{}) (*Agent, string, error) {
+	t.Helper()
+
+	dir := t.TempDir()
+	config["directory"] = filepath.Join(dir, "secrets")
+	config["allowDisk"] = true
+
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "agent.json")
+
+	if err := ioutil.WriteFile(filename, encoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := NewAgent(nil, filename)
+
+	return agent, config["directory"].(string), err
+}
+
+func agentFiles(files ...string) map[string]interface{} {
+	list := make([]map[string]string, 0, len(files))
+
+	for _, path := range files {
+		list = append(list, map[string]string{"path": path, "template": "x"})
+	}
+
+	return map[string]interface{}{"files": list}
+}
+
+func TestAgentFilePaths(t *testing.T) {
+	valid := []string{"db.env", "app/db.env", "./app//db.env", "..hidden", "app/../db.env"}
+
+	for _, path := range valid {
+		if _, _, err := newTestAgent(t, agentFiles(path)); err != nil {
+			t.Errorf("%q was rejected: %v", path, err)
+		}
+	}
+
+	invalid := [][]string{
+		{""},
+		{"."},
+		{".."},
+		{"../db.env"},
+		{"app/../../db.env"},
+		{"/etc/passwd"},
+		{"agent.sock"},
+		{"db.env", "./db.env"},
+	}
+
+	for _, paths := range invalid {
+		if _, _, err := newTestAgent(t, agentFiles(paths...)); err == nil {
+			t.Errorf("%q was accepted.", paths)
+		}
+	}
+
+	config := agentFiles("db.env")
+	config["files"].([]map[string]string)[0]["mode"] = "0644"
+
+	agent, dir, err := newTestAgent(t, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if agent.files[0].path != filepath.Join(dir, "db.env") || agent.files[0].mode != 0644 {
+		t.Errorf("The file was not configured as expected: %+v", agent.files[0])
+	}
+
+	config["files"].([]map[string]string)[0]["mode"] = "1777"
+
+	if _, _, err := newTestAgent(t, config); err == nil {
+		t.Error("An invalid mode was accepted.")
+	}
+}
+
+func TestAgentRender(t *testing.T) {
+	agent, dir, err := newTestAgent(t, map[string]interface{}{
+		"files": []map[string]string{
+			{"path": "app/db.env", "template": `DB_PASSWORD={{ secret "db-password" | trim }}`},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := agent.files[0]
+	filename := filepath.Join(dir, "app", "db.env")
+
+	agent.render(file, func(secret string) ([]byte, error) {
+		return []byte("hunter2\n"), nil
+	})
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil || string(content) != "DB_PASSWORD=hunter2" {
+		t.Fatalf("The file was not rendered: %q (%v)", content, err)
+	}
+
+	if info, _ := os.Stat(filename); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the file to be private, got %v.", info.Mode())
+	}
+
+	// no outdated secrets are left behind when a secret cannot be fetched anymore
+	agent.render(file, func(secret string) ([]byte, error) {
+		return nil, errors.New("The secret is gone.")
+	})
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("The file of a failed render was not removed: %v", err)
+	}
+
+	if file.err == nil {
+		t.Error("The failure was not recorded.")
+	}
+
+	entries, _ := ioutil.ReadDir(filepath.Dir(filename))
+	if len(entries) != 0 {
+		t.Errorf("Temporary files were left behind: %v", entries)
+	}
+}
+
+func TestAgentServesOnlyRenderedFiles(t *testing.T) {
+	agent, dir, err := newTestAgent(t, agentFiles("app/db.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent.render(agent.files[0], nil)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte("not rendered"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := agent.socketHandler()
+
+	testcases := map[string]int{
+		"/files/app/db.env": 200,
+		"/files/other":      404,
+		"/files/app":        404,
+	}
+
+	for target, status := range testcases {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", target, nil))
+
+		if res.Code != status {
+			t.Errorf("%s: expected %d, got %d.", target, status, res.Code)
+		}
+	}
+}
+
+func TestAgentNotificationSignature(t *testing.T) {
+	agent, _, err := newTestAgent(t, map[string]interface{}{
+		"notifications": map[string]string{"listen": "127.0.0.1:0", "webhookSecret": "s3cr3t"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(secret string, timestamp string, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "." + body))
+
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	body := `{"event":"secret-changed"}`
+
+	testcases := []struct {
+		timestamp string
+		signature string
+		status    int
+	}{
+		{now, sign("s3cr3t", now, body), http.StatusNoContent},
+		{now, sign("wrong", now, body), http.StatusForbidden},
+		{now, sign("s3cr3t", now, body+" "), http.StatusForbidden},
+		{old, sign("s3cr3t", old, body), http.StatusForbidden},
+		{"", sign("s3cr3t", "", body), http.StatusForbidden},
+	}
+
+	for idx, testcase := range testcases {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("X-Raziel-Timestamp", testcase.timestamp)
+		req.Header.Set("X-Raziel-Signature", testcase.signature)
+
+		res := httptest.NewRecorder()
+		agent.notificationHandler(res, req)
+
+		if res.Code != testcase.status {
+			t.Errorf("#%d: expected %d, got %d.", idx+1, testcase.status, res.Code)
+		}
+	}
+
+	select {
+	case <-agent.trigger:
+	default:
+		t.Error("The valid notification did not trigger a refresh.")
+	}
+}
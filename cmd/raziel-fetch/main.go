@@ -0,0 +1,158 @@
+// raziel-fetch fetches secrets from Raziel for use in build scripts and deployments.
+//
+//	raziel-fetch get db-password
+//	raziel-fetch write db-password=/etc/app/db.pass tls-key=/etc/app/tls.key
+//	raziel-fetch exec --env DB_PASSWORD=db-password -- ./app --migrate
+//	raziel-fetch agent --config agent.json
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/xrstf/raziel/client"
+)
+
+var (
+	baseUrl     = kingpin.Flag("url", "Base URL of the Raziel server").PlaceHolder("URL").OverrideDefaultFromEnvar("RAZIEL_URL").String()
+	consumer    = kingpin.Flag("consumer", "Consumer identifier").OverrideDefaultFromEnvar("RAZIEL_CONSUMER").String()
+	apiKey      = kingpin.Flag("key", "API key (prefer the environment variable)").OverrideDefaultFromEnvar("RAZIEL_KEY").String()
+	certificate = kingpin.Flag("cert", "Client certificate (PEM)").OverrideDefaultFromEnvar("RAZIEL_CERT").String()
+	privateKey  = kingpin.Flag("cert-key", "Private key of the client certificate (PEM)").OverrideDefaultFromEnvar("RAZIEL_CERT_KEY").String()
+	pin         = kingpin.Flag("pin", "SHA-256 fingerprint of the server certificate").OverrideDefaultFromEnvar("RAZIEL_PIN").String()
+	plain       = kingpin.Flag("plain", "Ask for plain text even if the consumer has an encryption key").Bool()
+	retries     = kingpin.Flag("retries", "Retries after server and network errors").Default("4").Int()
+	timeout     = kingpin.Flag("timeout", "Timeout per request").Default("30s").Duration()
+
+	getCmd     = kingpin.Command("get", "Print a secret to stdout")
+	getSecrets = getCmd.Arg("secret", "Secret slug").Required().Strings()
+
+	writeCmd   = kingpin.Command("write", "Write secrets to files (mode 0600)")
+	writeFiles = writeCmd.Arg("files", "secret=file pairs").Required().StringMap()
+
+	execCmd     = kingpin.Command("exec", "Run a command with secrets in its environment")
+	execEnv     = execCmd.Flag("env", "NAME=secret pairs").Short('e').Required().StringMap()
+	execCommand = execCmd.Arg("command", "Command and arguments").Required().Strings()
+
+	agentCmd    = kingpin.Command("agent", "Cache secrets, render them into files and serve them over a Unix socket")
+	agentConfig = agentCmd.Flag("config", "Agent configuration file").Required().ExistingFile()
+)
+
+func main() {
+	kingpin.UsageTemplate(kingpin.CompactUsageTemplate).Version("1.0").Author("Christoph Mewes")
+	kingpin.CommandLine.Help = "Fetch secrets from a Raziel server"
+	command := kingpin.Parse()
+
+	if *retries == 0 {
+		// the client treats 0 as "use the default"
+		*retries = -1
+	}
+
+	c, err := client.New(client.Options{
+		BaseUrl:     *baseUrl,
+		Consumer:    *consumer,
+		ApiKey:      *apiKey,
+		Certificate: *certificate,
+		PrivateKey:  *privateKey,
+		Pin:         *pin,
+		Plain:       *plain,
+		Retries:     *retries,
+		Timeout:     *timeout,
+	})
+	if err != nil {
+		kingpin.FatalUsage(err.Error())
+	}
+
+	switch command {
+	case getCmd.FullCommand():
+		for _, secret := range *getSecrets {
+			body, err := c.Get(secret)
+			kingpin.FatalIfError(err, "")
+
+			os.Stdout.Write(body)
+		}
+
+	case writeCmd.FullCommand():
+		for secret, filename := range *writeFiles {
+			kingpin.FatalIfError(c.WriteFile(secret, filename), "")
+		}
+
+	case execCmd.FullCommand():
+		env, err := c.Environment(*execEnv)
+		kingpin.FatalIfError(err, "")
+
+		os.Exit(run(*execCommand, env))
+
+	case agentCmd.FullCommand():
+		agent, err := NewAgent(c, *agentConfig)
+		if err != nil {
+			kingpin.FatalUsage(err.Error())
+		}
+
+		kingpin.FatalIfError(agent.Run(), "")
+	}
+}
+
+// run starts the command with the secrets added to our environment, forwards signals to it and
+// returns its exit code. The credentials used to fetch the secrets are not passed on.
+func run(command []string, secrets []string) int {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(childEnvironment(os.Environ()), secrets...)
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "raziel-fetch: %s\n", err)
+		return 127
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+	signal.Stop(signals)
+	close(signals)
+
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				if status.Signaled() {
+					return 128 + int(status.Signal())
+				}
+
+				return status.ExitStatus()
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "raziel-fetch: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func childEnvironment(environ []string) []string {
+	env := make([]string, 0, len(environ))
+
+	for _, pair := range environ {
+		name := strings.SplitN(pair, "=", 2)[0]
+
+		if name != "RAZIEL_KEY" && name != "RAZIEL_CERT_KEY" {
+			env = append(env, pair)
+		}
+	}
+
+	return env
+}
@@ -0,0 +1,22 @@
+package main
+
+import "syscall"
+
+const (
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+)
+
+// onTmpfs tells whether the directory is on a memory backed file system.
+func onTmpfs(directory string) (bool, error) {
+	stat := syscall.Statfs_t{}
+
+	if err := syscall.Statfs(directory, &stat); err != nil {
+		return false, err
+	}
+
+	// the field is signed on some platforms
+	fsType := uint32(stat.Type)
+
+	return fsType == tmpfsMagic || fsType == ramfsMagic, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func onTmpfs(directory string) (bool, error) {
+	return false, errors.New("This is only supported on Linux.")
+}
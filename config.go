@@ -30,6 +30,141 @@ type configuration struct {
 		Lifetime   string `json:"lifetime"`
 		Secure     bool   `json:"secure"`
 	} `json:"session"`
+
+	Passwords struct {
+		MinLength         int    `json:"minLength"`
+		DenyList          string `json:"denyList"`
+		History           int    `json:"history"`
+		ResetLinkLifetime string `json:"resetLinkLifetime"`
+	} `json:"passwords"`
+
+	AccessLog struct {
+		MaxAgeDays         int    `json:"maxAgeDays"`
+		MaxRowsPerConsumer int    `json:"maxRowsPerConsumer"`
+		ArchiveDirectory   string `json:"archiveDirectory"`
+		DeleteUnarchived   bool   `json:"deleteUnarchived"`
+		PruneInterval      string `json:"pruneInterval"`
+	} `json:"accessLog"`
+
+	Checkpoints struct {
+		Key      string `json:"key"`
+		Interval string `json:"interval"`
+	} `json:"checkpoints"`
+
+	Events struct {
+		BufferSize int               `json:"bufferSize"`
+		Sinks      []eventSinkConfig `json:"sinks"`
+	} `json:"events"`
+
+	Metrics struct {
+		Enabled bool   `json:"enabled"`
+		Token   string `json:"token"`
+	} `json:"metrics"`
+
+	Alerts struct {
+		DeniedBurst struct {
+			Threshold int    `json:"threshold"`
+			Window    string `json:"window"`
+		} `json:"deniedBurst"`
+		NotFoundBurst struct {
+			Threshold int    `json:"threshold"`
+			Window    string `json:"window"`
+		} `json:"notFoundBurst"`
+		NewOriginIp bool `json:"newOriginIp"`
+		OffHours    struct {
+			Enabled  bool   `json:"enabled"`
+			From     string `json:"from"`
+			To       string `json:"to"`
+			Weekends bool   `json:"weekends"`
+		} `json:"offHours"`
+		Cooldown string   `json:"cooldown"`
+		Email    []string `json:"email"`
+		Webhook  string   `json:"webhook"`
+	} `json:"alerts"`
+
+	Smtp struct {
+		Host       string `json:"host"`
+		Port       int    `json:"port"`
+		Username   string `json:"username"`
+		Password   string `json:"password"`
+		From       string `json:"from"`
+		StartTls   bool   `json:"startTls"`
+		SkipVerify bool   `json:"insecureSkipVerify"`
+	} `json:"smtp"`
+
+	Notifications struct {
+		WebhookSecret  string `json:"webhookSecret"`
+		DigestInterval string `json:"digestInterval"`
+		MaxAttempts    int    `json:"maxAttempts"`
+	} `json:"notifications"`
+
+	Rotation struct {
+		CheckInterval string `json:"checkInterval"`
+		KeepVersions  int    `json:"keepVersions"`
+	} `json:"rotation"`
+
+	Certificates struct {
+		CheckInterval string `json:"checkInterval"`
+		WarnDays      []int  `json:"warnDays"`
+	} `json:"certificates"`
+
+	Leases struct {
+		ReapInterval string `json:"reapInterval"`
+	} `json:"leases"`
+
+	Shares struct {
+		MaxTtl         string `json:"maxTtl"`
+		ExpireInterval string `json:"expireInterval"`
+	} `json:"shares"`
+
+	Ldap struct {
+		Enabled        bool              `json:"enabled"`
+		Url            string            `json:"url"`
+		StartTls       bool              `json:"startTls"`
+		SkipVerify     bool              `json:"insecureSkipVerify"`
+		BindDn         string            `json:"bindDn"`
+		BindPassword   string            `json:"bindPassword"`
+		BaseDn         string            `json:"baseDn"`
+		UserFilter     string            `json:"userFilter"`
+		LoginAttribute string            `json:"loginAttribute"`
+		NameAttribute  string            `json:"nameAttribute"`
+		GroupAttribute string            `json:"groupAttribute"`
+		Roles          map[string]string `json:"roles"`
+		DefaultRole    string            `json:"defaultRole"`
+		SyncInterval   string            `json:"syncInterval"`
+	} `json:"ldap"`
+
+	Oidc struct {
+		Enabled        bool     `json:"enabled"`
+		Issuer         string   `json:"issuer"`
+		ClientId       string   `json:"clientId"`
+		ClientSecret   string   `json:"clientSecret"`
+		AllowedDomains []string `json:"allowedDomains"`
+		LinkByEmail    bool     `json:"linkByEmail"`
+		DefaultRole    string   `json:"defaultRole"`
+		ButtonLabel    string   `json:"buttonLabel"`
+	} `json:"oidc"`
+}
+
+type eventSinkConfig struct {
+	Type string `json:"type"`
+
+	// syslog
+	Network    string `json:"network"`
+	Address    string `json:"address"`
+	Facility   string `json:"facility"`
+	Tag        string `json:"tag"`
+	CaFile     string `json:"caFile"`
+	SkipVerify bool   `json:"insecureSkipVerify"`
+
+	// file
+	Path     string `json:"path"`
+	MaxSize  int    `json:"maxSize"`
+	MaxFiles int    `json:"maxFiles"`
+
+	// webhook
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
 }
 
 func (c *configuration) Password() []byte {
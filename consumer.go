@@ -144,7 +144,7 @@ func (c *Consumer) GetSecrets(loadSecrets bool) []Secret {
 		secretCol = ", `secret`"
 	}
 
-	c._db.Select(&secrets, "SELECT `id`, `slug`, `name`, `created_at`, `created_by`, `updated_at`, `updated_by`"+secretCol+" FROM `secret` WHERE `id` IN (SELECT `secret_id` FROM `consumer_secret` WHERE `consumer_id` = ?) ORDER BY `name`", c.Id)
+	c._db.Select(&secrets, "SELECT "+secretColumns+secretCol+" FROM `secret` WHERE `id` IN (SELECT `secret_id` FROM `consumer_secret` WHERE `consumer_id` = ?) ORDER BY `name`", c.Id)
 
 	for i := range secrets {
 		secrets[i]._db = c._db
@@ -153,6 +153,13 @@ func (c *Consumer) GetSecrets(loadSecrets bool) []Secret {
 	return secrets
 }
 
+func (c *Consumer) HasSecret(secretId int) bool {
+	count := 0
+	c._db.Get(&count, "SELECT COUNT(*) FROM `consumer_secret` WHERE `consumer_id` = ? AND `secret_id` = ?", c.Id, secretId)
+
+	return count > 0
+}
+
 func (c *Consumer) WriteSecrets(secrets []consumerSecret) error {
 	_, err := c._db.Exec("DELETE FROM `consumer_secret` WHERE `consumer_id` = ?", c.Id)
 	if err != nil {
@@ -237,15 +244,22 @@ func (cr *consumerRestriction) IsNullContext() bool {
 type consumerFormData struct {
 	layoutData
 
-	Consumer       int
-	Name           string
-	NameError      string
-	Enabled        bool
-	InfoToken      *string
-	InfoTokenError string
-	OtherError     string
-	Secrets        []consumerSecret
-	Restrictions   map[string]consumerRestriction
+	Consumer           int
+	Name               string
+	NameError          string
+	Enabled            bool
+	InfoToken          *string
+	InfoTokenError     string
+	EncryptionKey      string
+	EncryptionRequired bool
+	EncryptionKeyError string
+	Fingerprint        string
+	OtherError         string
+	Secrets            []consumerSecret
+	Restrictions       map[string]consumerRestriction
+	Subscription       subscriptionPanel
+
+	key *ConsumerKey
 }
 
 func newConsumerFormData(layout layoutData) consumerFormData {
@@ -286,7 +300,14 @@ func (data *consumerFormData) fromConsumer(c *Consumer) {
 	data.Secrets = make([]consumerSecret, 0)
 
 	// load secrets
-	c._db.Select(&data.Secrets, "SELECT s.id, s.name, s.slug, IF(cs.secret_id IS NULL, 0, 1) AS checked FROM secret s LEFT JOIN consumer_secret cs ON s.id = cs.secret_id AND cs.consumer_id = ? ORDER BY s.name", c.Id)
+	c._db.Select(&data.Secrets, "SELECT s.id, s.name, s.slug, CASE WHEN cs.secret_id IS NULL THEN 0 ELSE 1 END AS checked FROM secret s LEFT JOIN consumer_secret cs ON s.id = cs.secret_id AND cs.consumer_id = ? ORDER BY s.name", c.Id)
+
+	if key := findConsumerKey(c.Id, c._db); key != nil {
+		data.EncryptionKey = key.PublicKey
+		data.EncryptionRequired = key.Required
+		data.Fingerprint = key.Label() + " " + key.Fingerprint
+		data.key = key
+	}
 
 	// load restrictions (and overwrite the dummy values from primeRestrictions)
 	for _, restriction := range c.GetRestrictions(true) {
@@ -313,6 +334,20 @@ func (data *consumerFormData) serializeForm(req *http.Request) bool {
 		data.InfoToken = &infoToken
 	}
 
+	data.EncryptionKey = strings.TrimSpace(req.FormValue("encryption_key"))
+	data.EncryptionRequired = req.FormValue("encryption_required") == "1"
+	data.key = nil
+
+	if len(data.EncryptionKey) > 0 {
+		key, err := parseConsumerKey(data.EncryptionKey, data.EncryptionRequired)
+		if err != nil {
+			data.EncryptionKeyError = err.Error()
+			okay = false
+		} else {
+			data.key = key
+		}
+	}
+
 	for idx, consumerSecret := range data.Secrets {
 		data.Secrets[idx].Checked = req.FormValue(fmt.Sprintf("secret_%d", consumerSecret.Id)) == "1"
 	}
@@ -412,9 +447,20 @@ func consumersCreateAction(req *http.Request, user *User, session *Session, db *
 		panic(err)
 	}
 
+	err = setConsumerKey(newConsumer.Id, data.key, db)
+	if err != nil {
+		panic(err)
+	}
+
 	auditLog := NewAuditLog(db, req)
 	auditLog.LogConsumerCreated(newConsumer.Id, user.Id)
 
+	for _, secret := range data.Secrets {
+		if secret.Checked {
+			auditLog.LogSecretGranted(secret.Id, newConsumer.Id, user.Id)
+		}
+	}
+
 	return redirect(302, "/consumers")
 }
 
@@ -433,6 +479,7 @@ func consumersEditAction(params martini.Params, user *User, session *Session, db
 	data.primeRestrictions()
 	data.primeSecrets(db)
 	data.fromConsumer(consumer)
+	data.Subscription = newSubscriptionPanel("consumer", consumer.Id, user, session.CsrfToken, db)
 
 	return renderTemplate(200, "consumers/form", data)
 }
@@ -472,6 +519,13 @@ func consumersUpdateAction(params martini.Params, req *http.Request, user *User,
 		panic(err)
 	}
 
+	// remember the old links to find newly granted secrets
+	previous := make(map[int]bool)
+
+	for _, secret := range consumer.GetSecrets(false) {
+		previous[secret.Id] = true
+	}
+
 	// create links to the allowed secrets
 	err = consumer.WriteSecrets(data.Secrets)
 	if err != nil {
@@ -484,9 +538,24 @@ func consumersUpdateAction(params martini.Params, req *http.Request, user *User,
 		panic(err)
 	}
 
+	err = setConsumerKey(consumer.Id, data.key, db)
+	if err != nil {
+		panic(err)
+	}
+
 	auditLog := NewAuditLog(db, req)
 	auditLog.LogConsumerUpdated(consumer.Id, user.Id)
 
+	for _, secret := range data.Secrets {
+		if secret.Checked && !previous[secret.Id] {
+			auditLog.LogSecretGranted(secret.Id, consumer.Id, user.Id)
+		}
+
+		if !secret.Checked && previous[secret.Id] {
+			auditLog.LogSecretUnassigned(findSecret(secret.Id, false, db), consumer.Id, user.Id)
+		}
+	}
+
 	return redirect(302, "/consumers")
 }
 
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"filippo.io/age"
+	agearmor "filippo.io/age/armor"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	// keys without hash preferences fall back to RIPEMD160, which must be available even though
+	// the messages are not signed
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+const (
+	KeyAge     = "age"
+	KeyOpenPgp = "openpgp"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Consumer key model
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// ConsumerKey is the public key deliveries to a consumer are encrypted to. If it is required, the
+// consumer cannot ask for plain text.
+type ConsumerKey struct {
+	ConsumerId  int    `db:"consumer_id"`
+	Kind        string `db:"kind"`
+	PublicKey   string `db:"public_key"`
+	Fingerprint string `db:"fingerprint"`
+	Required    bool   `db:"required"`
+}
+
+func findConsumerKey(consumerId int, db *sqlx.Tx) *ConsumerKey {
+	key := &ConsumerKey{}
+
+	db.Get(key, "SELECT `consumer_id`, `kind`, `public_key`, `fingerprint`, `required` FROM `consumer_key` WHERE `consumer_id` = ?", consumerId)
+	if key.ConsumerId == 0 {
+		return nil
+	}
+
+	return key
+}
+
+// setConsumerKey replaces the consumer's key; nil removes it.
+func setConsumerKey(consumerId int, key *ConsumerKey, db *sqlx.Tx) error {
+	_, err := db.Exec("DELETE FROM `consumer_key` WHERE `consumer_id` = ?", consumerId)
+	if err != nil || key == nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO `consumer_key` (`consumer_id`, `kind`, `public_key`, `fingerprint`, `required`) VALUES (?,?,?,?,?)",
+		consumerId, key.Kind, key.PublicKey, key.Fingerprint, key.Required,
+	)
+
+	return err
+}
+
+// parseConsumerKey recognizes age X25519 recipients and armored OpenPGP public keys.
+func parseConsumerKey(publicKey string, required bool) (*ConsumerKey, error) {
+	publicKey = strings.TrimSpace(publicKey)
+	key := &ConsumerKey{PublicKey: publicKey, Required: required}
+
+	switch {
+	case strings.HasPrefix(strings.ToLower(publicKey), "age1"):
+		// bech32 allows all uppercase, but never mixed case
+		mixedCase := strings.ToLower(publicKey) != publicKey && strings.ToUpper(publicKey) != publicKey
+
+		key.Kind = KeyAge
+		key.PublicKey = strings.ToLower(publicKey)
+
+		if _, err := age.ParseX25519Recipient(key.PublicKey); err != nil || mixedCase {
+			return nil, errors.New("The key is not a valid age X25519 recipient.")
+		}
+		key.Fingerprint = key.PublicKey
+
+	case strings.Contains(publicKey, "-----BEGIN PGP PUBLIC KEY BLOCK-----"):
+		entity, err := readOpenPgpKey(publicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		key.Kind = KeyOpenPgp
+		key.Fingerprint = fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+
+	default:
+		return nil, errors.New("The key must be an age recipient (age1...) or an ASCII armored OpenPGP public key.")
+	}
+
+	// make sure the key can actually be used before anything is delivered with it
+	if _, err := key.Encrypt([]byte(TestString)); err != nil {
+		return nil, errors.New("The key cannot be used for encryption: " + err.Error())
+	}
+
+	return key, nil
+}
+
+func readOpenPgpKey(publicKey string) (*openpgp.Entity, error) {
+	// only the first armored block would be read
+	if strings.Count(publicKey, "-----BEGIN PGP") > 1 {
+		return nil, errors.New("Exactly one OpenPGP public key must be given.")
+	}
+
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(publicKey))
+	if err != nil {
+		return nil, errors.New("The OpenPGP public key could not be read: " + err.Error())
+	}
+
+	if len(entities) != 1 {
+		return nil, errors.New("Exactly one OpenPGP public key must be given.")
+	}
+
+	if entities[0].PrivateKey != nil {
+		return nil, errors.New("Only the public key must be given.")
+	}
+
+	return entities[0], nil
+}
+
+// Encrypt returns the ASCII armored ciphertext.
+func (k *ConsumerKey) Encrypt(plaintext []byte) ([]byte, error) {
+	switch k.Kind {
+	case KeyAge:
+		recipient, err := age.ParseX25519Recipient(k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		out := &bytes.Buffer{}
+		armored := agearmor.NewWriter(out)
+
+		writer, err := age.Encrypt(armored, recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := writer.Write(plaintext); err != nil {
+			return nil, err
+		}
+
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+		if err := armored.Close(); err != nil {
+			return nil, err
+		}
+
+		return out.Bytes(), nil
+
+	case KeyOpenPgp:
+		entity, err := readOpenPgpKey(k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		out := &bytes.Buffer{}
+
+		armored, err := armor.Encode(out, "PGP MESSAGE", nil)
+		if err != nil {
+			return nil, err
+		}
+
+		writer, err := openpgp.Encrypt(armored, []*openpgp.Entity{entity}, nil, &openpgp.FileHints{IsBinary: true}, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := writer.Write(plaintext); err != nil {
+			return nil, err
+		}
+
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+		if err := armored.Close(); err != nil {
+			return nil, err
+		}
+
+		out.WriteString("\n")
+
+		return out.Bytes(), nil
+	}
+
+	return nil, errors.New("Unknown key type '" + k.Kind + "'.")
+}
+
+func (k *ConsumerKey) Label() string {
+	if k.Kind == KeyAge {
+		return "age"
+	}
+
+	return "OpenPGP"
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Delivery
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// encryptionContext is stored in the access log for deliveries to consumers with a key.
+type encryptionContext struct {
+	Kind        string `json:"kind,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// deliveryKey decides whether a delivery to the consumer is encrypted and notes it in the
+// contexts. Consumers with a key get encrypted secrets unless they ask for plain text ("plain=1"),
+// which is refused (false) if their key is required.
+func deliveryKey(consumer *Consumer, req *http.Request, contexts map[string]interface{}, db *sqlx.Tx) (*ConsumerKey, bool) {
+	key := findConsumerKey(consumer.Id, db)
+	if key == nil {
+		return nil, true
+	}
+
+	if req.FormValue("plain") != "1" {
+		contexts["encryption"] = encryptionContext{Kind: key.Kind, Fingerprint: key.Fingerprint}
+		return key, true
+	}
+
+	if key.Required {
+		contexts["encryption"] = encryptionContext{Error: "The consumer must not receive plain text."}
+		return nil, false
+	}
+
+	return nil, true
+}
+
+// sealDelivery encrypts the delivered content, if there is a key. The key has been checked when
+// it was set, so failing now is not the consumer's fault; the error is noted in the contexts, so
+// the failed delivery can be logged as such.
+func sealDelivery(key *ConsumerKey, content []byte, contexts map[string]interface{}) ([]byte, error) {
+	if key == nil {
+		return content, nil
+	}
+
+	sealed, err := key.Encrypt(content)
+	if err != nil {
+		contexts["encryption"] = encryptionContext{Kind: key.Kind, Fingerprint: key.Fingerprint, Error: err.Error()}
+		return nil, err
+	}
+
+	return sealed, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	agearmor "filippo.io/age/armor"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func newTestOpenPgpKey(t *testing.T) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("Consumer", "", "consumer@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+
+	writer, err := armor.Encode(out, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := entity.Serialize(writer); err != nil {
+		t.Fatal(err)
+	}
+
+	writer.Close()
+
+	return entity, out.String()
+}
+
+// decryptAge decrypts an armored file with the given identity.
+func decryptAge(t *testing.T, identity age.Identity, encrypted []byte) []byte {
+	t.Helper()
+
+	reader, err := age.Decrypt(agearmor.NewReader(bytes.NewReader(encrypted)), identity)
+	if err != nil {
+		t.Fatalf("The file could not be decrypted: %v", err)
+	}
+
+	plaintext, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("The payload could not be decrypted: %v", err)
+	}
+
+	return plaintext
+}
+
+func TestConsumerKeyAge(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipient := identity.Recipient().String()
+
+	key, err := parseConsumerKey("  "+strings.ToUpper(recipient)+"\n", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key.Kind != KeyAge || key.PublicKey != recipient || key.Fingerprint != recipient || !key.Required {
+		t.Errorf("The key was not parsed correctly: %+v", key)
+	}
+
+	// around the 64 KiB chunks of the payload
+	for _, size := range []int{0, 1, 64*1024 - 1, 64 * 1024, 64*1024 + 1, 128*1024 + 7} {
+		plaintext := bytes.Repeat([]byte{'x'}, size)
+
+		encrypted, err := key.Encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.HasPrefix(encrypted, []byte("-----BEGIN AGE ENCRYPTED FILE-----\n")) {
+			t.Errorf("%d bytes: the file is not armored.", size)
+		}
+
+		if decrypted := decryptAge(t, identity, encrypted); !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%d bytes: got %d bytes back.", size, len(decrypted))
+		}
+	}
+
+	other, _ := age.GenerateX25519Identity()
+	encrypted, _ := key.Encrypt([]byte("hunter2"))
+
+	if _, err := age.Decrypt(agearmor.NewReader(bytes.NewReader(encrypted)), other); err == nil {
+		t.Error("The file could be decrypted with another identity.")
+	}
+}
+
+func TestConsumerKeyOpenPgp(t *testing.T) {
+	entity, publicKey := newTestOpenPgpKey(t)
+
+	key, err := parseConsumerKey(publicKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key.Kind != KeyOpenPgp || key.Required || len(key.Fingerprint) != 40 {
+		t.Errorf("The key was not parsed correctly: %+v", key)
+	}
+
+	sealed, err := sealDelivery(key, []byte("hunter2"), map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := armor.Decode(bytes.NewReader(sealed))
+	if err != nil || block.Type != "PGP MESSAGE" {
+		t.Fatalf("The message is not armored: %v", err)
+	}
+
+	message, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := ioutil.ReadAll(message.UnverifiedBody)
+	if err != nil || string(decrypted) != "hunter2" {
+		t.Errorf("Expected hunter2, got %q (%v).", decrypted, err)
+	}
+}
+
+func TestParseConsumerKeyRejectsInvalidKeys(t *testing.T) {
+	entity, publicKey := newTestOpenPgpKey(t)
+	_, otherKey := newTestOpenPgpKey(t)
+	identity, _ := age.GenerateX25519Identity()
+	recipient := identity.Recipient().String()
+
+	privateKey := &bytes.Buffer{}
+	writer, _ := armor.Encode(privateKey, openpgp.PrivateKeyType, nil)
+	entity.SerializePrivate(writer, nil)
+	writer.Close()
+
+	invalid := map[string]string{
+		"empty":          "",
+		"ssh key":        "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+		"age identity":   "AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX",
+		"broken age":     "age1invalid",
+		"truncated age":  recipient[:len(recipient)-1],
+		"mixed case age": "AGE1" + recipient[4:],
+		"two keys":       publicKey + "\n" + otherKey,
+		"private key":    privateKey.String(),
+		"broken armor":   "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nnope\n-----END PGP PUBLIC KEY BLOCK-----",
+	}
+
+	for name, publicKey := range invalid {
+		if _, err := parseConsumerKey(publicKey, false); err == nil {
+			t.Errorf("%s: the key was accepted.", name)
+		}
+	}
+}
+
+func TestConsumerKeyRoundTrip(t *testing.T) {
+	tx := newTestTx(t)
+
+	user := createTestUser(t, "admin", tx)
+	consumer := createTestConsumer(t, "web", user, tx)
+
+	identity, _ := age.GenerateX25519Identity()
+	key, _ := parseConsumerKey(identity.Recipient().String(), true)
+
+	if err := setConsumerKey(consumer.Id, key, tx); err != nil {
+		t.Fatal(err)
+	}
+
+	found := findConsumerKey(consumer.Id, tx)
+	if found == nil || found.PublicKey != key.PublicKey || !found.Required || found.ConsumerId != consumer.Id {
+		t.Fatalf("The key was not stored: %+v", found)
+	}
+
+	if err := setConsumerKey(consumer.Id, nil, tx); err != nil {
+		t.Fatal(err)
+	}
+
+	if findConsumerKey(consumer.Id, tx) != nil {
+		t.Error("The key was not removed.")
+	}
+}
@@ -11,12 +11,14 @@ import (
 type dashboardData struct {
 	layoutData
 
-	Secrets    int
-	Consumers  int
-	Users      int
-	RecentHits int
-	AuditLog   []AuditLogEntry
-	AccessLog  []AccessLogEntry
+	Secrets      int
+	Consumers    int
+	Users        int
+	RecentHits   int
+	Alerts       []Alert
+	Certificates []SecretCertificate
+	AuditLog     []AuditLogEntry
+	AccessLog    []AccessLogEntry
 }
 
 func dashboardAction(user *User, req *http.Request, session *Session, db *sqlx.Tx) response {
@@ -39,13 +41,15 @@ func dashboardAction(user *User, req *http.Request, session *Session, db *sqlx.T
 	accessLog := NewAccessLog(db)
 
 	data := &dashboardData{
-		layoutData: NewLayoutData("Dashboard", "dashboard", user, session.CsrfToken),
-		Secrets:    secrets.Count,
-		Consumers:  consumers.Count,
-		Users:      users.Count,
-		RecentHits: recentHits.Count,
-		AuditLog:   auditLog.FindAll(10, 0),
-		AccessLog:  accessLog.FindAll(10, 0),
+		layoutData:   NewLayoutData("Dashboard", "dashboard", user, session.CsrfToken),
+		Secrets:      secrets.Count,
+		Consumers:    consumers.Count,
+		Users:        users.Count,
+		RecentHits:   recentHits.Count,
+		Alerts:       findOpenAlerts(limit, 10, db),
+		Certificates: findExpiringCertificates(30, 10, db),
+		AuditLog:     auditLog.FindAll(10, 0),
+		AccessLog:    accessLog.FindAll(10, 0),
 	}
 
 	return renderTemplate(200, "dashboard/index", data)
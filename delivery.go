@@ -1,16 +1,18 @@
 package main
 
 import (
-	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
+	"strings"
 
 	"github.com/go-martini/martini"
 	"github.com/jmoiron/sqlx"
 )
 
-func deliverSecretAction(params martini.Params, req *http.Request, db *sqlx.Tx) response {
-	accessLog := NewAccessLog(db)
-
+// checkDelivery resolves the consumer and secret of a delivery request and checks the consumer's
+// restrictions. Nothing is logged yet, as the caller might still reject the request.
+func checkDelivery(params martini.Params, req *http.Request, db *sqlx.Tx) (*Consumer, *Secret, map[string]interface{}, bool) {
 	// try to resolve the consumer
 	consumerId := DecodeConsumerIdentifier(params["consumer"])
 	consumer := findConsumer(consumerId, db)
@@ -20,11 +22,16 @@ func deliverSecretAction(params martini.Params, req *http.Request, db *sqlx.Tx)
 
 	// stop if either of the two is not found
 	if consumer == nil || secret == nil {
-		accessLog.LogNotFound(consumer, secret, req)
-
-		return newResponse(404, "Not Found.")
+		return consumer, secret, nil, false
 	}
 
+	contexts, accessGranted := checkConsumer(consumer, req)
+
+	return consumer, secret, contexts, accessGranted
+}
+
+// checkConsumer checks whether the consumer is enabled and passes all of its restrictions.
+func checkConsumer(consumer *Consumer, req *http.Request) (map[string]interface{}, bool) {
 	accessGranted := consumer.Enabled && !consumer.Deleted
 
 	// check all restrictions
@@ -41,7 +48,9 @@ func deliverSecretAction(params martini.Params, req *http.Request, db *sqlx.Tx)
 		okay, rContext := restriction.Check(req)
 		restrictionsOkay = restrictionsOkay && okay
 
-		fmt.Printf("rc = %+v\n", rContext)
+		if !okay {
+			metricRestrictionDenials.WithLabelValues(rType).Inc()
+		}
 
 		// remember the context if there was one
 		if rContext != nil {
@@ -49,31 +58,99 @@ func deliverSecretAction(params martini.Params, req *http.Request, db *sqlx.Tx)
 		}
 	}
 
-	accessGranted = accessGranted && restrictionsOkay
+	return contexts, accessGranted && restrictionsOkay
+}
 
-	status := 200
+func deliverSecretAction(params martini.Params, req *http.Request, res http.ResponseWriter, db *sqlx.Tx) response {
+	accessLog := NewAccessLog(db)
+	consumer, secret, contexts, accessGranted := checkDelivery(params, req, db)
 
-	if !accessGranted {
-		status = 403
+	// stop if either of the two is not found
+	if consumer == nil || secret == nil {
+		accessLog.LogNotFound(consumer, secret, req)
+		countDelivery(404, consumer, secret)
+
+		return newResponse(404, "Not Found.")
 	}
 
-	// log the access [attempt]
-	accessLog.LogAccess(consumer, secret, req, status, contexts)
+	// consumers with a key only get what they can decrypt
+	key, allowed := deliveryKey(consumer, req, contexts, db)
+	accessGranted = accessGranted && allowed
+
+	if dc := findDynamicCredential(secret.Id, db); dc != nil {
+		return deliverDynamicCredential(consumer, secret, dc, key, contexts, accessGranted, req, db)
+	}
 
 	// no access => go away
 	if !accessGranted {
+		accessLog.LogAccess(consumer, secret, req, 403, contexts)
+		countDelivery(403, consumer, secret)
+
 		return newResponse(403, "Nope.")
 	}
 
 	// finally load the secret with its body
 	secret = findSecret(secret.Id, true, db)
 
-	decrypted, err := Decrypt(secret.Secret)
+	// consumers that already have the current version are not sent it again; the access is
+	// still logged, as the consumer learned that the secret has not changed
+	etag := deliveryETag(secret, key)
+	res.Header().Set("ETag", etag)
+
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		accessLog.LogAccess(consumer, secret, req, 304, contexts)
+		countDelivery(304, consumer, secret)
+
+		return newResponse(304, "")
+	}
+
+	// prepare everything before logging, so that a failure is not logged as a delivery
+	body, err := Decrypt(secret.Secret)
+	if err == nil {
+		// consumers only get the certificate or public key of a certificate authority
+		if ca := findCertificateAuthority(secret.Id, db); ca != nil {
+			body = ca.PublicPart(body)
+		}
+
+		body, err = sealDelivery(key, body, contexts)
+	}
+
 	if err != nil {
+		accessLog.LogAccess(consumer, secret, req, 500, contexts)
+		countDelivery(500, consumer, secret)
+
 		return newResponse(500, "Nope.")
 	}
 
-	return newResponse(200, string(decrypted))
+	accessLog.LogAccess(consumer, secret, req, 200, contexts)
+	countDelivery(200, consumer, secret)
+
+	return newResponse(200, string(body))
+}
+
+// deliveryETag identifies what a consumer gets for a secret without revealing anything about it:
+// the body is only known in its encrypted form, which changes with every update.
+func deliveryETag(secret *Secret, key *ConsumerKey) string {
+	hash := sha256.New()
+	hash.Write(secret.Secret)
+
+	if key != nil {
+		hash.Write([]byte(key.Kind + ":" + key.Fingerprint))
+	}
+
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+
+	return false
 }
 
 func setupDeliveryCtrl(app *martini.ClassicMartini) {
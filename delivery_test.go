@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+func TestEtagMatches(t *testing.T) {
+	etag := `"abc"`
+
+	testcases := map[string]bool{
+		``:                false,
+		`"abc"`:           true,
+		`W/"abc"`:         true,
+		`*`:               true,
+		`"xyz", "abc"`:    true,
+		` "xyz" ,W/"abc"`: true,
+		`abc`:             false,
+		`"ab"`:            false,
+		`"abc`:            false,
+		`"xyz"`:           false,
+		`"xyz", W/"ab"`:   false,
+	}
+
+	for header, matches := range testcases {
+		if etagMatches(header, etag) != matches {
+			t.Errorf("Expected etagMatches(%q) to be %v.", header, matches)
+		}
+	}
+}
+
+func TestDeliverSecretNotModified(t *testing.T) {
+	tx := newTestTx(t)
+
+	user := createTestUser(t, "admin", tx)
+	consumer := createTestConsumer(t, "web", user, tx)
+	createTestSecret(t, "password", "hunter2", user, tx, consumer)
+
+	params := martini.Params{"consumer": consumer.GetIdentifier(), "secret": "password"}
+
+	deliver := func(etag string) (response, string) {
+		req := newTestRequest("GET", "/get/"+params["consumer"]+"/password")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		res := httptest.NewRecorder()
+		resp := deliverSecretAction(params, req, res, tx)
+
+		return resp, res.Header().Get("ETag")
+	}
+
+	resp, etag := deliver("")
+	if resp.Status != 200 || resp.Content != "hunter2" || etag == "" {
+		t.Fatalf("The secret was not delivered: %+v (ETag %q)", resp, etag)
+	}
+
+	resp, _ = deliver(etag)
+	if resp.Status != 304 || resp.Content != "" {
+		t.Errorf("Expected 304 without a body, got %+v.", resp)
+	}
+
+	resp, _ = deliver(`"outdated"`)
+	if resp.Status != 200 {
+		t.Errorf("An outdated ETag was answered with %d.", resp.Status)
+	}
+
+	entries := NewAccessLog(tx).Find([]int{}, []int{consumer.Id}, []int{}, 10, 0)
+	if len(entries) != 3 || entries[1].Status != 304 {
+		t.Errorf("Expected the 304 to be logged between the deliveries: %+v", entries)
+	}
+}
+
+func TestDeliverSecretFailures(t *testing.T) {
+	tx := newTestTx(t)
+
+	user := createTestUser(t, "admin", tx)
+	consumer := createTestConsumer(t, "web", user, tx)
+	secret := createTestSecret(t, "password", "hunter2", user, tx, consumer)
+
+	deliver := func() response {
+		params := martini.Params{"consumer": consumer.GetIdentifier(), "secret": "password"}
+		req := newTestRequest("GET", "/get/"+params["consumer"]+"/password")
+
+		return deliverSecretAction(params, req, httptest.NewRecorder(), tx)
+	}
+
+	lastStatus := func() int {
+		entries := NewAccessLog(tx).Find([]int{}, []int{consumer.Id}, []int{}, 1, 0)
+		if len(entries) == 0 {
+			return 0
+		}
+
+		return entries[0].Status
+	}
+
+	// a key that cannot be used anymore
+	broken := &ConsumerKey{Kind: KeyAge, PublicKey: "age1broken", Fingerprint: "age1broken"}
+	if err := setConsumerKey(consumer.Id, broken, tx); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := deliver(); resp.Status != 500 || strings.Contains(resp.Content, "hunter2") {
+		t.Errorf("Expected 500 for an unusable key, got %+v.", resp)
+	}
+
+	if status := lastStatus(); status != 500 {
+		t.Errorf("The failed encryption was logged as %d.", status)
+	}
+
+	setConsumerKey(consumer.Id, nil, tx)
+
+	// a body that cannot be decrypted
+	if _, err := tx.Exec("UPDATE `secret` SET `secret` = ? WHERE `id` = ?", []byte("garbage"), secret.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := deliver(); resp.Status != 500 {
+		t.Errorf("Expected 500 for a broken body, got %+v.", resp)
+	}
+
+	if status := lastStatus(); status != 500 {
+		t.Errorf("The failed decryption was logged as %d.", status)
+	}
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// the characters of the generated database passwords; no quotes, so they can be put into the
+// statements as they are
+const leasePasswordCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Dynamic credential model
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// DynamicCredential turns a secret, whose body is the DSN of an administrative connection to a
+// MySQL or PostgreSQL server, into a source of short-lived database users: every delivery creates
+// a new user with the Creation statements and leases it for Ttl, after which the Revocation
+// statements drop it again.
+type DynamicCredential struct {
+	SecretId   int    `db:"secret_id"`
+	Ttl        string `db:"ttl"`
+	Creation   string `db:"creation"`
+	Revocation string `db:"revocation"`
+
+	_db *sqlx.Tx
+}
+
+func findDynamicCredential(secretId int, db *sqlx.Tx) *DynamicCredential {
+	dc := &DynamicCredential{}
+	dc._db = db
+
+	db.Get(dc, "SELECT `secret_id`, `ttl`, `creation`, `revocation` FROM `dynamic_credential` WHERE `secret_id` = ?", secretId)
+	if dc.SecretId == 0 {
+		return nil
+	}
+
+	return dc
+}
+
+func (s *Secret) GetDynamicCredential() *DynamicCredential {
+	return findDynamicCredential(s.Id, s._db)
+}
+
+// setDynamicCredential stores the lease policy; nil turns the secret back into a regular one.
+func (s *Secret) setDynamicCredential(dc *DynamicCredential) error {
+	_, err := s._db.Exec("DELETE FROM `dynamic_credential` WHERE `secret_id` = ?", s.Id)
+	if err != nil || dc == nil {
+		return err
+	}
+
+	dc.SecretId = s.Id
+	dc._db = s._db
+
+	_, err = s._db.Exec("INSERT INTO `dynamic_credential` (`secret_id`, `ttl`, `creation`, `revocation`) VALUES (?,?,?,?)", dc.SecretId, dc.Ttl, dc.Creation, dc.Revocation)
+
+	return err
+}
+
+// newDynamicCredential validates a policy as entered by a user.
+func newDynamicCredential(ttl string, creation string, revocation string) (*DynamicCredential, error) {
+	duration, err := time.ParseDuration(strings.TrimSpace(ttl))
+	if err != nil || duration < time.Minute {
+		return nil, errors.New("The TTL must be a duration like 1h or 30m, at least one minute.")
+	}
+
+	creation = strings.TrimSpace(creation)
+	revocation = strings.TrimSpace(revocation)
+
+	if !strings.Contains(creation, "{{name}}") || !strings.Contains(creation, "{{password}}") {
+		return nil, errors.New("The creation statements must contain {{name}} and {{password}}.")
+	}
+
+	if !strings.Contains(revocation, "{{name}}") {
+		return nil, errors.New("The revocation statements must contain {{name}}.")
+	}
+
+	return &DynamicCredential{
+		Ttl:        duration.String(),
+		Creation:   creation,
+		Revocation: revocation,
+	}, nil
+}
+
+func (dc *DynamicCredential) MaxTtl() time.Duration {
+	ttl, err := time.ParseDuration(dc.Ttl)
+	if err != nil {
+		return 0
+	}
+
+	return ttl
+}
+
+// renderStatements fills in the placeholders and splits the statements at semicolons.
+func renderStatements(statements string, name string, password string, expiration time.Time) []string {
+	replacer := strings.NewReplacer(
+		"{{name}}", name,
+		"{{password}}", password,
+		"{{expiration}}", expiration.UTC().Format("2006-01-02 15:04:05Z"),
+	)
+
+	result := []string{}
+
+	for _, statement := range strings.Split(replacer.Replace(statements), ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			result = append(result, statement)
+		}
+	}
+
+	return result
+}
+
+// openTargetDatabase connects to the server a dynamic secret's body points to. Unlike Raziel's
+// own database, the statements are sent as they are.
+func openTargetDatabase(body []byte) (*sql.DB, error) {
+	dsn := strings.TrimSpace(string(body))
+
+	switch {
+	case strings.HasPrefix(dsn, "mysql://"):
+		return sql.Open("mysql", strings.TrimPrefix(dsn, "mysql://"))
+
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return sql.Open("postgres", dsn)
+	}
+
+	return nil, errors.New("The body must be a mysql:// or postgres:// URL of an administrative connection.")
+}
+
+// checkTargetDatabase makes sure a dynamic secret's body is a usable DSN. The server is not
+// contacted, as it might not be reachable yet.
+func checkTargetDatabase(body []byte) error {
+	target, err := openTargetDatabase(body)
+	if err != nil {
+		return err
+	}
+
+	return target.Close()
+}
+
+// execStatements runs the statements one by one; MySQL commits most of them implicitly anyway.
+func execStatements(target *sql.DB, statements []string) error {
+	for _, statement := range statements {
+		if _, err := target.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Create adds a new user to the target server and leases it to the consumer. The password is
+// returned once and never stored. The lease is inserted before the user is created, so that a user
+// whose creation failed halfway and could not be dropped right away is reaped once the lease
+// expires. Like everything else, the lease is only persisted when the request's transaction is
+// committed; if it is rolled back instead, pendingLeases drops the user. If the process dies before
+// either happens, nothing remembers the user, which is why the creation statements should let it
+// expire on the server as well (e.g. VALID UNTIL '{{expiration}}').
+func (dc *DynamicCredential) Create(secret *Secret, consumer *Consumer) (*Lease, string, error) {
+	body, err := Decrypt(secret.Secret)
+	if err != nil {
+		return nil, "", err
+	}
+
+	target, err := openTargetDatabase(body)
+	if err != nil {
+		return nil, "", err
+	}
+	defer target.Close()
+
+	suffix := make([]byte, 4)
+
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	password, err := randomPassword(32, leasePasswordCharset)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(dc.MaxTtl())
+	name := fmt.Sprintf("raziel_%d_%s", consumer.Id, hex.EncodeToString(suffix))
+
+	lease := &Lease{
+		SecretId:   secret.Id,
+		ConsumerId: &consumer.Id,
+		Username:   name,
+		CreatedAt:  now.Format("2006-01-02 15:04:05"),
+		ExpiresAt:  expiresAt.Format("2006-01-02 15:04:05"),
+		_db:        dc._db,
+	}
+
+	result, err := dc._db.Exec(
+		"INSERT INTO `lease` (`secret_id`, `consumer_id`, `username`, `created_at`, `expires_at`, `revoked_at`, `revoked_by`, `last_error`) VALUES (?,?,?,?,?,NULL,NULL,NULL)",
+		lease.SecretId, lease.ConsumerId, lease.Username, lease.CreatedAt, lease.ExpiresAt,
+	)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, "", err
+	}
+
+	lease.Id = int(id)
+
+	err = execStatements(target, renderStatements(dc.Creation, name, string(password), expiresAt))
+	if err != nil {
+		// do not leave a half-created user behind; if it cannot be dropped now, the lease stays
+		// with the error and the reaper tries again
+		if dc.Revoke(secret, lease, nil) == nil {
+			dc._db.Exec("DELETE FROM `lease` WHERE `id` = ?", lease.Id)
+		}
+
+		return nil, "", err
+	}
+
+	pendingLeases.add(dc._db, func() error {
+		return dc.dropUser(body, name)
+	})
+
+	return lease, string(password), nil
+}
+
+// dropUser runs the revocation statements for a user on the target server.
+func (dc *DynamicCredential) dropUser(body []byte, username string) error {
+	target, err := openTargetDatabase(body)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	return execStatements(target, renderStatements(dc.Revocation, username, "", time.Now()))
+}
+
+// userMissing tells whether the revocation statements failed because the user does not exist.
+func userMissing(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1396 // ER_CANNOT_USER
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "42704" // undefined_object
+	}
+
+	return false
+}
+
+// Revoke drops the lease's user from the target server. userId is nil when the reaper drops an
+// expired user. Failures are recorded on the lease, so they show up in the UI.
+func (dc *DynamicCredential) Revoke(secret *Secret, lease *Lease, userId *int) error {
+	body, err := Decrypt(secret.Secret)
+	if err != nil {
+		return err
+	}
+
+	// a user that has already been dropped (e.g. by hand) does not need to be dropped again
+	err = dc.dropUser(body, lease.Username)
+	if err != nil && !userMissing(err) {
+		message := err.Error()
+		lease.LastError = &message
+
+		_, dbErr := lease._db.Exec("UPDATE `lease` SET `last_error` = ? WHERE `id` = ?", message, lease.Id)
+		if dbErr != nil {
+			return dbErr
+		}
+
+		return err
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+
+	_, err = lease._db.Exec("UPDATE `lease` SET `revoked_at` = ?, `revoked_by` = ?, `last_error` = NULL WHERE `id` = ?", now, userId, lease.Id)
+	if err != nil {
+		return err
+	}
+
+	lease.RevokedAt = &now
+	lease.RevokedBy = userId
+	lease.LastError = nil
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Leases
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type Lease struct {
+	Id         int     `db:"id"`
+	SecretId   int     `db:"secret_id"`
+	ConsumerId *int    `db:"consumer_id"`
+	Username   string  `db:"username"`
+	CreatedAt  string  `db:"created_at"`
+	ExpiresAt  string  `db:"expires_at"`
+	RevokedAt  *string `db:"revoked_at"`
+	RevokedBy  *int    `db:"revoked_by"`
+	LastError  *string `db:"last_error"`
+
+	_db *sqlx.Tx
+}
+
+const leaseColumns = "`id`, `secret_id`, `consumer_id`, `username`, `created_at`, `expires_at`, `revoked_at`, `revoked_by`, `last_error`"
+
+func findLeases(secretId int, limit int, db *sqlx.Tx) []Lease {
+	list := make([]Lease, 0)
+
+	db.Select(&list, "SELECT "+leaseColumns+" FROM `lease` WHERE `secret_id` = ? ORDER BY `id` DESC LIMIT ?", secretId, limit)
+
+	for i := range list {
+		list[i]._db = db
+	}
+
+	return list
+}
+
+func findActiveLeases(secretId int, db *sqlx.Tx) []Lease {
+	list := make([]Lease, 0)
+
+	db.Select(&list, "SELECT "+leaseColumns+" FROM `lease` WHERE `secret_id` = ? AND `revoked_at` IS NULL ORDER BY `id`", secretId)
+
+	for i := range list {
+		list[i]._db = db
+	}
+
+	return list
+}
+
+// findExpiredLeases returns the leases whose users still have to be dropped.
+func findExpiredLeases(db *sqlx.Tx) []Lease {
+	list := make([]Lease, 0)
+
+	db.Select(&list, "SELECT "+leaseColumns+" FROM `lease` WHERE `revoked_at` IS NULL AND `expires_at` <= NOW() ORDER BY `id`")
+
+	for i := range list {
+		list[i]._db = db
+	}
+
+	return list
+}
+
+func findLease(id int, db *sqlx.Tx) *Lease {
+	lease := &Lease{}
+	lease._db = db
+
+	db.Get(lease, "SELECT "+leaseColumns+" FROM `lease` WHERE `id` = ?", id)
+	if lease.Id == 0 {
+		return nil
+	}
+
+	return lease
+}
+
+func (l *Lease) GetConsumer() *Consumer {
+	if l.ConsumerId == nil {
+		return nil
+	}
+
+	return findConsumer(*l.ConsumerId, l._db)
+}
+
+func (l *Lease) GetRevoker() *User {
+	if l.RevokedBy == nil {
+		return nil
+	}
+
+	return findUser(*l.RevokedBy, false, l._db)
+}
+
+// leaseContext is stored in the access log for every delivery of a dynamic secret.
+type leaseContext struct {
+	Id        int    `json:"id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// leaseResponse is what the consumer gets.
+type leaseResponse struct {
+	Lease     int    `json:"lease"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Uncommitted leases
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// pendingLeases remembers the users created by transactions that have not been committed yet. If
+// such a transaction is rolled back, its leases are gone and nothing would ever drop the users.
+var pendingLeases = &leaseTracker{drops: make(map[*sqlx.Tx][]func() error)}
+
+type leaseTracker struct {
+	drops map[*sqlx.Tx][]func() error
+	lock  sync.Mutex
+}
+
+func (t *leaseTracker) add(tx *sqlx.Tx, drop func() error) {
+	t.lock.Lock()
+	t.drops[tx] = append(t.drops[tx], drop)
+	t.lock.Unlock()
+}
+
+func (t *leaseTracker) take(tx *sqlx.Tx) []func() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	drops := t.drops[tx]
+	delete(t.drops, tx)
+
+	return drops
+}
+
+// Committed forgets the users of a committed transaction, as their leases take care of them now.
+func (t *leaseTracker) Committed(tx *sqlx.Tx) {
+	t.take(tx)
+}
+
+// RolledBack drops the users that were created by a rolled back transaction.
+func (t *leaseTracker) RolledBack(tx *sqlx.Tx) {
+	for _, drop := range t.take(tx) {
+		if err := drop(); err != nil {
+			log.Println("Warning: Could not drop the database user of a rolled back lease: " + err.Error())
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Reaper
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// LeaseReaper drops the users of expired leases.
+type LeaseReaper struct {
+	interval time.Duration
+}
+
+func NewLeaseReaper(c *configuration) (*LeaseReaper, error) {
+	r := &LeaseReaper{
+		interval: 1 * time.Minute,
+	}
+
+	if c.Leases.ReapInterval != "" {
+		interval, err := time.ParseDuration(c.Leases.ReapInterval)
+		if err != nil {
+			return nil, errors.New("Invalid lease reap interval configured: " + err.Error())
+		}
+
+		r.interval = interval
+	}
+
+	return r, nil
+}
+
+func (r *LeaseReaper) Run(database *sqlx.DB) {
+	for {
+		dropped, err := r.Reap(database)
+		if err != nil {
+			log.Println("Warning: Dropping expired database users failed: " + err.Error())
+		} else if dropped > 0 {
+			log.Printf("Dropped %d expired database user(s).", dropped)
+		}
+
+		<-time.After(r.interval)
+	}
+}
+
+// Reap drops the users of all expired leases and returns how many were dropped. Every lease is
+// revoked in its own transaction, so one slow or unreachable server neither holds the others back
+// nor takes their revocations down with it. Leases that cannot be dropped are tried again next
+// time.
+func (r *LeaseReaper) Reap(database *sqlx.DB) (int, error) {
+	tx, err := database.Beginx()
+	if err != nil {
+		return 0, err
+	}
+
+	expired := findExpiredLeases(tx)
+	tx.Rollback()
+
+	dropped := 0
+
+	for _, lease := range expired {
+		revoked, err := r.reapLease(lease.Id, database)
+		if err != nil {
+			return dropped, err
+		}
+
+		if revoked {
+			dropped++
+		}
+	}
+
+	return dropped, nil
+}
+
+// reapLease revokes a single expired lease. If its secret is gone or no longer a dynamic
+// credential, there is nothing left to drop the user with; the lease is marked as revoked anyway,
+// with an error that tells the user to drop it by hand.
+func (r *LeaseReaper) reapLease(leaseId int, database *sqlx.DB) (bool, error) {
+	tx, err := database.Beginx()
+	if err != nil {
+		return false, err
+	}
+
+	// the lease could have been revoked by hand in the meantime
+	lease := findLease(leaseId, tx)
+	if lease == nil || lease.RevokedAt != nil {
+		tx.Rollback()
+		return false, nil
+	}
+
+	secret := findSecret(lease.SecretId, true, tx)
+	dc := findDynamicCredential(lease.SecretId, tx)
+
+	if secret == nil || dc == nil {
+		message := "The secret is no longer a dynamic credential, the user has to be dropped manually."
+		now := time.Now().Format("2006-01-02 15:04:05")
+
+		_, err = tx.Exec("UPDATE `lease` SET `revoked_at` = ?, `last_error` = ? WHERE `id` = ?", now, message, lease.Id)
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+
+		log.Printf("Warning: Could not drop the database user %s: %s", lease.Username, message)
+
+		return false, tx.Commit()
+	}
+
+	// the error is recorded on the lease
+	err = dc.Revoke(secret, lease, nil)
+	if err != nil {
+		log.Printf("Warning: Could not drop the database user %s: %s", lease.Username, err)
+	}
+
+	return err == nil, tx.Commit()
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// HTTP Handlers
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// deliverDynamicCredential is the part of deliverSecretAction for dynamic secrets: instead of the
+// body, every authorized delivery gets a new database user.
+func deliverDynamicCredential(consumer *Consumer, secret *Secret, dc *DynamicCredential, key *ConsumerKey, contexts map[string]interface{}, accessGranted bool, req *http.Request, db *sqlx.Tx) response {
+	accessLog := NewAccessLog(db)
+
+	// like issuing certificates, this requires the secret to be assigned to the consumer
+	if !accessGranted || !consumer.HasSecret(secret.Id) {
+		accessLog.LogAccess(consumer, secret, req, 403, contexts)
+		countDelivery(403, consumer, secret)
+
+		return newResponse(403, "Nope.")
+	}
+
+	lease, password, err := dc.Create(findSecret(secret.Id, true, db), consumer)
+	if err != nil {
+		contexts["lease"] = leaseContext{Error: err.Error()}
+		accessLog.LogAccess(consumer, secret, req, 502, contexts)
+		countDelivery(502, consumer, secret)
+
+		return newResponse(502, "Could not create the database user.")
+	}
+
+	contexts["lease"] = leaseContext{
+		Id:        lease.Id,
+		Username:  lease.Username,
+		ExpiresAt: lease.ExpiresAt,
+	}
+
+	encoded, err := json.Marshal(leaseResponse{lease.Id, lease.Username, password, lease.ExpiresAt})
+	if err != nil {
+		panic(err)
+	}
+
+	// the user is dropped again by the reaper once the lease expires
+	sealed, err := sealDelivery(key, encoded, contexts)
+	if err != nil {
+		accessLog.LogAccess(consumer, secret, req, 500, contexts)
+		countDelivery(500, consumer, secret)
+
+		return newResponse(500, "Nope.")
+	}
+
+	accessLog.LogAccess(consumer, secret, req, 200, contexts)
+	countDelivery(200, consumer, secret)
+
+	if key != nil {
+		return newResponse(200, string(sealed))
+	}
+
+	return response{200, string(encoded), "application/json"}
+}
+
+func secretsRevokeLeaseAction(params martini.Params, req *http.Request, user *User, db *sqlx.Tx) response {
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return renderError(400, "Invalid ID given.")
+	}
+
+	leaseId, err := strconv.Atoi(params["lease"])
+	if err != nil {
+		return renderError(400, "Invalid lease ID given.")
+	}
+
+	lease := findLease(leaseId, db)
+	if lease == nil || lease.SecretId != id {
+		return renderError(404, "Lease could not be found.")
+	}
+
+	secret := findSecret(id, true, db)
+	dc := secret.GetDynamicCredential()
+
+	if lease.RevokedAt == nil && dc != nil {
+		err = dc.Revoke(secret, lease, &user.Id)
+		if err != nil {
+			return renderError(502, "Could not drop the database user: "+err.Error())
+		}
+
+		consumerId := -1
+		if lease.ConsumerId != nil {
+			consumerId = *lease.ConsumerId
+		}
+
+		auditLog := NewAuditLog(db, req)
+		auditLog.LogLeaseRevoked(lease.SecretId, consumerId, user.Id, lease.Username)
+	}
+
+	return redirect(302, "/secrets/"+strconv.Itoa(id))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+func TestDynamicCredentialCreateRecordsFailedCleanup(t *testing.T) {
+	tx := newTestTx(t)
+
+	user := createTestUser(t, "admin", tx)
+	consumer := createTestConsumer(t, "web", user, tx)
+
+	// nothing listens on port 1, so neither creating nor dropping the user works
+	secret := createTestSecret(t, "db", "postgres://raziel@127.0.0.1:1/postgres?sslmode=disable", user, tx, consumer)
+
+	dc, err := newDynamicCredential("1h", "CREATE USER {{name}} PASSWORD '{{password}}'", "DROP USER {{name}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := secret.setDynamicCredential(dc); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := dc.Create(secret, consumer); err == nil {
+		t.Fatal("Creating a user on an unreachable server succeeded.")
+	}
+
+	leases := findActiveLeases(secret.Id, tx)
+	if len(leases) != 1 || leases[0].LastError == nil {
+		t.Fatalf("The lease of the possibly half-created user was not kept for the reaper: %+v", leases)
+	}
+
+	if len(pendingLeases.take(tx)) != 0 {
+		t.Error("A user that has not been created would be dropped on rollback.")
+	}
+}
+
+func TestLeaseTracker(t *testing.T) {
+	tracker := &leaseTracker{drops: make(map[*sqlx.Tx][]func() error)}
+	committed, rolledBack := &sqlx.Tx{}, &sqlx.Tx{}
+	dropped := []string{}
+
+	drop := func(name string) func() error {
+		return func() error {
+			dropped = append(dropped, name)
+			return errors.New("The server is gone.")
+		}
+	}
+
+	tracker.add(committed, drop("a"))
+	tracker.add(rolledBack, drop("b"))
+	tracker.add(rolledBack, drop("c"))
+
+	tracker.Committed(committed)
+	tracker.RolledBack(rolledBack)
+	tracker.RolledBack(rolledBack)
+
+	if len(dropped) != 2 || dropped[0] != "b" || dropped[1] != "c" {
+		t.Errorf("Expected the users of the rolled back transaction to be dropped once, got %v.", dropped)
+	}
+
+	if len(tracker.drops) != 0 {
+		t.Error("The tracker did not forget the finished transactions.")
+	}
+}
+
+// insertExpiredLease records a lease that should have been dropped an hour ago.
+func insertExpiredLease(t *testing.T, secret *Secret, consumer *Consumer, username string, tx *sqlx.Tx) int {
+	t.Helper()
+
+	result, err := tx.Exec(
+		"INSERT INTO `lease` (`secret_id`, `consumer_id`, `username`, `created_at`, `expires_at`) VALUES (?,?,?,?,?)",
+		secret.Id, consumer.Id, username, "2020-01-01 00:00:00", "2020-01-01 01:00:00",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := result.LastInsertId()
+
+	return int(id)
+}
+
+func TestLeaseReaper(t *testing.T) {
+	db := newTestDatabase(t)
+
+	tx, _ := db.Beginx()
+	user := createTestUser(t, "admin", tx)
+	consumer := createTestConsumer(t, "web", user, tx)
+
+	// nothing listens on port 1, so the user cannot be dropped
+	unreachable := createTestSecret(t, "db", "postgres://raziel@127.0.0.1:1/postgres?sslmode=disable", user, tx, consumer)
+	orphaned := createTestSecret(t, "regular", "postgres://raziel@127.0.0.1:1/postgres?sslmode=disable", user, tx, consumer)
+
+	dc, _ := newDynamicCredential("1h", "CREATE USER {{name}} PASSWORD '{{password}}'", "DROP USER {{name}}")
+	if err := unreachable.setDynamicCredential(dc); err != nil {
+		t.Fatal(err)
+	}
+
+	failing := insertExpiredLease(t, unreachable, consumer, "raziel_1_failing", tx)
+	orphan := insertExpiredLease(t, orphaned, consumer, "raziel_1_orphan", tx)
+	tx.Commit()
+
+	dropped, err := (&LeaseReaper{}).Reap(db)
+	if err != nil || dropped != 0 {
+		t.Fatalf("Expected nothing to be dropped, got %d (%v).", dropped, err)
+	}
+
+	tx, _ = db.Beginx()
+	defer tx.Rollback()
+
+	// the failure is kept, even though the lease was handled in a transaction of its own
+	lease := findLease(failing, tx)
+	if lease.RevokedAt != nil || lease.LastError == nil {
+		t.Errorf("The failed revocation was not recorded: %+v", lease)
+	}
+
+	lease = findLease(orphan, tx)
+	if lease.RevokedAt == nil || lease.LastError == nil {
+		t.Errorf("The orphaned lease was not given up on: %+v", lease)
+	}
+
+	if expired := findExpiredLeases(tx); len(expired) != 1 || expired[0].Id != failing {
+		t.Errorf("Expected only the failed lease to be tried again, got %+v.", expired)
+	}
+}
+
+func TestUserMissing(t *testing.T) {
+	testcases := map[error]bool{
+		&mysql.MySQLError{Number: 1396, Message: "Operation DROP USER failed"}: true,
+		&pq.Error{Code: "42704", Message: `role "raziel_1" does not exist`}:    true,
+		fmt.Errorf("Revoking failed: %w", &pq.Error{Code: "42704"}):            true,
+		&mysql.MySQLError{Number: 1045, Message: "Access denied"}:              false,
+		&pq.Error{Code: "28P01", Message: "password authentication failed"}:    false,
+		errors.New("connection refused"):                                       false,
+	}
+
+	for err, missing := range testcases {
+		if userMissing(err) != missing {
+			t.Errorf("Expected userMissing(%v) to be %v.", err, missing)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/go-martini/martini"
+)
+
+// The templates and the assets compiled by Grunt are part of the binary, so Raziel does not depend
+// on its working directory. www/ only contains a placeholder until `grunt` has been run.
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+//go:embed all:www
+var embeddedAssets embed.FS
+
+//go:embed resources/schema.sql resources/schema.postgres.sql resources/schema.sqlite.sql
+var embeddedSchemas embed.FS
+
+// resourceFS returns the named resource directory ("templates" or "www"). If a resource directory
+// was given on the command line, the files are read from disk instead, so that changes during
+// development are visible without recompiling.
+func resourceFS(name string) fs.FS {
+	if *resourceDir != "" {
+		return os.DirFS(filepath.Join(*resourceDir, name))
+	}
+
+	var embedded embed.FS
+
+	switch name {
+	case "templates":
+		embedded = embeddedTemplates
+	case "www":
+		embedded = embeddedAssets
+	default:
+		panic("Unknown resource directory '" + name + "'.")
+	}
+
+	sub, err := fs.Sub(embedded, name)
+	if err != nil {
+		panic(err)
+	}
+
+	return sub
+}
+
+// staticAssets works like martini.Static, but serves files from a fs.FS. Requests for files that
+// do not exist are passed on to the next handler.
+func staticAssets(assets fs.FS) martini.Handler {
+	files := http.FS(assets)
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			return
+		}
+
+		file, err := files.Open(path.Clean("/" + req.URL.Path))
+		if err != nil {
+			return
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil || info.IsDir() {
+			return
+		}
+
+		http.ServeContent(res, req, info.Name(), info.ModTime(), file)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestResourceFS(t *testing.T) {
+	if _, err := fs.Stat(resourceFS("www"), "."); err != nil {
+		t.Errorf("The assets have not been embedded: %v", err)
+	}
+
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "templates"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "templates", "login.html"), []byte("from disk"), 0600)
+
+	previous := *resourceDir
+	*resourceDir = dir
+	defer func() { *resourceDir = previous }()
+
+	if content, err := fs.ReadFile(resourceFS("templates"), "login.html"); err != nil || string(content) != "from disk" {
+		t.Errorf("The templates were not read from disk: %q (%v)", content, err)
+	}
+
+	*resourceDir = ""
+
+	defer func() {
+		if recover() == nil {
+			t.Error("An unknown resource directory was accepted.")
+		}
+	}()
+
+	resourceFS("secrets")
+}
+
+func TestStaticAssets(t *testing.T) {
+	handler := staticAssets(fstest.MapFS{
+		"css/site.css": {Data: []byte("body {}")},
+	}).(func(http.ResponseWriter, *http.Request))
+
+	testcases := []struct {
+		method string
+		path   string
+		served bool
+	}{
+		{"GET", "/css/site.css", true},
+		{"HEAD", "/css/site.css", true},
+		{"GET", "/css/../css/site.css", true},
+		{"POST", "/css/site.css", false},
+		{"GET", "/css", false},
+		{"GET", "/css/missing.css", false},
+	}
+
+	for _, testcase := range testcases {
+		res := httptest.NewRecorder()
+		handler(res, httptest.NewRequest(testcase.method, testcase.path, nil))
+
+		if served := res.Code == 200 && res.Header().Get("Content-Type") != ""; served != testcase.served {
+			t.Errorf("%s %s: expected served=%v, got %d.", testcase.method, testcase.path, testcase.served, res.Code)
+		}
+	}
+}
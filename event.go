@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var eventBus *EventBus
+
+// Event is the representation of an audit or access log entry that is shipped to external
+// systems like a SIEM.
+type Event struct {
+	Time      time.Time       `json:"time"`
+	Type      string          `json:"type"`
+	Action    string          `json:"action,omitempty"`
+	Status    int             `json:"status,omitempty"`
+	Secret    *int            `json:"secret,omitempty"`
+	Consumer  *int            `json:"consumer,omitempty"`
+	User      *int            `json:"user,omitempty"`
+	CreatedBy *int            `json:"createdBy,omitempty"`
+	OriginIp  string          `json:"originIp,omitempty"`
+	UserAgent *string         `json:"userAgent,omitempty"`
+	Context   json.RawMessage `json:"context,omitempty"`
+	Message   string          `json:"message,omitempty"`
+	Hash      string          `json:"hash,omitempty"`
+}
+
+const (
+	EventTypeAudit  = "audit"
+	EventTypeAccess = "access"
+	EventTypeAlert  = "alert"
+)
+
+// EventSink is an interface that represents a destination for events.
+type EventSink interface {
+	GetIdentifier() string
+	Send(*Event) error
+	Close() error
+}
+
+// eventSinkWorker decouples a sink from the request handling. Events are buffered and dropped if
+// the sink cannot keep up, so that a slow sink never delays a delivery.
+type eventSinkWorker struct {
+	sink    EventSink
+	queue   chan *Event
+	dropped int
+	lastLog time.Time
+	lock    sync.Mutex
+	done    chan struct{}
+}
+
+func (w *eventSinkWorker) run() {
+	defer close(w.done)
+
+	for event := range w.queue {
+		err := w.sink.Send(event)
+		if err != nil {
+			w.warn("Could not send event to " + w.sink.GetIdentifier() + " sink: " + err.Error())
+		}
+	}
+
+	err := w.sink.Close()
+	if err != nil {
+		log.Printf("Warning: Could not close the %s sink: %s", w.sink.GetIdentifier(), err)
+	}
+}
+
+func (w *eventSinkWorker) offer(event *Event) {
+	select {
+	case w.queue <- event:
+	default:
+		w.lock.Lock()
+		w.dropped++
+		w.lock.Unlock()
+
+		w.warn("The " + w.sink.GetIdentifier() + " sink is too slow, dropping events.")
+	}
+}
+
+// warn logs at most one message per minute per sink to not flood the server log.
+func (w *eventSinkWorker) warn(message string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if time.Since(w.lastLog) < time.Minute {
+		return
+	}
+
+	w.lastLog = time.Now()
+	log.Printf("Warning: %s (%d events dropped so far)", message, w.dropped)
+}
+
+// EventBus distributes events to all configured sinks. Events are only published once the
+// transaction they were created in has been committed.
+type EventBus struct {
+	workers    []*eventSinkWorker
+	pending    map[*sqlx.Tx][]*Event
+	bufferSize int
+	lock       sync.Mutex
+}
+
+func NewEventBus(c *configuration) (*EventBus, error) {
+	bufferSize := c.Events.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = 1000
+	}
+
+	bus := &EventBus{
+		workers:    make([]*eventSinkWorker, 0),
+		pending:    make(map[*sqlx.Tx][]*Event),
+		bufferSize: bufferSize,
+	}
+
+	// alerts are delivered like any other event, to keep them from blocking requests
+	if len(c.Alerts.Email) > 0 || c.Alerts.Webhook != "" {
+		sink, err := NewAlertSink(c)
+		if err != nil {
+			return nil, err
+		}
+
+		bus.addSink(sink, bufferSize)
+	}
+
+	for _, sinkConfig := range c.Events.Sinks {
+		var sink EventSink
+		var err error
+
+		switch sinkConfig.Type {
+		case "syslog":
+			sink, err = NewSyslogSink(sinkConfig)
+		case "file":
+			sink, err = NewFileSink(sinkConfig)
+		case "webhook":
+			sink, err = NewWebhookSink(sinkConfig)
+		default:
+			err = errors.New("Unknown event sink type '" + sinkConfig.Type + "' configured.")
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		bus.addSink(sink, bufferSize)
+	}
+
+	return bus, nil
+}
+
+func (b *EventBus) addSink(sink EventSink, bufferSize int) {
+	worker := &eventSinkWorker{sink: sink, queue: make(chan *Event, bufferSize), done: make(chan struct{})}
+	go worker.run()
+
+	b.workers = append(b.workers, worker)
+}
+
+// Subscribe adds a sink that is not configured, but only needed by the server.
+func (b *EventBus) Subscribe(sink EventSink) {
+	b.addSink(sink, b.bufferSize)
+}
+
+// Queue remembers the event until the transaction is finished.
+func (b *EventBus) Queue(tx *sqlx.Tx, event *Event) {
+	if b == nil || len(b.workers) == 0 {
+		return
+	}
+
+	b.lock.Lock()
+	b.pending[tx] = append(b.pending[tx], event)
+	b.lock.Unlock()
+}
+
+// Flush publishes all events that were queued for the (committed) transaction.
+func (b *EventBus) Flush(tx *sqlx.Tx) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	events := b.pending[tx]
+	delete(b.pending, tx)
+	b.lock.Unlock()
+
+	for _, event := range events {
+		for _, worker := range b.workers {
+			worker.offer(event)
+		}
+	}
+}
+
+// Discard forgets all events of a transaction that has been rolled back.
+func (b *EventBus) Discard(tx *sqlx.Tx) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	delete(b.pending, tx)
+	b.lock.Unlock()
+}
+
+// Close waits until all queued events have been sent and closes the sinks. This is used by the
+// command line tools, which would otherwise exit before their events are shipped.
+func (b *EventBus) Close() {
+	if b == nil {
+		return
+	}
+
+	for _, worker := range b.workers {
+		close(worker.queue)
+	}
+
+	for _, worker := range b.workers {
+		<-worker.done
+	}
+
+	b.workers = nil
+}
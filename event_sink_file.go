@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// FileSink appends events as JSON lines to a file. Once the file exceeds the configured size, it
+// is rotated (events.jsonl becomes events.jsonl.1 and so on) and the oldest file is removed.
+type FileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func NewFileSink(c eventSinkConfig) (*FileSink, error) {
+	if c.Path == "" {
+		return nil, errors.New("No path configured for the file event sink.")
+	}
+
+	sink := &FileSink{
+		path:     c.Path,
+		maxSize:  int64(c.MaxSize) * 1024 * 1024,
+		maxFiles: c.MaxFiles,
+	}
+
+	if sink.maxSize <= 0 {
+		sink.maxSize = 100 * 1024 * 1024
+	}
+
+	if sink.maxFiles <= 0 {
+		sink.maxFiles = 5
+	}
+
+	// fail early if the file is not writable
+	err := sink.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func (s *FileSink) GetIdentifier() string {
+	return "file"
+}
+
+func (s *FileSink) Send(event *Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	if s.file == nil || s.size+int64(len(line)) > s.maxSize {
+		err = s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+
+	return err
+}
+
+func (s *FileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	return s.file.Close()
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+
+		// events.jsonl.4 -> events.jsonl.5, ..., events.jsonl -> events.jsonl.1
+		os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxFiles))
+
+		for i := s.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+
+		err := os.Rename(s.path, s.path+".1")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return s.open()
+}
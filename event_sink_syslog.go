@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "ntp": 12, "security": 13, "console": 14,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21,
+	"local6": 22, "local7": 23,
+}
+
+const (
+	syslogSeverityWarning = 4
+	syslogSeverityNotice  = 5
+	syslogSeverityInfo    = 6
+)
+
+// SyslogSink sends events as RFC 5424 messages, with the event's JSON representation as the
+// message. TCP and TLS use octet counting framing (RFC 6587 / RFC 5425).
+type SyslogSink struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	facility  int
+	tag       string
+	hostname  string
+	conn      net.Conn
+}
+
+func NewSyslogSink(c eventSinkConfig) (*SyslogSink, error) {
+	sink := &SyslogSink{
+		network:  c.Network,
+		address:  c.Address,
+		facility: syslogFacilities["local0"],
+		tag:      c.Tag,
+	}
+
+	if sink.network == "" {
+		sink.network = "udp"
+	}
+
+	if sink.network != "udp" && sink.network != "tcp" && sink.network != "tls" {
+		return nil, errors.New("The syslog network must be udp, tcp or tls.")
+	}
+
+	if sink.address == "" {
+		return nil, errors.New("No syslog address configured.")
+	}
+
+	if c.Facility != "" {
+		facility, ok := syslogFacilities[c.Facility]
+		if !ok {
+			return nil, errors.New("Unknown syslog facility '" + c.Facility + "' configured.")
+		}
+
+		sink.facility = facility
+	}
+
+	if sink.tag == "" {
+		sink.tag = "raziel"
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	sink.tag = sanitizeSyslogField(sink.tag)
+	sink.hostname = sanitizeSyslogField(hostname)
+
+	if sink.network == "tls" {
+		host, _, err := net.SplitHostPort(sink.address)
+		if err != nil {
+			return nil, errors.New("Invalid syslog address: " + err.Error())
+		}
+
+		sink.tlsConfig = &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: c.SkipVerify,
+		}
+
+		if c.CaFile != "" {
+			pem, err := ioutil.ReadFile(c.CaFile)
+			if err != nil {
+				return nil, errors.New("Could not read syslog CA file: " + err.Error())
+			}
+
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.New("The syslog CA file does not contain any certificates.")
+			}
+
+			sink.tlsConfig.RootCAs = pool
+		}
+	}
+
+	return sink, nil
+}
+
+func (s *SyslogSink) GetIdentifier() string {
+	return "syslog"
+}
+
+func (s *SyslogSink) Send(event *Event) error {
+	message, err := s.format(event)
+	if err != nil {
+		return err
+	}
+
+	// try once more with a fresh connection if the old one went away
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			err = s.connect()
+			if err != nil {
+				return err
+			}
+		}
+
+		s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, err = s.conn.Write(message)
+		if err == nil {
+			return nil
+		}
+
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return err
+}
+
+func (s *SyslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	return s.conn.Close()
+}
+
+func (s *SyslogSink) connect() error {
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	if s.network == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.address, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(s.network, s.address)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+
+	return nil
+}
+
+func (s *SyslogSink) format(event *Event) ([]byte, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	severity := syslogSeverityInfo
+
+	if event.Type == EventTypeAccess && event.Status >= 400 {
+		severity = syslogSeverityWarning
+	} else if event.Type == EventTypeAudit {
+		severity = syslogSeverityNotice
+	}
+
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	message := fmt.Sprintf(
+		"<%d>1 %s %s %s %d %s - %s",
+		s.facility*8+severity,
+		event.Time.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		s.hostname,
+		s.tag,
+		os.Getpid(),
+		event.Type,
+		payload,
+	)
+
+	if s.network == "udp" {
+		return []byte(message), nil
+	}
+
+	return []byte(fmt.Sprintf("%d %s", len(message), message)), nil
+}
+
+// sanitizeSyslogField makes sure a header field contains only printable ASCII characters.
+func sanitizeSyslogField(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+
+		return r
+	}, value)
+}
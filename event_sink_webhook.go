@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// WebhookSink POSTs every event as a JSON document to a URL.
+type WebhookSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func NewWebhookSink(c eventSinkConfig) (*WebhookSink, error) {
+	parsed, err := url.Parse(c.Url)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil, errors.New("The webhook event sink needs a http:// or https:// URL.")
+	}
+
+	return &WebhookSink{
+		url:     c.Url,
+		headers: c.Headers,
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+func (s *WebhookSink) GetIdentifier() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Send(event *Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Raziel")
+
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// drain the body to allow re-using the connection
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("The webhook responded with status %d.", res.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *WebhookSink) Close() error {
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// recordingSink remembers the events it was sent.
+type recordingSink struct {
+	lock   sync.Mutex
+	events []*Event
+	closed bool
+}
+
+func (s *recordingSink) GetIdentifier() string {
+	return "recording"
+}
+
+func (s *recordingSink) Send(event *Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.events = append(s.events, event)
+
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestEventBusPublishesCommittedEvents(t *testing.T) {
+	db := newTestDatabase(t)
+
+	bus, err := NewEventBus(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordingSink{}
+	bus.Subscribe(sink)
+
+	previous := eventBus
+	eventBus = bus
+	defer func() { eventBus = previous }()
+
+	committed, _ := db.Beginx()
+	user := createTestUser(t, "admin", committed)
+	NewAuditLog(committed, newTestRequest("POST", "/users")).LogUserCreated(user.Id, user.Id)
+	committed.Commit()
+
+	rolledBack, _ := db.Beginx()
+	NewAuditLog(rolledBack, nil).LogUserDeleted(user.Id, user.Id)
+	rolledBack.Rollback()
+
+	bus.Discard(rolledBack)
+	bus.Flush(committed)
+	bus.Close()
+
+	if !sink.closed {
+		t.Error("The sink was not closed.")
+	}
+
+	if len(sink.events) != 1 {
+		t.Fatalf("Expected only the committed event, got %d.", len(sink.events))
+	}
+
+	event := sink.events[0]
+	if event.Type != EventTypeAudit || event.Action != "user-created" || event.Hash == "" || event.OriginIp != "192.0.2.1" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+
+	sink, err := NewFileSink(eventSinkConfig{Path: path, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// room for two events per file
+	sink.maxSize = 200
+
+	for i := 1; i <= 8; i++ {
+		if err := sink.Send(&Event{Type: EventTypeAccess, Status: 200, Message: fmt.Sprintf("event %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sink.Close()
+
+	expected := map[string][]string{
+		"":   {"event 7", "event 8"},
+		".1": {"event 5", "event 6"},
+		".2": {"event 3", "event 4"},
+		".3": nil,
+	}
+
+	for suffix, messages := range expected {
+		content, err := ioutil.ReadFile(path + suffix)
+		if messages == nil {
+			if err == nil {
+				t.Errorf("events.jsonl%s should have been removed.", suffix)
+			}
+
+			continue
+		}
+
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		if len(lines) != len(messages) {
+			t.Errorf("events.jsonl%s: expected %d lines, got %q.", suffix, len(messages), content)
+			continue
+		}
+
+		for i, line := range lines {
+			event := Event{}
+			if err := json.Unmarshal([]byte(line), &event); err != nil || event.Message != messages[i] {
+				t.Errorf("events.jsonl%s: expected %q, got %s.", suffix, messages[i], line)
+			}
+		}
+	}
+
+	if _, err := NewFileSink(eventSinkConfig{Path: filepath.Join(path, "not-a-directory", "events.jsonl")}); err == nil {
+		t.Error("An unwritable file was accepted.")
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 10)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+
+		for {
+			length := 0
+			if _, err := fmt.Fscanf(reader, "%d ", &length); err != nil {
+				return
+			}
+
+			message := make([]byte, length)
+			if _, err := io.ReadFull(reader, message); err != nil {
+				return
+			}
+
+			received <- string(message)
+		}
+	}()
+
+	sink, err := NewSyslogSink(eventSinkConfig{Network: "tcp", Address: listener.Addr().String(), Facility: "auth", Tag: "raziel prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := []*Event{
+		{Time: when, Type: EventTypeAccess, Status: 403},
+		{Time: when, Type: EventTypeAudit, Action: "secret-created"},
+		{Time: when, Type: EventTypeAccess, Status: 200},
+	}
+
+	for _, event := range events {
+		if err := sink.Send(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// auth is facility 4; warnings, notices and infos are severities 4, 5 and 6
+	prefixes := []string{
+		"<36>1 2020-01-02T03:04:05.000000Z ",
+		"<37>1 2020-01-02T03:04:05.000000Z ",
+		"<38>1 2020-01-02T03:04:05.000000Z ",
+	}
+
+	for i, prefix := range prefixes {
+		select {
+		case message := <-received:
+			if !strings.HasPrefix(message, prefix) || !strings.Contains(message, " raziel_prod ") {
+				t.Errorf("Expected a message starting with %q, got %q.", prefix, message)
+			}
+
+			payload := Event{}
+			if err := json.Unmarshal([]byte(message[strings.Index(message, " - ")+3:]), &payload); err != nil || payload.Status != events[i].Status {
+				t.Errorf("The message does not end with the event: %q", message)
+			}
+
+		case <-time.After(5 * time.Second):
+			t.Fatal("Not all events were received.")
+		}
+	}
+
+	invalid := []eventSinkConfig{
+		{Network: "unix", Address: "/dev/log"},
+		{Network: "udp"},
+		{Network: "udp", Address: "127.0.0.1:514", Facility: "local8"},
+		{Network: "tls", Address: "no-port"},
+	}
+
+	for _, c := range invalid {
+		if _, err := NewSyslogSink(c); err == nil {
+			t.Errorf("%+v was accepted.", c)
+		}
+	}
+}
+
+func TestSyslogSinkUdp(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the network defaults to udp and the facility to local0
+	sink, err := NewSyslogSink(eventSinkConfig{Address: conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	if err := sink.Send(&Event{Type: EventTypeAccess, Status: 403}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	buffer := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// datagrams are not framed
+	if message := string(buffer[:n]); !strings.HasPrefix(message, "<132>1 ") || !strings.Contains(message, " raziel ") {
+		t.Errorf("Unexpected message: %q", message)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	status := 204
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		event := Event{}
+
+		if req.Header.Get("Content-Type") != "application/json" || req.UserAgent() != "Raziel" {
+			res.WriteHeader(415)
+			return
+		}
+
+		if req.Header.Get("Authorization") != "Bearer token" || json.NewDecoder(req.Body).Decode(&event) != nil || event.Action != "secret-created" {
+			res.WriteHeader(400)
+			return
+		}
+
+		res.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink, err := NewWebhookSink(eventSinkConfig{Url: server.URL, Headers: map[string]string{"Authorization": "Bearer token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := &Event{Type: EventTypeAudit, Action: "secret-created"}
+
+	if err := sink.Send(event); err != nil {
+		t.Errorf("The event was not sent: %v", err)
+	}
+
+	status = 500
+
+	if err := sink.Send(event); err == nil {
+		t.Error("A failed delivery was not reported.")
+	}
+
+	if _, err := NewWebhookSink(eventSinkConfig{Url: "ftp://example.com"}); err == nil {
+		t.Error("A non-HTTP URL was accepted.")
+	}
+}
+
+// failingSink fails every event.
+type failingSink struct{ recordingSink }
+
+func (s *failingSink) Send(event *Event) error {
+	s.recordingSink.Send(event)
+	return errors.New("The sink is down.")
+}
+
+func TestEventBusIsolatesSinks(t *testing.T) {
+	bus := &EventBus{pending: make(map[*sqlx.Tx][]*Event), bufferSize: 10}
+	failing, working := &failingSink{}, &recordingSink{}
+
+	bus.Subscribe(failing)
+	bus.Subscribe(working)
+
+	tx := &sqlx.Tx{}
+
+	for i := 0; i < 3; i++ {
+		bus.Queue(tx, &Event{Type: EventTypeAccess})
+	}
+
+	bus.Flush(tx)
+	bus.Close()
+
+	if len(working.events) != 3 || len(failing.events) != 3 {
+		t.Errorf("Expected both sinks to get all events, got %d and %d.", len(working.events), len(failing.events))
+	}
+}
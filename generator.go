@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	GeneratePassword   = "password"
+	GenerateHex        = "hex"
+	GenerateBase64     = "base64"
+	GenerateRsa        = "rsa"
+	GenerateEcdsa      = "ecdsa"
+	GenerateEd25519    = "ed25519"
+	GenerateSshRsa     = "ssh-rsa"
+	GenerateSshEcdsa   = "ssh-ecdsa"
+	GenerateSshEd25519 = "ssh-ed25519"
+)
+
+// the generator types in the order they are offered in the UI
+var generatorTypes = []string{
+	GeneratePassword, GenerateHex, GenerateBase64,
+	GenerateRsa, GenerateEcdsa, GenerateEd25519,
+	GenerateSshRsa, GenerateSshEcdsa, GenerateSshEd25519,
+}
+
+var generatorLabels = map[string]string{
+	GeneratePassword:   "random password",
+	GenerateHex:        "hex token",
+	GenerateBase64:     "base64 token",
+	GenerateRsa:        "RSA key pair (PEM)",
+	GenerateEcdsa:      "ECDSA key pair (PEM)",
+	GenerateEd25519:    "Ed25519 key pair (PEM)",
+	GenerateSshRsa:     "SSH key pair (RSA)",
+	GenerateSshEcdsa:   "SSH key pair (ECDSA)",
+	GenerateSshEd25519: "SSH key pair (Ed25519)",
+}
+
+var passwordCharsets = map[string]string{
+	"alphanumeric": "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789",
+	"symbols":      "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789!#$%&()*+,-./:;<=>?@[]^_{|}~",
+	"readable":     "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789",
+	"digits":       "0123456789",
+}
+
+var ellipticCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// SecretGenerator describes how a secret's value is created. It is stored as JSON with the
+// secret, so that scheduled rotations produce the same kind of value.
+type SecretGenerator struct {
+	Type    string `json:"type"`
+	Length  int    `json:"length,omitempty"`  // characters (password) or bytes (hex, base64)
+	Charset string `json:"charset,omitempty"` // password
+	Bits    int    `json:"bits,omitempty"`    // RSA keys
+	Curve   string `json:"curve,omitempty"`   // ECDSA keys
+}
+
+// NewSecretGenerator fills in the defaults for the given type and validates the result.
+func NewSecretGenerator(kind string, length int, charset string, bits int, curve string) (*SecretGenerator, error) {
+	g := &SecretGenerator{Type: kind}
+
+	switch kind {
+	case GeneratePassword:
+		g.Length = length
+		g.Charset = charset
+
+		if g.Length == 0 {
+			g.Length = 32
+		}
+
+		if g.Charset == "" {
+			g.Charset = "alphanumeric"
+		}
+
+		if _, ok := passwordCharsets[g.Charset]; !ok {
+			return nil, errors.New("Unknown character set '" + g.Charset + "'.")
+		}
+
+		if g.Length < 8 || g.Length > 1024 {
+			return nil, errors.New("Passwords must be between 8 and 1024 characters long.")
+		}
+
+	case GenerateHex, GenerateBase64:
+		g.Length = length
+
+		if g.Length == 0 {
+			g.Length = 32
+		}
+
+		if g.Length < 16 || g.Length > 1024 {
+			return nil, errors.New("Tokens must be between 16 and 1024 bytes long.")
+		}
+
+	case GenerateRsa, GenerateSshRsa:
+		g.Bits = bits
+
+		if g.Bits == 0 {
+			g.Bits = 4096
+		}
+
+		if g.Bits != 2048 && g.Bits != 3072 && g.Bits != 4096 {
+			return nil, errors.New("RSA keys must have 2048, 3072 or 4096 bits.")
+		}
+
+	case GenerateEcdsa, GenerateSshEcdsa:
+		g.Curve = curve
+
+		if g.Curve == "" {
+			g.Curve = "P-256"
+		}
+
+		if _, ok := ellipticCurves[g.Curve]; !ok {
+			return nil, errors.New("Unknown elliptic curve '" + g.Curve + "'.")
+		}
+
+	case GenerateEd25519, GenerateSshEd25519:
+		// nothing to configure
+
+	default:
+		return nil, errors.New("Unknown generator '" + kind + "'.")
+	}
+
+	return g, nil
+}
+
+// parseSecretGenerator reads the generator from the secret form. It returns nil if no generator
+// was selected.
+func parseSecretGenerator(req *http.Request) (*SecretGenerator, error) {
+	kind := req.FormValue("generator")
+	if kind == "" {
+		return nil, nil
+	}
+
+	length, _ := strconv.Atoi(strings.TrimSpace(req.FormValue("generator_length")))
+	bits, _ := strconv.Atoi(req.FormValue("generator_bits"))
+
+	return NewSecretGenerator(kind, length, req.FormValue("generator_charset"), bits, req.FormValue("generator_curve"))
+}
+
+func decodeSecretGenerator(encoded string) (*SecretGenerator, error) {
+	g := SecretGenerator{}
+
+	err := json.Unmarshal([]byte(encoded), &g)
+	if err != nil {
+		return nil, errors.New("Invalid generator configuration: " + err.Error())
+	}
+
+	return NewSecretGenerator(g.Type, g.Length, g.Charset, g.Bits, g.Curve)
+}
+
+func (g *SecretGenerator) Encode() string {
+	encoded, _ := json.Marshal(g)
+	return string(encoded)
+}
+
+func (g *SecretGenerator) String() string {
+	switch g.Type {
+	case GeneratePassword:
+		return fmt.Sprintf("%d character %s password", g.Length, g.Charset)
+	case GenerateHex, GenerateBase64:
+		return fmt.Sprintf("%d byte %s token", g.Length, g.Type)
+	case GenerateRsa, GenerateSshRsa:
+		return fmt.Sprintf("%s (%d bits)", generatorLabels[g.Type], g.Bits)
+	case GenerateEcdsa, GenerateSshEcdsa:
+		return fmt.Sprintf("%s (%s)", generatorLabels[g.Type], g.Curve)
+	}
+
+	return generatorLabels[g.Type]
+}
+
+// Generate creates a new value. Key pairs consist of the private key, followed by the public key
+// (PEM for plain key pairs, the authorized_keys format for SSH keys).
+func (g *SecretGenerator) Generate() ([]byte, error) {
+	switch g.Type {
+	case GeneratePassword:
+		return randomPassword(g.Length, passwordCharsets[g.Charset])
+
+	case GenerateHex, GenerateBase64:
+		token := make([]byte, g.Length)
+
+		_, err := rand.Read(token)
+		if err != nil {
+			return nil, err
+		}
+
+		if g.Type == GenerateHex {
+			return []byte(hex.EncodeToString(token)), nil
+		}
+
+		return []byte(base64.StdEncoding.EncodeToString(token)), nil
+	}
+
+	private, public, err := g.generateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	switch g.Type {
+	case GenerateSshRsa, GenerateSshEcdsa, GenerateSshEd25519:
+		return encodeSshKeyPair(private, public)
+	}
+
+	return encodePemKeyPair(private, public)
+}
+
+func (g *SecretGenerator) generateKey() (crypto.PrivateKey, crypto.PublicKey, error) {
+	switch g.Type {
+	case GenerateRsa, GenerateSshRsa:
+		key, err := rsa.GenerateKey(rand.Reader, g.Bits)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return key, key.Public(), nil
+
+	case GenerateEcdsa, GenerateSshEcdsa:
+		key, err := ecdsa.GenerateKey(ellipticCurves[g.Curve], rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return key, key.Public(), nil
+
+	case GenerateEd25519, GenerateSshEd25519:
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return private, public, nil
+	}
+
+	return nil, nil, errors.New("Unknown generator '" + g.Type + "'.")
+}
+
+// randomPassword picks every character uniformly from the charset.
+func randomPassword(length int, charset string) ([]byte, error) {
+	password := make([]byte, length)
+	max := big.NewInt(int64(len(charset)))
+
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return nil, err
+		}
+
+		password[i] = charset[n.Int64()]
+	}
+
+	return password, nil
+}
+
+func encodePemKeyPair(private crypto.PrivateKey, public crypto.PublicKey) ([]byte, error) {
+	privateDer, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	publicDer, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+
+	result := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDer})
+	result = append(result, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer})...)
+
+	return result, nil
+}
+
+func encodeSshKeyPair(private crypto.PrivateKey, public crypto.PublicKey) ([]byte, error) {
+	block, err := ssh.MarshalPrivateKey(private, "raziel")
+	if err != nil {
+		return nil, err
+	}
+
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+
+	result := pem.EncodeToMemory(block)
+	result = append(result, ssh.MarshalAuthorizedKey(sshPublic)...)
+
+	return result, nil
+}
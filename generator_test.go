@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNewSecretGenerator(t *testing.T) {
+	g, err := NewSecretGenerator(GeneratePassword, 0, "", 0, "")
+	if err != nil || g.Length != 32 || g.Charset != "alphanumeric" {
+		t.Errorf("The password defaults were not applied: %+v (%v)", g, err)
+	}
+
+	g, err = NewSecretGenerator(GenerateRsa, 0, "", 0, "")
+	if err != nil || g.Bits != 4096 {
+		t.Errorf("The RSA defaults were not applied: %+v (%v)", g, err)
+	}
+
+	g, err = NewSecretGenerator(GenerateSshEcdsa, 0, "", 0, "")
+	if err != nil || g.Curve != "P-256" {
+		t.Errorf("The ECDSA defaults were not applied: %+v (%v)", g, err)
+	}
+
+	invalid := []SecretGenerator{
+		{Type: "uuid"},
+		{Type: GeneratePassword, Length: 7},
+		{Type: GeneratePassword, Length: 1025},
+		{Type: GeneratePassword, Charset: "emoji"},
+		{Type: GenerateHex, Length: 15},
+		{Type: GenerateBase64, Length: 1025},
+		{Type: GenerateRsa, Bits: 1024},
+		{Type: GenerateEcdsa, Curve: "P-224"},
+	}
+
+	for _, g := range invalid {
+		if _, err := NewSecretGenerator(g.Type, g.Length, g.Charset, g.Bits, g.Curve); err == nil {
+			t.Errorf("%+v was accepted.", g)
+		}
+	}
+
+	// the stored configuration is validated again when it is read
+	g, _ = NewSecretGenerator(GeneratePassword, 20, "digits", 0, "")
+
+	if decoded, err := decodeSecretGenerator(g.Encode()); err != nil || *decoded != *g {
+		t.Errorf("The generator did not survive encoding: %+v (%v)", decoded, err)
+	}
+
+	if _, err := decodeSecretGenerator(`{"type": "password", "length": 4}`); err == nil {
+		t.Error("An invalid stored generator was accepted.")
+	}
+}
+
+func TestGenerateTokens(t *testing.T) {
+	for charset, chars := range passwordCharsets {
+		g, _ := NewSecretGenerator(GeneratePassword, 64, charset, 0, "")
+
+		password, err := g.Generate()
+		if err != nil || len(password) != 64 {
+			t.Fatalf("Expected a 64 character password, got %q (%v).", password, err)
+		}
+
+		for _, c := range string(password) {
+			if !strings.ContainsRune(chars, c) {
+				t.Errorf("The %s password %q contains %q.", charset, password, c)
+			}
+		}
+	}
+
+	g, _ := NewSecretGenerator(GenerateHex, 16, "", 0, "")
+	token, _ := g.Generate()
+
+	if decoded, err := hex.DecodeString(string(token)); err != nil || len(decoded) != 16 {
+		t.Errorf("Expected 16 hex encoded bytes, got %q.", token)
+	}
+
+	g, _ = NewSecretGenerator(GenerateBase64, 24, "", 0, "")
+	token, _ = g.Generate()
+
+	if decoded, err := base64.StdEncoding.DecodeString(string(token)); err != nil || len(decoded) != 24 {
+		t.Errorf("Expected 24 base64 encoded bytes, got %q.", token)
+	}
+
+	other, _ := g.Generate()
+	if string(token) == string(other) {
+		t.Error("The generator returned the same token twice.")
+	}
+}
+
+func TestGenerateKeyPairs(t *testing.T) {
+	for _, kind := range []string{GenerateRsa, GenerateEcdsa, GenerateEd25519} {
+		g, _ := NewSecretGenerator(kind, 0, "", 2048, "P-384")
+
+		body, err := g.Generate()
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+
+		private, rest := pem.Decode(body)
+		public, _ := pem.Decode(rest)
+
+		if private == nil || public == nil || private.Type != "PRIVATE KEY" || public.Type != "PUBLIC KEY" {
+			t.Fatalf("%s: expected the private and the public key, got %s", kind, body)
+		}
+
+		if _, err := x509.ParsePKCS8PrivateKey(private.Bytes); err != nil {
+			t.Errorf("%s: invalid private key: %v", kind, err)
+		}
+
+		if _, err := x509.ParsePKIXPublicKey(public.Bytes); err != nil {
+			t.Errorf("%s: invalid public key: %v", kind, err)
+		}
+	}
+
+	expectedTypes := map[string]string{
+		GenerateSshRsa:     ssh.KeyAlgoRSA,
+		GenerateSshEcdsa:   ssh.KeyAlgoECDSA384,
+		GenerateSshEd25519: ssh.KeyAlgoED25519,
+	}
+
+	for kind, keyType := range expectedTypes {
+		g, _ := NewSecretGenerator(kind, 0, "", 2048, "P-384")
+
+		body, err := g.Generate()
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+
+		// generated SSH keys can be used as SSH certificate authorities right away
+		signer, err := loadSshSigner(body)
+		if err != nil {
+			t.Fatalf("%s: invalid private key: %v", kind, err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+
+		public, _, _, _, err := ssh.ParseAuthorizedKey([]byte(lines[len(lines)-1]))
+		if err != nil || public.Type() != keyType {
+			t.Fatalf("%s: expected a %s public key, got %v (%v).", kind, keyType, public, err)
+		}
+
+		if string(public.Marshal()) != string(signer.PublicKey().Marshal()) {
+			t.Errorf("%s: the public key does not belong to the private key.", kind)
+		}
+	}
+}
+
+func TestRotateDue(t *testing.T) {
+	db := newTestDatabase(t)
+
+	previous := secretRotator
+	secretRotator = &SecretRotator{keepVersions: 2}
+	defer func() { secretRotator = previous }()
+
+	tx, _ := db.Beginx()
+	user := createTestUser(t, "admin", tx)
+	due := createTestSecret(t, "due", "initial", user, tx)
+	later := createTestSecret(t, "later", "initial", user, tx)
+
+	g, _ := NewSecretGenerator(GenerateHex, 16, "", 0, "")
+
+	for _, secret := range []*Secret{due, later} {
+		if err := secret.setRotationPolicy(g, 30); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := secret.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE `secret` SET `rotate_at` = ? WHERE `id` = ?", "2020-01-01 00:00:00", due.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	tx.Commit()
+
+	// three rotations, of which only the newest two previous values are kept
+	for i := 0; i < 3; i++ {
+		if rotated, err := secretRotator.RotateDue(db); err != nil || rotated != 1 {
+			t.Fatalf("Expected one rotated secret, got %d (%v).", rotated, err)
+		}
+
+		if _, err := db.Exec("UPDATE `secret` SET `rotate_at` = ? WHERE `id` = ?", "2020-01-01 00:00:00", due.Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, _ = db.Beginx()
+	defer tx.Rollback()
+
+	rotated := findSecret(due.Id, true, tx)
+	body, _ := Decrypt(rotated.Secret)
+
+	if len(body) != 32 || rotated.RotatedAt == nil || rotated.UpdatedBy != nil {
+		t.Errorf("The secret was not rotated by Raziel: %q, %+v", body, rotated)
+	}
+
+	versions := findSecretVersions(due.Id, tx)
+	if len(versions) != 2 {
+		t.Fatalf("Expected two kept versions, got %d.", len(versions))
+	}
+
+	for _, version := range versions {
+		if old, _ := Decrypt(version.Secret); string(old) == "initial" {
+			t.Error("The oldest version was not dropped.")
+		}
+	}
+
+	if body, _ := Decrypt(findSecret(later.Id, true, tx).Secret); string(body) != "initial" {
+		t.Errorf("A secret that was not due has been rotated: %q", body)
+	}
+
+	if entries := NewAuditLog(tx, nil).FindByActions([]string{"secret-rotated"}, 10, 0); len(entries) != 3 {
+		t.Errorf("Expected three logged rotations, got %d.", len(entries))
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ImportDotenv     = "dotenv"
+	ImportMap        = "map"
+	ImportKubernetes = "kubernetes"
+	ImportVault      = "vault"
+
+	ImportSkip      = "skip"
+	ImportOverwrite = "overwrite"
+
+	maxImportSize = 1024 * 1024
+)
+
+var importFormats = map[string]string{
+	ImportDotenv:     "dotenv file (KEY=value)",
+	ImportMap:        "flat JSON or YAML map",
+	ImportKubernetes: "Kubernetes Secret manifest",
+	ImportVault:      "HashiCorp Vault KV v2 export",
+}
+
+// importItem is a single key/value pair found in an import, together with what the import
+// would do with it.
+type importItem struct {
+	Key    string `json:"key"`
+	Slug   string `json:"slug"`
+	Status string `json:"status"` // "new", "exists", "duplicate" or "invalid"
+	Error  string `json:"error,omitempty"`
+	Value  []byte `json:"-"`
+}
+
+func (i *importItem) IsImportable(collisions string) bool {
+	return i.Status == "new" || (i.Status == "exists" && collisions == ImportOverwrite)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Parsers
+
+func parseImport(format string, content []byte) (map[string][]byte, error) {
+	switch format {
+	case ImportDotenv:
+		return parseDotenv(content)
+	case ImportMap:
+		return parseFlatMap(content)
+	case ImportKubernetes:
+		return parseKubernetesSecret(content)
+	case ImportVault:
+		return parseVaultExport(content)
+	}
+
+	return nil, errors.New("Unknown import format '" + format + "'.")
+}
+
+var dotenvPattern = regexp.MustCompile(`^(?:export\s+)?([A-Za-z_][A-Za-z0-9_.-]*)\s*=\s*(.*)$`)
+
+func parseDotenv(content []byte) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		match := dotenvPattern.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("Line %d is not a valid KEY=value assignment.", lineNo)
+		}
+
+		value := match[2]
+
+		switch {
+		case strings.HasPrefix(value, `"`):
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d contains an invalid double-quoted value.", lineNo)
+			}
+
+			value = unquoted
+
+		case strings.HasPrefix(value, "'"):
+			if len(value) < 2 || !strings.HasSuffix(value, "'") {
+				return nil, fmt.Errorf("Line %d contains an invalid single-quoted value.", lineNo)
+			}
+
+			value = value[1 : len(value)-1]
+
+		default:
+			// strip trailing comments from unquoted values
+			if pos := strings.Index(value, " #"); pos >= 0 {
+				value = strings.TrimSpace(value[:pos])
+			}
+		}
+
+		result[match[1]] = []byte(value)
+	}
+
+	return result, scanner.Err()
+}
+
+// parseFlatMap accepts JSON and YAML, as every JSON document is valid YAML.
+func parseFlatMap(content []byte) (map[string][]byte, error) {
+	parsed := make(map[string]interface{})
+
+	err := yaml.Unmarshal(content, &parsed)
+	if err != nil {
+		return nil, errors.New("The map could not be parsed: " + err.Error())
+	}
+
+	return flattenValues(parsed)
+}
+
+func flattenValues(values map[string]interface{}) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+
+	for key, value := range values {
+		switch v := value.(type) {
+		case string:
+			result[key] = []byte(v)
+		case int, int64, float64, bool:
+			result[key] = []byte(fmt.Sprintf("%v", v))
+		case nil:
+			return nil, errors.New("The value of '" + key + "' is empty.")
+		default:
+			return nil, errors.New("The value of '" + key + "' is not a string; nested maps and lists cannot be imported.")
+		}
+	}
+
+	return result, nil
+}
+
+type kubernetesSecret struct {
+	Kind       string            `yaml:"kind"`
+	Data       map[string]string `yaml:"data"`
+	StringData map[string]string `yaml:"stringData"`
+}
+
+// parseKubernetesSecret reads one or more Secret manifests (YAML or JSON).
+func parseKubernetesSecret(content []byte) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	found := false
+
+	for {
+		secret := kubernetesSecret{}
+
+		err := decoder.Decode(&secret)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, errors.New("The manifest could not be parsed: " + err.Error())
+		}
+
+		// skip empty documents
+		if secret.Kind == "" && len(secret.Data) == 0 && len(secret.StringData) == 0 {
+			continue
+		}
+
+		if secret.Kind != "Secret" {
+			return nil, errors.New("Only manifests of kind Secret can be imported, found '" + secret.Kind + "'.")
+		}
+
+		found = true
+
+		for key, encoded := range secret.Data {
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, errors.New("The value of '" + key + "' is not valid base64.")
+			}
+
+			result[key] = decoded
+		}
+
+		// stringData takes precedence, just like in Kubernetes
+		for key, value := range secret.StringData {
+			result[key] = []byte(value)
+		}
+	}
+
+	if !found {
+		return nil, errors.New("The manifest does not contain a Secret.")
+	}
+
+	return result, nil
+}
+
+// parseVaultExport reads the output of `vault kv get -format=json`, which nests the key/value
+// pairs in data.data for KV v2 engines.
+func parseVaultExport(content []byte) (map[string][]byte, error) {
+	export := struct {
+		Data struct {
+			Data     map[string]interface{} `json:"data"`
+			Metadata map[string]interface{} `json:"metadata"`
+		} `json:"data"`
+	}{}
+
+	err := json.Unmarshal(content, &export)
+	if err != nil {
+		return nil, errors.New("The Vault export could not be parsed: " + err.Error())
+	}
+
+	if export.Data.Data == nil || export.Data.Metadata == nil {
+		return nil, errors.New("This is not a Vault KV v2 export (data.data and data.metadata are missing).")
+	}
+
+	return flattenValues(export.Data.Data)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Planning
+
+var slugInvalidChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// deriveSlug turns a key like DATABASE_PASSWORD into a slug like database-password that
+// passes validateSafeString.
+func deriveSlug(prefix string, key string) (string, error) {
+	slug := slugInvalidChars.ReplaceAllString(strings.ToLower(prefix+key), "-")
+	slug = strings.Trim(slug, "-")
+
+	if len(slug) > 0 && !matches("^[a-z]", slug) {
+		slug = "s-" + slug
+	}
+
+	return validateSafeString(slug, "slug")
+}
+
+// planImport derives the slugs and checks them for collisions, without changing anything.
+func planImport(values map[string][]byte, prefix string, db *sqlx.Tx) []importItem {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	items := make([]importItem, 0, len(keys))
+	seen := make(map[string]string)
+
+	for _, key := range keys {
+		item := importItem{Key: key, Value: values[key], Status: "new"}
+
+		slug, err := deriveSlug(prefix, key)
+		item.Slug = slug
+		certErr := checkCertificateBundle(item.Value)
+
+		switch {
+		case err != nil:
+			item.Status = "invalid"
+			item.Error = err.Error()
+
+		case len(item.Value) == 0:
+			item.Status = "invalid"
+			item.Error = "The value is empty."
+
+		case certErr != nil:
+			item.Status = "invalid"
+			item.Error = certErr.Error()
+
+		case seen[slug] != "":
+			item.Status = "duplicate"
+			item.Error = "The key '" + seen[slug] + "' results in the same slug."
+
+		case findSecretBySlug(slug, false, db) != nil:
+			item.Status = "exists"
+		}
+
+		if slug != "" && seen[slug] == "" {
+			seen[slug] = key
+		}
+
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// executeImport creates or overwrites the secrets and optionally grants a consumer access. It
+// returns the number of imported secrets.
+func executeImport(items []importItem, format string, collisions string, consumer *Consumer, user *User, req *http.Request, db *sqlx.Tx) (int, error) {
+	auditLog := NewAuditLog(db, req)
+	imported := 0
+
+	var granted map[int]bool
+
+	if consumer != nil {
+		granted = make(map[int]bool)
+
+		for _, secret := range consumer.GetSecrets(false) {
+			granted[secret.Id] = true
+		}
+	}
+
+	for _, item := range items {
+		if !item.IsImportable(collisions) {
+			continue
+		}
+
+		encrypted, err := Encrypt(item.Value)
+		if err != nil {
+			return 0, errors.New("Could not encrypt secret: " + err.Error())
+		}
+
+		secret := findSecretBySlug(item.Slug, false, db)
+		overwritten := secret != nil
+
+		if secret == nil {
+			secret = &Secret{
+				Id:        -1,
+				Name:      item.Key,
+				Slug:      item.Slug,
+				Secret:    encrypted,
+				CreatedBy: user.Id,
+				_db:       db,
+			}
+		} else {
+			err = secret.replaceValue(encrypted, &user.Id)
+			if err != nil {
+				return 0, err
+			}
+
+			secret.UpdatedBy = &user.Id
+		}
+
+		err = secret.Save()
+		if err != nil {
+			return 0, err
+		}
+
+		consumerId := -1
+
+		if consumer != nil {
+			consumerId = consumer.Id
+
+			if !granted[secret.Id] {
+				_, err = db.Exec("INSERT INTO `consumer_secret` (`consumer_id`, `secret_id`) VALUES (?,?)", consumer.Id, secret.Id)
+				if err != nil {
+					return 0, err
+				}
+
+				granted[secret.Id] = true
+			}
+		}
+
+		auditLog.LogSecretImported(secret.Id, consumerId, user.Id, format, overwritten)
+		imported++
+	}
+
+	return imported, nil
+}
+
+// importRequest holds the parameters shared by the import page and the API.
+type importRequest struct {
+	Format     string
+	Content    string
+	Prefix     string
+	Collisions string
+	ConsumerId int
+}
+
+func readImportRequest(req *http.Request) (importRequest, error) {
+	r := importRequest{
+		Format:     req.FormValue("format"),
+		Content:    req.FormValue("content"),
+		Prefix:     strings.TrimSpace(req.FormValue("prefix")),
+		Collisions: req.FormValue("collisions"),
+	}
+
+	// an uploaded file takes precedence over the text area
+	file, _, err := req.FormFile("file")
+	if err == nil {
+		defer file.Close()
+
+		content, err := ioutil.ReadAll(io.LimitReader(file, maxImportSize+1))
+		if err != nil {
+			return r, err
+		}
+
+		if len(content) > 0 {
+			r.Content = string(content)
+		}
+	}
+
+	if len(r.Content) > maxImportSize {
+		return r, errors.New("The import is too large (at most 1 MiB).")
+	}
+
+	if r.Collisions != ImportOverwrite {
+		r.Collisions = ImportSkip
+	}
+
+	if consumer := req.FormValue("consumer"); consumer != "" {
+		r.ConsumerId, _ = strconv.Atoi(consumer)
+	}
+
+	return r, nil
+}
+
+func (r importRequest) findConsumer(db *sqlx.Tx) (*Consumer, error) {
+	if r.ConsumerId <= 0 {
+		return nil, nil
+	}
+
+	consumer := findConsumer(r.ConsumerId, db)
+	if consumer == nil || consumer.Deleted {
+		return nil, errors.New("The consumer could not be found.")
+	}
+
+	return consumer, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// HTTP Handlers
+
+type importFormData struct {
+	layoutData
+
+	Formats    map[string]string
+	Consumers  []Consumer
+	Format     string
+	Content    string
+	Prefix     string
+	Collisions string
+	Consumer   int
+	Items      []importItem
+	Importable int
+	Error      string
+}
+
+func newImportFormData(user *User, session *Session, db *sqlx.Tx) *importFormData {
+	return &importFormData{
+		layoutData: NewLayoutData("Import Secrets", "secrets", user, session.CsrfToken),
+		Formats:    importFormats,
+		Consumers:  findAllConsumers(db),
+		Format:     ImportDotenv,
+		Collisions: ImportSkip,
+	}
+}
+
+func secretsImportFormAction(user *User, session *Session, db *sqlx.Tx) response {
+	return renderTemplate(200, "secrets/import", newImportFormData(user, session, db))
+}
+
+func secretsImportAction(req *http.Request, user *User, session *Session, db *sqlx.Tx) response {
+	data := newImportFormData(user, session, db)
+
+	r, err := readImportRequest(req)
+
+	data.Format = r.Format
+	data.Content = r.Content
+	data.Prefix = r.Prefix
+	data.Collisions = r.Collisions
+	data.Consumer = r.ConsumerId
+
+	if err != nil {
+		data.Error = err.Error()
+		return renderTemplate(400, "secrets/import", data)
+	}
+
+	consumer, err := r.findConsumer(db)
+	if err != nil {
+		data.Error = err.Error()
+		return renderTemplate(400, "secrets/import", data)
+	}
+
+	values, err := parseImport(r.Format, []byte(r.Content))
+	if err != nil {
+		data.Error = err.Error()
+		return renderTemplate(400, "secrets/import", data)
+	}
+
+	if len(values) == 0 {
+		data.Error = "The import does not contain any secrets."
+		return renderTemplate(400, "secrets/import", data)
+	}
+
+	data.Items = planImport(values, r.Prefix, db)
+
+	for _, item := range data.Items {
+		if item.IsImportable(r.Collisions) {
+			data.Importable++
+		}
+	}
+
+	// the first submit only shows the preview
+	if req.FormValue("confirm") != "1" {
+		return renderTemplate(200, "secrets/import", data)
+	}
+
+	_, err = executeImport(data.Items, r.Format, r.Collisions, consumer, user, req, db)
+	if err != nil {
+		panic(err)
+	}
+
+	return redirect(302, "/secrets")
+}
+
+// apiSecretsImportAction works like the import page, but returns JSON. Unless dry_run is set, the
+// secrets are imported right away.
+func apiSecretsImportAction(req *http.Request, user *User, db *sqlx.Tx) response {
+	r, err := readImportRequest(req)
+	if err != nil {
+		return renderJSON(400, map[string]string{"error": err.Error()})
+	}
+
+	consumer, err := r.findConsumer(db)
+	if err != nil {
+		return renderJSON(400, map[string]string{"error": err.Error()})
+	}
+
+	values, err := parseImport(r.Format, []byte(r.Content))
+	if err != nil {
+		return renderJSON(400, map[string]string{"error": err.Error()})
+	}
+
+	items := planImport(values, r.Prefix, db)
+	imported := 0
+
+	if req.FormValue("dry_run") == "" {
+		imported, err = executeImport(items, r.Format, r.Collisions, consumer, user, req, db)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return renderJSON(200, map[string]interface{}{
+		"secrets":  items,
+		"imported": imported,
+	})
+}
+
+// setupImportCtrl sets up the API; the import page is part of the secrets controller.
+func setupImportCtrl(app *martini.ClassicMartini) {
+	// API clients authenticate with their credentials instead of a session and CSRF token
+	app.Post("/api/secrets/import", sessions.RequireBasicAuth, apiSecretsImportAction)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// checkImport compares parsed values with the expected ones.
+func checkImport(t *testing.T, name string, parsed map[string][]byte, err error, expected map[string]string) {
+	t.Helper()
+
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+
+	if len(parsed) != len(expected) {
+		t.Errorf("%s: expected %d values, got %q.", name, len(expected), parsed)
+	}
+
+	for key, value := range expected {
+		if string(parsed[key]) != value {
+			t.Errorf("%s: expected %s to be %q, got %q.", name, key, value, parsed[key])
+		}
+	}
+}
+
+func TestParseDotenv(t *testing.T) {
+	content := `
+# database
+DB_HOST=db.internal
+export DB_USER = raziel
+DB_PASSWORD="hunter2 \"quoted\"\n"
+DB_NAME='raziel # not a comment'
+DB_PORT=5432 # the default
+EMPTY=
+dotted.key-name=x
+`
+
+	parsed, err := parseDotenv([]byte(content))
+	checkImport(t, "dotenv", parsed, err, map[string]string{
+		"DB_HOST":         "db.internal",
+		"DB_USER":         "raziel",
+		"DB_PASSWORD":     "hunter2 \"quoted\"\n",
+		"DB_NAME":         "raziel # not a comment",
+		"DB_PORT":         "5432",
+		"EMPTY":           "",
+		"dotted.key-name": "x",
+	})
+
+	invalid := []string{
+		"no assignment",
+		"1KEY=value",
+		"KEY WITH SPACES=value",
+		`KEY="unterminated`,
+		`KEY='unterminated`,
+		`KEY='`,
+	}
+
+	for _, line := range invalid {
+		if _, err := parseDotenv([]byte("VALID=1\n" + line)); err == nil || !strings.HasPrefix(err.Error(), "Line 2 ") {
+			t.Errorf("%q: expected an error for line 2, got %v.", line, err)
+		}
+	}
+}
+
+func TestParseFlatMap(t *testing.T) {
+	parsed, err := parseFlatMap([]byte(`{"password": "hunter2", "port": 5432, "ratio": 0.5, "enabled": true}`))
+	checkImport(t, "JSON", parsed, err, map[string]string{
+		"password": "hunter2",
+		"port":     "5432",
+		"ratio":    "0.5",
+		"enabled":  "true",
+	})
+
+	parsed, err = parseFlatMap([]byte("password: hunter2\ncertificate: |\n  line 1\n  line 2\n"))
+	checkImport(t, "YAML", parsed, err, map[string]string{
+		"password":    "hunter2",
+		"certificate": "line 1\nline 2\n",
+	})
+
+	invalid := []string{
+		`{"nested": {"key": "value"}}`,
+		`{"list": ["a", "b"]}`,
+		`{"empty": null}`,
+		`["not", "a", "map"]`,
+		`{"broken": `,
+	}
+
+	for _, content := range invalid {
+		if _, err := parseFlatMap([]byte(content)); err == nil {
+			t.Errorf("%s was accepted.", content)
+		}
+	}
+}
+
+func TestParseKubernetesSecret(t *testing.T) {
+	manifests := `---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: database
+data:
+  password: aHVudGVyMg==
+  user: cmF6aWVs
+stringData:
+  user: admin
+---
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: api
+stringData:
+  token: abc123
+`
+
+	parsed, err := parseKubernetesSecret([]byte(manifests))
+	checkImport(t, "YAML", parsed, err, map[string]string{
+		"password": "hunter2",
+		"user":     "admin",
+		"token":    "abc123",
+	})
+
+	parsed, err = parseKubernetesSecret([]byte(`{"apiVersion": "v1", "kind": "Secret", "data": {"password": "aHVudGVyMg=="}}`))
+	checkImport(t, "JSON", parsed, err, map[string]string{
+		"password": "hunter2",
+	})
+
+	invalid := map[string]string{
+		"ConfigMap":      "kind: ConfigMap\ndata:\n  key: value\n",
+		"mixed kinds":    "kind: Secret\nstringData:\n  a: b\n---\nkind: ConfigMap\ndata:\n  key: value\n",
+		"invalid base64": "kind: Secret\ndata:\n  password: hunter2!\n",
+		"no documents":   "---\n",
+		"broken YAML":    "kind: Secret\ndata: [\n",
+	}
+
+	for name, content := range invalid {
+		if _, err := parseKubernetesSecret([]byte(content)); err == nil {
+			t.Errorf("%s: the manifest was accepted.", name)
+		}
+	}
+}
+
+func TestParseVaultExport(t *testing.T) {
+	export := `{
+  "request_id": "5a5e0b2c",
+  "data": {
+    "data": {"password": "hunter2", "port": 5432},
+    "metadata": {"created_time": "2020-01-01T00:00:00Z", "version": 3}
+  }
+}`
+
+	parsed, err := parseVaultExport([]byte(export))
+	checkImport(t, "KV v2", parsed, err, map[string]string{
+		"password": "hunter2",
+		"port":     "5432",
+	})
+
+	invalid := map[string]string{
+		"KV v1":       `{"data": {"password": "hunter2"}}`,
+		"nested":      `{"data": {"data": {"db": {"password": "hunter2"}}, "metadata": {}}}`,
+		"broken JSON": `{"data": `,
+	}
+
+	for name, content := range invalid {
+		if _, err := parseVaultExport([]byte(content)); err == nil {
+			t.Errorf("%s: the export was accepted.", name)
+		}
+	}
+
+	if _, err := parseImport("xml", []byte(export)); err == nil {
+		t.Error("An unknown format was accepted.")
+	}
+}
+
+func TestDeriveSlug(t *testing.T) {
+	testcases := map[string]string{
+		"DATABASE_PASSWORD": "database-password",
+		"api.token":         "api-token",
+		"__private__":       "private",
+		"2FA_SECRET":        "s-2fa-secret",
+	}
+
+	for key, expected := range testcases {
+		if slug, err := deriveSlug("", key); err != nil || slug != expected {
+			t.Errorf("Expected %q to become %q, got %q (%v).", key, expected, slug, err)
+		}
+	}
+
+	if slug, _ := deriveSlug("prod_", "DB_PASSWORD"); slug != "prod-db-password" {
+		t.Errorf("The prefix was not applied: %q", slug)
+	}
+
+	if _, err := deriveSlug("", "___"); err == nil {
+		t.Error("A key without any usable characters was accepted.")
+	}
+}
+
+func TestImport(t *testing.T) {
+	tx := newTestTx(t)
+
+	user := createTestUser(t, "admin", tx)
+	consumer := createTestConsumer(t, "web", user, tx)
+	createTestSecret(t, "db-password", "old", user, tx)
+
+	values := map[string][]byte{
+		"DB_PASSWORD": []byte("new"),
+		"API_TOKEN":   []byte("abc123"),
+		"api.token":   []byte("duplicate"),
+		"EMPTY":       []byte(""),
+	}
+
+	items := planImport(values, "", tx)
+	statuses := make(map[string]string)
+
+	for _, item := range items {
+		statuses[item.Key] = item.Status
+	}
+
+	expected := map[string]string{"API_TOKEN": "new", "DB_PASSWORD": "exists", "EMPTY": "invalid", "api.token": "duplicate"}
+
+	for key, status := range expected {
+		if statuses[key] != status {
+			t.Errorf("Expected %s to be %s, got %q.", key, status, statuses[key])
+		}
+	}
+
+	// existing secrets are kept unless they are to be overwritten
+	imported, err := executeImport(items, ImportDotenv, ImportSkip, consumer, user, newTestRequest("POST", "/secrets/import"), tx)
+	if err != nil || imported != 1 {
+		t.Fatalf("Expected one secret to be imported, got %d (%v).", imported, err)
+	}
+
+	if body, _ := Decrypt(findSecretBySlug("db-password", true, tx).Secret); string(body) != "old" {
+		t.Errorf("The existing secret was overwritten: %q", body)
+	}
+
+	imported, err = executeImport(planImport(values, "", tx), ImportDotenv, ImportOverwrite, consumer, user, newTestRequest("POST", "/secrets/import"), tx)
+	if err != nil || imported != 2 {
+		t.Fatalf("Expected two secrets to be imported, got %d (%v).", imported, err)
+	}
+
+	if body, _ := Decrypt(findSecretBySlug("db-password", true, tx).Secret); string(body) != "new" {
+		t.Errorf("The existing secret was not overwritten: %q", body)
+	}
+
+	if secrets := consumer.GetSecrets(false); len(secrets) != 2 {
+		t.Errorf("Expected the consumer to be granted both secrets, got %+v.", secrets)
+	}
+}
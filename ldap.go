@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/ldap.v2"
+)
+
+var ldapAuth *LdapAuthenticator
+
+// errLdapUserNotFound is returned whenever a login could not be resolved to exactly one
+// directory entry. It is used to tell "the user is gone" apart from "the directory is down".
+var errLdapUserNotFound = errors.New("User could not be found in the directory.")
+
+type ldapUser struct {
+	Dn     string
+	Login  string
+	Name   string
+	Groups []string
+}
+
+// LdapAuthenticator authenticates users by binding against an LDAP directory (OpenLDAP, Active
+// Directory, glauth, ...) and keeps the local user table in sync with it.
+type LdapAuthenticator struct {
+	url          *url.URL
+	startTls     bool
+	skipVerify   bool
+	bindDn       string
+	bindPassword string
+	baseDn       string
+	userFilter   string
+	loginAttr    string
+	nameAttr     string
+	groupAttr    string
+	roles        map[string]string
+	defaultRole  string
+}
+
+func NewLdapAuthenticator(c *configuration) (*LdapAuthenticator, error) {
+	cfg := c.Ldap
+
+	parsed, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, errors.New("Invalid LDAP URL configured: " + err.Error())
+	}
+
+	if parsed.Scheme != "ldap" && parsed.Scheme != "ldaps" {
+		return nil, errors.New("The LDAP URL must start with ldap:// or ldaps://.")
+	}
+
+	if cfg.BaseDn == "" {
+		return nil, errors.New("No LDAP base DN configured.")
+	}
+
+	if cfg.DefaultRole != "" && !isValidRole(cfg.DefaultRole) {
+		return nil, errors.New("Invalid default LDAP role '" + cfg.DefaultRole + "' configured.")
+	}
+
+	// the login is put into the filter with fmt.Sprintf
+	if cfg.UserFilter != "" && (strings.Count(cfg.UserFilter, "%s") != 1 || strings.Count(strings.Replace(cfg.UserFilter, "%%", "", -1), "%") != 1) {
+		return nil, errors.New("The LDAP user filter must contain exactly one %s for the login (and %% for a literal percent sign).")
+	}
+
+	roles := make(map[string]string)
+
+	for group, role := range cfg.Roles {
+		if !isValidRole(role) {
+			return nil, errors.New("Invalid role '" + role + "' configured for LDAP group '" + group + "'.")
+		}
+
+		// DNs are case-insensitive
+		roles[strings.ToLower(group)] = role
+	}
+
+	auth := &LdapAuthenticator{
+		url:          parsed,
+		startTls:     cfg.StartTls,
+		skipVerify:   cfg.SkipVerify,
+		bindDn:       cfg.BindDn,
+		bindPassword: cfg.BindPassword,
+		baseDn:       cfg.BaseDn,
+		userFilter:   cfg.UserFilter,
+		loginAttr:    cfg.LoginAttribute,
+		nameAttr:     cfg.NameAttribute,
+		groupAttr:    cfg.GroupAttribute,
+		roles:        roles,
+		defaultRole:  cfg.DefaultRole,
+	}
+
+	// set some sane defaults that work with OpenLDAP and glauth
+	if auth.loginAttr == "" {
+		auth.loginAttr = "uid"
+	}
+
+	if auth.nameAttr == "" {
+		auth.nameAttr = "cn"
+	}
+
+	if auth.groupAttr == "" {
+		auth.groupAttr = "memberOf"
+	}
+
+	if auth.userFilter == "" {
+		auth.userFilter = "(" + auth.loginAttr + "=%s)"
+	}
+
+	return auth, nil
+}
+
+// Authenticate checks the given credentials against the directory and returns the matching
+// directory entry. The password is verified by binding as the user.
+func (a *LdapAuthenticator) Authenticate(login string, password string) (*ldapUser, error) {
+	// an empty password would result in an unauthenticated bind, which most servers accept
+	if len(password) == 0 {
+		return nil, errors.New("No password given.")
+	}
+
+	conn, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	user, err := a.find(conn, login)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.Bind(user.Dn, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Lookup finds a user in the directory without checking any credentials.
+func (a *LdapAuthenticator) Lookup(login string) (*ldapUser, error) {
+	conn, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return a.find(conn, login)
+}
+
+// Role maps the user's group memberships to a Raziel role. Admin wins over any other role. An
+// empty string means that the user is not allowed to log in at all.
+func (a *LdapAuthenticator) Role(user *ldapUser) string {
+	role := ""
+
+	for _, group := range user.Groups {
+		mapped, ok := a.roles[strings.ToLower(group)]
+		if !ok {
+			continue
+		}
+
+		if mapped == RoleAdmin {
+			return RoleAdmin
+		}
+
+		role = mapped
+	}
+
+	if role == "" {
+		role = a.defaultRole
+	}
+
+	return role
+}
+
+func (a *LdapAuthenticator) connect() (*ldap.Conn, error) {
+	var conn *ldap.Conn
+	var err error
+
+	host := a.url.Host
+	tlsConfig := &tls.Config{
+		ServerName:         a.url.Hostname(),
+		InsecureSkipVerify: a.skipVerify,
+	}
+
+	if a.url.Scheme == "ldaps" {
+		if a.url.Port() == "" {
+			host = net.JoinHostPort(host, "636")
+		}
+
+		conn, err = ldap.DialTLS("tcp", host, tlsConfig)
+	} else {
+		if a.url.Port() == "" {
+			host = net.JoinHostPort(host, "389")
+		}
+
+		conn, err = ldap.Dial("tcp", host)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if a.startTls && a.url.Scheme == "ldap" {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// bind as the service account (if configured) to be allowed to search the directory
+	if a.bindDn != "" {
+		err = conn.Bind(a.bindDn, a.bindPassword)
+		if err != nil {
+			conn.Close()
+			return nil, errors.New("Could not bind as the LDAP service account: " + err.Error())
+		}
+	}
+
+	return conn, nil
+}
+
+func (a *LdapAuthenticator) find(conn *ldap.Conn, login string) (*ldapUser, error) {
+	request := ldap.NewSearchRequest(
+		a.baseDn,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf(a.userFilter, ldap.EscapeFilter(login)),
+		[]string{"dn", a.loginAttr, a.nameAttr, a.groupAttr},
+		nil,
+	)
+
+	result, err := conn.Search(request)
+	if err != nil {
+		// a size limit error means there was more than one match
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, errLdapUserNotFound
+		}
+
+		return nil, err
+	}
+
+	if len(result.Entries) != 1 {
+		return nil, errLdapUserNotFound
+	}
+
+	entry := result.Entries[0]
+	user := &ldapUser{
+		Dn:     entry.DN,
+		Login:  entry.GetAttributeValue(a.loginAttr),
+		Name:   entry.GetAttributeValue(a.nameAttr),
+		Groups: entry.GetAttributeValues(a.groupAttr),
+	}
+
+	if user.Name == "" {
+		user.Name = user.Login
+	}
+
+	return user, nil
+}
+
+// provisionLdapUser creates or updates the local user for a successfully authenticated
+// directory user. It returns nil if the user is not allowed to log in.
+func provisionLdapUser(entry *ldapUser, req *http.Request, db *sqlx.Tx) (*User, error) {
+	role := ldapAuth.Role(entry)
+	if role == "" {
+		return nil, nil
+	}
+
+	login, err := validateSafeString(entry.Login, "login")
+	if err != nil {
+		return nil, errors.New("LDAP login '" + entry.Login + "' is not usable: " + err.Error())
+	}
+
+	dn := entry.Dn
+	user := findUserByLogin(login, false, db)
+
+	// never take over local accounts
+	if user != nil && user.Backend != BackendLdap {
+		return nil, errors.New("LDAP login '" + login + "' collides with a local user.")
+	}
+
+	if user == nil {
+		user = &User{
+			Id:         -1,
+			Name:       entry.Name,
+			LoginName:  login,
+			Role:       role,
+			Backend:    BackendLdap,
+			ExternalId: &dn,
+			_db:        db,
+		}
+
+		err = user.Save()
+		if err != nil {
+			return nil, err
+		}
+
+		NewAuditLog(db, req).LogUserProvisioned(user.Id, BackendLdap)
+
+		return user, nil
+	}
+
+	// keep the local copy up-to-date
+	if user.Name != entry.Name || user.Role != role || user.ExternalId == nil || *user.ExternalId != dn {
+		user.Name = entry.Name
+		user.Role = role
+		user.ExternalId = &dn
+
+		err = user.Save()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// syncLdapUsers periodically checks all LDAP users and marks those as deleted that have been
+// removed from the directory or lost all of their role-granting group memberships.
+func syncLdapUsers(database *sqlx.DB, interval time.Duration) {
+	for {
+		<-time.After(interval)
+
+		err := syncLdapUsersOnce(database)
+		if err != nil {
+			log.Println("Warning: LDAP user sync failed: " + err.Error())
+		}
+	}
+}
+
+// syncLdapUsersOnce looks up all LDAP users and then updates them, each in a short transaction of
+// its own; no transaction is kept open while waiting for the directory.
+func syncLdapUsersOnce(database *sqlx.DB) error {
+	return syncLdapUsersWith(database, ldapAuth.Lookup)
+}
+
+// syncLdapUsersWith does the work of syncLdapUsersOnce, looking up the users with the given
+// function.
+func syncLdapUsersWith(database *sqlx.DB, lookup func(string) (*ldapUser, error)) error {
+	tx, err := database.Beginx()
+	if err != nil {
+		return err
+	}
+
+	users := findUsersByBackend(BackendLdap, tx)
+	tx.Rollback()
+
+	// nil for users that are gone from the directory
+	entries := make(map[int]*ldapUser)
+
+	for _, user := range users {
+		entry, err := lookup(user.LoginName)
+
+		// do not touch anyone if the directory is unreachable
+		if err != nil && err != errLdapUserNotFound {
+			return err
+		}
+
+		entries[user.Id] = entry
+	}
+
+	for _, user := range users {
+		err := syncLdapUser(user.Id, entries[user.Id], database)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncLdapUser applies the directory entry to a user, or deletes the user if there is no entry or
+// it does not grant any role.
+func syncLdapUser(userId int, entry *ldapUser, database *sqlx.DB) error {
+	tx, err := database.Beginx()
+	if err != nil {
+		return err
+	}
+
+	// the user might have been changed while the directory was asked
+	user := findUser(userId, false, tx)
+
+	if user == nil || user.Backend != BackendLdap || user.Deleted != nil {
+		tx.Rollback()
+		return nil
+	}
+
+	if entry == nil || ldapAuth.Role(entry) == "" {
+		err = user.Delete()
+		if err == nil {
+			NewAuditLog(tx, nil).LogUserDeprovisioned(user.Id, BackendLdap)
+		}
+	} else if role := ldapAuth.Role(entry); user.Role != role || user.Name != entry.Name {
+		user.Role = role
+		user.Name = entry.Name
+
+		err = user.Save()
+	}
+
+	if err != nil {
+		eventBus.Discard(tx)
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		eventBus.Discard(tx)
+		return err
+	}
+
+	eventBus.Flush(tx)
+
+	return nil
+}
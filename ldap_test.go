@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestNewLdapAuthenticatorChecksTheUserFilter(t *testing.T) {
+	testcases := map[string]bool{
+		"":         true,
+		"(uid=%s)": true,
+		"(&(objectClass=user)(sAMAccountName=%s))": true,
+		"(&(uid=%s)(description=100%%))":           true,
+		"(objectClass=posixAccount)":               false,
+		"(|(uid=%s)(mail=%s))":                     false,
+		"(uid=%d)":                                 false,
+		"(&(uid=%s)(description=100%))":            false,
+		"(uid=%%s)":                                false,
+	}
+
+	for filter, valid := range testcases {
+		config := &configuration{}
+		config.Ldap.Url = "ldap://localhost"
+		config.Ldap.BaseDn = "dc=example,dc=com"
+		config.Ldap.UserFilter = filter
+
+		if _, err := NewLdapAuthenticator(config); (err == nil) != valid {
+			t.Errorf("%q: expected valid=%v, got %v.", filter, valid, err)
+		}
+	}
+}
+
+func TestSyncLdapUsers(t *testing.T) {
+	db := newTestDatabase(t)
+
+	tx, _ := db.Beginx()
+	users := make(map[string]*User)
+
+	for _, login := range []string{"gone", "demoted", "renamed", "unchanged"} {
+		users[login] = createTestUser(t, login, tx)
+	}
+
+	if _, err := tx.Exec("UPDATE `user` SET `backend` = ?", BackendLdap); err != nil {
+		t.Fatal(err)
+	}
+
+	tx.Commit()
+
+	previous := ldapAuth
+	ldapAuth = &LdapAuthenticator{roles: map[string]string{"cn=admins": RoleAdmin}}
+	defer func() { ldapAuth = previous }()
+
+	directory := map[string]*ldapUser{
+		"demoted":   {Login: "demoted", Name: "demoted"},
+		"renamed":   {Login: "renamed", Name: "Jane Doe", Groups: []string{"CN=Admins"}},
+		"unchanged": {Login: "unchanged", Name: "unchanged", Groups: []string{"cn=admins"}},
+	}
+
+	unreachable := errors.New("The directory is down.")
+
+	// nobody is touched while the directory is unreachable
+	err := syncLdapUsersWith(db, func(login string) (*ldapUser, error) {
+		if login == "unchanged" {
+			return nil, unreachable
+		}
+
+		return nil, errLdapUserNotFound
+	})
+
+	if err != unreachable {
+		t.Errorf("Expected the lookup error, got %v.", err)
+	}
+
+	if count := countLdapUsers(t, db); count != 4 {
+		t.Fatalf("Users were deleted although the directory was unreachable; %d are left.", count)
+	}
+
+	err = syncLdapUsersWith(db, func(login string) (*ldapUser, error) {
+		// writing would time out if the sync kept a transaction open while asking the directory
+		tx, err := db.Beginx()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.Exec("UPDATE `user` SET `email` = NULL WHERE `login` = ?", login); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+
+		if entry, ok := directory[login]; ok {
+			return entry, nil
+		}
+
+		return nil, errLdapUserNotFound
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, _ = db.Beginx()
+	defer tx.Rollback()
+
+	for login, deleted := range map[string]bool{"gone": true, "demoted": true, "renamed": false, "unchanged": false} {
+		user := findUser(users[login].Id, false, tx)
+
+		if (user.Deleted != nil) != deleted {
+			t.Errorf("%s: expected deleted=%v, got %+v.", login, deleted, user)
+		}
+	}
+
+	if renamed := findUser(users["renamed"].Id, false, tx); renamed.Name != "Jane Doe" || renamed.Role != RoleAdmin {
+		t.Errorf("The user was not updated: %+v", renamed)
+	}
+
+	if entries := NewAuditLog(tx, nil).FindByActions([]string{"user-deprovisioned"}, 10, 0); len(entries) != 2 {
+		t.Errorf("Expected two deprovisioned users, got %+v.", entries)
+	}
+}
+
+func countLdapUsers(t *testing.T, db *sqlx.DB) int {
+	t.Helper()
+
+	count := 0
+	if err := db.Get(&count, "SELECT COUNT(*) FROM `user` WHERE `backend` = ? AND `deleted` IS NULL", BackendLdap); err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
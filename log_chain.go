@@ -0,0 +1,590 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Every entry in the audit and access log stores a hash over its content and the hash of its
+// predecessor. Changing or deleting an entry breaks the chain, which can be detected by walking
+// it. The audit log forms a single chain, the access log has one chain per consumer, so that
+// pruning old entries only ever cuts off the beginning of a chain.
+
+const (
+	chainAuditLog  = "audit_log"
+	chainAccessLog = "access_log"
+)
+
+var checkpointKey ed25519.PrivateKey
+
+type auditLogLink struct {
+	Secret    *int    `json:"secret"`
+	Consumer  *int    `json:"consumer"`
+	User      *int    `json:"user"`
+	Action    string  `json:"action"`
+	CreatedAt string  `json:"createdAt"`
+	CreatedBy int     `json:"createdBy"`
+	OriginIp  string  `json:"originIp"`
+	UserAgent *string `json:"userAgent"`
+	Context   *string `json:"context"`
+}
+
+type accessLogLink struct {
+	Secret      *int    `json:"secret"`
+	Consumer    *int    `json:"consumer"`
+	RequestedAt string  `json:"requestedAt"`
+	OriginIp    string  `json:"originIp"`
+	Status      int     `json:"status"`
+	Context     *string `json:"context"`
+	RequestBody *string `json:"requestBody"`
+}
+
+func chainHash(prevHash string, content interface{}) string {
+	encoded, err := json.Marshal(content)
+	if err != nil {
+		panic(err)
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(prevHash))
+	hash.Write([]byte("\n"))
+	hash.Write(encoded)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// databaseNow returns the database's current time, so that the hashed timestamp is exactly the
+// one that is stored.
+func databaseNow(db *sqlx.Tx) string {
+	now := ""
+
+	err := db.Get(&now, "SELECT NOW()")
+	if err != nil {
+		panic(err)
+	}
+
+	return now
+}
+
+// auditLogHead returns the hash of the newest audit log entry. Writing to the audit log is
+// serialised by locking the audit_log_lock config row until the transaction ends, so concurrent
+// requests can neither fork the chain nor commit their entries out of order (see changesSince).
+// Locking the newest entry would not do, as there is none in an empty log.
+func auditLogHead(db *sqlx.Tx) string {
+	var hash sql.NullString
+	var lock string
+
+	err := db.Get(&lock, "SELECT `key` FROM `config` WHERE `key` = 'audit_log_lock' FOR UPDATE")
+	if err != nil {
+		panic(err)
+	}
+
+	err = db.Get(&hash, "SELECT `hash` FROM `audit_log` ORDER BY `id` DESC LIMIT 1 FOR UPDATE")
+	if err != nil && err != sql.ErrNoRows {
+		panic(err)
+	}
+
+	return hash.String
+}
+
+// accessLogHead returns the hash of the newest access log entry of the given consumer (nil for
+// requests that could not be attributed to any consumer). Like auditLogHead, writers of the same
+// chain are serialised by a lock row: the consumer itself, or the access_log_lock config row for
+// the unattributed requests. The head itself is still read with FOR UPDATE, as only a locking read
+// sees entries committed after MySQL took the transaction's snapshot.
+func accessLogHead(consumer *int, db *sqlx.Tx) string {
+	var hash sql.NullString
+	var lock string
+	var err error
+
+	if consumer == nil {
+		err = db.Get(&lock, "SELECT `key` FROM `config` WHERE `key` = 'access_log_lock' FOR UPDATE")
+		if err != nil {
+			panic(err)
+		}
+
+		err = db.Get(&hash, "SELECT `hash` FROM `access_log` WHERE `consumer_id` IS NULL ORDER BY `id` DESC LIMIT 1 FOR UPDATE")
+	} else {
+		// a consumer that does not exist (anymore) cannot be logged for anyway
+		err = db.Get(&lock, "SELECT `id` FROM `consumer` WHERE `id` = ? FOR UPDATE", *consumer)
+		if err != nil && err != sql.ErrNoRows {
+			panic(err)
+		}
+
+		err = db.Get(&hash, "SELECT `hash` FROM `access_log` WHERE `consumer_id` = ? ORDER BY `id` DESC LIMIT 1 FOR UPDATE", *consumer)
+	}
+
+	if err != nil && err != sql.ErrNoRows {
+		panic(err)
+	}
+
+	return hash.String
+}
+
+func accessLogChainName(consumer *int) string {
+	if consumer == nil {
+		return "none"
+	}
+
+	return strconv.Itoa(*consumer)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Verification
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type chainVerification struct {
+	Log         string
+	Entries     int
+	Chains      int
+	Checkpoints int
+	BrokenAt    int
+	Problem     string
+}
+
+func (v *chainVerification) Okay() bool {
+	return v.Problem == ""
+}
+
+func (v *chainVerification) fail(id int, problem string) {
+	if v.Problem == "" {
+		v.BrokenAt = id
+		v.Problem = problem
+	}
+}
+
+type chainedAuditLogRow struct {
+	Id        int            `db:"id"`
+	Secret    *int           `db:"secret_id"`
+	Consumer  *int           `db:"consumer_id"`
+	User      *int           `db:"user_id"`
+	Action    string         `db:"action"`
+	CreatedAt string         `db:"created_at"`
+	CreatedBy int            `db:"created_by"`
+	OriginIp  string         `db:"origin_ip"`
+	UserAgent *string        `db:"user_agent"`
+	Context   *string        `db:"context"`
+	PrevHash  sql.NullString `db:"prev_hash"`
+	Hash      sql.NullString `db:"hash"`
+}
+
+type chainedAccessLogRow struct {
+	Id          int            `db:"id"`
+	Secret      *int           `db:"secret_id"`
+	Consumer    *int           `db:"consumer_id"`
+	RequestedAt string         `db:"requested_at"`
+	OriginIp    string         `db:"origin_ip"`
+	Status      int            `db:"status"`
+	Context     *string        `db:"context"`
+	RequestBody *string        `db:"request_body"`
+	PrevHash    sql.NullString `db:"prev_hash"`
+	Hash        sql.NullString `db:"hash"`
+}
+
+// chainWalker keeps track of the last seen hash per chain. Entries before start were written
+// before the chains were introduced and may lack a hash; all others must be hashed. A chain
+// starts with an empty prev_hash or, once it has been pruned, with the hash of the newest pruned
+// entry.
+type chainWalker struct {
+	heads  map[string]string
+	start  int
+	pruned map[string]map[string]bool
+	result *chainVerification
+}
+
+func newChainWalker(logName string, result *chainVerification, db *sqlx.Tx) *chainWalker {
+	walker := &chainWalker{
+		heads:  make(map[string]string),
+		start:  chainStart(logName, db),
+		pruned: make(map[string]map[string]bool),
+		result: result,
+	}
+
+	markers := make([]logCheckpoint, 0)
+
+	err := db.Select(&markers, "SELECT `chain`, `hash` FROM `log_checkpoint` WHERE `log` = ? AND `pruned` = 1", logName)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, marker := range markers {
+		if walker.pruned[marker.Chain] == nil {
+			walker.pruned[marker.Chain] = make(map[string]bool)
+		}
+
+		walker.pruned[marker.Chain][marker.Hash] = true
+	}
+
+	return walker
+}
+
+// chainStart returns the ID of the first entry that must be hashed. The value is recorded when
+// migrating an existing database; in new databases, every entry is hashed.
+func chainStart(logName string, db *sqlx.Tx) int {
+	c := dbConfig{}
+
+	err := db.Get(&c, "SELECT `key`, `value` FROM `config` WHERE `key` = ?", logName+"_chain_start")
+	if err == sql.ErrNoRows {
+		return 0
+	}
+
+	if err != nil {
+		panic(err)
+	}
+
+	start, _ := strconv.Atoi(string(c.Value))
+
+	return start
+}
+
+func (w *chainWalker) visit(chain string, id int, prevHash sql.NullString, hash sql.NullString, content interface{}) {
+	head, known := w.heads[chain]
+
+	if !hash.Valid {
+		if known || id >= w.start {
+			w.result.fail(id, "The entry has no hash; its hash has been removed.")
+		}
+
+		return
+	}
+
+	w.result.Entries++
+
+	if !known {
+		w.result.Chains++
+
+		if prevHash.String != "" && !w.pruned[chain][prevHash.String] {
+			w.result.fail(id, "The first entry of the chain does not link to its start; entries have been removed.")
+		}
+	} else if prevHash.String != head {
+		w.result.fail(id, "The entry does not link to its predecessor; entries have been removed or re-ordered.")
+	}
+
+	if chainHash(prevHash.String, content) != hash.String {
+		w.result.fail(id, "The entry's content does not match its hash; it has been modified.")
+	}
+
+	w.heads[chain] = hash.String
+}
+
+func verifyAuditLog(db *sqlx.Tx) *chainVerification {
+	result := &chainVerification{Log: chainAuditLog}
+	walker := newChainWalker(chainAuditLog, result, db)
+	lastId := 0
+
+	for result.Okay() {
+		rows := make([]chainedAuditLogRow, 0)
+
+		err := db.Select(&rows, "SELECT `id`, `secret_id`, `consumer_id`, `user_id`, `action`, `created_at`, `created_by`, `origin_ip`, `user_agent`, `context`, `prev_hash`, `hash` FROM `audit_log` WHERE `id` > ? ORDER BY `id` LIMIT 1000", lastId)
+		if err != nil {
+			panic(err)
+		}
+
+		if len(rows) == 0 {
+			break
+		}
+
+		for _, row := range rows {
+			walker.visit(chainAuditLog, row.Id, row.PrevHash, row.Hash, auditLogLink{
+				Secret:    row.Secret,
+				Consumer:  row.Consumer,
+				User:      row.User,
+				Action:    row.Action,
+				CreatedAt: row.CreatedAt,
+				CreatedBy: row.CreatedBy,
+				OriginIp:  row.OriginIp,
+				UserAgent: row.UserAgent,
+				Context:   row.Context,
+			})
+
+			lastId = row.Id
+		}
+	}
+
+	verifyCheckpoints(chainAuditLog, result, db)
+
+	return result
+}
+
+func verifyAccessLog(db *sqlx.Tx) *chainVerification {
+	result := &chainVerification{Log: chainAccessLog}
+	walker := newChainWalker(chainAccessLog, result, db)
+	lastId := 0
+
+	for result.Okay() {
+		rows := make([]chainedAccessLogRow, 0)
+
+		err := db.Select(&rows, "SELECT `id`, `secret_id`, `consumer_id`, `requested_at`, `origin_ip`, `status`, `context`, `request_body`, `prev_hash`, `hash` FROM `access_log` WHERE `id` > ? ORDER BY `id` LIMIT 1000", lastId)
+		if err != nil {
+			panic(err)
+		}
+
+		if len(rows) == 0 {
+			break
+		}
+
+		for _, row := range rows {
+			walker.visit(accessLogChainName(row.Consumer), row.Id, row.PrevHash, row.Hash, accessLogLink{
+				Secret:      row.Secret,
+				Consumer:    row.Consumer,
+				RequestedAt: row.RequestedAt,
+				OriginIp:    row.OriginIp,
+				Status:      row.Status,
+				Context:     row.Context,
+				RequestBody: row.RequestBody,
+			})
+
+			lastId = row.Id
+		}
+	}
+
+	verifyCheckpoints(chainAccessLog, result, db)
+
+	return result
+}
+
+// runLogVerification verifies both logs, prints the results and returns the exit code.
+func runLogVerification(database *sqlx.DB) int {
+	tx, err := database.Beginx()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer tx.Rollback()
+
+	code := 0
+
+	for _, result := range []*chainVerification{verifyAuditLog(tx), verifyAccessLog(tx)} {
+		if result.Okay() {
+			fmt.Printf("%s: OK (%d entries in %d chain(s), %d checkpoint(s))\n", result.Log, result.Entries, result.Chains, result.Checkpoints)
+		} else {
+			fmt.Printf("%s: BROKEN at entry #%d: %s\n", result.Log, result.BrokenAt, result.Problem)
+			code = 1
+		}
+	}
+
+	return code
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Signed checkpoints
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type logCheckpoint struct {
+	Id        int    `db:"id"`
+	CreatedAt string `db:"created_at"`
+	Log       string `db:"log"`
+	Chain     string `db:"chain"`
+	EntryId   int    `db:"entry_id"`
+	Hash      string `db:"hash"`
+	Signature string `db:"signature"`
+	Pruned    bool   `db:"pruned"`
+}
+
+func (c *logCheckpoint) message() []byte {
+	message := fmt.Sprintf("%s:%s:%d:%s:%s", c.Log, c.Chain, c.EntryId, c.Hash, c.CreatedAt)
+
+	if c.Pruned {
+		message += ":pruned"
+	}
+
+	return []byte(message)
+}
+
+// insert signs the checkpoint (if a key is configured) and stores it.
+func (c *logCheckpoint) insert(db sqlx.Execer) error {
+	c.Signature = ""
+
+	if checkpointKey != nil {
+		c.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(checkpointKey, c.message()))
+	}
+
+	_, err := db.Exec(
+		"INSERT INTO `log_checkpoint` (`created_at`, `log`, `chain`, `entry_id`, `hash`, `signature`, `pruned`) VALUES (?,?,?,?,?,?,?)",
+		c.CreatedAt, c.Log, c.Chain, c.EntryId, c.Hash, c.Signature, c.Pruned,
+	)
+
+	return err
+}
+
+// loadCheckpointKey reads an Ed25519 private key in PKCS#8 PEM format, as created by
+// "openssl genpkey -algorithm ed25519".
+func loadCheckpointKey(filename string) (ed25519.PrivateKey, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("The checkpoint key is not PEM-encoded.")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("The checkpoint key is not an Ed25519 key.")
+	}
+
+	return key, nil
+}
+
+// writeCheckpoints periodically signs the current head of every chain.
+func writeCheckpoints(database *sqlx.DB, interval time.Duration) {
+	for {
+		<-time.After(interval)
+
+		err := writeCheckpointsOnce(database)
+		if err != nil {
+			log.Println("Warning: Could not write log checkpoints: " + err.Error())
+		}
+	}
+}
+
+func writeCheckpointsOnce(database *sqlx.DB) error {
+	tx, err := database.Beginx()
+	if err != nil {
+		return err
+	}
+
+	heads := make([]logCheckpoint, 0)
+	chains := make([]struct {
+		Consumer *int   `db:"consumer_id"`
+		EntryId  int    `db:"id"`
+		Hash     string `db:"hash"`
+	}, 0)
+
+	err = tx.Select(&heads, "SELECT '"+chainAuditLog+"' AS `log`, '' AS `chain`, `id` AS `entry_id`, `hash` FROM `audit_log` WHERE `id` = (SELECT MAX(`id`) FROM `audit_log` WHERE `hash` IS NOT NULL)")
+	if err == nil {
+		err = tx.Select(&chains, "SELECT `consumer_id`, `id`, `hash` FROM `access_log` WHERE `id` IN (SELECT MAX(`id`) FROM `access_log` WHERE `hash` IS NOT NULL GROUP BY `consumer_id`)")
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, chain := range chains {
+		heads = append(heads, logCheckpoint{
+			Log:     chainAccessLog,
+			Chain:   accessLogChainName(chain.Consumer),
+			EntryId: chain.EntryId,
+			Hash:    chain.Hash,
+		})
+	}
+	now := time.Now().Format("2006-01-02 15:04:05")
+
+	for _, head := range heads {
+		last := 0
+		tx.Get(&last, "SELECT `entry_id` FROM `log_checkpoint` WHERE `log` = ? AND `chain` = ? ORDER BY `id` DESC LIMIT 1", head.Log, head.Chain)
+
+		// nothing happened since the last checkpoint
+		if last == head.EntryId {
+			continue
+		}
+
+		head.CreatedAt = now
+
+		err = head.insert(tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		// also leave a trace outside of the database
+		log.Printf("Log checkpoint: %s:%s #%d %s", head.Log, head.Chain, head.EntryId, head.Hash)
+	}
+
+	return tx.Commit()
+}
+
+// verifyCheckpoints makes sure that every checkpointed entry still exists with the same hash. As
+// the access log is pruned, checkpointed entries may legitimately be gone if the pruning was
+// recorded.
+func verifyCheckpoints(logName string, result *chainVerification, db *sqlx.Tx) {
+	checkpoints := make([]logCheckpoint, 0)
+
+	err := db.Select(&checkpoints, "SELECT `id`, `created_at`, `log`, `chain`, `entry_id`, `hash`, `signature`, `pruned` FROM `log_checkpoint` WHERE `log` = ? ORDER BY `id`", logName)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, checkpoint := range checkpoints {
+		result.Checkpoints++
+
+		if checkpointKey != nil {
+			signature, err := base64.StdEncoding.DecodeString(checkpoint.Signature)
+			public := checkpointKey.Public().(ed25519.PublicKey)
+
+			if err != nil || !ed25519.Verify(public, checkpoint.message(), signature) {
+				result.fail(checkpoint.EntryId, "Checkpoint #"+strconv.Itoa(checkpoint.Id)+" has an invalid signature.")
+				continue
+			}
+		}
+
+		var hash sql.NullString
+		var pruned int
+
+		err := db.Get(&hash, "SELECT `hash` FROM `"+logName+"` WHERE `id` = ?", checkpoint.EntryId)
+
+		if err == sql.ErrNoRows {
+			err = db.Get(&pruned, "SELECT COUNT(*) FROM `log_checkpoint` WHERE `log` = ? AND `chain` = ? AND `pruned` = 1 AND `entry_id` >= ?", logName, checkpoint.Chain, checkpoint.EntryId)
+			if err != nil {
+				panic(err)
+			}
+
+			if pruned > 0 {
+				continue
+			}
+
+			result.fail(checkpoint.EntryId, "The entry recorded in checkpoint #"+strconv.Itoa(checkpoint.Id)+" has been deleted.")
+			continue
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		if hash.String != checkpoint.Hash {
+			result.fail(checkpoint.EntryId, "The entry does not match checkpoint #"+strconv.Itoa(checkpoint.Id)+".")
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// HTTP Handlers
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type logVerificationData struct {
+	layoutData
+
+	Results     []*chainVerification
+	Checkpoints bool
+}
+
+func logVerificationAction(user *User, session *Session, db *sqlx.Tx) response {
+	data := &logVerificationData{
+		layoutData:  NewLayoutData("Log Verification", "auditlog", user, session.CsrfToken),
+		Results:     []*chainVerification{verifyAuditLog(db), verifyAccessLog(db)},
+		Checkpoints: checkpointKey != nil,
+	}
+
+	return renderTemplate(200, "audit_log/verify", data)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-martini/martini"
+	"github.com/jmoiron/sqlx"
+)
+
+// fillAuditLog logs the given number of logins.
+func fillAuditLog(t *testing.T, db *sqlx.DB, entries int) {
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := createTestUser(t, "admin", tx)
+	auditLog := NewAuditLog(tx, newTestRequest("POST", "/login"))
+
+	for i := 0; i < entries; i++ {
+		auditLog.LogLogin(user.Id)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// logDeliveries logs the given number of deliveries to a single consumer. Unlike fillAccessLog,
+// the entries are not modified afterwards, so that their hashes stay valid.
+func logDeliveries(t *testing.T, db *sqlx.DB, entries int) {
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := createTestUser(t, "admin", tx)
+	consumer := createTestConsumer(t, "web", user, tx)
+	secret := createTestSecret(t, "password", "hunter2", user, tx, consumer)
+	accessLog := NewAccessLog(tx)
+
+	for i := 0; i < entries; i++ {
+		accessLog.LogAccess(consumer, secret, newTestRequest("GET", "/get"), 200, nil)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustExec(t *testing.T, db *sqlx.DB, query string, args ...interface{}) {
+	t.Helper()
+
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func verifyLog(t *testing.T, db *sqlx.DB, verify func(*sqlx.Tx) *chainVerification) *chainVerification {
+	t.Helper()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	return verify(tx)
+}
+
+func useCheckpointKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkpointKey = key
+	t.Cleanup(func() { checkpointKey = nil })
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	db := newTestDatabase(t)
+	fillAuditLog(t, db, 3)
+
+	result := verifyLog(t, db, verifyAuditLog)
+	if !result.Okay() || result.Entries != 3 || result.Chains != 1 {
+		t.Errorf("The intact log was not verified: %+v", result)
+	}
+}
+
+func TestConcurrentDeliveriesKeepTheChainsIntact(t *testing.T) {
+	db := newTestDatabase(t)
+
+	tx, _ := db.Beginx()
+	user := createTestUser(t, "admin", tx)
+	consumer := createTestConsumer(t, "web", user, tx)
+	createTestSecret(t, "password", "hunter2", user, tx, consumer)
+	tx.Commit()
+
+	// deliveries to the consumer and to unknown consumers, whose 404s are not attributed to anyone
+	identifiers := []string{consumer.GetIdentifier(), "nope"}
+	deliveries := 20
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < deliveries; i++ {
+		wg.Add(1)
+
+		go func(identifier string) {
+			defer wg.Done()
+
+			tx, err := db.Beginx()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			params := martini.Params{"consumer": identifier, "secret": "password"}
+			deliverSecretAction(params, newTestRequest("GET", "/get/"+identifier+"/password"), httptest.NewRecorder(), tx)
+
+			if err := tx.Commit(); err != nil {
+				t.Error(err)
+			}
+		}(identifiers[i%2])
+	}
+
+	wg.Wait()
+
+	result := verifyLog(t, db, verifyAccessLog)
+	if !result.Okay() || result.Entries != deliveries || result.Chains != 2 {
+		t.Errorf("Concurrent deliveries broke the chains: %+v", result)
+	}
+}
+
+func TestAccessLogWritesAreSerialised(t *testing.T) {
+	tx := newTestTx(t)
+
+	if _, err := tx.Exec("DELETE FROM `config` WHERE `key` = 'access_log_lock'"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("The access log was written without taking the lock.")
+		}
+	}()
+
+	NewAccessLog(tx).LogNotFound(nil, nil, newTestRequest("GET", "/get/nope/password"))
+}
+
+func TestVerifyAuditLogDetectsTampering(t *testing.T) {
+	testcases := map[string]struct {
+		query    string
+		brokenAt int
+	}{
+		"modified entry":         {"UPDATE `audit_log` SET `origin_ip` = '198.51.100.1' WHERE `id` = 2", 2},
+		"deleted entry":          {"DELETE FROM `audit_log` WHERE `id` = 2", 3},
+		"deleted head":           {"DELETE FROM `audit_log` WHERE `id` = 1", 2},
+		"removed hashes":         {"UPDATE `audit_log` SET `prev_hash` = NULL, `hash` = NULL", 1},
+		"removed hash":           {"UPDATE `audit_log` SET `prev_hash` = NULL, `hash` = NULL WHERE `id` = 3", 3},
+		"removed leading hashes": {"UPDATE `audit_log` SET `prev_hash` = NULL, `hash` = NULL WHERE `id` < 3", 1},
+	}
+
+	for name, testcase := range testcases {
+		db := newTestDatabase(t)
+		fillAuditLog(t, db, 3)
+		mustExec(t, db, testcase.query)
+
+		result := verifyLog(t, db, verifyAuditLog)
+		if result.Okay() {
+			t.Errorf("%s: the tampering was not detected.", name)
+		} else if result.BrokenAt != testcase.brokenAt {
+			t.Errorf("%s: expected the chain to break at #%d, but it broke at #%d (%s).", name, testcase.brokenAt, result.BrokenAt, result.Problem)
+		}
+	}
+}
+
+func TestVerifyAuditLogAcceptsEntriesFromBeforeTheChain(t *testing.T) {
+	db := newTestDatabase(t)
+	fillAuditLog(t, db, 2)
+
+	// as if the first two entries were written before the migration to 1.5
+	mustExec(t, db, "UPDATE `audit_log` SET `prev_hash` = NULL, `hash` = NULL")
+	mustExec(t, db, "INSERT INTO `config` (`key`, `value`) VALUES ('audit_log_chain_start', ?)", []byte("3"))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	NewAuditLog(tx, newTestRequest("POST", "/login")).LogLogin(1)
+	tx.Commit()
+
+	result := verifyLog(t, db, verifyAuditLog)
+	if !result.Okay() || result.Entries != 1 {
+		t.Errorf("The log with unhashed legacy entries was not verified: %+v", result)
+	}
+}
+
+func TestVerifyAccessLogAfterPruning(t *testing.T) {
+	useCheckpointKey(t)
+
+	db := newTestDatabase(t)
+	logDeliveries(t, db, 5)
+
+	if err := writeCheckpointsOnce(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// checkpoint the second entry as well, so that a checkpoint refers to a pruned entry
+	tx, _ := db.Beginx()
+	head := logCheckpoint{Log: chainAccessLog, Chain: "1", EntryId: 2, CreatedAt: "2024-01-01 00:00:00"}
+	tx.Get(&head.Hash, "SELECT `hash` FROM `access_log` WHERE `id` = 2")
+	if err := head.insert(tx); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	retention := &AccessLogRetention{maxRowsPerConsumer: 2, deleteUnarchived: true}
+
+	if _, err := retention.Prune(db); err != nil {
+		t.Fatal(err)
+	}
+
+	result := verifyLog(t, db, verifyAccessLog)
+	if !result.Okay() || result.Entries != 2 || result.Checkpoints != 3 {
+		t.Fatalf("The pruned log was not verified: %+v", result)
+	}
+
+	// deleting the start of the remaining chain is not the same as pruning it
+	mustExec(t, db, "DELETE FROM `access_log` WHERE `id` = 4")
+
+	result = verifyLog(t, db, verifyAccessLog)
+	if result.Okay() || result.BrokenAt != 5 {
+		t.Errorf("Deleting the start of a pruned chain was not detected: %+v", result)
+	}
+}
+
+func TestVerifyAccessLogRejectsUnsignedPruning(t *testing.T) {
+	useCheckpointKey(t)
+
+	db := newTestDatabase(t)
+	logDeliveries(t, db, 3)
+
+	tx, _ := db.Beginx()
+	marker := logCheckpoint{Log: chainAccessLog, Chain: "1", EntryId: 1, Pruned: true, CreatedAt: "2024-01-01 00:00:00"}
+	tx.Get(&marker.Hash, "SELECT `hash` FROM `access_log` WHERE `id` = 1")
+	marker.insert(tx)
+	tx.Commit()
+
+	// an attacker without the key
+	mustExec(t, db, "UPDATE `log_checkpoint` SET `signature` = ''")
+	mustExec(t, db, "DELETE FROM `access_log` WHERE `id` = 1")
+
+	result := verifyLog(t, db, verifyAccessLog)
+	if result.Okay() {
+		t.Errorf("An unsigned record of pruned entries was accepted: %+v", result)
+	}
+}
+
+func TestVerifyCheckpoints(t *testing.T) {
+	useCheckpointKey(t)
+
+	db := newTestDatabase(t)
+	fillAuditLog(t, db, 3)
+
+	if err := writeCheckpointsOnce(db); err != nil {
+		t.Fatal(err)
+	}
+
+	result := verifyLog(t, db, verifyAuditLog)
+	if !result.Okay() || result.Checkpoints != 1 {
+		t.Fatalf("The checkpointed log was not verified: %+v", result)
+	}
+
+	// nothing happened, so no new checkpoint is written
+	if err := writeCheckpointsOnce(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// removing the newest entry keeps the chain intact, but not the checkpoint
+	mustExec(t, db, "DELETE FROM `audit_log` WHERE `id` = 3")
+
+	result = verifyLog(t, db, verifyAuditLog)
+	if result.Okay() || result.Checkpoints != 1 {
+		t.Errorf("Deleting a checkpointed entry was not detected: %+v", result)
+	}
+
+	useCheckpointKey(t)
+
+	result = verifyLog(t, db, verifyAuditLog)
+	if result.Okay() || result.BrokenAt != 3 {
+		t.Errorf("A checkpoint signed with another key was accepted: %+v", result)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"net/http"
 	"strings"
 
@@ -10,10 +11,28 @@ import (
 
 type loginData struct {
 	LoginName string
+	Sso       bool
+	SsoLabel  string
+	Error     string
+}
+
+func newLoginData(login string) loginData {
+	data := loginData{LoginName: login}
+
+	if oidcProvider != nil {
+		data.Sso = true
+		data.SsoLabel = config.Oidc.ButtonLabel
+
+		if data.SsoLabel == "" {
+			data.SsoLabel = "Log in with SSO"
+		}
+	}
+
+	return data
 }
 
 func loginFormAction() response {
-	return renderTemplate(200, "login", loginData{""})
+	return renderTemplate(200, "login", newLoginData(""))
 }
 
 func loginAction(m *SessionMiddleware, req *http.Request, res http.ResponseWriter, db *sqlx.Tx) response {
@@ -22,21 +41,41 @@ func loginAction(m *SessionMiddleware, req *http.Request, res http.ResponseWrite
 
 	validated, err := validateSafeString(login, "login")
 	if err != nil {
-		return renderTemplate(403, "login", loginData{""})
+		return renderTemplate(403, "login", newLoginData(""))
+	}
+
+	user := authenticateUser(validated, password, req, db)
+	if user == nil {
+		return renderTemplate(403, "login", newLoginData(validated))
 	}
 
+	return startUserSession(user, m, req, res, db)
+}
+
+// authenticateUser checks the credentials of a local or LDAP user and returns nil if they are
+// not valid.
+func authenticateUser(login string, password string, req *http.Request, db *sqlx.Tx) *User {
 	user := findUserByLogin(login, true, db)
-	if user == nil || user.Deleted != nil {
-		return renderTemplate(403, "login", loginData{validated})
+
+	// unknown users and users managed by LDAP are authenticated against the directory
+	if ldapAuth != nil && (user == nil || user.Backend == BackendLdap) {
+		user = authenticateLdap(login, password, req, db)
+	} else if user != nil && (user.Password == nil || !CompareBcrypt(*user.Password, password)) {
+		user = nil
 	}
 
-	if !CompareBcrypt(*user.Password, password) {
-		return renderTemplate(403, "login", loginData{validated})
+	if user == nil || user.Deleted != nil {
+		return nil
 	}
 
+	return user
+}
+
+// startUserSession is the common final step of all login methods.
+func startUserSession(user *User, m *SessionMiddleware, req *http.Request, res http.ResponseWriter, db *sqlx.Tx) response {
 	s, err := m.StartSession(user, res)
 	if err != nil {
-		return renderTemplate(500, "login", loginData{validated})
+		return renderTemplate(500, "login", newLoginData(user.LoginName))
 	}
 
 	NewAuditLog(db, req).LogLogin(user.Id)
@@ -52,6 +91,107 @@ func loginAction(m *SessionMiddleware, req *http.Request, res http.ResponseWrite
 	return redirect(302, "/")
 }
 
+func authenticateLdap(login string, password string, req *http.Request, db *sqlx.Tx) *User {
+	entry, err := ldapAuth.Authenticate(login, password)
+	if err != nil {
+		if err != errLdapUserNotFound {
+			log.Println("LDAP login for '" + login + "' failed: " + err.Error())
+		}
+
+		return nil
+	}
+
+	user, err := provisionLdapUser(entry, req, db)
+	if err != nil {
+		log.Println("Could not provision LDAP user '" + login + "': " + err.Error())
+		return nil
+	}
+
+	return user
+}
+
+func oidcLoginAction(res http.ResponseWriter) response {
+	if oidcProvider == nil {
+		return renderError(404, "Single sign-on is not enabled.")
+	}
+
+	state, target, err := oidcProvider.AuthCodeUrl()
+	if err != nil {
+		log.Println("Could not start OIDC login: " + err.Error())
+
+		data := newLoginData("")
+		data.Error = "The identity provider is currently not available."
+
+		return renderTemplate(502, "login", data)
+	}
+
+	// bind the login attempt to this browser to prevent login CSRF
+	cookie := http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   config.Session.Secure,
+	}
+
+	res.Header().Add("Set-Cookie", cookie.String())
+
+	return redirect(302, target)
+}
+
+func oidcCallbackAction(m *SessionMiddleware, req *http.Request, res http.ResponseWriter, db *sqlx.Tx) response {
+	if oidcProvider == nil {
+		return renderError(404, "Single sign-on is not enabled.")
+	}
+
+	data := newLoginData("")
+	data.Error = "Single sign-on failed."
+
+	if errCode := req.FormValue("error"); errCode != "" {
+		log.Println("OIDC login was rejected by the identity provider: " + errCode)
+		return renderTemplate(403, "login", data)
+	}
+
+	state := req.FormValue("state")
+	cookie, err := req.Cookie(oidcStateCookie)
+
+	if err != nil || state == "" || cookie.Value != state {
+		return renderTemplate(403, "login", data)
+	}
+
+	identity, err := oidcProvider.Exchange(state, req.FormValue("code"))
+	if err != nil {
+		log.Println("OIDC login failed: " + err.Error())
+		return renderTemplate(403, "login", data)
+	}
+
+	if !oidcProvider.IsAllowed(identity) {
+		data.Error = "Your account is not allowed to access Raziel."
+		return renderTemplate(403, "login", data)
+	}
+
+	user, err := provisionOidcUser(identity, req, db)
+	if err == errOidcUserDeleted || err == errOidcEmailTaken {
+		log.Println("Refused OIDC login for '" + identity.Subject + "': " + err.Error())
+		data.Error = "Your account is not allowed to access Raziel."
+		return renderTemplate(403, "login", data)
+	}
+
+	if err != nil {
+		log.Println("Could not provision OIDC user '" + identity.Subject + "': " + err.Error())
+		return renderTemplate(500, "login", data)
+	}
+
+	response := startUserSession(user, m, req, res, db)
+
+	// the state cookie is not needed anymore
+	expired := http.Cookie{Name: oidcStateCookie, Value: "-", Path: "/login/oidc", MaxAge: -1}
+	res.Header().Add("Set-Cookie", expired.String())
+
+	return response
+}
+
 func logoutAction(session *Session, m *SessionMiddleware, res http.ResponseWriter) response {
 	m.EndSession(session, res)
 
@@ -61,5 +201,7 @@ func logoutAction(session *Session, m *SessionMiddleware, res http.ResponseWrite
 func setupLoginCtrl(app *martini.ClassicMartini) {
 	app.Get("/login", loginFormAction)
 	app.Post("/login", loginAction)
+	app.Get("/login/oidc", oidcLoginAction)
+	app.Get("/login/oidc/callback", oidcCallbackAction)
 	app.Post("/logout", sessions.RequireLogin, sessions.RequireCsrfToken, logoutAction)
 }
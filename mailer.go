@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sendMail delivers a plain text e-mail using the configured SMTP server. Authentication is only
+// attempted if a username is configured, so that local test servers like MailHog work out of the
+// box.
+func sendMail(to []string, subject string, body string) error {
+	cfg := config.Smtp
+
+	if cfg.Host == "" {
+		return errors.New("No SMTP server configured.")
+	}
+
+	port := cfg.Port
+	if port == 0 {
+		port = 25
+	}
+
+	address := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	client, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if cfg.StartTls {
+		err = client.StartTLS(&tls.Config{ServerName: cfg.Host, InsecureSkipVerify: cfg.SkipVerify})
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(cfg.From)
+	if err != nil {
+		return err
+	}
+
+	for _, recipient := range to {
+		err = client.Rcpt(recipient)
+		if err != nil {
+			return err
+		}
+	}
+
+	// never allow header injection via the subject
+	subject = strings.NewReplacer("\r", "", "\n", " ").Replace(subject)
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		cfg.From,
+		strings.Join(to, ", "),
+		subject,
+		time.Now().Format(time.RFC1123Z),
+		strings.Replace(body, "\n", "\r\n", -1),
+	)
+
+	_, err = writer.Write([]byte(message))
+	if err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/alecthomas/kingpin"
@@ -23,14 +24,19 @@ var config *configuration
 var sessions *SessionMiddleware
 
 var (
-	password   = kingpin.Flag("password", "Encryption key in plain text (discouraged)").String()
-	configFile = kingpin.Flag("config", "Configuration file to use").ExistingFile()
+	password    = kingpin.Flag("password", "Encryption key in plain text (discouraged)").String()
+	configFile  = kingpin.Flag("config", "Configuration file to use").ExistingFile()
+	verifyLogs  = kingpin.Flag("verify-logs", "Verify the audit and access log hash chains and exit").Bool()
+	resourceDir = kingpin.Flag("resources", "Serve templates and assets from this directory instead of the embedded copies (development)").String()
+
+	serveCmd   = kingpin.Command("serve", "Run the HTTP server (default)").Default()
+	migrateCmd = kingpin.Command("migrate", "Apply pending database migrations and exit")
 )
 
 func main() {
 	kingpin.UsageTemplate(kingpin.CompactUsageTemplate).Version("1.0").Author("Christoph Mewes")
 	kingpin.CommandLine.Help = "HTTP application server to run the Raziel secret management"
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	if *configFile == "" {
 		kingpin.FatalUsage("No configuration file (--config) given!")
@@ -42,14 +48,50 @@ func main() {
 		kingpin.FatalUsage(err.Error())
 	}
 
+	if *password != "" {
+		masterPassword = []byte(*password)
+	}
+
+	switch command {
+	case checkConfigCmd.FullCommand():
+		os.Exit(runCheckConfig())
+	case backupKeygenCmd.FullCommand():
+		os.Exit(runBackupKeygen())
+	case backupVerifyCmd.FullCommand():
+		os.Exit(runBackupVerify())
+	}
+
 	// connect to database
-	database, err := sqlx.Connect("mysql", config.Database.Source)
+	database, databaseDialect, err := OpenDatabase(config.Database.Source)
 	if err != nil {
 		kingpin.FatalUsage(err.Error())
 	}
 
+	dialect = databaseDialect
+
+	switch command {
+	case initDbCmd.FullCommand():
+		os.Exit(runInitDb(database))
+	case backupRestoreCmd.FullCommand():
+		os.Exit(runBackupRestore(database))
+	}
+
+	if command == migrateCmd.FullCommand() {
+		os.Exit(runMigrations(database))
+	}
+
+	// bring the schema up to date, refusing to work with a newer schema
+	err = migrateDatabase(database)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	validateMasterPassword(database)
 
+	if command == backupExportCmd.FullCommand() {
+		os.Exit(runBackupExport(database))
+	}
+
 	// init restriction handlers
 	restrictionHandlers = make(map[string]RestrictionHandler)
 	addRestrictionHandler(ApiKeyRestriction{})
@@ -60,9 +102,171 @@ func main() {
 	addRestrictionHandler(FileRestriction{})
 	addRestrictionHandler(HitLimitRestriction{})
 	addRestrictionHandler(ThrottleRestriction{})
+	addRestrictionHandler(SshCertificateRestriction{})
+
+	// load the password policy
+	passwordPolicy, err = NewPasswordPolicy(config)
+	if err != nil {
+		kingpin.FatalUsage(err.Error())
+	}
+
+	// load the checkpoint signing key
+	if config.Checkpoints.Key != "" {
+		checkpointKey, err = loadCheckpointKey(config.Checkpoints.Key)
+		if err != nil {
+			kingpin.FatalUsage("Could not load the checkpoint key: " + err.Error())
+		}
+	}
+
+	if *verifyLogs {
+		os.Exit(runLogVerification(database))
+	}
+
+	if checkpointKey != nil {
+		interval := 1 * time.Hour
+
+		if config.Checkpoints.Interval != "" {
+			interval, err = time.ParseDuration(config.Checkpoints.Interval)
+			if err != nil {
+				log.Fatal("Invalid checkpoint interval configured: " + err.Error())
+			}
+		}
+
+		go writeCheckpoints(database, interval)
+	}
+
+	// setup alerting
+	rules, err := NewAlertRules(config)
+	if err != nil {
+		kingpin.FatalUsage(err.Error())
+	}
+
+	if rules.Enabled() {
+		alertRules = rules
+	}
+
+	// setup event shipping
+	eventBus, err = NewEventBus(config)
+	if err != nil {
+		kingpin.FatalUsage(err.Error())
+	}
+
+	// setup secret rotation; the admin commands need it to keep secret versions
+	secretRotator, err = NewSecretRotator(config)
+	if err != nil {
+		kingpin.FatalUsage(err.Error())
+	}
+
+	if code, ok := runAdminCommand(command, database); ok {
+		os.Exit(code)
+	}
+
+	// setup Prometheus metrics
+	var metricsAuth *metricsAuthenticator
+
+	if config.Metrics.Enabled {
+		metricsAuth, err = newMetricsAuthenticator(config)
+		if err != nil {
+			kingpin.FatalUsage(err.Error())
+		}
+
+		setupMetrics()
+	}
+
+	// setup access log retention
+	retention, err := NewAccessLogRetention(config)
+	if err != nil {
+		kingpin.FatalUsage(err.Error())
+	}
+
+	if retention.Enabled() {
+		interval := 1 * time.Hour
+
+		if config.AccessLog.PruneInterval != "" {
+			interval, err = time.ParseDuration(config.AccessLog.PruneInterval)
+			if err != nil {
+				log.Fatal("Invalid access log prune interval configured: " + err.Error())
+			}
+		}
+
+		go retention.Run(database, interval)
+	}
+
+	// setup the notification queue
+	notifications, err := NewNotificationQueue(config)
+	if err != nil {
+		kingpin.FatalUsage(err.Error())
+	}
+
+	go notifications.Run(database)
+	go secretRotator.Run(database)
+
+	// setup certificate expiry warnings
+	certificates, err := NewCertificateMonitor(config)
+	if err != nil {
+		kingpin.FatalUsage(err.Error())
+	}
+
+	go certificates.Run(database)
+
+	// setup dropping expired database users
+	reaper, err := NewLeaseReaper(config)
+	if err != nil {
+		kingpin.FatalUsage(err.Error())
+	}
+
+	go reaper.Run(database)
+
+	// setup expiring share links
+	shareSweeper, err = NewShareSweeper(config)
+	if err != nil {
+		kingpin.FatalUsage(err.Error())
+	}
+
+	go shareSweeper.Run(database)
+
+	// setup the change feed, which is woken up by the audit events
+	changeFeed := NewChangeFeed(database)
+	eventBus.Subscribe(changeFeed)
+
+	// setup LDAP authentication
+	if config.Ldap.Enabled {
+		ldapAuth, err = NewLdapAuthenticator(config)
+		if err != nil {
+			kingpin.FatalUsage(err.Error())
+		}
+
+		interval := 15 * time.Minute
+
+		if config.Ldap.SyncInterval != "" {
+			interval, err = time.ParseDuration(config.Ldap.SyncInterval)
+			if err != nil {
+				log.Fatal("Invalid LDAP sync interval configured: " + err.Error())
+			}
+		}
+
+		go syncLdapUsers(database, interval)
+	}
+
+	// setup OpenID Connect single sign-on
+	if config.Oidc.Enabled {
+		oidcProvider, err = NewOidcProvider(config)
+		if err != nil {
+			kingpin.FatalUsage(err.Error())
+		}
+	}
 
 	// init templates
-	templateManager = NewTemplateManager("templates")
+	templateManager, err = NewTemplateManager(resourceFS("templates"))
+	if errs, ok := err.(TemplateErrors); ok {
+		for _, e := range errs {
+			log.Printf("Invalid template %s", e)
+		}
+
+		log.Fatalf("%d template(s) could not be loaded.", len(errs))
+	} else if err != nil {
+		log.Fatal("Could not load the templates: " + err.Error())
+	}
 
 	// setup basic Martini server
 
@@ -74,19 +278,38 @@ func main() {
 
 	m := martini.New()
 	m.Use(martini.Logger())
+
+	if metricsAuth != nil {
+		m.Use(measureRequest)
+	}
+
 	m.Use(gzip.All())
 	m.Use(martini.Recovery())
-	m.Use(martini.Static("www"))
+	m.Use(staticAssets(resourceFS("www")))
 	m.Use(method.Override())
 
+	// long-polling requests manage their transactions themselves
+	m.Use(changeFeed.Handler())
+
 	// force all handlers to run inside a transaction
 
 	m.Use(func(c martini.Context) {
-		tx := database.MustBegin()
+		start := time.Now()
+
+		tx, err := database.Beginx()
+		if err != nil {
+			metricTransactionFailures.WithLabelValues("begin").Inc()
+			panic(err)
+		}
 
 		defer func() {
+			metricTransactionDuration.Observe(time.Since(start).Seconds())
+
 			if r := recover(); r != nil {
+				metricTransactionFailures.WithLabelValues("rollback").Inc()
+				eventBus.Discard(tx)
 				tx.Rollback()
+				pendingLeases.RolledBack(tx)
 				panic(r)
 			}
 		}()
@@ -94,10 +317,15 @@ func main() {
 		c.Map(tx)
 		c.Next()
 
-		err := tx.Commit()
+		err = tx.Commit()
 		if err != nil {
+			metricTransactionFailures.WithLabelValues("commit").Inc()
 			panic(err)
 		}
+
+		// only now that everything is persisted, ship the events
+		eventBus.Flush(tx)
+		pendingLeases.Committed(tx)
 	})
 
 	// setup session and CSRF support
@@ -116,11 +344,13 @@ func main() {
 
 	sessions.Setup(m)
 
-	// re-compile all templates on each hit
+	// re-compile all templates on each hit when they are read from disk
 
-	if martini.Env != martini.Prod {
+	if *resourceDir != "" {
 		m.Use(func() {
-			templateManager.Init()
+			if err := templateManager.Init(); err != nil {
+				log.Printf("Could not reload all templates: %s", err)
+			}
 		})
 	}
 
@@ -138,10 +368,20 @@ func main() {
 	setupLoginCtrl(martini)
 	setupSecretsCtrl(martini)
 	setupUsersCtrl(martini)
+	setupPasswordResetCtrl(martini)
 	setupConsumersCtrl(martini)
 	setupAuditLogCtrl(martini)
 	setupAccessLogCtrl(martini)
 	setupDeliveryCtrl(martini)
+	setupCertificateAuthorityCtrl(martini)
+	setupShareCtrl(martini)
+	setupAlertCtrl(martini)
+	setupSubscriptionsCtrl(martini)
+	setupImportCtrl(martini)
+
+	if metricsAuth != nil {
+		setupMetricsCtrl(martini, metricsAuth)
+	}
 
 	// setup our own http server and configure TLS
 	srv := &http.Server{
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	sql.Register("raziel-sqlite3-checked", &checkedDriver{&translatingDriver{&sqlite3.SQLiteDriver{}, sqliteDialect{}}})
+}
+
+// checkedDriver remembers the queries SQLite could not prepare after they were translated. Many
+// finders ignore their errors, so without it, an untranslatable query would go unnoticed.
+type checkedDriver struct {
+	driver.Driver
+}
+
+var (
+	unpreparedLock    sync.Mutex
+	unpreparedQueries []string
+)
+
+func (d *checkedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &checkedConn{conn}, nil
+}
+
+type checkedConn struct {
+	driver.Conn
+}
+
+func (c *checkedConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		unpreparedLock.Lock()
+		unpreparedQueries = append(unpreparedQueries, query+": "+err.Error())
+		unpreparedLock.Unlock()
+	}
+
+	return stmt, err
+}
+
+// newTestDatabase creates a SQLite database with the current schema, so that the models can be
+// tested without a database server. The global configuration is reset as well. The test fails if
+// any query could not be prepared.
+func newTestDatabase(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	db := openTestDatabase(t)
+
+	if err := createSchema(db); err != nil {
+		t.Fatalf("Could not create the schema: %v", err)
+	}
+
+	return db
+}
+
+// openTestDatabase opens an empty SQLite database.
+func openTestDatabase(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	db, err := sqlx.Connect("raziel-sqlite3-checked", sqliteDsn(filepath.Join(t.TempDir(), "raziel.db")))
+	if err != nil {
+		t.Fatalf("Could not open the test database: %v", err)
+	}
+
+	unpreparedLock.Lock()
+	unpreparedQueries = nil
+	unpreparedLock.Unlock()
+
+	t.Cleanup(func() {
+		db.Close()
+
+		unpreparedLock.Lock()
+		queries := unpreparedQueries
+		unpreparedQueries = nil
+		unpreparedLock.Unlock()
+
+		for _, query := range queries {
+			t.Errorf("Invalid query: %s", query)
+		}
+	})
+
+	dialect = sqliteDialect{}
+	config = &configuration{}
+	masterPassword = []byte("test master password")
+
+	return db
+}
+
+// newTestTx returns a transaction on a fresh test database, which is rolled back after the test.
+func newTestTx(t *testing.T) *sqlx.Tx {
+	t.Helper()
+
+	tx, err := newTestDatabase(t).Beginx()
+	if err != nil {
+		t.Fatalf("Could not begin a transaction: %v", err)
+	}
+
+	t.Cleanup(func() { tx.Rollback() })
+
+	return tx
+}
+
+// newTestRequest is a request as the handlers receive it, with a remote address for the logs.
+func newTestRequest(method string, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	return req
+}
+
+// createTestUser stores a local user.
+func createTestUser(t *testing.T, login string, tx *sqlx.Tx) *User {
+	t.Helper()
+
+	user := &User{Id: -1, Name: login, LoginName: login, Role: RoleAdmin, Backend: BackendLocal, _db: tx}
+
+	if err := user.Save(); err != nil {
+		t.Fatalf("Could not create user '%s': %v", login, err)
+	}
+
+	return user
+}
+
+// createTestConsumer stores an enabled consumer without restrictions.
+func createTestConsumer(t *testing.T, name string, creator *User, tx *sqlx.Tx) *Consumer {
+	t.Helper()
+
+	consumer := &Consumer{Id: -1, Name: name, CreatedBy: creator.Id, Enabled: true, _db: tx}
+
+	if err := consumer.Save(); err != nil {
+		t.Fatalf("Could not create consumer '%s': %v", name, err)
+	}
+
+	return consumer
+}
+
+// createTestSecret stores an encrypted secret and assigns it to the given consumers.
+func createTestSecret(t *testing.T, slug string, body string, creator *User, tx *sqlx.Tx, consumers ...*Consumer) *Secret {
+	t.Helper()
+
+	encrypted, err := Encrypt([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := &Secret{Id: -1, Name: slug, Slug: slug, Secret: encrypted, CreatedBy: creator.Id, _db: tx}
+
+	if err := secret.Save(); err != nil {
+		t.Fatalf("Could not create secret '%s': %v", slug, err)
+	}
+
+	for _, consumer := range consumers {
+		_, err := tx.Exec("INSERT INTO `consumer_secret` (`consumer_id`, `secret_id`) VALUES (?,?)", consumer.Id, secret.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return secret
+}
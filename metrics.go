@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "raziel",
+		Name:      "deliveries_total",
+		Help:      "Number of secret delivery attempts by status, consumer and secret.",
+	}, []string{"status", "consumer", "secret"})
+
+	metricRestrictionDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "raziel",
+		Name:      "restriction_denials_total",
+		Help:      "Number of delivery attempts denied by each restriction type.",
+	}, []string{"restriction"})
+
+	metricRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "raziel",
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	metricTransactionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "raziel",
+		Name:      "db_transaction_duration_seconds",
+		Help:      "Duration of the per-request database transactions.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	metricTransactionFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "raziel",
+		Name:      "db_transaction_failures_total",
+		Help:      "Number of per-request database transactions that could not be started or committed, or were rolled back.",
+	}, []string{"reason"})
+)
+
+// the routes whose latency is tracked individually; everything else is summed up as "other"
+var metricRoutes = map[string]string{
+	"":              "dashboard",
+	"get":           "delivery",
+	"login":         "login",
+	"logout":        "login",
+	"profile":       "profile",
+	"secrets":       "secrets",
+	"consumers":     "consumers",
+	"users":         "users",
+	"reset":         "reset",
+	"auditlog":      "auditlog",
+	"accesslog":     "accesslog",
+	"subscriptions": "subscriptions",
+	"metrics":       "metrics",
+}
+
+func setupMetrics() {
+	prometheus.MustRegister(
+		metricDeliveries,
+		metricRestrictionDenials,
+		metricRequestDuration,
+		metricTransactionDuration,
+		metricTransactionFailures,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "raziel",
+			Name:      "sessions_active",
+			Help:      "Number of currently active sessions.",
+		}, func() float64 {
+			return float64(sessions.Count())
+		}),
+	)
+}
+
+func metricRouteName(path string) string {
+	segment := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+
+	if route, ok := metricRoutes[segment]; ok {
+		return route
+	}
+
+	return "other"
+}
+
+// measureRequest is a middleware that records the latency of every request.
+func measureRequest(req *http.Request, res http.ResponseWriter, c martini.Context) {
+	start := time.Now()
+
+	c.Next()
+
+	status := "0"
+	if rw, ok := res.(martini.ResponseWriter); ok {
+		status = strconv.Itoa(rw.Status())
+	}
+
+	metricRequestDuration.WithLabelValues(metricRouteName(req.URL.Path), req.Method, status).Observe(time.Since(start).Seconds())
+}
+
+func countDelivery(status int, consumer *Consumer, secret *Secret) {
+	consumerName := "unknown"
+	secretSlug := "unknown"
+
+	// never use the requested identifiers as labels, as anyone could create arbitrary time series
+	if consumer != nil {
+		consumerName = consumer.Name
+	}
+
+	if secret != nil {
+		secretSlug = secret.Slug
+	}
+
+	metricDeliveries.WithLabelValues(strconv.Itoa(status), consumerName, secretSlug).Inc()
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// HTTP Handlers
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type metricsAuthenticator struct {
+	token string
+}
+
+func newMetricsAuthenticator(c *configuration) (*metricsAuthenticator, error) {
+	if len(c.Metrics.Token) < 16 {
+		return nil, errors.New("The metrics token must be at least 16 characters long.")
+	}
+
+	return &metricsAuthenticator{c.Metrics.Token}, nil
+}
+
+// Require checks the bearer token sent by the Prometheus server.
+func (m *metricsAuthenticator) Require(req *http.Request, res http.ResponseWriter) {
+	header := req.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+
+	if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(m.token)) != 1 {
+		res.Header().Set("WWW-Authenticate", `Bearer realm="raziel"`)
+		http.Error(res, "Nope.", http.StatusUnauthorized)
+	}
+}
+
+func setupMetricsCtrl(app *martini.ClassicMartini, auth *metricsAuthenticator) {
+	app.Get("/metrics", auth.Require, promhttp.Handler().ServeHTTP)
+}
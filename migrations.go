@@ -0,0 +1,656 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// migration brings the schema from the previous version to its own version. MySQL implicitly
+// commits on every DDL statement, so a migration can be interrupted halfway through; all steps
+// must therefore be safe to run again.
+type migration struct {
+	version     string
+	description string
+	apply       func(tx *sqlx.Tx) error
+}
+
+// migrations must be sorted by version. The resources/schema*.sql files always reflect the newest
+// version. PostgreSQL and SQLite are supported since 1.7, so all older migrations only ever run
+// on MySQL; newer migrations are translated like any other query.
+var migrations = []migration{
+	{"1.1", "add the missing restriction.enabled column", func(tx *sqlx.Tx) error {
+		return addColumn(tx, "restriction", "enabled", "TINYINT(1) UNSIGNED NOT NULL DEFAULT 1")
+	}},
+
+	{"1.2", "add external login backends to users", func(tx *sqlx.Tx) error {
+		err := addColumns(tx, "user", []string{
+			"role", "VARCHAR(20) NOT NULL DEFAULT 'admin' AFTER `name`",
+			"backend", "VARCHAR(20) NOT NULL DEFAULT 'local' AFTER `role`",
+			"external_id", "VARCHAR(255) NULL AFTER `backend`",
+			"email", "VARCHAR(255) NULL AFTER `external_id`",
+			"oidc_subject", "VARCHAR(255) NULL AFTER `email`",
+		})
+
+		if err != nil {
+			return err
+		}
+
+		err = addIndex(tx, "user", "oidc_subject_idx", "(`oidc_subject` ASC)")
+		if err != nil {
+			return err
+		}
+
+		return addIndex(tx, "user", "email_idx", "(`email` ASC)")
+	}},
+
+	{"1.3", "add password history and reset links", func(tx *sqlx.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS `password_history` ("+
+				"`id` INT UNSIGNED NOT NULL AUTO_INCREMENT,"+
+				"`user_id` SMALLINT UNSIGNED NOT NULL,"+
+				"`password` VARCHAR(255) NOT NULL,"+
+				"`created_at` DATETIME NOT NULL,"+
+				"PRIMARY KEY (`id`),"+
+				"INDEX `fk_password_history_user_idx` (`user_id` ASC),"+
+				"CONSTRAINT `fk_password_history_user` FOREIGN KEY (`user_id`) REFERENCES `user` (`id`) ON DELETE CASCADE ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+
+			"CREATE TABLE IF NOT EXISTS `password_reset` ("+
+				"`id` INT UNSIGNED NOT NULL AUTO_INCREMENT,"+
+				"`token_hash` CHAR(64) NOT NULL,"+
+				"`user_id` SMALLINT UNSIGNED NOT NULL,"+
+				"`created_at` DATETIME NOT NULL,"+
+				"`created_by` SMALLINT UNSIGNED NOT NULL,"+
+				"`expires_at` DATETIME NOT NULL,"+
+				"`used_at` DATETIME NULL,"+
+				"PRIMARY KEY (`id`),"+
+				"UNIQUE INDEX `token_hash_UNIQUE` (`token_hash` ASC),"+
+				"INDEX `fk_password_reset_user_idx` (`user_id` ASC),"+
+				"CONSTRAINT `fk_password_reset_user` FOREIGN KEY (`user_id`) REFERENCES `user` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,"+
+				"CONSTRAINT `fk_password_reset_user2` FOREIGN KEY (`created_by`) REFERENCES `user` (`id`) ON DELETE RESTRICT ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+		)
+	}},
+
+	{"1.4", "index the access log by request time", func(tx *sqlx.Tx) error {
+		return addIndex(tx, "access_log", "requested_at_idx", "(`requested_at` ASC)")
+	}},
+
+	{"1.5", "add hash chains and checkpoints to the logs", func(tx *sqlx.Tx) error {
+		for _, table := range []string{"audit_log", "access_log"} {
+			err := addColumns(tx, table, []string{
+				"prev_hash", "CHAR(64) NULL",
+				"hash", "CHAR(64) NULL",
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS `log_checkpoint` ("+
+				"`id` INT UNSIGNED NOT NULL AUTO_INCREMENT,"+
+				"`created_at` DATETIME NOT NULL,"+
+				"`log` VARCHAR(20) NOT NULL,"+
+				"`chain` VARCHAR(20) NOT NULL,"+
+				"`entry_id` INT UNSIGNED NOT NULL,"+
+				"`hash` CHAR(64) NOT NULL,"+
+				"`signature` VARCHAR(100) NOT NULL,"+
+				"PRIMARY KEY (`id`),"+
+				"INDEX `log_chain_idx` (`log` ASC, `chain` ASC)"+
+				") ENGINE = InnoDB",
+		)
+	}},
+
+	{"1.6", "add alerts", func(tx *sqlx.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS `alert` ("+
+				"`id` INT UNSIGNED NOT NULL AUTO_INCREMENT,"+
+				"`rule` VARCHAR(50) NOT NULL,"+
+				"`subject` VARCHAR(100) NOT NULL,"+
+				"`consumer_id` INT UNSIGNED NULL,"+
+				"`origin_ip` VARCHAR(45) NOT NULL,"+
+				"`message` TEXT NOT NULL,"+
+				"`created_at` DATETIME NOT NULL,"+
+				"`dismissed_at` DATETIME NULL,"+
+				"`dismissed_by` SMALLINT UNSIGNED NULL,"+
+				"PRIMARY KEY (`id`),"+
+				"INDEX `rule_subject_idx` (`rule` ASC, `subject` ASC, `created_at` ASC),"+
+				"CONSTRAINT `fk_alert_consumer` FOREIGN KEY (`consumer_id`) REFERENCES `consumer` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,"+
+				"CONSTRAINT `fk_alert_user` FOREIGN KEY (`dismissed_by`) REFERENCES `user` (`id`) ON DELETE SET NULL ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+		)
+	}},
+
+	{"1.7", "add subscriptions and notifications", func(tx *sqlx.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS `subscription` ("+
+				"`id` INT UNSIGNED NOT NULL AUTO_INCREMENT,"+
+				"`user_id` SMALLINT UNSIGNED NOT NULL,"+
+				"`secret_id` INT UNSIGNED NULL,"+
+				"`consumer_id` INT UNSIGNED NULL,"+
+				"`mode` VARCHAR(20) NOT NULL,"+
+				"`channel` VARCHAR(20) NOT NULL,"+
+				"`webhook_url` VARCHAR(255) NULL,"+
+				"`created_at` DATETIME NOT NULL,"+
+				"PRIMARY KEY (`id`),"+
+				"CONSTRAINT `fk_subscription_user` FOREIGN KEY (`user_id`) REFERENCES `user` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,"+
+				"CONSTRAINT `fk_subscription_secret` FOREIGN KEY (`secret_id`) REFERENCES `secret` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,"+
+				"CONSTRAINT `fk_subscription_consumer` FOREIGN KEY (`consumer_id`) REFERENCES `consumer` (`id`) ON DELETE CASCADE ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+
+			"CREATE TABLE IF NOT EXISTS `notification_digest` ("+
+				"`id` INT UNSIGNED NOT NULL AUTO_INCREMENT,"+
+				"`user_id` SMALLINT UNSIGNED NOT NULL,"+
+				"`channel` VARCHAR(20) NOT NULL,"+
+				"`target` VARCHAR(255) NOT NULL,"+
+				"`payload` TEXT NOT NULL,"+
+				"`created_at` DATETIME NOT NULL,"+
+				"PRIMARY KEY (`id`),"+
+				"CONSTRAINT `fk_notification_digest_user` FOREIGN KEY (`user_id`) REFERENCES `user` (`id`) ON DELETE CASCADE ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+
+			"CREATE TABLE IF NOT EXISTS `notification` ("+
+				"`id` INT UNSIGNED NOT NULL AUTO_INCREMENT,"+
+				"`user_id` SMALLINT UNSIGNED NOT NULL,"+
+				"`channel` VARCHAR(20) NOT NULL,"+
+				"`target` VARCHAR(255) NOT NULL,"+
+				"`subject` VARCHAR(255) NOT NULL,"+
+				"`payload` MEDIUMTEXT NOT NULL,"+
+				"`created_at` DATETIME NOT NULL,"+
+				"`attempts` INT UNSIGNED NOT NULL DEFAULT 0,"+
+				"`next_attempt_at` DATETIME NOT NULL,"+
+				"`sent_at` DATETIME NULL,"+
+				"`failed_at` DATETIME NULL,"+
+				"`last_error` TEXT NULL,"+
+				"PRIMARY KEY (`id`),"+
+				"INDEX `pending_idx` (`sent_at` ASC, `failed_at` ASC, `next_attempt_at` ASC),"+
+				"CONSTRAINT `fk_notification_user` FOREIGN KEY (`user_id`) REFERENCES `user` (`id`) ON DELETE CASCADE ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+		)
+	}},
+
+	{"1.8", "add secret generators, rotation and versions", func(tx *sqlx.Tx) error {
+		err := addColumns(tx, "secret", []string{
+			"generator", "VARCHAR(255) NULL AFTER `updated_by`",
+			"rotation_days", "SMALLINT UNSIGNED NULL AFTER `generator`",
+			"rotate_at", "DATETIME NULL AFTER `rotation_days`",
+			"rotated_at", "DATETIME NULL AFTER `rotate_at`",
+		})
+
+		if err != nil {
+			return err
+		}
+
+		err = addIndex(tx, "secret", "rotate_at_idx", "(`rotate_at` ASC)")
+		if err != nil {
+			return err
+		}
+
+		err = execAll(tx,
+			"CREATE TABLE IF NOT EXISTS `secret_version` ("+
+				"`id` INT UNSIGNED NOT NULL AUTO_INCREMENT,"+
+				"`secret_id` INT UNSIGNED NOT NULL,"+
+				"`secret` MEDIUMBLOB NOT NULL,"+
+				"`created_at` DATETIME NOT NULL,"+
+				"`created_by` SMALLINT UNSIGNED NULL,"+
+				"PRIMARY KEY (`id`),"+
+				"CONSTRAINT `fk_secret_version_secret` FOREIGN KEY (`secret_id`) REFERENCES `secret` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,"+
+				"CONSTRAINT `fk_secret_version_user` FOREIGN KEY (`created_by`) REFERENCES `user` (`id`) ON DELETE SET NULL ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+		)
+
+		if err != nil {
+			return err
+		}
+
+		return addIndex(tx, "secret_version", "fk_secret_version_secret_idx", "(`secret_id` ASC)")
+	}},
+
+	// the metadata is filled in by the certificate monitor on startup
+	{"1.9", "add certificate metadata", func(tx *sqlx.Tx) error {
+		err := execAll(tx,
+			"CREATE TABLE IF NOT EXISTS `secret_certificate` ("+
+				"`secret_id` INT UNSIGNED NOT NULL,"+
+				"`subject` VARCHAR(255) NOT NULL,"+
+				"`issuer` VARCHAR(255) NOT NULL,"+
+				"`sans` TEXT NOT NULL,"+
+				"`serial` VARCHAR(100) NOT NULL,"+
+				"`not_before` DATETIME NOT NULL,"+
+				"`not_after` DATETIME NOT NULL,"+
+				"`key_type` VARCHAR(50) NOT NULL,"+
+				"`private_key` VARCHAR(20) NOT NULL,"+
+				"`chain_length` SMALLINT UNSIGNED NOT NULL,"+
+				"`warned_days` SMALLINT UNSIGNED NULL,"+
+				"PRIMARY KEY (`secret_id`),"+
+				"CONSTRAINT `fk_secret_certificate_secret` FOREIGN KEY (`secret_id`) REFERENCES `secret` (`id`) ON DELETE CASCADE ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+		)
+
+		if err != nil {
+			return err
+		}
+
+		return addIndex(tx, "secret_certificate", "not_after_idx", "(`not_after` ASC)")
+	}},
+
+	{"1.10", "add certificate authorities", func(tx *sqlx.Tx) error {
+		err := execAll(tx,
+			"CREATE TABLE IF NOT EXISTS `certificate_authority` ("+
+				"`secret_id` INT UNSIGNED NOT NULL,"+
+				"`ttl` VARCHAR(20) NOT NULL,"+
+				"`allowed_names` TEXT NOT NULL,"+
+				"PRIMARY KEY (`secret_id`),"+
+				"CONSTRAINT `fk_certificate_authority_secret` FOREIGN KEY (`secret_id`) REFERENCES `secret` (`id`) ON DELETE CASCADE ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+
+			"CREATE TABLE IF NOT EXISTS `issued_certificate` ("+
+				"`id` INT UNSIGNED NOT NULL AUTO_INCREMENT,"+
+				"`secret_id` INT UNSIGNED NOT NULL,"+
+				"`consumer_id` INT UNSIGNED NULL,"+
+				"`serial` VARCHAR(100) NOT NULL,"+
+				"`subject` VARCHAR(255) NOT NULL,"+
+				"`sans` TEXT NOT NULL,"+
+				"`not_after` DATETIME NOT NULL,"+
+				"`issued_at` DATETIME NOT NULL,"+
+				"`revoked_at` DATETIME NULL,"+
+				"`revoked_by` SMALLINT UNSIGNED NULL,"+
+				"PRIMARY KEY (`id`),"+
+				"CONSTRAINT `fk_issued_certificate_secret` FOREIGN KEY (`secret_id`) REFERENCES `secret` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,"+
+				"CONSTRAINT `fk_issued_certificate_consumer` FOREIGN KEY (`consumer_id`) REFERENCES `consumer` (`id`) ON DELETE SET NULL ON UPDATE CASCADE,"+
+				"CONSTRAINT `fk_issued_certificate_user` FOREIGN KEY (`revoked_by`) REFERENCES `user` (`id`) ON DELETE SET NULL ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+		)
+
+		if err != nil {
+			return err
+		}
+
+		exists, err := indexExists(tx, "issued_certificate", "serial_UNIQUE")
+		if err != nil || exists {
+			return err
+		}
+
+		_, err = tx.Exec("CREATE UNIQUE INDEX `serial_UNIQUE` ON `issued_certificate` (`secret_id` ASC, `serial` ASC)")
+
+		return err
+	}},
+
+	{"1.11", "add SSH certificate authorities", func(tx *sqlx.Tx) error {
+		return addColumn(tx, "certificate_authority", "kind", "VARCHAR(10) NOT NULL DEFAULT 'x509' AFTER `secret_id`")
+	}},
+
+	{"1.12", "add dynamic database credentials", func(tx *sqlx.Tx) error {
+		err := execAll(tx,
+			"CREATE TABLE IF NOT EXISTS `dynamic_credential` ("+
+				"`secret_id` INT UNSIGNED NOT NULL,"+
+				"`ttl` VARCHAR(20) NOT NULL,"+
+				"`creation` TEXT NOT NULL,"+
+				"`revocation` TEXT NOT NULL,"+
+				"PRIMARY KEY (`secret_id`),"+
+				"CONSTRAINT `fk_dynamic_credential_secret` FOREIGN KEY (`secret_id`) REFERENCES `secret` (`id`) ON DELETE CASCADE ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+
+			"CREATE TABLE IF NOT EXISTS `lease` ("+
+				"`id` INT UNSIGNED NOT NULL AUTO_INCREMENT,"+
+				"`secret_id` INT UNSIGNED NOT NULL,"+
+				"`consumer_id` INT UNSIGNED NULL,"+
+				"`username` VARCHAR(100) NOT NULL,"+
+				"`created_at` DATETIME NOT NULL,"+
+				"`expires_at` DATETIME NOT NULL,"+
+				"`revoked_at` DATETIME NULL,"+
+				"`revoked_by` SMALLINT UNSIGNED NULL,"+
+				"`last_error` TEXT NULL,"+
+				"PRIMARY KEY (`id`),"+
+				"CONSTRAINT `fk_lease_secret` FOREIGN KEY (`secret_id`) REFERENCES `secret` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,"+
+				"CONSTRAINT `fk_lease_consumer` FOREIGN KEY (`consumer_id`) REFERENCES `consumer` (`id`) ON DELETE SET NULL ON UPDATE CASCADE,"+
+				"CONSTRAINT `fk_lease_user` FOREIGN KEY (`revoked_by`) REFERENCES `user` (`id`) ON DELETE SET NULL ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+		)
+
+		if err != nil {
+			return err
+		}
+
+		return addIndex(tx, "lease", "expires_at_idx", "(`revoked_at` ASC, `expires_at` ASC)")
+	}},
+
+	{"1.13", "add one-time share links", func(tx *sqlx.Tx) error {
+		err := execAll(tx,
+			"CREATE TABLE IF NOT EXISTS `share` ("+
+				"`id` INT UNSIGNED NOT NULL AUTO_INCREMENT,"+
+				"`token_hash` CHAR(64) NOT NULL,"+
+				"`secret_id` INT UNSIGNED NOT NULL,"+
+				"`consumer_id` INT UNSIGNED NULL,"+
+				"`payload` MEDIUMBLOB NULL,"+
+				"`created_at` DATETIME NOT NULL,"+
+				"`created_by` SMALLINT UNSIGNED NOT NULL,"+
+				"`expires_at` DATETIME NOT NULL,"+
+				"`used_at` DATETIME NULL,"+
+				"`expired_at` DATETIME NULL,"+
+				"PRIMARY KEY (`id`),"+
+				"CONSTRAINT `fk_share_secret` FOREIGN KEY (`secret_id`) REFERENCES `secret` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,"+
+				"CONSTRAINT `fk_share_consumer` FOREIGN KEY (`consumer_id`) REFERENCES `consumer` (`id`) ON DELETE SET NULL ON UPDATE CASCADE,"+
+				"CONSTRAINT `fk_share_user` FOREIGN KEY (`created_by`) REFERENCES `user` (`id`) ON DELETE RESTRICT ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+		)
+
+		if err != nil {
+			return err
+		}
+
+		exists, err := indexExists(tx, "share", "share_token_hash_UNIQUE")
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			_, err = tx.Exec("CREATE UNIQUE INDEX `share_token_hash_UNIQUE` ON `share` (`token_hash` ASC)")
+			if err != nil {
+				return err
+			}
+		}
+
+		return addIndex(tx, "share", "share_expires_at_idx", "(`used_at` ASC, `expired_at` ASC, `expires_at` ASC)")
+	}},
+
+	{"1.14", "add consumer encryption keys", func(tx *sqlx.Tx) error {
+		return execAll(tx,
+			"CREATE TABLE IF NOT EXISTS `consumer_key` ("+
+				"`consumer_id` INT UNSIGNED NOT NULL,"+
+				"`kind` VARCHAR(10) NOT NULL,"+
+				"`public_key` TEXT NOT NULL,"+
+				"`fingerprint` VARCHAR(100) NOT NULL,"+
+				"`required` TINYINT(1) NOT NULL DEFAULT 0,"+
+				"PRIMARY KEY (`consumer_id`),"+
+				"CONSTRAINT `fk_consumer_key_consumer` FOREIGN KEY (`consumer_id`) REFERENCES `consumer` (`id`) ON DELETE CASCADE ON UPDATE CASCADE"+
+				") ENGINE = InnoDB",
+		)
+	}},
+
+	{"1.15", "record where the log chains start and which entries were pruned", func(tx *sqlx.Tx) error {
+		err := addColumn(tx, "log_checkpoint", "pruned", "TINYINT(1) NOT NULL DEFAULT 0")
+		if err != nil {
+			return err
+		}
+
+		// entries written before 1.5 have no hash; everything from here on must be chained
+		for _, table := range []string{"audit_log", "access_log"} {
+			key := table + "_chain_start"
+			exists := 0
+
+			err := tx.Get(&exists, "SELECT COUNT(*) FROM `config` WHERE `key` = ?", key)
+			if err != nil {
+				return err
+			}
+
+			if exists > 0 {
+				continue
+			}
+
+			start := 0
+
+			err = tx.Get(&start, "SELECT COALESCE(MIN(`id`), (SELECT COALESCE(MAX(`id`), 0) + 1 FROM `"+table+"`)) FROM `"+table+"` WHERE `hash` IS NOT NULL")
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec("INSERT INTO `config` (`key`, `value`) VALUES (?,?)", key, []byte(strconv.Itoa(start)))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}},
+
+	{"1.16", "make wildcard certificates opt-in", func(tx *sqlx.Tx) error {
+		return addColumn(tx, "certificate_authority", "allow_wildcards", "TINYINT(1) NOT NULL DEFAULT 0")
+	}},
+
+	{"1.17", "serialise writing to the audit log", func(tx *sqlx.Tx) error {
+		exists := 0
+
+		err := tx.Get(&exists, "SELECT COUNT(*) FROM `config` WHERE `key` = 'audit_log_lock'")
+		if err != nil || exists > 0 {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO `config` (`key`, `value`) VALUES ('audit_log_lock', ?)", []byte{})
+
+		return err
+	}},
+
+	{"1.18", "serialise writing to the access log", func(tx *sqlx.Tx) error {
+		exists := 0
+
+		err := tx.Get(&exists, "SELECT COUNT(*) FROM `config` WHERE `key` = 'access_log_lock'")
+		if err != nil || exists > 0 {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO `config` (`key`, `value`) VALUES ('access_log_lock', ?)", []byte{})
+
+		return err
+	}},
+}
+
+// SchemaVersion is the schema version this binary works with.
+func SchemaVersion() string {
+	return migrations[len(migrations)-1].version
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Runner
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func databaseVersion(db *sqlx.DB) (string, error) {
+	c := dbConfig{}
+
+	err := db.Get(&c, "SELECT `key`, `value` FROM `config` WHERE `key` = 'version'")
+	if err != nil {
+		return "", errors.New("Could not read the schema version from the config table: " + err.Error())
+	}
+
+	return string(c.Value), nil
+}
+
+// compareVersions compares two dotted version numbers numerically, so that 1.10 > 1.9.
+func compareVersions(a string, b string) int {
+	partsA := strings.Split(a, ".")
+	partsB := strings.Split(b, ".")
+
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		numA, numB := 0, 0
+
+		if i < len(partsA) {
+			numA, _ = strconv.Atoi(partsA[i])
+		}
+
+		if i < len(partsB) {
+			numB, _ = strconv.Atoi(partsB[i])
+		}
+
+		if numA != numB {
+			if numA < numB {
+				return -1
+			}
+
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// pendingMigrations returns the migrations that have not yet been applied. It fails if the
+// database has been migrated by a newer version of Raziel, as this binary cannot know what
+// changed.
+func pendingMigrations(db *sqlx.DB) ([]migration, string, error) {
+	current, err := databaseVersion(db)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if compareVersions(current, SchemaVersion()) > 0 {
+		return nil, current, fmt.Errorf("The database schema (version %s) is newer than this binary supports (version %s). Please upgrade Raziel.", current, SchemaVersion())
+	}
+
+	pending := make([]migration, 0)
+
+	for _, m := range migrations {
+		if compareVersions(m.version, current) > 0 {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, current, nil
+}
+
+// migrateDatabase applies all pending migrations, each in its own transaction together with the
+// update of the version number.
+func migrateDatabase(db *sqlx.DB) error {
+	pending, current, err := pendingMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		log.Printf("Migrating database schema from %s to %s (%s)...", current, m.version, m.description)
+
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+
+		err = m.apply(tx)
+		if err == nil {
+			_, err = tx.Exec("UPDATE `config` SET `value` = ? WHERE `key` = 'version'", []byte(m.version))
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration to %s failed: %s", m.version, err.Error())
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+
+		current = m.version
+	}
+
+	return nil
+}
+
+// runMigrations implements the migrate command and returns the exit code.
+func runMigrations(db *sqlx.DB) int {
+	pending, current, err := pendingMigrations(db)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	if len(pending) == 0 {
+		log.Printf("The database schema is up to date (version %s).", current)
+		return 0
+	}
+
+	err = migrateDatabase(db)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	log.Printf("The database schema has been migrated to version %s.", SchemaVersion())
+
+	return 0
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func execAll(tx *sqlx.Tx, statements ...string) error {
+	for _, statement := range statements {
+		_, err := tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func columnExists(tx *sqlx.Tx, table string, column string) (bool, error) {
+	var err error
+	count := 0
+
+	switch dialect.Name() {
+	case "postgres":
+		err = tx.Get(&count, "SELECT COUNT(*) FROM `information_schema`.`columns` WHERE `table_schema` = current_schema() AND `table_name` = ? AND `column_name` = ?", table, column)
+	case "sqlite":
+		err = tx.Get(&count, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE `name` = ?", table, column)
+	default:
+		err = tx.Get(&count, "SELECT COUNT(*) FROM `information_schema`.`COLUMNS` WHERE `TABLE_SCHEMA` = DATABASE() AND `TABLE_NAME` = ? AND `COLUMN_NAME` = ?", table, column)
+	}
+
+	return count > 0, err
+}
+
+func indexExists(tx *sqlx.Tx, table string, index string) (bool, error) {
+	var err error
+	count := 0
+
+	switch dialect.Name() {
+	case "postgres":
+		err = tx.Get(&count, "SELECT COUNT(*) FROM `pg_indexes` WHERE `schemaname` = current_schema() AND `tablename` = ? AND `indexname` = ?", table, index)
+	case "sqlite":
+		err = tx.Get(&count, "SELECT COUNT(*) FROM `sqlite_master` WHERE `type` = 'index' AND `tbl_name` = ? AND `name` = ?", table, index)
+	default:
+		err = tx.Get(&count, "SELECT COUNT(*) FROM `information_schema`.`STATISTICS` WHERE `TABLE_SCHEMA` = DATABASE() AND `TABLE_NAME` = ? AND `INDEX_NAME` = ?", table, index)
+	}
+
+	return count > 0, err
+}
+
+func addColumn(tx *sqlx.Tx, table string, column string, definition string) error {
+	exists, err := columnExists(tx, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = tx.Exec("ALTER TABLE `" + table + "` ADD COLUMN `" + column + "` " + definition)
+
+	return err
+}
+
+// addColumns takes pairs of column names and definitions.
+func addColumns(tx *sqlx.Tx, table string, columns []string) error {
+	for i := 0; i+1 < len(columns); i += 2 {
+		err := addColumn(tx, table, columns[i], columns[i+1])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addIndex(tx *sqlx.Tx, table string, index string, columns string) error {
+	exists, err := indexExists(tx, table, index)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = tx.Exec("CREATE INDEX `" + index + "` ON `" + table + "` " + columns)
+
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestCompareVersions(t *testing.T) {
+	testcases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.9", "1.10", -1},
+		{"1.10", "1.9", 1},
+		{"1.10", "1.10", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.2.1", "1.2", 1},
+		{"2.0", "1.18", 1},
+		{"0", "1.0", -1},
+	}
+
+	for _, testcase := range testcases {
+		if result := compareVersions(testcase.a, testcase.b); result != testcase.expected {
+			t.Errorf("Expected compareVersions(%q, %q) to be %d, got %d.", testcase.a, testcase.b, testcase.expected, result)
+		}
+	}
+}
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for i := 1; i < len(migrations); i++ {
+		if compareVersions(migrations[i-1].version, migrations[i].version) >= 0 {
+			t.Errorf("Migration %s must come after %s.", migrations[i-1].version, migrations[i].version)
+		}
+	}
+
+	// the schema files are the newest version
+	for _, d := range []Dialect{mysqlDialect{}, postgresDialect{}, sqliteDialect{}} {
+		script, err := embeddedSchemas.ReadFile(schemaFile(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		version := "'" + SchemaVersion() + "'"
+		if d.Name() == "mysql" {
+			version = fmt.Sprintf("0x%X", SchemaVersion())
+		}
+
+		if !strings.Contains(string(script), "('version', "+version+")") {
+			t.Errorf("%s does not set the schema version %s.", schemaFile(d), SchemaVersion())
+		}
+	}
+}
+
+func TestMigrateDatabase(t *testing.T) {
+	db := newTestDatabase(t)
+
+	if pending, _, err := pendingMigrations(db); err != nil || len(pending) != 0 {
+		t.Errorf("A fresh database should not need migrating, got %d migration(s) (%v).", len(pending), err)
+	}
+
+	// a failing migration is rolled back and stops the run
+	previous := migrations
+	defer func() { migrations = previous }()
+
+	migrations = append(migrations[:len(migrations):len(migrations)],
+		migration{"99.1", "works", func(tx *sqlx.Tx) error {
+			return execAll(tx, "CREATE TABLE `first` (`id` INTEGER)")
+		}},
+		migration{"99.2", "fails", func(tx *sqlx.Tx) error {
+			if err := execAll(tx, "CREATE TABLE `second` (`id` INTEGER)"); err != nil {
+				return err
+			}
+
+			return errors.New("The migration failed.")
+		}},
+	)
+
+	if err := migrateDatabase(db); err == nil || !strings.Contains(err.Error(), "99.2") {
+		t.Errorf("Expected the second migration to fail, got %v.", err)
+	}
+
+	if version, _ := databaseVersion(db); version != "99.1" {
+		t.Errorf("Expected the database to be at the last successful migration, got %s.", version)
+	}
+
+	tables := sqliteSchema(t, db)
+
+	if _, ok := tables["first"]; !ok {
+		t.Error("The successful migration was not kept.")
+	}
+
+	if _, ok := tables["second"]; ok {
+		t.Error("The failed migration was not rolled back.")
+	}
+
+	// a newer database is not touched by an older binary
+	migrations = previous
+
+	if err := migrateDatabase(db); err == nil {
+		t.Error("A database with a newer schema was migrated.")
+	}
+}
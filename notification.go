@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	NotifyImmediate = "immediate"
+	NotifyDigest    = "digest"
+
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+)
+
+// the audit log actions subscribers are notified about; "secret-deleted" is missing on purpose,
+// as the secret and its subscriptions are already gone when the audit log entry is written, so
+// the delete handler notifies the subscribers itself
+var notifiableActions = map[string]bool{
+	"secret-updated":   true,
+	"secret-imported":  true,
+	"secret-rotated":   true,
+	"secret-revealed":  true,
+	"secret-shared":    true,
+	"secret-granted":   true,
+	"consumer-updated": true,
+	"consumer-deleted": true,
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Subscription model
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type Subscription struct {
+	Id         int     `db:"id"`
+	UserId     int     `db:"user_id"`
+	Secret     *int    `db:"secret_id"`
+	Consumer   *int    `db:"consumer_id"`
+	Mode       string  `db:"mode"`
+	Channel    string  `db:"channel"`
+	WebhookUrl *string `db:"webhook_url"`
+	CreatedAt  string  `db:"created_at"`
+	_db        *sqlx.Tx
+}
+
+const subscriptionColumns = "`id`, `user_id`, `secret_id`, `consumer_id`, `mode`, `channel`, `webhook_url`, `created_at`"
+
+func findSubscription(id int, db *sqlx.Tx) *Subscription {
+	subscription := &Subscription{}
+	subscription._db = db
+
+	db.Get(subscription, "SELECT "+subscriptionColumns+" FROM `subscription` WHERE `id` = ?", id)
+	if subscription.Id == 0 {
+		return nil
+	}
+
+	return subscription
+}
+
+func findSubscriptionsByUser(userId int, db *sqlx.Tx) []Subscription {
+	list := make([]Subscription, 0)
+
+	db.Select(&list, "SELECT "+subscriptionColumns+" FROM `subscription` WHERE `user_id` = ? ORDER BY `id`", userId)
+
+	for i := range list {
+		list[i]._db = db
+	}
+
+	return list
+}
+
+// findSubscriber returns the user's subscription for a secret or consumer (exactly one of the two
+// IDs is expected to be > 0).
+func findSubscriber(userId int, secretId int, consumerId int, db *sqlx.Tx) *Subscription {
+	subscription := &Subscription{}
+	subscription._db = db
+
+	if secretId > 0 {
+		db.Get(subscription, "SELECT "+subscriptionColumns+" FROM `subscription` WHERE `user_id` = ? AND `secret_id` = ?", userId, secretId)
+	} else {
+		db.Get(subscription, "SELECT "+subscriptionColumns+" FROM `subscription` WHERE `user_id` = ? AND `consumer_id` = ?", userId, consumerId)
+	}
+
+	if subscription.Id == 0 {
+		return nil
+	}
+
+	return subscription
+}
+
+func (s *Subscription) Save() error {
+	result, err := s._db.Exec(
+		"INSERT INTO `subscription` (`user_id`, `secret_id`, `consumer_id`, `mode`, `channel`, `webhook_url`, `created_at`) VALUES (?,?,?,?,?,?,NOW())",
+		s.UserId, s.Secret, s.Consumer, s.Mode, s.Channel, s.WebhookUrl,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	s.Id = int(id)
+
+	return nil
+}
+
+func (s *Subscription) Delete() error {
+	_, err := s._db.Exec("DELETE FROM `subscription` WHERE `id` = ?", s.Id)
+	return err
+}
+
+func (s *Subscription) GetSecret() *Secret {
+	if s.Secret == nil {
+		return nil
+	}
+
+	return findSecret(*s.Secret, false, s._db)
+}
+
+func (s *Subscription) GetConsumer() *Consumer {
+	if s.Consumer == nil {
+		return nil
+	}
+
+	return findConsumer(*s.Consumer, s._db)
+}
+
+// target returns the e-mail address or webhook URL to notify.
+func (s *Subscription) target(user *User) string {
+	if s.Channel == ChannelWebhook {
+		if s.WebhookUrl == nil {
+			return ""
+		}
+
+		return *s.WebhookUrl
+	}
+
+	if user.Email == nil {
+		return ""
+	}
+
+	return *user.Email
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Enqueueing
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// notificationItem describes a single change and is rendered into e-mails or sent as JSON.
+type notificationItem struct {
+	Action       string `json:"action"`
+	Time         string `json:"time"`
+	Actor        string `json:"actor"`
+	SecretId     *int   `json:"secretId,omitempty"`
+	SecretName   string `json:"secret,omitempty"`
+	ConsumerId   *int   `json:"consumerId,omitempty"`
+	ConsumerName string `json:"consumer,omitempty"`
+	ExpiresAt    string `json:"expiresAt,omitempty"`
+}
+
+func (i notificationItem) String() string {
+	switch i.Action {
+	case "secret-updated":
+		return fmt.Sprintf("%s updated the secret '%s'.", i.Actor, i.SecretName)
+	case "secret-deleted":
+		return fmt.Sprintf("%s deleted the secret '%s'.", i.Actor, i.SecretName)
+	case "secret-imported":
+		return fmt.Sprintf("%s imported the secret '%s'.", i.Actor, i.SecretName)
+	case "secret-rotated":
+		return fmt.Sprintf("The secret '%s' has been rotated, consumers receive the new value from now on.", i.SecretName)
+	case "certificate-expiring":
+		return fmt.Sprintf("The certificate in the secret '%s' expires on %s.", i.SecretName, i.ExpiresAt)
+	case "secret-revealed":
+		return fmt.Sprintf("%s read the secret '%s' on the command line.", i.Actor, i.SecretName)
+	case "secret-shared":
+		return fmt.Sprintf("%s created a one-time link to the secret '%s'.", i.Actor, i.SecretName)
+	case "secret-granted":
+		return fmt.Sprintf("%s granted the consumer '%s' access to the secret '%s'.", i.Actor, i.ConsumerName, i.SecretName)
+	case "consumer-updated":
+		return fmt.Sprintf("%s updated the consumer '%s'.", i.Actor, i.ConsumerName)
+	case "consumer-deleted":
+		return fmt.Sprintf("%s deleted the consumer '%s'.", i.Actor, i.ConsumerName)
+	}
+
+	return fmt.Sprintf("%s: %s", i.Actor, i.Action)
+}
+
+// notifySubscribers queues notifications for all users that subscribed to the affected secret or consumer. The notifications are written in the same
+// transaction as the change itself, so nothing is lost if the server goes down before sending.
+func notifySubscribers(action string, secretId int, consumerId int, actorId int, db *sqlx.Tx) {
+	item := notificationItem{
+		Action: action,
+		Time:   time.Now().Format("2006-01-02 15:04:05"),
+		Actor:  "Someone",
+	}
+
+	if actor := findUser(actorId, false, db); actor != nil {
+		item.Actor = actor.Name
+	}
+
+	if secretId > 0 {
+		item.SecretId = &secretId
+
+		if secret := findSecret(secretId, false, db); secret != nil {
+			item.SecretName = secret.Name
+		}
+	}
+
+	if consumerId > 0 {
+		item.ConsumerId = &consumerId
+
+		if consumer := findConsumer(consumerId, db); consumer != nil {
+			item.ConsumerName = consumer.Name
+		}
+	}
+
+	queueForSubscribers(item, secretId, consumerId, actorId, db)
+}
+
+// queueForSubscribers sends the item to everyone who subscribed to the secret or consumer, except
+// for the actor.
+func queueForSubscribers(item notificationItem, secretId int, consumerId int, actorId int, db *sqlx.Tx) {
+	subscriptions := make([]Subscription, 0)
+
+	err := db.Select(&subscriptions, "SELECT "+subscriptionColumns+" FROM `subscription` WHERE (`secret_id` = ? OR `consumer_id` = ?) AND `user_id` <> ?", secretId, consumerId, actorId)
+	if err != nil {
+		panic(err)
+	}
+
+	payload, err := json.Marshal(item)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, subscription := range subscriptions {
+		user := findUser(subscription.UserId, false, db)
+		if user == nil || user.Deleted != nil {
+			continue
+		}
+
+		target := subscription.target(user)
+		if target == "" {
+			continue
+		}
+
+		if subscription.Mode == NotifyDigest {
+			_, err = db.Exec(
+				"INSERT INTO `notification_digest` (`user_id`, `channel`, `target`, `payload`, `created_at`) VALUES (?,?,?,?,?)",
+				user.Id, subscription.Channel, target, string(payload), item.Time,
+			)
+		} else {
+			err = queueNotification(user.Id, subscription.Channel, target, "[Raziel] "+item.String(), []notificationItem{item}, db)
+		}
+
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// notifyOwners sends the item to the creator and the last editor of a secret, for events that
+// happen without anyone changing the secret. Owners that subscribed to the secret are reached
+// through their subscription instead, unless they are the actor and thus excluded from it.
+func notifyOwners(secret *Secret, item notificationItem, actorId int, db *sqlx.Tx) {
+	owners := []int{secret.CreatedBy}
+	if secret.UpdatedBy != nil && *secret.UpdatedBy != secret.CreatedBy {
+		owners = append(owners, *secret.UpdatedBy)
+	}
+
+	for _, id := range owners {
+		if id != actorId && findSubscriber(id, secret.Id, -1, db) != nil {
+			continue
+		}
+
+		user := findUser(id, false, db)
+		if user == nil || user.Deleted != nil || user.Email == nil {
+			continue
+		}
+
+		err := queueNotification(user.Id, ChannelEmail, *user.Email, "[Raziel] "+item.String(), []notificationItem{item}, db)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func queueNotification(userId int, channel string, target string, subject string, items []notificationItem, db *sqlx.Tx) error {
+	payload, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+
+	_, err = db.Exec(
+		"INSERT INTO `notification` (`user_id`, `channel`, `target`, `subject`, `payload`, `created_at`, `attempts`, `next_attempt_at`) VALUES (?,?,?,?,?,?,0,?)",
+		userId, channel, target, subject, string(payload), now, now,
+	)
+
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Delivery
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type queuedNotification struct {
+	Id       int    `db:"id"`
+	UserId   int    `db:"user_id"`
+	Channel  string `db:"channel"`
+	Target   string `db:"target"`
+	Subject  string `db:"subject"`
+	Payload  string `db:"payload"`
+	Attempts int    `db:"attempts"`
+}
+
+// NotificationQueue sends queued notifications, retrying failed ones with an exponential backoff,
+// and regularly turns the collected digest items into notifications.
+type NotificationQueue struct {
+	digestInterval time.Duration
+	maxAttempts    int
+	webhookSecret  []byte
+	client         *http.Client
+}
+
+func NewNotificationQueue(c *configuration) (*NotificationQueue, error) {
+	queue := &NotificationQueue{
+		digestInterval: 24 * time.Hour,
+		maxAttempts:    c.Notifications.MaxAttempts,
+		webhookSecret:  []byte(c.Notifications.WebhookSecret),
+		client:         &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if c.Notifications.DigestInterval != "" {
+		interval, err := time.ParseDuration(c.Notifications.DigestInterval)
+		if err != nil {
+			return nil, errors.New("Invalid notification digest interval configured: " + err.Error())
+		}
+
+		queue.digestInterval = interval
+	}
+
+	if queue.maxAttempts <= 0 {
+		queue.maxAttempts = 10
+	}
+
+	return queue, nil
+}
+
+func (q *NotificationQueue) Run(database *sqlx.DB) {
+	nextDigest := time.Now().Add(q.digestInterval)
+
+	for {
+		if time.Now().After(nextDigest) {
+			err := q.buildDigests(database)
+			if err != nil {
+				log.Println("Warning: Could not build notification digests: " + err.Error())
+			}
+
+			nextDigest = time.Now().Add(q.digestInterval)
+		}
+
+		err := q.process(database)
+		if err != nil {
+			log.Println("Warning: Could not process the notification queue: " + err.Error())
+		}
+
+		<-time.After(30 * time.Second)
+	}
+}
+
+type digestItem struct {
+	Id      int    `db:"id"`
+	UserId  int    `db:"user_id"`
+	Channel string `db:"channel"`
+	Target  string `db:"target"`
+	Payload string `db:"payload"`
+}
+
+// digestKey groups digest items, so that every user receives one digest per destination.
+type digestKey struct {
+	user    int
+	channel string
+	target  string
+}
+
+func (q *NotificationQueue) buildDigests(database *sqlx.DB) error {
+	tx, err := database.Beginx()
+	if err != nil {
+		return err
+	}
+
+	items := make([]digestItem, 0)
+
+	err = tx.Select(&items, "SELECT `id`, `user_id`, `channel`, `target`, `payload` FROM `notification_digest` ORDER BY `id`")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	digests := make(map[digestKey][]notificationItem)
+	order := make([]digestKey, 0)
+
+	for _, row := range items {
+		key := digestKey{row.UserId, row.Channel, row.Target}
+		item := notificationItem{}
+
+		err = json.Unmarshal([]byte(row.Payload), &item)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := digests[key]; !ok {
+			order = append(order, key)
+		}
+
+		digests[key] = append(digests[key], item)
+	}
+
+	for _, key := range order {
+		subject := fmt.Sprintf("[Raziel] %d change(s) to your subscriptions", len(digests[key]))
+
+		err = queueNotification(key.user, key.channel, key.target, subject, digests[key], tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if len(items) > 0 {
+		_, err = tx.Exec("DELETE FROM `notification_digest` WHERE `id` <= ?", items[len(items)-1].Id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (q *NotificationQueue) process(database *sqlx.DB) error {
+	now := time.Now()
+	pending := make([]queuedNotification, 0)
+
+	err := database.Select(&pending, "SELECT `id`, `user_id`, `channel`, `target`, `subject`, `payload`, `attempts` FROM `notification` WHERE `sent_at` IS NULL AND `failed_at` IS NULL AND `next_attempt_at` <= ? ORDER BY `id` LIMIT 50", now.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return err
+	}
+
+	for _, notification := range pending {
+		err = q.send(&notification)
+
+		if err == nil {
+			_, err = database.Exec("UPDATE `notification` SET `sent_at` = ?, `attempts` = `attempts` + 1, `last_error` = NULL WHERE `id` = ?", time.Now().Format("2006-01-02 15:04:05"), notification.Id)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		attempts := notification.Attempts + 1
+		message := err.Error()
+
+		if attempts >= q.maxAttempts {
+			log.Printf("Giving up on notification #%d after %d attempts: %s", notification.Id, attempts, message)
+			_, err = database.Exec("UPDATE `notification` SET `failed_at` = ?, `attempts` = ?, `last_error` = ? WHERE `id` = ?", time.Now().Format("2006-01-02 15:04:05"), attempts, message, notification.Id)
+		} else {
+			next := time.Now().Add(notificationBackoff(attempts)).Format("2006-01-02 15:04:05")
+			_, err = database.Exec("UPDATE `notification` SET `next_attempt_at` = ?, `attempts` = ?, `last_error` = ? WHERE `id` = ?", next, attempts, message, notification.Id)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// notificationBackoff returns 1, 2, 4, 8, ... minutes, but at most 6 hours.
+func notificationBackoff(attempts int) time.Duration {
+	backoff := time.Minute
+
+	for i := 1; i < attempts && backoff < 6*time.Hour; i++ {
+		backoff *= 2
+	}
+
+	if backoff > 6*time.Hour {
+		backoff = 6 * time.Hour
+	}
+
+	return backoff
+}
+
+func (q *NotificationQueue) send(notification *queuedNotification) error {
+	items := make([]notificationItem, 0)
+
+	err := json.Unmarshal([]byte(notification.Payload), &items)
+	if err != nil {
+		return err
+	}
+
+	if notification.Channel == ChannelWebhook {
+		return q.sendWebhook(notification, items)
+	}
+
+	lines := make([]string, 0, len(items))
+
+	for _, item := range items {
+		lines = append(lines, item.Time+"  "+item.String())
+	}
+
+	body := strings.Join(lines, "\n") + "\n\n" +
+		"You receive this e-mail because you subscribed to these changes. Manage your subscriptions\n" +
+		"at " + strings.TrimSuffix(config.Server.BaseUrl, "/") + "/profile.\n"
+
+	return sendMail([]string{notification.Target}, notification.Subject, body)
+}
+
+// sendWebhook POSTs the items as JSON. The request is signed with HMAC-SHA256 over
+// "<timestamp>.<body>", so receivers can verify its origin and reject replays.
+func (q *NotificationQueue) sendWebhook(notification *queuedNotification, items []notificationItem) error {
+	if len(q.webhookSecret) == 0 {
+		return errors.New("No webhook secret configured.")
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":      notification.Id,
+		"subject": notification.Subject,
+		"items":   items,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, q.webhookSecret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequest("POST", notification.Target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Raziel")
+	req.Header.Set("X-Raziel-Timestamp", timestamp)
+	req.Header.Set("X-Raziel-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	res, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("The webhook responded with status %d.", res.StatusCode)
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// HTTP Handlers
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// subscriptionPanel is embedded into the secret and consumer forms.
+type subscriptionPanel struct {
+	Kind         string
+	Target       int
+	Subscription *Subscription
+	HasEmail     bool
+	CsrfToken    string
+}
+
+func newSubscriptionPanel(kind string, target int, user *User, csrfToken string, db *sqlx.Tx) subscriptionPanel {
+	panel := subscriptionPanel{
+		Kind:      kind,
+		Target:    target,
+		HasEmail:  user.Email != nil,
+		CsrfToken: csrfToken,
+	}
+
+	if kind == "secret" {
+		panel.Subscription = findSubscriber(user.Id, target, 0, db)
+	} else {
+		panel.Subscription = findSubscriber(user.Id, 0, target, db)
+	}
+
+	return panel
+}
+
+func subscribeAction(req *http.Request, user *User, db *sqlx.Tx) response {
+	secretId, _ := strconv.Atoi(req.FormValue("secret"))
+	consumerId, _ := strconv.Atoi(req.FormValue("consumer"))
+	back := "/"
+
+	subscription := &Subscription{
+		UserId:  user.Id,
+		Mode:    req.FormValue("mode"),
+		Channel: req.FormValue("channel"),
+		_db:     db,
+	}
+
+	if secretId > 0 {
+		if findSecret(secretId, false, db) == nil {
+			return renderError(404, "Secret could not be found.")
+		}
+
+		subscription.Secret = &secretId
+		back = "/secrets/" + strconv.Itoa(secretId)
+	} else if consumerId > 0 {
+		if findConsumer(consumerId, db) == nil {
+			return renderError(404, "Consumer could not be found.")
+		}
+
+		subscription.Consumer = &consumerId
+		back = "/consumers/" + strconv.Itoa(consumerId)
+	} else {
+		return renderError(400, "No secret or consumer given.")
+	}
+
+	if subscription.Mode != NotifyImmediate && subscription.Mode != NotifyDigest {
+		return renderError(400, "Invalid notification mode given.")
+	}
+
+	switch subscription.Channel {
+	case ChannelEmail:
+		if user.Email == nil {
+			return renderError(400, "Your account has no e-mail address, ask an administrator to add one.")
+		}
+
+	case ChannelWebhook:
+		webhook := strings.TrimSpace(req.FormValue("webhook_url"))
+		parsed, err := url.Parse(webhook)
+
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return renderError(400, "The webhook URL must be a valid http:// or https:// URL.")
+		}
+
+		subscription.WebhookUrl = &webhook
+
+	default:
+		return renderError(400, "Invalid notification channel given.")
+	}
+
+	// replace any existing subscription
+	if existing := findSubscriber(user.Id, secretId, consumerId, db); existing != nil {
+		err := existing.Delete()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	err := subscription.Save()
+	if err != nil {
+		panic(err)
+	}
+
+	return redirect(302, back)
+}
+
+func unsubscribeAction(params martini.Params, req *http.Request, user *User, db *sqlx.Tx) response {
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return renderError(400, "Invalid ID given.")
+	}
+
+	subscription := findSubscription(id, db)
+	if subscription == nil || subscription.UserId != user.Id {
+		return renderError(404, "Subscription could not be found.")
+	}
+
+	err = subscription.Delete()
+	if err != nil {
+		panic(err)
+	}
+
+	back := "/profile"
+
+	if req.FormValue("back") == "secret" && subscription.Secret != nil {
+		back = "/secrets/" + strconv.Itoa(*subscription.Secret)
+	} else if req.FormValue("back") == "consumer" && subscription.Consumer != nil {
+		back = "/consumers/" + strconv.Itoa(*subscription.Consumer)
+	}
+
+	return redirect(302, back)
+}
+
+func setupSubscriptionsCtrl(app *martini.ClassicMartini) {
+	app.Group("/subscriptions", func(r martini.Router) {
+		app.Post("", subscribeAction)
+		app.Delete("/:id", unsubscribeAction)
+	}, sessions.RequireLogin, sessions.RequireCsrfToken)
+}
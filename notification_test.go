@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/jmoiron/sqlx"
+)
+
+// createTestUserWithEmail stores a local user with an e-mail address.
+func createTestUserWithEmail(t *testing.T, login string, tx *sqlx.Tx) *User {
+	t.Helper()
+
+	email := login + "@example.com"
+	user := &User{Id: -1, Name: login, LoginName: login, Email: &email, Role: RoleUser, Backend: BackendLocal, _db: tx}
+
+	if err := user.Save(); err != nil {
+		t.Fatalf("Could not create user '%s': %v", login, err)
+	}
+
+	return user
+}
+
+func TestSubscribe(t *testing.T) {
+	db := newTestDatabase(t)
+
+	var err error
+
+	templateManager, err = NewTemplateManager(resourceFS("templates"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, _ := db.Beginx()
+	defer tx.Rollback()
+
+	admin := createTestUser(t, "admin", tx)
+	jane := createTestUserWithEmail(t, "jane", tx)
+	secret := createTestSecret(t, "password", "hunter2", admin, tx)
+	id := strconv.Itoa(secret.Id)
+
+	subscribe := func(user *User, form url.Values) response {
+		return subscribeAction(newTestRequest("POST", "/subscriptions?"+form.Encode()), user, tx)
+	}
+
+	testcases := []struct {
+		user   *User
+		form   url.Values
+		status int
+	}{
+		{jane, url.Values{"mode": {NotifyImmediate}, "channel": {ChannelEmail}}, 400},
+		{jane, url.Values{"secret": {"999"}, "mode": {NotifyImmediate}, "channel": {ChannelEmail}}, 404},
+		{jane, url.Values{"consumer": {"999"}, "mode": {NotifyImmediate}, "channel": {ChannelEmail}}, 404},
+		{jane, url.Values{"secret": {id}, "mode": {"hourly"}, "channel": {ChannelEmail}}, 400},
+		{jane, url.Values{"secret": {id}, "mode": {NotifyImmediate}, "channel": {"sms"}}, 400},
+		{admin, url.Values{"secret": {id}, "mode": {NotifyImmediate}, "channel": {ChannelEmail}}, 400},
+		{jane, url.Values{"secret": {id}, "mode": {NotifyDigest}, "channel": {ChannelWebhook}, "webhook_url": {"ftp://example.com"}}, 400},
+		{jane, url.Values{"secret": {id}, "mode": {NotifyDigest}, "channel": {ChannelWebhook}, "webhook_url": {"https://"}}, 400},
+	}
+
+	for _, testcase := range testcases {
+		if resp := subscribe(testcase.user, testcase.form); resp.Status != testcase.status {
+			t.Errorf("Expected %d for %v, got %d.", testcase.status, testcase.form, resp.Status)
+		}
+	}
+
+	if len(findSubscriptionsByUser(jane.Id, tx)) != 0 {
+		t.Fatal("An invalid subscription was stored.")
+	}
+
+	// subscribing again replaces the previous subscription
+	subscribe(jane, url.Values{"secret": {id}, "mode": {NotifyImmediate}, "channel": {ChannelEmail}})
+	resp := subscribe(jane, url.Values{"secret": {id}, "mode": {NotifyDigest}, "channel": {ChannelWebhook}, "webhook_url": {" https://example.com/hook "}})
+
+	if resp.Status != 302 || resp.Content != "/secrets/"+id {
+		t.Errorf("Expected a redirect to the secret, got %d (%s).", resp.Status, resp.Content)
+	}
+
+	subscriptions := findSubscriptionsByUser(jane.Id, tx)
+	if len(subscriptions) != 1 {
+		t.Fatalf("Expected one subscription, got %d.", len(subscriptions))
+	}
+
+	subscription := subscriptions[0]
+	if subscription.Mode != NotifyDigest || subscription.target(jane) != "https://example.com/hook" {
+		t.Errorf("The subscription was not replaced: %+v", subscription)
+	}
+
+	unsubscribe := func(user *User, back string) response {
+		params := martini.Params{"id": strconv.Itoa(subscription.Id)}
+		return unsubscribeAction(params, newTestRequest("DELETE", "/subscriptions/"+params["id"]+"?back="+back), user, tx)
+	}
+
+	if resp := unsubscribe(admin, "secret"); resp.Status != 404 {
+		t.Errorf("Another user's subscription could be removed: %d", resp.Status)
+	}
+
+	if resp := unsubscribe(jane, "secret"); resp.Status != 302 || resp.Content != "/secrets/"+id {
+		t.Errorf("Expected a redirect to the secret, got %d (%s).", resp.Status, resp.Content)
+	}
+
+	if findSubscription(subscription.Id, tx) != nil {
+		t.Error("The subscription was not removed.")
+	}
+}
+
+func TestNotifySubscribers(t *testing.T) {
+	db := newTestDatabase(t)
+
+	tx, _ := db.Beginx()
+	defer tx.Rollback()
+
+	admin := createTestUserWithEmail(t, "admin", tx)
+	jane := createTestUserWithEmail(t, "jane", tx)
+	bob := createTestUserWithEmail(t, "bob", tx)
+	carl := createTestUser(t, "carl", tx)
+	consumer := createTestConsumer(t, "web", admin, tx)
+	secret := createTestSecret(t, "password", "hunter2", admin, tx)
+	hook := "https://example.com/hook"
+
+	subscriptions := []*Subscription{
+		{UserId: admin.Id, Secret: &secret.Id, Mode: NotifyImmediate, Channel: ChannelEmail},
+		{UserId: jane.Id, Secret: &secret.Id, Mode: NotifyImmediate, Channel: ChannelEmail},
+		{UserId: bob.Id, Consumer: &consumer.Id, Mode: NotifyDigest, Channel: ChannelWebhook, WebhookUrl: &hook},
+		// carl has no e-mail address to notify
+		{UserId: carl.Id, Secret: &secret.Id, Mode: NotifyImmediate, Channel: ChannelEmail},
+	}
+
+	for _, subscription := range subscriptions {
+		subscription._db = tx
+
+		if err := subscription.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the actor is not told about their own change
+	notifySubscribers("secret-granted", secret.Id, consumer.Id, admin.Id, tx)
+
+	// queued returns and clears the queued notifications
+	queued := func() []queuedNotification {
+		list := make([]queuedNotification, 0)
+		tx.Select(&list, "SELECT `id`, `user_id`, `channel`, `target`, `subject`, `payload`, `attempts` FROM `notification` ORDER BY `id`")
+		tx.Exec("DELETE FROM `notification`")
+
+		return list
+	}
+
+	notifications := queued()
+
+	if len(notifications) != 1 {
+		t.Fatalf("Expected one notification, got %d.", len(notifications))
+	}
+
+	expected := "[Raziel] admin granted the consumer 'web' access to the secret 'password'."
+	if n := notifications[0]; n.UserId != jane.Id || n.Target != "jane@example.com" || n.Subject != expected {
+		t.Errorf("Unexpected notification: %+v", n)
+	}
+
+	digest := make([]digestItem, 0)
+	tx.Select(&digest, "SELECT `id`, `user_id`, `channel`, `target`, `payload` FROM `notification_digest`")
+
+	if len(digest) != 1 || digest[0].UserId != bob.Id || digest[0].Target != hook {
+		t.Fatalf("Expected one digest item for bob, got %+v.", digest)
+	}
+
+	item := notificationItem{}
+	if err := json.Unmarshal([]byte(digest[0].Payload), &item); err != nil || item.SecretName != "password" || *item.ConsumerId != consumer.Id {
+		t.Errorf("Unexpected digest item: %s", digest[0].Payload)
+	}
+
+	// owners are notified directly, unless they already subscribed to the secret
+	findSubscriber(jane.Id, secret.Id, 0, tx).Delete()
+
+	secret.UpdatedBy = &jane.Id
+	notifyOwners(secret, notificationItem{Action: "certificate-expiring", SecretName: "password", ExpiresAt: "2020-01-01"}, 0, tx)
+
+	notifications = queued()
+
+	expected = "[Raziel] The certificate in the secret 'password' expires on 2020-01-01."
+	if len(notifications) != 1 || notifications[0].UserId != jane.Id || notifications[0].Subject != expected {
+		t.Errorf("Expected only the unsubscribed editor to be notified, got %+v.", notifications)
+	}
+
+	// an owner who is the actor is still told, as their subscription excludes them
+	notifyOwners(secret, notificationItem{Action: "secret-rotated", SecretName: "password"}, admin.Id, tx)
+	notifications = queued()
+
+	if len(notifications) != 2 || notifications[0].UserId != admin.Id || notifications[1].UserId != jane.Id {
+		t.Errorf("Expected both owners to be notified, got %+v.", notifications)
+	}
+}
+
+func TestNotificationQueue(t *testing.T) {
+	db := newTestDatabase(t)
+
+	config.Notifications.WebhookSecret = "webhook secret"
+	config.Notifications.MaxAttempts = 2
+
+	queue, err := NewNotificationQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make([]map[string]interface{}, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		mac := hmac.New(sha256.New, []byte("webhook secret"))
+		mac.Write([]byte(req.Header.Get("X-Raziel-Timestamp") + "."))
+		mac.Write(body)
+
+		if req.Header.Get("X-Raziel-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			res.WriteHeader(400)
+			return
+		}
+
+		payload := map[string]interface{}{}
+		json.Unmarshal(body, &payload)
+		received = append(received, payload)
+	}))
+	defer server.Close()
+
+	tx, _ := db.Beginx()
+	user := createTestUserWithEmail(t, "jane", tx)
+	secret := createTestSecret(t, "password", "hunter2", user, tx)
+	hook := server.URL + "/hook"
+
+	subscription := &Subscription{UserId: user.Id, Secret: &secret.Id, Mode: NotifyDigest, Channel: ChannelWebhook, WebhookUrl: &hook, _db: tx}
+	if err := subscription.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	notifySubscribers("secret-updated", secret.Id, 0, 0, tx)
+	notifySubscribers("secret-revealed", secret.Id, 0, 0, tx)
+
+	// without an SMTP server, e-mails fail
+	queueNotification(user.Id, ChannelEmail, *user.Email, "[Raziel] Test", []notificationItem{{Action: "secret-updated"}}, tx)
+	tx.Commit()
+
+	// both changes end up in a single digest
+	if err := queue.buildDigests(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := queue.process(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(received) != 1 || received[0]["subject"] != "[Raziel] 2 change(s) to your subscriptions" || len(received[0]["items"].([]interface{})) != 2 {
+		t.Fatalf("Expected one digest with two items, got %v.", received)
+	}
+
+	type state struct {
+		Attempts int     `db:"attempts"`
+		SentAt   *string `db:"sent_at"`
+		FailedAt *string `db:"failed_at"`
+		Error    *string `db:"last_error"`
+	}
+
+	states := func() []state {
+		list := make([]state, 0)
+		db.Select(&list, "SELECT `attempts`, `sent_at`, `failed_at`, `last_error` FROM `notification` ORDER BY `id`")
+
+		return list
+	}
+
+	list := states()
+	if len(list) != 2 || list[1].SentAt == nil || list[0].SentAt != nil || list[0].Attempts != 1 || list[0].Error == nil {
+		t.Fatalf("Expected the digest to be sent and the e-mail to be retried: %+v", list)
+	}
+
+	// the retry is not due yet
+	queue.process(db)
+
+	if list := states(); list[0].Attempts != 1 {
+		t.Errorf("The notification was retried before its backoff: %+v", list[0])
+	}
+
+	db.Exec("UPDATE `notification` SET `next_attempt_at` = ?", "2000-01-01 00:00:00")
+	queue.process(db)
+
+	if list := states(); list[0].Attempts != 2 || list[0].FailedAt == nil {
+		t.Errorf("Expected the e-mail to be given up on: %+v", list[0])
+	}
+
+	if err := queue.buildDigests(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if list := states(); len(list) != 2 {
+		t.Error("The digest items were sent twice.")
+	}
+}
+
+func TestNotificationBackoff(t *testing.T) {
+	expected := map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		4:  8 * time.Minute,
+		9:  256 * time.Minute,
+		10: 6 * time.Hour,
+		50: 6 * time.Hour,
+	}
+
+	for attempts, backoff := range expected {
+		if actual := notificationBackoff(attempts); actual != backoff {
+			t.Errorf("Expected %s after %d attempts, got %s.", backoff, attempts, actual)
+		}
+	}
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var oidcProvider *OidcProvider
+
+var (
+	errOidcUserDeleted = errors.New("The account linked to this OIDC subject has been deleted.")
+	errOidcEmailTaken  = errors.New("An account with this e-mail address exists, but linking by e-mail is disabled.")
+)
+
+const oidcStateCookie = "raziel_oidc"
+
+// OidcProvider implements the OpenID Connect authorization code flow with PKCE against a single
+// identity provider. It only uses the standard library, so any spec-compliant IdP (including
+// local mock servers) works.
+type OidcProvider struct {
+	issuer         string
+	clientId       string
+	clientSecret   string
+	redirectUrl    string
+	allowedDomains []string
+	client         *http.Client
+
+	metadata   *oidcMetadata
+	keys       map[string]crypto.PublicKey
+	keysLoaded time.Time
+	pending    map[string]*oidcPendingLogin
+	lock       sync.Mutex
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcPendingLogin struct {
+	Nonce    string
+	Verifier string
+	Expires  time.Time
+}
+
+// oidcIdentity is the subset of ID token claims we care about.
+type oidcIdentity struct {
+	Issuer            string      `json:"iss"`
+	Subject           string      `json:"sub"`
+	Audience          interface{} `json:"aud"`
+	Expires           int64       `json:"exp"`
+	Nonce             string      `json:"nonce"`
+	Email             string      `json:"email"`
+	EmailVerified     interface{} `json:"email_verified"`
+	Name              string      `json:"name"`
+	PreferredUsername string      `json:"preferred_username"`
+}
+
+func NewOidcProvider(c *configuration) (*OidcProvider, error) {
+	cfg := c.Oidc
+
+	if cfg.Issuer == "" || cfg.ClientId == "" {
+		return nil, errors.New("OIDC requires at least an issuer and a client ID.")
+	}
+
+	if len(cfg.AllowedDomains) == 0 {
+		return nil, errors.New("OIDC requires at least one allowed e-mail domain, otherwise anyone with an account at the identity provider could log in.")
+	}
+
+	if cfg.DefaultRole != "" && !isValidRole(cfg.DefaultRole) {
+		return nil, errors.New("Invalid default OIDC role '" + cfg.DefaultRole + "' configured.")
+	}
+
+	domains := make([]string, 0, len(cfg.AllowedDomains))
+
+	for _, domain := range cfg.AllowedDomains {
+		domains = append(domains, strings.ToLower(strings.TrimSpace(domain)))
+	}
+
+	provider := &OidcProvider{
+		issuer:         strings.TrimSuffix(cfg.Issuer, "/"),
+		clientId:       cfg.ClientId,
+		clientSecret:   cfg.ClientSecret,
+		redirectUrl:    strings.TrimSuffix(c.Server.BaseUrl, "/") + "/login/oidc/callback",
+		allowedDomains: domains,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		pending:        make(map[string]*oidcPendingLogin),
+	}
+
+	go provider.cleanup()
+
+	return provider, nil
+}
+
+// AuthCodeUrl prepares a new login attempt and returns the state (to be bound to the browser)
+// and the URL to send the user to.
+func (p *OidcProvider) AuthCodeUrl() (string, string, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := safeRandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce, err := safeRandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	verifier, err := safeRandomString(48)
+	if err != nil {
+		return "", "", err
+	}
+
+	p.lock.Lock()
+	p.pending[state] = &oidcPendingLogin{nonce, verifier, time.Now().Add(10 * time.Minute)}
+	p.lock.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.clientId)
+	query.Set("redirect_uri", p.redirectUrl)
+	query.Set("scope", "openid email profile")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	target := meta.AuthorizationEndpoint
+
+	if strings.Contains(target, "?") {
+		target += "&" + query.Encode()
+	} else {
+		target += "?" + query.Encode()
+	}
+
+	return state, target, nil
+}
+
+// Exchange redeems the authorization code and returns the verified identity of the user.
+func (p *OidcProvider) Exchange(state string, code string) (*oidcIdentity, error) {
+	p.lock.Lock()
+	login, ok := p.pending[state]
+	delete(p.pending, state)
+	p.lock.Unlock()
+
+	if !ok || time.Now().After(login.Expires) {
+		return nil, errors.New("Unknown or expired login attempt.")
+	}
+
+	meta, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectUrl)
+	form.Set("client_id", p.clientId)
+	form.Set("code_verifier", login.Verifier)
+
+	req, err := http.NewRequest("POST", meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("Token endpoint responded with " + res.Status + ".")
+	}
+
+	tokens := struct {
+		IdToken string `json:"id_token"`
+	}{}
+
+	err = json.NewDecoder(res.Body).Decode(&tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	if tokens.IdToken == "" {
+		return nil, errors.New("Token endpoint did not return an ID token.")
+	}
+
+	identity, err := p.verify(tokens.IdToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(identity.Nonce), []byte(login.Nonce)) != 1 {
+		return nil, errors.New("ID token nonce does not match.")
+	}
+
+	return identity, nil
+}
+
+// IsAllowed checks the e-mail domain against the configured list of allowed domains. Without
+// any allowed domains, nobody is allowed.
+func (p *OidcProvider) IsAllowed(identity *oidcIdentity) bool {
+	if !identity.IsEmailVerified() {
+		return false
+	}
+
+	at := strings.LastIndex(identity.Email, "@")
+	if at < 0 {
+		return false
+	}
+
+	return isInStringList(strings.ToLower(identity.Email[at+1:]), p.allowedDomains)
+}
+
+func (p *OidcProvider) discover() (*oidcMetadata, error) {
+	p.lock.Lock()
+	meta := p.metadata
+	p.lock.Unlock()
+
+	if meta != nil {
+		return meta, nil
+	}
+
+	meta = &oidcMetadata{}
+
+	err := p.getJson(p.issuer+"/.well-known/openid-configuration", meta)
+	if err != nil {
+		return nil, errors.New("OIDC discovery failed: " + err.Error())
+	}
+
+	if strings.TrimSuffix(meta.Issuer, "/") != p.issuer {
+		return nil, errors.New("OIDC discovery returned unexpected issuer '" + meta.Issuer + "'.")
+	}
+
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JwksUri == "" {
+		return nil, errors.New("OIDC discovery document is incomplete.")
+	}
+
+	p.lock.Lock()
+	p.metadata = meta
+	p.lock.Unlock()
+
+	return meta, nil
+}
+
+func (p *OidcProvider) verify(token string) (*oidcIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed ID token.")
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+
+	err := decodeJwtSegment(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Malformed ID token signature.")
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch header.Alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("Invalid ID token signature.")
+		}
+
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return nil, errors.New("Invalid ID token signature.")
+		}
+
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return nil, errors.New("Invalid ID token signature.")
+		}
+
+	default:
+		return nil, errors.New("Unsupported ID token algorithm '" + header.Alg + "'.")
+	}
+
+	identity := &oidcIdentity{}
+
+	err = decodeJwtSegment(parts[1], identity)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(identity.Issuer, "/") != p.issuer {
+		return nil, errors.New("ID token was issued by someone else.")
+	}
+
+	if !identity.HasAudience(p.clientId) {
+		return nil, errors.New("ID token was not issued for us.")
+	}
+
+	if time.Now().Unix() > identity.Expires {
+		return nil, errors.New("ID token has expired.")
+	}
+
+	if identity.Subject == "" {
+		return nil, errors.New("ID token does not contain a subject.")
+	}
+
+	return identity, nil
+}
+
+// key returns the signing key with the given ID, re-fetching the key set when an unknown key is
+// requested (IdPs rotate their keys), but not more often than once a minute.
+func (p *OidcProvider) key(kid string) (crypto.PublicKey, error) {
+	p.lock.Lock()
+	key, ok := p.keys[kid]
+	stale := time.Since(p.keysLoaded) > time.Minute
+	p.lock.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	if !stale {
+		return nil, errors.New("Unknown ID token signing key.")
+	}
+
+	meta, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	jwks := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+
+	err = p.getJson(meta.JwksUri, &jwks)
+	if err != nil {
+		return nil, errors.New("Could not fetch OIDC signing keys: " + err.Error())
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+
+	for _, jwk := range jwks.Keys {
+		switch jwk.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(jwk.E)
+
+			if err1 == nil && err2 == nil {
+				keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			}
+
+		case "EC":
+			x, err1 := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(jwk.Y)
+
+			if err1 == nil && err2 == nil && jwk.Crv == "P-256" {
+				keys[jwk.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			}
+		}
+	}
+
+	p.lock.Lock()
+	p.keys = keys
+	p.keysLoaded = time.Now()
+	p.lock.Unlock()
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, errors.New("Unknown ID token signing key.")
+	}
+
+	return key, nil
+}
+
+func (p *OidcProvider) getJson(target string, dest interface{}) error {
+	res, err := p.client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New(target + " responded with " + res.Status + ".")
+	}
+
+	return json.NewDecoder(res.Body).Decode(dest)
+}
+
+func (p *OidcProvider) cleanup() {
+	for {
+		now := time.Now()
+
+		p.lock.Lock()
+		for state, login := range p.pending {
+			if now.After(login.Expires) {
+				delete(p.pending, state)
+			}
+		}
+		p.lock.Unlock()
+
+		<-time.After(1 * time.Minute)
+	}
+}
+
+func decodeJwtSegment(segment string, dest interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("Malformed ID token.")
+	}
+
+	return json.Unmarshal(decoded, dest)
+}
+
+func (i *oidcIdentity) HasAudience(clientId string) bool {
+	switch aud := i.Audience.(type) {
+	case string:
+		return aud == clientId
+
+	case []interface{}:
+		for _, value := range aud {
+			if str, ok := value.(string); ok && str == clientId {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// IsEmailVerified handles IdPs that send the flag as a string instead of a boolean.
+func (i *oidcIdentity) IsEmailVerified() bool {
+	switch verified := i.EmailVerified.(type) {
+	case bool:
+		return verified
+
+	case string:
+		return verified == "true"
+	}
+
+	return false
+}
+
+// LoginName derives a login that passes validateSafeString from the identity.
+func (i *oidcIdentity) LoginName() string {
+	candidate := i.PreferredUsername
+
+	if candidate == "" {
+		candidate = i.Email
+	}
+
+	if at := strings.Index(candidate, "@"); at >= 0 {
+		candidate = candidate[:at]
+	}
+
+	candidate = strings.ToLower(candidate)
+	cleaned := ""
+
+	for _, char := range candidate {
+		if (char >= 'a' && char <= 'z') || (char >= '0' && char <= '9') || char == '-' || char == '_' {
+			cleaned += string(char)
+		} else {
+			cleaned += "-"
+		}
+	}
+
+	cleaned = strings.TrimLeft(cleaned, "0123456789-_")
+	cleaned = strings.TrimRight(cleaned, "-_")
+
+	if cleaned == "" {
+		cleaned = "sso-user"
+	}
+
+	return cleaned
+}
+
+// provisionOidcUser finds the user for the given identity, first by subject, then (if enabled) by
+// verified e-mail address, linking the account on the way. If no user is found, a new one is
+// created. Subjects of deleted users are never provisioned again.
+func provisionOidcUser(identity *oidcIdentity, req *http.Request, db *sqlx.Tx) (*User, error) {
+	subject := identity.Subject
+
+	user := findUserByOidcSubject(subject, db)
+	if user != nil {
+		if user.Deleted != nil {
+			return nil, errOidcUserDeleted
+		}
+
+		return user, nil
+	}
+
+	if identity.Email != "" && identity.IsEmailVerified() {
+		user = findUserByEmail(identity.Email, db)
+
+		if user != nil {
+			// linking would hand the account to whoever controls the e-mail address at the IdP
+			if !config.Oidc.LinkByEmail || user.OidcSubject != nil {
+				return nil, errOidcEmailTaken
+			}
+
+			user.OidcSubject = &subject
+
+			err := user.Save()
+			if err != nil {
+				return nil, err
+			}
+
+			NewAuditLog(db, req).LogUserLinked(user.Id, BackendOidc)
+
+			return user, nil
+		}
+	}
+
+	role := config.Oidc.DefaultRole
+	if role == "" {
+		role = RoleUser
+	}
+
+	// find a free login name
+	base := identity.LoginName()
+	login := base
+
+	for i := 2; findUserByLogin(login, false, db) != nil; i++ {
+		login = fmt.Sprintf("%s%d", base, i)
+	}
+
+	name := identity.Name
+	if name == "" {
+		name = login
+	}
+
+	user = &User{
+		Id:          -1,
+		Name:        name,
+		LoginName:   login,
+		Role:        role,
+		Backend:     BackendOidc,
+		OidcSubject: &subject,
+		_db:         db,
+	}
+
+	if identity.Email != "" && identity.IsEmailVerified() {
+		email := strings.ToLower(identity.Email)
+		user.Email = &email
+	}
+
+	err := user.Save()
+	if err != nil {
+		return nil, err
+	}
+
+	NewAuditLog(db, req).LogUserProvisioned(user.Id, BackendOidc)
+
+	return user, nil
+}
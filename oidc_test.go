@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testIssuer = "https://idp.example.com"
+
+type testIdp struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newTestIdp(t *testing.T) (*testIdp, *OidcProvider) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := &OidcProvider{
+		issuer:         testIssuer,
+		clientId:       "raziel",
+		allowedDomains: []string{"example.com"},
+		keys: map[string]crypto.PublicKey{
+			"rsa": &rsaKey.PublicKey,
+			"ec":  &ecKey.PublicKey,
+		},
+		// keep the provider from fetching the key set
+		keysLoaded: time.Now(),
+	}
+
+	return &testIdp{rsaKey, ecKey}, provider
+}
+
+func (i *testIdp) sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+
+	switch alg {
+	case "RS256":
+		var err error
+
+		signature, err = rsa.SignPKCS1v15(rand.Reader, i.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, i.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            testIssuer,
+		"sub":            "subject-1",
+		"aud":            "raziel",
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"nonce":          "nonce",
+		"email":          "jane@example.com",
+		"email_verified": true,
+	}
+}
+
+func TestOidcVerify(t *testing.T) {
+	idp, provider := newTestIdp(t)
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		kid := "rsa"
+		if alg == "ES256" {
+			kid = "ec"
+		}
+
+		identity, err := provider.verify(idp.sign(t, alg, kid, testClaims()))
+		if err != nil {
+			t.Fatalf("%s: valid token was rejected: %v", alg, err)
+		}
+
+		if identity.Subject != "subject-1" || identity.Email != "jane@example.com" {
+			t.Errorf("%s: unexpected identity %+v", alg, identity)
+		}
+	}
+
+	// a list of audiences is fine as long as we are in it
+	claims := testClaims()
+	claims["aud"] = []string{"other", "raziel"}
+
+	if _, err := provider.verify(idp.sign(t, "RS256", "rsa", claims)); err != nil {
+		t.Errorf("token with multiple audiences was rejected: %v", err)
+	}
+}
+
+func TestOidcVerifyRejectsInvalidTokens(t *testing.T) {
+	idp, provider := newTestIdp(t)
+
+	modified := func(key string, value interface{}) map[string]interface{} {
+		claims := testClaims()
+
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+
+		return claims
+	}
+
+	valid := idp.sign(t, "RS256", "rsa", testClaims())
+	parts := strings.Split(valid, ".")
+	tampered, _ := json.Marshal(modified("sub", "admin"))
+
+	testcases := map[string]string{
+		"malformed":          "not-a-token",
+		"tampered payload":   parts[0] + "." + base64.RawURLEncoding.EncodeToString(tampered) + "." + parts[2],
+		"missing signature":  parts[0] + "." + parts[1] + ".",
+		"unsigned":           idp.sign(t, "none", "rsa", testClaims()),
+		"symmetric":          idp.sign(t, "HS256", "rsa", testClaims()),
+		"key type mismatch":  idp.sign(t, "RS256", "ec", testClaims()),
+		"unknown key":        idp.sign(t, "RS256", "unknown", testClaims()),
+		"wrong issuer":       idp.sign(t, "RS256", "rsa", modified("iss", "https://evil.example.com")),
+		"wrong audience":     idp.sign(t, "RS256", "rsa", modified("aud", "someone-else")),
+		"no audience":        idp.sign(t, "RS256", "rsa", modified("aud", nil)),
+		"expired":            idp.sign(t, "RS256", "rsa", modified("exp", time.Now().Add(-time.Minute).Unix())),
+		"no subject":         idp.sign(t, "RS256", "rsa", modified("sub", "")),
+		"other key's tokens": strings.Join(append(strings.Split(idp.sign(t, "ES256", "ec", testClaims()), ".")[:2], parts[2]), "."),
+	}
+
+	for name, token := range testcases {
+		if _, err := provider.verify(token); err == nil {
+			t.Errorf("%s: token was accepted", name)
+		}
+	}
+}
+
+func TestNewOidcProviderRequiresAllowedDomains(t *testing.T) {
+	c := &configuration{}
+	c.Oidc.Issuer = testIssuer
+	c.Oidc.ClientId = "raziel"
+
+	if _, err := NewOidcProvider(c); err == nil {
+		t.Error("provider without allowed domains was created")
+	}
+}
+
+func TestOidcIsAllowed(t *testing.T) {
+	_, provider := newTestIdp(t)
+
+	testcases := []struct {
+		email    string
+		verified interface{}
+		allowed  bool
+	}{
+		{"jane@example.com", true, true},
+		{"Jane@EXAMPLE.com", "true", true},
+		{"jane@example.com", false, false},
+		{"jane@example.com", nil, false},
+		{"jane@sub.example.com", true, false},
+		{"jane@example.com.evil.com", true, false},
+		{"example.com@evil.com", true, false},
+		{"jane", true, false},
+		{"", true, false},
+	}
+
+	for _, testcase := range testcases {
+		identity := &oidcIdentity{Email: testcase.email, EmailVerified: testcase.verified}
+
+		if allowed := provider.IsAllowed(identity); allowed != testcase.allowed {
+			t.Errorf("IsAllowed(%q, verified=%v) = %v, expected %v", testcase.email, testcase.verified, allowed, testcase.allowed)
+		}
+	}
+
+	provider.allowedDomains = nil
+
+	if provider.IsAllowed(&oidcIdentity{Email: "jane@example.com", EmailVerified: true}) {
+		t.Error("identity was allowed without any allowed domains")
+	}
+}
+
+func TestOidcLoginName(t *testing.T) {
+	testcases := []struct {
+		identity oidcIdentity
+		expected string
+	}{
+		{oidcIdentity{PreferredUsername: "Jane.Doe"}, "jane-doe"},
+		{oidcIdentity{Email: "j.doe@example.com"}, "j-doe"},
+		{oidcIdentity{PreferredUsername: "42-admin_"}, "admin"},
+		{oidcIdentity{Email: "@foo"}, "sso-user"},
+	}
+
+	for _, testcase := range testcases {
+		login := testcase.identity.LoginName()
+
+		if login != testcase.expected {
+			t.Errorf("LoginName(%+v) = %q, expected %q", testcase.identity, login, testcase.expected)
+		}
+
+		if _, err := validateSafeString(login, "login"); err != nil {
+			t.Errorf("LoginName(%+v) is not a valid login: %v", testcase.identity, err)
+		}
+	}
+}
+
+func TestProvisionOidcUser(t *testing.T) {
+	tx := newTestTx(t)
+	req := newTestRequest("GET", "/login/oidc/callback")
+
+	identity := &oidcIdentity{Subject: "subject-1", Email: "Jane@example.com", EmailVerified: true, PreferredUsername: "jane"}
+
+	user, err := provisionOidcUser(identity, req, tx)
+	if err != nil {
+		t.Fatalf("Could not provision a new user: %v", err)
+	}
+
+	if user.LoginName != "jane" || user.Backend != BackendOidc || user.Role != RoleUser || *user.Email != "jane@example.com" {
+		t.Errorf("Unexpected new user %+v", user)
+	}
+
+	again, err := provisionOidcUser(identity, req, tx)
+	if err != nil || again.Id != user.Id {
+		t.Fatalf("Second login did not find the same user: %v", err)
+	}
+
+	// deleted users must not come back
+	if err := user.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := provisionOidcUser(identity, req, tx); err != errOidcUserDeleted {
+		t.Errorf("Login of a deleted user returned %v", err)
+	}
+}
+
+func TestProvisionOidcUserLinkingByEmail(t *testing.T) {
+	tx := newTestTx(t)
+	req := newTestRequest("GET", "/login/oidc/callback")
+
+	local := createTestUser(t, "jane", tx)
+	email := "jane@example.com"
+	local.Email = &email
+
+	if err := local.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	identity := &oidcIdentity{Subject: "subject-1", Email: email, EmailVerified: true}
+
+	// linking is disabled by default, the login is refused instead of creating a second account
+	if _, err := provisionOidcUser(identity, req, tx); err != errOidcEmailTaken {
+		t.Fatalf("Login with the e-mail of a local account returned %v", err)
+	}
+
+	config.Oidc.LinkByEmail = true
+
+	// unverified addresses are never linked, but also not copied to the new account
+	unverified := &oidcIdentity{Subject: "subject-2", Email: email, EmailVerified: false, PreferredUsername: "mallory"}
+
+	user, err := provisionOidcUser(unverified, req, tx)
+	if err != nil || user.Id == local.Id || user.Email != nil {
+		t.Fatalf("Unverified e-mail address was linked (%v)", err)
+	}
+
+	linked, err := provisionOidcUser(identity, req, tx)
+	if err != nil || linked.Id != local.Id || linked.OidcSubject == nil || *linked.OidcSubject != "subject-1" {
+		t.Fatalf("Local account was not linked (%v)", err)
+	}
+
+	// an account that is linked already cannot be taken over by another subject
+	other := &oidcIdentity{Subject: "subject-3", Email: email, EmailVerified: true}
+
+	if _, err := provisionOidcUser(other, req, tx); err != errOidcEmailTaken {
+		t.Errorf("Linked account was linked again, got %v", err)
+	}
+}
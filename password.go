@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/jmoiron/sqlx"
+)
+
+var passwordPolicy *PasswordPolicy
+
+// a few of the most common passwords; a longer list can be configured via passwords.denyList
+var builtinDeniedPasswords = []string{
+	"123456", "12345678", "123456789", "1234567890", "password", "password1", "password123",
+	"qwerty", "qwertz", "qwerty123", "abc123", "111111", "000000", "123123", "1q2w3e4r",
+	"iloveyou", "letmein", "welcome", "welcome1", "monkey", "dragon", "sunshine", "princess",
+	"football", "baseball", "master", "admin", "administrator", "changeme", "secret", "passw0rd",
+	"trustno1", "starwars", "superman", "hello123", "login", "root", "toor", "test", "test123",
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Password policy
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type PasswordPolicy struct {
+	minLength int
+	history   int
+	denied    map[string]bool
+}
+
+func NewPasswordPolicy(c *configuration) (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{
+		minLength: c.Passwords.MinLength,
+		history:   c.Passwords.History,
+		denied:    make(map[string]bool),
+	}
+
+	if policy.minLength <= 0 {
+		policy.minLength = 10
+	}
+
+	for _, password := range builtinDeniedPasswords {
+		policy.denied[password] = true
+	}
+
+	if c.Passwords.DenyList != "" {
+		file, err := os.Open(c.Passwords.DenyList)
+		if err != nil {
+			return nil, errors.New("Could not read password deny list: " + err.Error())
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+
+			if len(line) > 0 && !strings.HasPrefix(line, "#") {
+				policy.denied[strings.ToLower(line)] = true
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, errors.New("Could not read password deny list: " + err.Error())
+		}
+	}
+
+	return policy, nil
+}
+
+// Check validates a new password for the given user. The user can be nil when a new account is
+// being created, in which case the login is used to prevent trivial passwords.
+func (p *PasswordPolicy) Check(password string, login string, user *User, db *sqlx.Tx) error {
+	if len([]rune(password)) < p.minLength {
+		return fmt.Errorf("The passphrase must be at least %d characters long.", p.minLength)
+	}
+
+	lowered := strings.ToLower(password)
+
+	if p.denied[lowered] || (len(login) > 0 && strings.Contains(lowered, strings.ToLower(login))) {
+		return errors.New("This passphrase is too common or too easy to guess.")
+	}
+
+	if user != nil && p.history > 0 {
+		for _, hash := range findPasswordHistory(user.Id, p.history, db) {
+			if CompareBcrypt(hash, password) {
+				return fmt.Errorf("You cannot re-use one of your last %d passphrases.", p.history)
+			}
+		}
+	}
+
+	return nil
+}
+
+func findPasswordHistory(userId int, limit int, db *sqlx.Tx) []string {
+	hashes := make([]string, 0)
+
+	db.Select(&hashes, "SELECT `password` FROM `password_history` WHERE `user_id` = ? ORDER BY `id` DESC LIMIT "+strconv.Itoa(limit), userId)
+
+	return hashes
+}
+
+// RememberPassword records the user's current password hash, so it cannot be re-used, and
+// forgets all entries that are older than the configured history.
+func (u *User) RememberPassword() error {
+	if u.Password == nil {
+		return nil
+	}
+
+	_, err := u._db.Exec("INSERT INTO `password_history` (`user_id`, `password`, `created_at`) VALUES (?,?,NOW())", u.Id, *u.Password)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int, 0)
+
+	err = u._db.Select(&ids, "SELECT `id` FROM `password_history` WHERE `user_id` = ? ORDER BY `id` DESC", u.Id)
+	if err != nil {
+		return err
+	}
+
+	keep := passwordPolicy.history
+	if keep < 1 {
+		keep = 1
+	}
+
+	if len(ids) > keep {
+		_, err = u._db.Exec("DELETE FROM `password_history` WHERE `user_id` = ? AND `id` <= ?", u.Id, ids[keep])
+	}
+
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Password reset model
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type PasswordReset struct {
+	Id        int     `db:"id"`
+	TokenHash string  `db:"token_hash"`
+	UserId    int     `db:"user_id"`
+	CreatedAt string  `db:"created_at"`
+	CreatedBy int     `db:"created_by"`
+	ExpiresAt string  `db:"expires_at"`
+	UsedAt    *string `db:"used_at"`
+	_db       *sqlx.Tx
+}
+
+func hashResetToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// findPasswordReset returns the reset for the given token, but only if it is still usable.
+func findPasswordReset(token string, db *sqlx.Tx) *PasswordReset {
+	reset := &PasswordReset{}
+	reset._db = db
+
+	db.Get(reset, "SELECT `id`, `token_hash`, `user_id`, `created_at`, `created_by`, `expires_at`, `used_at` FROM `password_reset` WHERE `token_hash` = ? AND `used_at` IS NULL AND `expires_at` > NOW()", hashResetToken(token))
+	if reset.Id == 0 {
+		return nil
+	}
+
+	return reset
+}
+
+// issuePasswordReset invalidates all pending resets for the user and creates a new one. The
+// plaintext token is returned, as only its hash is stored.
+func issuePasswordReset(user *User, creator *User, db *sqlx.Tx) (string, error) {
+	lifetime := 24 * time.Hour
+
+	if config.Passwords.ResetLinkLifetime != "" {
+		parsed, err := time.ParseDuration(config.Passwords.ResetLinkLifetime)
+		if err != nil {
+			return "", err
+		}
+
+		lifetime = parsed
+	}
+
+	token, err := safeRandomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec("UPDATE `password_reset` SET `used_at` = NOW() WHERE `user_id` = ? AND `used_at` IS NULL", user.Id)
+	if err != nil {
+		return "", err
+	}
+
+	// the expiry is compared to the database's clock, not ours (see findPasswordReset)
+	now, err := time.Parse("2006-01-02 15:04:05", databaseNow(db))
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO `password_reset` (`token_hash`, `user_id`, `created_at`, `created_by`, `expires_at`) VALUES (?,?,?,?,?)",
+		hashResetToken(token), user.Id, now.Format("2006-01-02 15:04:05"), creator.Id, now.Add(lifetime).Format("2006-01-02 15:04:05"),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (r *PasswordReset) MarkUsed() error {
+	_, err := r._db.Exec("UPDATE `password_reset` SET `used_at` = NOW() WHERE `id` = ?", r.Id)
+	return err
+}
+
+func (r *PasswordReset) GetUser() *User {
+	return findUser(r.UserId, false, r._db)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// HTTP Handlers
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type passwordResetIssuedData struct {
+	layoutData
+
+	User      int
+	Name      string
+	Url       string
+	ExpiresIn string
+}
+
+type passwordResetFormData struct {
+	Token         string
+	Name          string
+	PasswordError string
+}
+
+func usersIssueResetAction(params martini.Params, req *http.Request, currentUser *User, session *Session, db *sqlx.Tx) response {
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return renderError(400, "Invalid ID given.")
+	}
+
+	subject := findUser(id, false, db)
+	if subject == nil || subject.Deleted != nil {
+		return renderError(404, "User could not be found.")
+	}
+
+	if subject.Backend != BackendLocal {
+		return renderError(409, "Only local users have a passphrase that can be reset.")
+	}
+
+	token, err := issuePasswordReset(subject, currentUser, db)
+	if err != nil {
+		panic(err)
+	}
+
+	auditLog := NewAuditLog(db, req)
+	auditLog.LogPasswordResetIssued(currentUser.Id, subject.Id)
+
+	lifetime := config.Passwords.ResetLinkLifetime
+	if lifetime == "" {
+		lifetime = "24h"
+	}
+
+	data := &passwordResetIssuedData{
+		layoutData: NewLayoutData("Passphrase Reset", "users", currentUser, session.CsrfToken),
+		User:       subject.Id,
+		Name:       subject.Name,
+		Url:        strings.TrimSuffix(config.Server.BaseUrl, "/") + "/reset/" + token,
+		ExpiresIn:  lifetime,
+	}
+
+	return renderTemplate(200, "users/reset", data)
+}
+
+func passwordResetFormAction(params martini.Params, db *sqlx.Tx) response {
+	reset := findPasswordReset(params["token"], db)
+	if reset == nil {
+		return renderError(404, "This link is invalid or has expired.")
+	}
+
+	user := reset.GetUser()
+	if user == nil || user.Deleted != nil {
+		return renderError(404, "This link is invalid or has expired.")
+	}
+
+	return renderTemplate(200, "reset", passwordResetFormData{Token: params["token"], Name: user.Name})
+}
+
+// passwordResetAction sets the new passphrase and ends all sessions of the user, as one of them
+// might belong to whoever made the reset necessary.
+func passwordResetAction(params martini.Params, req *http.Request, m *SessionMiddleware, db *sqlx.Tx) response {
+	reset := findPasswordReset(params["token"], db)
+	if reset == nil {
+		return renderError(404, "This link is invalid or has expired.")
+	}
+
+	user := findUser(reset.UserId, true, db)
+	if user == nil || user.Deleted != nil {
+		return renderError(404, "This link is invalid or has expired.")
+	}
+
+	data := passwordResetFormData{Token: params["token"], Name: user.Name}
+	password := req.FormValue("password")
+
+	if password != req.FormValue("password_confirmation") {
+		data.PasswordError = "The passphrases do not match."
+		return renderTemplate(400, "reset", data)
+	}
+
+	err := passwordPolicy.Check(password, user.LoginName, user, db)
+	if err != nil {
+		data.PasswordError = err.Error()
+		return renderTemplate(400, "reset", data)
+	}
+
+	hashed := string(HashBcrypt(password))
+	user.Password = &hashed
+
+	err = user.Save()
+	if err != nil {
+		panic(err)
+	}
+
+	err = user.RememberPassword()
+	if err != nil {
+		panic(err)
+	}
+
+	err = reset.MarkUsed()
+	if err != nil {
+		panic(err)
+	}
+
+	m.EndUserSessions(user.Id)
+
+	auditLog := NewAuditLog(db, req)
+	auditLog.LogPasswordResetUsed(user.Id)
+
+	return redirect(302, "/login")
+}
+
+func setupPasswordResetCtrl(app *martini.ClassicMartini) {
+	app.Post("/users/:id/reset", sessions.RequireLogin, sessions.RequireAdmin, sessions.RequireCsrfToken, usersIssueResetAction)
+
+	// public
+	app.Get("/reset/:token", passwordResetFormAction)
+	app.Post("/reset/:token", passwordResetAction)
+}
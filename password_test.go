@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	denyList := filepath.Join(t.TempDir(), "denied.txt")
+	ioutil.WriteFile(denyList, []byte("# a comment line\nCorrectHorseBattery\n"), 0600)
+
+	c := &configuration{}
+	c.Passwords.DenyList = denyList
+
+	policy, err := NewPasswordPolicy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := map[string]bool{
+		"short":                       false,
+		"ninechars":                   false,
+		"tencharsok":                  true,
+		"ümlaut-äöü":                  true,
+		"administrator":               false,
+		"AdMiNiStRaToR":               false,
+		"correcthorsebattery":         false,
+		"# a comment line":            true,
+		"my-name-is-jane-doe":         false,
+		"really long and fine phrase": true,
+	}
+
+	for password, valid := range testcases {
+		err := policy.Check(password, "jane-doe", nil, nil)
+
+		if valid && err != nil {
+			t.Errorf("%q was rejected: %v", password, err)
+		} else if !valid && err == nil {
+			t.Errorf("%q was accepted", password)
+		}
+	}
+}
+
+func TestPasswordHistory(t *testing.T) {
+	tx := newTestTx(t)
+
+	config.Passwords.History = 2
+
+	policy, err := NewPasswordPolicy(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passwordPolicy = policy
+	user := createTestUser(t, "jane", tx)
+
+	for _, password := range []string{"first passphrase", "second passphrase", "third passphrase"} {
+		hash := string(HashBcrypt(password))
+		user.Password = &hash
+
+		if err := user.Save(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := user.RememberPassword(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := policy.Check("third passphrase", "jane", user, tx); err == nil {
+		t.Error("The current passphrase could be re-used.")
+	}
+
+	if err := policy.Check("second passphrase", "jane", user, tx); err == nil {
+		t.Error("The previous passphrase could be re-used.")
+	}
+
+	if err := policy.Check("first passphrase", "jane", user, tx); err != nil {
+		t.Errorf("A passphrase older than the history was rejected: %v", err)
+	}
+
+	if history := findPasswordHistory(user.Id, 100, tx); len(history) != 2 {
+		t.Errorf("Expected the history to be trimmed to 2 entries, found %d.", len(history))
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	tx := newTestTx(t)
+
+	admin := createTestUser(t, "admin", tx)
+	user := createTestUser(t, "jane", tx)
+
+	first, err := issuePasswordReset(user, admin, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := issuePasswordReset(user, admin, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if findPasswordReset(first, tx) != nil {
+		t.Error("Issuing a new reset link did not invalidate the previous one.")
+	}
+
+	reset := findPasswordReset(second, tx)
+	if reset == nil || reset.GetUser().Id != user.Id {
+		t.Fatal("The reset link could not be found.")
+	}
+
+	if reset.TokenHash == second {
+		t.Error("The token was stored in plain text.")
+	}
+
+	if err := reset.MarkUsed(); err != nil {
+		t.Fatal(err)
+	}
+
+	if findPasswordReset(second, tx) != nil {
+		t.Error("The reset link could be used twice.")
+	}
+
+	config.Passwords.ResetLinkLifetime = "-1m"
+
+	expired, err := issuePasswordReset(user, admin, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if findPasswordReset(expired, tx) != nil {
+		t.Error("An expired reset link could be used.")
+	}
+}
+
+func TestPasswordResetExpiresByTheDatabaseClock(t *testing.T) {
+	tx := newTestTx(t)
+
+	admin := createTestUser(t, "admin", tx)
+	user := createTestUser(t, "jane", tx)
+
+	config.Passwords.ResetLinkLifetime = "90m"
+	defer func() { config.Passwords.ResetLinkLifetime = "" }()
+
+	token, err := issuePasswordReset(user, admin, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reset := findPasswordReset(token, tx)
+	if reset == nil {
+		t.Fatal("The reset link could not be found.")
+	}
+
+	created, _ := time.Parse("2006-01-02 15:04:05", reset.CreatedAt)
+	expires, _ := time.Parse("2006-01-02 15:04:05", reset.ExpiresAt)
+
+	if lifetime := expires.Sub(created); lifetime != 90*time.Minute {
+		t.Errorf("Expected the link to be valid for 90m, got %s.", lifetime)
+	}
+}
+
+func TestPasswordResetEndsSessions(t *testing.T) {
+	tx := newTestTx(t)
+
+	admin := createTestUser(t, "admin", tx)
+	user := createTestUser(t, "jane", tx)
+
+	policy, err := NewPasswordPolicy(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passwordPolicy = policy
+
+	token, err := issuePasswordReset(user, admin, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewSessionMiddleware(cookieOptions{Name: "session", MaxAge: time.Hour})
+	m.newSession(user)
+	m.newSession(user)
+	m.newSession(admin)
+
+	req := newTestRequest("POST", "/reset/"+token+"?password=fresh+passphrase&password_confirmation=fresh+passphrase")
+
+	if resp := passwordResetAction(martini.Params{"token": token}, req, m, tx); resp.Status != 302 {
+		t.Fatalf("The passphrase was not reset: %+v", resp)
+	}
+
+	if m.Count() != 1 {
+		t.Errorf("Expected only the session of the other user to be left, got %d.", m.Count())
+	}
+}
@@ -11,19 +11,22 @@ import (
 type profileData struct {
 	layoutData
 
-	Name          string
-	NameError     string
-	LoginName     string
-	LoginError    string
-	PasswordError string
-	OtherError    string
+	Name             string
+	NameError        string
+	LoginName        string
+	LoginError       string
+	PasswordError    string
+	NewPasswordError string
+	OtherError       string
+	Subscriptions    []Subscription
 }
 
-func profileAction(user *User, session *Session) response {
+func profileAction(user *User, session *Session, db *sqlx.Tx) response {
 	data := &profileData{
-		layoutData: NewLayoutData("Profile", "profile", user, session.CsrfToken),
-		Name:       user.Name,
-		LoginName:  user.LoginName,
+		layoutData:    NewLayoutData("Profile", "profile", user, session.CsrfToken),
+		Name:          user.Name,
+		LoginName:     user.LoginName,
+		Subscriptions: findSubscriptionsByUser(user.Id, db),
 	}
 
 	return renderTemplate(200, "profile/form", data)
@@ -42,6 +45,11 @@ func updateProfileAction(user *User, req *http.Request, session *Session, db *sq
 	data.Name = name
 	data.LoginName = login
 
+	if user.IsExternal() {
+		data.OtherError = "Your account is managed by an external directory and cannot be edited here."
+		return renderTemplate(409, "profile/form", data)
+	}
+
 	if len(name) == 0 {
 		data.NameError = "Your name cannot be empty."
 		return renderTemplate(400, "profile/form", data)
@@ -81,22 +89,48 @@ func changePasswordAction(user *User, req *http.Request, session *Session, db *s
 		LoginName:  user.LoginName,
 	}
 
-	password := strings.TrimSpace(req.FormValue("password"))
+	current := req.FormValue("oldpassword")
+	password := req.FormValue("password")
+
+	// the session user comes without the password hash
+	user = findUser(user.Id, true, db)
 
-	if len(password) == 0 {
+	if user.Password == nil {
+		data.PasswordError = "Your account does not have a passphrase that could be changed."
+		return renderTemplate(400, "profile/form", data)
+	}
+
+	if len(current) == 0 {
 		data.PasswordError = "Your password cannot be empty."
 		return renderTemplate(400, "profile/form", data)
 	}
 
-	if !CompareBcrypt(*user.Password, password) {
+	if !CompareBcrypt(*user.Password, current) {
 		data.PasswordError = "This was not your current password."
 		return renderTemplate(400, "profile/form", data)
 	}
 
+	if password != req.FormValue("password_confirmation") {
+		data.NewPasswordError = "The passphrases do not match."
+		return renderTemplate(400, "profile/form", data)
+	}
+
+	err := passwordPolicy.Check(password, user.LoginName, user, db)
+	if err != nil {
+		data.NewPasswordError = err.Error()
+		return renderTemplate(400, "profile/form", data)
+	}
+
 	hashed := string(HashBcrypt(password))
 	user.Password = &hashed
 
-	err := user.Save()
+	err = user.Save()
+	if err != nil {
+		data.OtherError = err.Error()
+		return renderTemplate(500, "profile/form", data)
+	}
+
+	err = user.RememberPassword()
 	if err != nil {
 		data.OtherError = err.Error()
 		return renderTemplate(500, "profile/form", data)
@@ -19,6 +19,11 @@ CREATE TABLE IF NOT EXISTS `user` (
   `login` VARCHAR(200) NOT NULL,
   `password` VARCHAR(255) NULL,
   `name` VARCHAR(255) NULL,
+  `role` VARCHAR(20) NOT NULL DEFAULT 'admin',
+  `backend` VARCHAR(20) NOT NULL DEFAULT 'local',
+  `external_id` VARCHAR(255) NULL,
+  `email` VARCHAR(255) NULL,
+  `oidc_subject` VARCHAR(255) NULL,
   `last_login_at` DATETIME NULL,
   `deleted` DATETIME NULL DEFAULT 0,
   PRIMARY KEY (`id`))
@@ -26,6 +31,10 @@ ENGINE = InnoDB;
 
 CREATE UNIQUE INDEX `login_UNIQUE` ON `user` (`login` ASC, `deleted` ASC);
 
+CREATE INDEX `oidc_subject_idx` ON `user` (`oidc_subject` ASC);
+
+CREATE INDEX `email_idx` ON `user` (`email` ASC);
+
 
 -- -----------------------------------------------------
 -- Table `secret`
@@ -39,6 +48,10 @@ CREATE TABLE IF NOT EXISTS `secret` (
   `updated_at` DATETIME NULL,
   `created_by` SMALLINT UNSIGNED NOT NULL,
   `updated_by` SMALLINT UNSIGNED NULL,
+  `generator` VARCHAR(255) NULL,
+  `rotation_days` SMALLINT UNSIGNED NULL,
+  `rotate_at` DATETIME NULL,
+  `rotated_at` DATETIME NULL,
   PRIMARY KEY (`id`),
   CONSTRAINT `fk_secret_user1`
     FOREIGN KEY (`created_by`)
@@ -58,6 +71,8 @@ CREATE INDEX `fk_secret_user1_idx` ON `secret` (`created_by` ASC);
 
 CREATE INDEX `fk_secret_user2_idx` ON `secret` (`updated_by` ASC);
 
+CREATE INDEX `rotate_at_idx` ON `secret` (`rotate_at` ASC);
+
 
 -- -----------------------------------------------------
 -- Table `consumer`
@@ -102,6 +117,8 @@ CREATE TABLE IF NOT EXISTS `access_log` (
   `status` SMALLINT UNSIGNED NOT NULL,
   `context` MEDIUMBLOB NULL,
   `request_body` MEDIUMBLOB NULL,
+  `prev_hash` CHAR(64) NULL,
+  `hash` CHAR(64) NULL,
   PRIMARY KEY (`id`),
   CONSTRAINT `fk_access_log_secret1`
     FOREIGN KEY (`secret_id`)
@@ -119,6 +136,8 @@ CREATE INDEX `fk_access_log_secret1_idx` ON `access_log` (`secret_id` ASC);
 
 CREATE INDEX `fk_access_log_consumer1_idx` ON `access_log` (`consumer_id` ASC);
 
+CREATE INDEX `requested_at_idx` ON `access_log` (`requested_at` ASC);
+
 
 -- -----------------------------------------------------
 -- Table `consumer_secret`
@@ -156,6 +175,8 @@ CREATE TABLE IF NOT EXISTS `audit_log` (
   `origin_ip` VARCHAR(45) NOT NULL,
   `user_agent` VARCHAR(255) NULL,
   `context` TEXT NULL,
+  `prev_hash` CHAR(64) NULL,
+  `hash` CHAR(64) NULL,
   PRIMARY KEY (`id`),
   CONSTRAINT `fk_audit_log_secret0`
     FOREIGN KEY (`consumer_id`)
@@ -195,6 +216,7 @@ CREATE TABLE IF NOT EXISTS `restriction` (
   `consumer_id` INT UNSIGNED NOT NULL,
   `type` VARCHAR(25) NOT NULL,
   `context` MEDIUMBLOB NULL,
+  `enabled` TINYINT(1) UNSIGNED NOT NULL DEFAULT 1,
   PRIMARY KEY (`consumer_id`, `type`),
   CONSTRAINT `fk_restriction_consumer1`
     FOREIGN KEY (`consumer_id`)
@@ -216,6 +238,383 @@ CREATE TABLE IF NOT EXISTS `config` (
 ENGINE = InnoDB;
 
 
+-- -----------------------------------------------------
+-- Table `password_history`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `password_history` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `user_id` SMALLINT UNSIGNED NOT NULL,
+  `password` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  PRIMARY KEY (`id`),
+  CONSTRAINT `fk_password_history_user`
+    FOREIGN KEY (`user_id`)
+    REFERENCES `user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+CREATE INDEX `fk_password_history_user_idx` ON `password_history` (`user_id` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `password_reset`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `password_reset` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `token_hash` CHAR(64) NOT NULL,
+  `user_id` SMALLINT UNSIGNED NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `created_by` SMALLINT UNSIGNED NOT NULL,
+  `expires_at` DATETIME NOT NULL,
+  `used_at` DATETIME NULL,
+  PRIMARY KEY (`id`),
+  CONSTRAINT `fk_password_reset_user`
+    FOREIGN KEY (`user_id`)
+    REFERENCES `user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_password_reset_user2`
+    FOREIGN KEY (`created_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+CREATE UNIQUE INDEX `token_hash_UNIQUE` ON `password_reset` (`token_hash` ASC);
+
+CREATE INDEX `fk_password_reset_user_idx` ON `password_reset` (`user_id` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `log_checkpoint`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `log_checkpoint` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `created_at` DATETIME NOT NULL,
+  `log` VARCHAR(20) NOT NULL,
+  `chain` VARCHAR(20) NOT NULL,
+  `entry_id` INT UNSIGNED NOT NULL,
+  `hash` CHAR(64) NOT NULL,
+  `signature` VARCHAR(100) NOT NULL,
+  `pruned` TINYINT(1) NOT NULL DEFAULT 0,
+  PRIMARY KEY (`id`))
+ENGINE = InnoDB;
+
+CREATE INDEX `log_chain_idx` ON `log_checkpoint` (`log` ASC, `chain` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `alert`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `alert` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `rule` VARCHAR(50) NOT NULL,
+  `subject` VARCHAR(100) NOT NULL,
+  `consumer_id` INT UNSIGNED NULL,
+  `origin_ip` VARCHAR(45) NOT NULL,
+  `message` TEXT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `dismissed_at` DATETIME NULL,
+  `dismissed_by` SMALLINT UNSIGNED NULL,
+  PRIMARY KEY (`id`),
+  CONSTRAINT `fk_alert_consumer`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_alert_user`
+    FOREIGN KEY (`dismissed_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+CREATE INDEX `rule_subject_idx` ON `alert` (`rule` ASC, `subject` ASC, `created_at` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `subscription`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `subscription` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `user_id` SMALLINT UNSIGNED NOT NULL,
+  `secret_id` INT UNSIGNED NULL,
+  `consumer_id` INT UNSIGNED NULL,
+  `mode` VARCHAR(20) NOT NULL,
+  `channel` VARCHAR(20) NOT NULL,
+  `webhook_url` VARCHAR(255) NULL,
+  `created_at` DATETIME NOT NULL,
+  PRIMARY KEY (`id`),
+  CONSTRAINT `fk_subscription_user`
+    FOREIGN KEY (`user_id`)
+    REFERENCES `user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_subscription_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_subscription_consumer`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+
+-- -----------------------------------------------------
+-- Table `notification_digest`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `notification_digest` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `user_id` SMALLINT UNSIGNED NOT NULL,
+  `channel` VARCHAR(20) NOT NULL,
+  `target` VARCHAR(255) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  PRIMARY KEY (`id`),
+  CONSTRAINT `fk_notification_digest_user`
+    FOREIGN KEY (`user_id`)
+    REFERENCES `user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+
+-- -----------------------------------------------------
+-- Table `notification`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `notification` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `user_id` SMALLINT UNSIGNED NOT NULL,
+  `channel` VARCHAR(20) NOT NULL,
+  `target` VARCHAR(255) NOT NULL,
+  `subject` VARCHAR(255) NOT NULL,
+  `payload` MEDIUMTEXT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `attempts` INT UNSIGNED NOT NULL DEFAULT 0,
+  `next_attempt_at` DATETIME NOT NULL,
+  `sent_at` DATETIME NULL,
+  `failed_at` DATETIME NULL,
+  `last_error` TEXT NULL,
+  PRIMARY KEY (`id`),
+  CONSTRAINT `fk_notification_user`
+    FOREIGN KEY (`user_id`)
+    REFERENCES `user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+CREATE INDEX `pending_idx` ON `notification` (`sent_at` ASC, `failed_at` ASC, `next_attempt_at` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `secret_version`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `secret_version` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `secret_id` INT UNSIGNED NOT NULL,
+  `secret` MEDIUMBLOB NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `created_by` SMALLINT UNSIGNED NULL,
+  PRIMARY KEY (`id`),
+  CONSTRAINT `fk_secret_version_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_secret_version_user`
+    FOREIGN KEY (`created_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+CREATE INDEX `fk_secret_version_secret_idx` ON `secret_version` (`secret_id` ASC);
+
+-- -----------------------------------------------------
+-- Table `secret_certificate`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `secret_certificate` (
+  `secret_id` INT UNSIGNED NOT NULL,
+  `subject` VARCHAR(255) NOT NULL,
+  `issuer` VARCHAR(255) NOT NULL,
+  `sans` TEXT NOT NULL,
+  `serial` VARCHAR(100) NOT NULL,
+  `not_before` DATETIME NOT NULL,
+  `not_after` DATETIME NOT NULL,
+  `key_type` VARCHAR(50) NOT NULL,
+  `private_key` VARCHAR(20) NOT NULL,
+  `chain_length` SMALLINT UNSIGNED NOT NULL,
+  `warned_days` SMALLINT UNSIGNED NULL,
+  PRIMARY KEY (`secret_id`),
+  CONSTRAINT `fk_secret_certificate_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+CREATE INDEX `not_after_idx` ON `secret_certificate` (`not_after` ASC);
+
+-- -----------------------------------------------------
+-- Table `certificate_authority`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `certificate_authority` (
+  `secret_id` INT UNSIGNED NOT NULL,
+  `kind` VARCHAR(10) NOT NULL DEFAULT 'x509',
+  `ttl` VARCHAR(20) NOT NULL,
+  `allowed_names` TEXT NOT NULL,
+  `allow_wildcards` TINYINT(1) NOT NULL DEFAULT 0,
+  PRIMARY KEY (`secret_id`),
+  CONSTRAINT `fk_certificate_authority_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+
+-- -----------------------------------------------------
+-- Table `issued_certificate`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `issued_certificate` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `secret_id` INT UNSIGNED NOT NULL,
+  `consumer_id` INT UNSIGNED NULL,
+  `serial` VARCHAR(100) NOT NULL,
+  `subject` VARCHAR(255) NOT NULL,
+  `sans` TEXT NOT NULL,
+  `not_after` DATETIME NOT NULL,
+  `issued_at` DATETIME NOT NULL,
+  `revoked_at` DATETIME NULL,
+  `revoked_by` SMALLINT UNSIGNED NULL,
+  PRIMARY KEY (`id`),
+  CONSTRAINT `fk_issued_certificate_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_issued_certificate_consumer`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_issued_certificate_user`
+    FOREIGN KEY (`revoked_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+CREATE UNIQUE INDEX `serial_UNIQUE` ON `issued_certificate` (`secret_id` ASC, `serial` ASC);
+
+-- -----------------------------------------------------
+-- Table `dynamic_credential`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `dynamic_credential` (
+  `secret_id` INT UNSIGNED NOT NULL,
+  `ttl` VARCHAR(20) NOT NULL,
+  `creation` TEXT NOT NULL,
+  `revocation` TEXT NOT NULL,
+  PRIMARY KEY (`secret_id`),
+  CONSTRAINT `fk_dynamic_credential_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+-- -----------------------------------------------------
+-- Table `lease`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `lease` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `secret_id` INT UNSIGNED NOT NULL,
+  `consumer_id` INT UNSIGNED NULL,
+  `username` VARCHAR(100) NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `expires_at` DATETIME NOT NULL,
+  `revoked_at` DATETIME NULL,
+  `revoked_by` SMALLINT UNSIGNED NULL,
+  `last_error` TEXT NULL,
+  PRIMARY KEY (`id`),
+  CONSTRAINT `fk_lease_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_lease_consumer`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_lease_user`
+    FOREIGN KEY (`revoked_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+CREATE INDEX `expires_at_idx` ON `lease` (`revoked_at` ASC, `expires_at` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `share`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `share` (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `token_hash` CHAR(64) NOT NULL,
+  `secret_id` INT UNSIGNED NOT NULL,
+  `consumer_id` INT UNSIGNED NULL,
+  `payload` MEDIUMBLOB NULL,
+  `created_at` DATETIME NOT NULL,
+  `created_by` SMALLINT UNSIGNED NOT NULL,
+  `expires_at` DATETIME NOT NULL,
+  `used_at` DATETIME NULL,
+  `expired_at` DATETIME NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `share_token_hash_UNIQUE` (`token_hash` ASC),
+  CONSTRAINT `fk_share_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_share_consumer`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_share_user`
+    FOREIGN KEY (`created_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+CREATE INDEX `share_expires_at_idx` ON `share` (`used_at` ASC, `expired_at` ASC, `expires_at` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `consumer_key`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `consumer_key` (
+  `consumer_id` INT UNSIGNED NOT NULL,
+  `kind` VARCHAR(10) NOT NULL,
+  `public_key` TEXT NOT NULL,
+  `fingerprint` VARCHAR(100) NOT NULL,
+  `required` TINYINT(1) NOT NULL DEFAULT 0,
+  PRIMARY KEY (`consumer_id`),
+  CONSTRAINT `fk_consumer_key_consumer`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE)
+ENGINE = InnoDB;
+
+
 SET SQL_MODE=@OLD_SQL_MODE;
 SET FOREIGN_KEY_CHECKS=@OLD_FOREIGN_KEY_CHECKS;
 SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS;
@@ -225,7 +624,9 @@ SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS;
 -- -----------------------------------------------------
 START TRANSACTION;
 INSERT INTO `config` (`key`, `value`) VALUES ('teststring', NULL);
-INSERT INTO `config` (`key`, `value`) VALUES ('version', 0x312E30);
+INSERT INTO `config` (`key`, `value`) VALUES ('audit_log_lock', '');
+INSERT INTO `config` (`key`, `value`) VALUES ('access_log_lock', '');
+INSERT INTO `config` (`key`, `value`) VALUES ('version', 0x312E3138);
 
 COMMIT;
 
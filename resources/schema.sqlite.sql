@@ -0,0 +1,575 @@
+-- Raziel database schema for SQLite
+-- Generated from schema.sql; keep both files in sync.
+
+PRAGMA foreign_keys = ON;
+
+-- -----------------------------------------------------
+-- Table `user`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `user` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `login` VARCHAR(200) NOT NULL,
+  `password` VARCHAR(255) NULL,
+  `name` VARCHAR(255) NULL,
+  `role` VARCHAR(20) NOT NULL DEFAULT 'admin',
+  `backend` VARCHAR(20) NOT NULL DEFAULT 'local',
+  `external_id` VARCHAR(255) NULL,
+  `email` VARCHAR(255) NULL,
+  `oidc_subject` VARCHAR(255) NULL,
+  `last_login_at` DATETIME NULL,
+  `deleted` DATETIME NULL);
+
+CREATE UNIQUE INDEX `login_UNIQUE` ON `user` (`login` ASC, `deleted` ASC);
+
+CREATE INDEX `oidc_subject_idx` ON `user` (`oidc_subject` ASC);
+
+CREATE INDEX `email_idx` ON `user` (`email` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `secret`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `secret` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `slug` VARCHAR(255) NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `secret` MEDIUMBLOB NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `updated_at` DATETIME NULL,
+  `created_by` SMALLINT NOT NULL,
+  `updated_by` SMALLINT NULL,
+  `generator` VARCHAR(255) NULL,
+  `rotation_days` SMALLINT NULL,
+  `rotate_at` DATETIME NULL,
+  `rotated_at` DATETIME NULL,
+  CONSTRAINT `fk_secret_user1`
+    FOREIGN KEY (`created_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_secret_user2`
+    FOREIGN KEY (`updated_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE);
+
+CREATE UNIQUE INDEX `slug_UNIQUE` ON `secret` (`slug` ASC);
+
+CREATE INDEX `fk_secret_user1_idx` ON `secret` (`created_by` ASC);
+
+CREATE INDEX `fk_secret_user2_idx` ON `secret` (`updated_by` ASC);
+
+CREATE INDEX `rotate_at_idx` ON `secret` (`rotate_at` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `consumer`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `consumer` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `name` VARCHAR(255) NOT NULL,
+  `enabled` TINYINT(1) NOT NULL DEFAULT 1,
+  `info_token` VARCHAR(255) NULL,
+  `created_at` DATETIME NOT NULL,
+  `updated_at` DATETIME NULL,
+  `created_by` SMALLINT NOT NULL,
+  `updated_by` SMALLINT NULL,
+  `deleted` TINYINT(1) NOT NULL DEFAULT 0,
+  CONSTRAINT `fk_consumer_user1`
+    FOREIGN KEY (`created_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_consumer_user2`
+    FOREIGN KEY (`updated_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE);
+
+CREATE INDEX `fk_consumer_user1_idx` ON `consumer` (`created_by` ASC);
+
+CREATE INDEX `fk_consumer_user2_idx` ON `consumer` (`updated_by` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `access_log`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `access_log` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `secret_id` INT NULL,
+  `consumer_id` INT NULL,
+  `requested_at` DATETIME NOT NULL,
+  `origin_ip` VARCHAR(45) NOT NULL,
+  `status` SMALLINT NOT NULL,
+  `context` MEDIUMBLOB NULL,
+  `request_body` MEDIUMBLOB NULL,
+  `prev_hash` CHAR(64) NULL,
+  `hash` CHAR(64) NULL,
+  CONSTRAINT `fk_access_log_secret1`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_access_log_consumer1`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE);
+
+CREATE INDEX `fk_access_log_secret1_idx` ON `access_log` (`secret_id` ASC);
+
+CREATE INDEX `fk_access_log_consumer1_idx` ON `access_log` (`consumer_id` ASC);
+
+CREATE INDEX `requested_at_idx` ON `access_log` (`requested_at` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `consumer_secret`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `consumer_secret` (
+  `consumer_id` INT NOT NULL,
+  `secret_id` INT NOT NULL,
+  PRIMARY KEY (`consumer_id`, `secret_id`),
+  CONSTRAINT `fk_consumer_secret_secret1`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_consumer_secret_consumer1`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE);
+
+CREATE INDEX `fk_consumer_secret_secret1_idx` ON `consumer_secret` (`secret_id` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `audit_log`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `audit_log` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `secret_id` INT NULL,
+  `consumer_id` INT NULL,
+  `user_id` SMALLINT NULL,
+  `action` VARCHAR(100) NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `created_by` SMALLINT NOT NULL,
+  `origin_ip` VARCHAR(45) NOT NULL,
+  `user_agent` VARCHAR(255) NULL,
+  `context` TEXT NULL,
+  `prev_hash` CHAR(64) NULL,
+  `hash` CHAR(64) NULL,
+  CONSTRAINT `fk_audit_log_secret0`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_audit_log_user10`
+    FOREIGN KEY (`created_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_audit_log_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_audit_log_user`
+    FOREIGN KEY (`user_id`)
+    REFERENCES `user` (`id`)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE);
+
+CREATE INDEX `fk_audit_log_user1_idx` ON `audit_log` (`created_by` ASC);
+
+CREATE INDEX `fk_audit_log_secret0_idx` ON `audit_log` (`consumer_id` ASC);
+
+CREATE INDEX `fk_audit_log_secret_idx` ON `audit_log` (`secret_id` ASC);
+
+CREATE INDEX `fk_audit_log_user_idx` ON `audit_log` (`user_id` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `restriction`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `restriction` (
+  `consumer_id` INT NOT NULL,
+  `type` VARCHAR(25) NOT NULL,
+  `context` MEDIUMBLOB NULL,
+  `enabled` TINYINT(1) NOT NULL DEFAULT 1,
+  PRIMARY KEY (`consumer_id`, `type`),
+  CONSTRAINT `fk_restriction_consumer1`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE);
+
+CREATE INDEX `fk_restriction_consumer1_idx` ON `restriction` (`consumer_id` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `config`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `config` (
+  `key` VARCHAR(30) NOT NULL,
+  `value` BLOB NULL,
+  PRIMARY KEY (`key`));
+
+
+-- -----------------------------------------------------
+-- Table `password_history`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `password_history` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `user_id` SMALLINT NOT NULL,
+  `password` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  CONSTRAINT `fk_password_history_user`
+    FOREIGN KEY (`user_id`)
+    REFERENCES `user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE);
+
+CREATE INDEX `fk_password_history_user_idx` ON `password_history` (`user_id` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `password_reset`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `password_reset` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `token_hash` CHAR(64) NOT NULL,
+  `user_id` SMALLINT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `created_by` SMALLINT NOT NULL,
+  `expires_at` DATETIME NOT NULL,
+  `used_at` DATETIME NULL,
+  CONSTRAINT `fk_password_reset_user`
+    FOREIGN KEY (`user_id`)
+    REFERENCES `user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_password_reset_user2`
+    FOREIGN KEY (`created_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE);
+
+CREATE UNIQUE INDEX `token_hash_UNIQUE` ON `password_reset` (`token_hash` ASC);
+
+CREATE INDEX `fk_password_reset_user_idx` ON `password_reset` (`user_id` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `log_checkpoint`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `log_checkpoint` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `created_at` DATETIME NOT NULL,
+  `log` VARCHAR(20) NOT NULL,
+  `chain` VARCHAR(20) NOT NULL,
+  `entry_id` INT NOT NULL,
+  `hash` CHAR(64) NOT NULL,
+  `signature` VARCHAR(100) NOT NULL,
+  `pruned` TINYINT(1) NOT NULL DEFAULT 0);
+
+CREATE INDEX `log_chain_idx` ON `log_checkpoint` (`log` ASC, `chain` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `alert`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `alert` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `rule` VARCHAR(50) NOT NULL,
+  `subject` VARCHAR(100) NOT NULL,
+  `consumer_id` INT NULL,
+  `origin_ip` VARCHAR(45) NOT NULL,
+  `message` TEXT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `dismissed_at` DATETIME NULL,
+  `dismissed_by` SMALLINT NULL,
+  CONSTRAINT `fk_alert_consumer`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_alert_user`
+    FOREIGN KEY (`dismissed_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE);
+
+CREATE INDEX `rule_subject_idx` ON `alert` (`rule` ASC, `subject` ASC, `created_at` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `subscription`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `subscription` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `user_id` SMALLINT NOT NULL,
+  `secret_id` INT NULL,
+  `consumer_id` INT NULL,
+  `mode` VARCHAR(20) NOT NULL,
+  `channel` VARCHAR(20) NOT NULL,
+  `webhook_url` VARCHAR(255) NULL,
+  `created_at` DATETIME NOT NULL,
+  CONSTRAINT `fk_subscription_user`
+    FOREIGN KEY (`user_id`)
+    REFERENCES `user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_subscription_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_subscription_consumer`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE);
+
+
+-- -----------------------------------------------------
+-- Table `notification_digest`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `notification_digest` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `user_id` SMALLINT NOT NULL,
+  `channel` VARCHAR(20) NOT NULL,
+  `target` VARCHAR(255) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  CONSTRAINT `fk_notification_digest_user`
+    FOREIGN KEY (`user_id`)
+    REFERENCES `user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE);
+
+
+-- -----------------------------------------------------
+-- Table `notification`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `notification` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `user_id` SMALLINT NOT NULL,
+  `channel` VARCHAR(20) NOT NULL,
+  `target` VARCHAR(255) NOT NULL,
+  `subject` VARCHAR(255) NOT NULL,
+  `payload` MEDIUMTEXT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `next_attempt_at` DATETIME NOT NULL,
+  `sent_at` DATETIME NULL,
+  `failed_at` DATETIME NULL,
+  `last_error` TEXT NULL,
+  CONSTRAINT `fk_notification_user`
+    FOREIGN KEY (`user_id`)
+    REFERENCES `user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE);
+
+CREATE INDEX `pending_idx` ON `notification` (`sent_at` ASC, `failed_at` ASC, `next_attempt_at` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `secret_version`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `secret_version` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `secret_id` INT NOT NULL,
+  `secret` MEDIUMBLOB NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `created_by` SMALLINT NULL,
+  CONSTRAINT `fk_secret_version_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_secret_version_user`
+    FOREIGN KEY (`created_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE);
+
+CREATE INDEX `fk_secret_version_secret_idx` ON `secret_version` (`secret_id` ASC);
+
+-- -----------------------------------------------------
+-- Table `secret_certificate`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `secret_certificate` (
+  `secret_id` INT NOT NULL,
+  `subject` VARCHAR(255) NOT NULL,
+  `issuer` VARCHAR(255) NOT NULL,
+  `sans` TEXT NOT NULL,
+  `serial` VARCHAR(100) NOT NULL,
+  `not_before` DATETIME NOT NULL,
+  `not_after` DATETIME NOT NULL,
+  `key_type` VARCHAR(50) NOT NULL,
+  `private_key` VARCHAR(20) NOT NULL,
+  `chain_length` SMALLINT NOT NULL,
+  `warned_days` SMALLINT NULL,
+  PRIMARY KEY (`secret_id`),
+  CONSTRAINT `fk_secret_certificate_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE);
+
+CREATE INDEX `not_after_idx` ON `secret_certificate` (`not_after` ASC);
+
+-- -----------------------------------------------------
+-- Table `certificate_authority`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `certificate_authority` (
+  `secret_id` INT NOT NULL,
+  `kind` VARCHAR(10) NOT NULL DEFAULT 'x509',
+  `ttl` VARCHAR(20) NOT NULL,
+  `allowed_names` TEXT NOT NULL,
+  `allow_wildcards` TINYINT(1) NOT NULL DEFAULT 0,
+  PRIMARY KEY (`secret_id`),
+  CONSTRAINT `fk_certificate_authority_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE);
+
+-- -----------------------------------------------------
+-- Table `issued_certificate`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `issued_certificate` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `secret_id` INT NOT NULL,
+  `consumer_id` INT NULL,
+  `serial` VARCHAR(100) NOT NULL,
+  `subject` VARCHAR(255) NOT NULL,
+  `sans` TEXT NOT NULL,
+  `not_after` DATETIME NOT NULL,
+  `issued_at` DATETIME NOT NULL,
+  `revoked_at` DATETIME NULL,
+  `revoked_by` SMALLINT NULL,
+  CONSTRAINT `fk_issued_certificate_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_issued_certificate_consumer`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_issued_certificate_user`
+    FOREIGN KEY (`revoked_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE);
+
+CREATE UNIQUE INDEX `serial_UNIQUE` ON `issued_certificate` (`secret_id` ASC, `serial` ASC);
+
+-- -----------------------------------------------------
+-- Table `dynamic_credential`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `dynamic_credential` (
+  `secret_id` INT NOT NULL,
+  `ttl` VARCHAR(20) NOT NULL,
+  `creation` TEXT NOT NULL,
+  `revocation` TEXT NOT NULL,
+  PRIMARY KEY (`secret_id`),
+  CONSTRAINT `fk_dynamic_credential_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE);
+
+-- -----------------------------------------------------
+-- Table `lease`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `lease` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `secret_id` INT NOT NULL,
+  `consumer_id` INT NULL,
+  `username` VARCHAR(100) NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `expires_at` DATETIME NOT NULL,
+  `revoked_at` DATETIME NULL,
+  `revoked_by` SMALLINT NULL,
+  `last_error` TEXT NULL,
+  CONSTRAINT `fk_lease_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_lease_consumer`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_lease_user`
+    FOREIGN KEY (`revoked_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE);
+
+CREATE INDEX `expires_at_idx` ON `lease` (`revoked_at` ASC, `expires_at` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `share`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `share` (
+  `id` INTEGER PRIMARY KEY AUTOINCREMENT,
+  `token_hash` CHAR(64) NOT NULL,
+  `secret_id` INT NOT NULL,
+  `consumer_id` INT NULL,
+  `payload` MEDIUMBLOB NULL,
+  `created_at` DATETIME NOT NULL,
+  `created_by` SMALLINT NOT NULL,
+  `expires_at` DATETIME NOT NULL,
+  `used_at` DATETIME NULL,
+  `expired_at` DATETIME NULL,
+  CONSTRAINT `fk_share_secret`
+    FOREIGN KEY (`secret_id`)
+    REFERENCES `secret` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_share_consumer`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE SET NULL
+    ON UPDATE CASCADE,
+  CONSTRAINT `fk_share_user`
+    FOREIGN KEY (`created_by`)
+    REFERENCES `user` (`id`)
+    ON DELETE RESTRICT
+    ON UPDATE CASCADE);
+
+CREATE UNIQUE INDEX `share_token_hash_UNIQUE` ON `share` (`token_hash` ASC);
+CREATE INDEX `share_expires_at_idx` ON `share` (`used_at` ASC, `expired_at` ASC, `expires_at` ASC);
+
+
+-- -----------------------------------------------------
+-- Table `consumer_key`
+-- -----------------------------------------------------
+CREATE TABLE IF NOT EXISTS `consumer_key` (
+  `consumer_id` INT NOT NULL,
+  `kind` VARCHAR(10) NOT NULL,
+  `public_key` TEXT NOT NULL,
+  `fingerprint` VARCHAR(100) NOT NULL,
+  `required` TINYINT(1) NOT NULL DEFAULT 0,
+  PRIMARY KEY (`consumer_id`),
+  CONSTRAINT `fk_consumer_key_consumer`
+    FOREIGN KEY (`consumer_id`)
+    REFERENCES `consumer` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE CASCADE);
+
+-- -----------------------------------------------------
+-- Data for table `config`
+-- -----------------------------------------------------
+INSERT INTO `config` (`key`, `value`) VALUES ('teststring', NULL);
+INSERT INTO `config` (`key`, `value`) VALUES ('audit_log_lock', '');
+INSERT INTO `config` (`key`, `value`) VALUES ('access_log_lock', '');
+INSERT INTO `config` (`key`, `value`) VALUES ('version', '1.18');
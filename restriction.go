@@ -70,8 +70,18 @@ func (r *Restriction) Save() error {
 			return err
 		}
 	} else {
+		// not using REPLACE INTO, as not all database servers support it
 		_, err := r._db.Exec(
-			"REPLACE INTO `restriction` (`consumer_id`, `type`, `context`, `enabled`) VALUES (?,?,?,?)",
+			"DELETE FROM `restriction` WHERE `consumer_id` = ? AND `type` = ?",
+			r.ConsumerId, r.Type,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = r._db.Exec(
+			"INSERT INTO `restriction` (`consumer_id`, `type`, `context`, `enabled`) VALUES (?,?,?,?)",
 			r.ConsumerId, r.Type, []byte(*r.Context), r.Enabled,
 		)
 
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the extensions OpenSSH knows for user certificates
+var sshExtensions = []string{"permit-X11-forwarding", "permit-agent-forwarding", "permit-port-forwarding", "permit-pty", "permit-user-rc"}
+
+type sshExtension struct {
+	Name     string
+	Selected bool
+}
+
+type sshCertType struct {
+	Name     string
+	Label    string
+	Selected bool
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// restriction handler
+
+// SshCertificateRestriction does not restrict deliveries, but is the policy for SSH certificates:
+// consumers without it cannot have any keys signed by an SSH authority.
+type SshCertificateRestriction struct{}
+
+func (SshCertificateRestriction) GetIdentifier() string {
+	return "ssh_certificate"
+}
+
+func (SshCertificateRestriction) GetNullContext() interface{} {
+	return newSshCertificateContext("user", "", []string{"permit-pty"}, "")
+}
+
+func (SshCertificateRestriction) IsNullContext(ctx interface{}) bool {
+	asserted, ok := ctx.(*sshCertificateContext)
+	return ok && asserted.Principals == "" && asserted.Validity == ""
+}
+
+func (SshCertificateRestriction) SerializeForm(req *http.Request, enabled bool, oldCtx interface{}) (interface{}, error) {
+	certType := req.FormValue("restriction_ssh_certificate_type")
+	validity := strings.TrimSpace(req.FormValue("restriction_ssh_certificate_validity"))
+	principals := []string{}
+	extensions := []string{}
+
+	for _, line := range strings.Split(req.FormValue("restriction_ssh_certificate_principals"), "\n") {
+		if principal := strings.TrimSpace(line); principal != "" {
+			principals = append(principals, principal)
+		}
+	}
+
+	for _, extension := range req.Form["restriction_ssh_certificate_extensions"] {
+		for _, known := range sshExtensions {
+			if extension == known {
+				extensions = append(extensions, extension)
+			}
+		}
+	}
+
+	if certType != "host" {
+		certType = "user"
+	}
+
+	ctx := newSshCertificateContext(certType, strings.Join(principals, "\n"), extensions, validity)
+
+	if !enabled {
+		return ctx, nil
+	}
+
+	if len(principals) == 0 {
+		return ctx, errors.New("At least one principal must be given.")
+	}
+
+	for _, principal := range principals {
+		if strings.ContainsAny(principal, " ,*?") {
+			return ctx, errors.New("The principal '" + principal + "' must not contain spaces, commas or wildcards.")
+		}
+	}
+
+	if ctx.MaxValidity() < time.Minute {
+		return ctx, errors.New("The validity must be a duration like 8h or 30m, at least one minute.")
+	}
+
+	return ctx, nil
+}
+
+func (SshCertificateRestriction) CheckAccess(request *http.Request, context interface{}) (bool, interface{}) {
+	return true, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// context representation
+
+type sshCertificateContext struct {
+	CertType   string   `json:"type"`
+	Principals string   `json:"principals"`
+	Extensions []string `json:"extensions"`
+	Validity   string   `json:"validity"`
+}
+
+func newSshCertificateContext(certType string, principals string, extensions []string, validity string) *sshCertificateContext {
+	return &sshCertificateContext{certType, principals, extensions, validity}
+}
+
+func (c *sshCertificateContext) Types() []sshCertType {
+	return []sshCertType{
+		{"user", "User", c.CertType != "host"},
+		{"host", "Host", c.CertType == "host"},
+	}
+}
+
+func (c *sshCertificateContext) ExtensionList() []sshExtension {
+	list := make([]sshExtension, len(sshExtensions))
+
+	for i, name := range sshExtensions {
+		list[i] = sshExtension{name, c.HasExtension(name)}
+	}
+
+	return list
+}
+
+func (c *sshCertificateContext) HasExtension(name string) bool {
+	for _, extension := range c.Extensions {
+		if extension == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *sshCertificateContext) PrincipalList() []string {
+	if c.Principals == "" {
+		return []string{}
+	}
+
+	return strings.Split(c.Principals, "\n")
+}
+
+func (c *sshCertificateContext) AllowsPrincipal(principal string) bool {
+	for _, allowed := range c.PrincipalList() {
+		if allowed == principal {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *sshCertificateContext) MaxValidity() time.Duration {
+	validity, err := time.ParseDuration(c.Validity)
+	if err != nil {
+		return 0
+	}
+
+	return validity
+}
@@ -28,6 +28,10 @@ func newReturnHandler() martini.ReturnHandler {
 		contentType := "text/html"
 		content := asserted.Content
 
+		if asserted.ContentType != "" {
+			contentType = asserted.ContentType
+		}
+
 		if asserted.Status == 302 {
 			res.Header().Set("Location", asserted.Content)
 
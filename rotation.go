@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/jmoiron/sqlx"
+)
+
+// the number of previous values kept per secret, unless configured otherwise
+const defaultSecretVersions = 5
+
+var secretRotator *SecretRotator
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Secret versions
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// SecretVersion is a previous value of a secret. CreatedAt is the time it was replaced, CreatedBy
+// is nil if the server replaced it during a scheduled rotation.
+type SecretVersion struct {
+	Id        int    `db:"id"`
+	SecretId  int    `db:"secret_id"`
+	Secret    []byte `db:"secret"`
+	CreatedAt string `db:"created_at"`
+	CreatedBy *int   `db:"created_by"`
+
+	_db *sqlx.Tx
+}
+
+func findSecretVersions(secretId int, db *sqlx.Tx) []SecretVersion {
+	list := make([]SecretVersion, 0)
+
+	db.Select(&list, "SELECT `id`, `secret_id`, `created_at`, `created_by` FROM `secret_version` WHERE `secret_id` = ? ORDER BY `id` DESC", secretId)
+
+	for i := range list {
+		list[i]._db = db
+	}
+
+	return list
+}
+
+func (v *SecretVersion) GetCreator() *User {
+	if v.CreatedBy == nil {
+		return nil
+	}
+
+	return findUser(*v.CreatedBy, false, v._db)
+}
+
+// replaceValue keeps the current value as a version and sets the new (encrypted) one. A pending
+// rotation is rescheduled, as the value is fresh now. The secret still has to be saved.
+func (s *Secret) replaceValue(encrypted []byte, userId *int) error {
+	_, err := s._db.Exec("INSERT INTO `secret_version` (`secret_id`, `secret`, `created_at`, `created_by`) SELECT `id`, `secret`, NOW(), ? FROM `secret` WHERE `id` = ?", userId, s.Id)
+	if err != nil {
+		return err
+	}
+
+	keep := defaultSecretVersions
+	if secretRotator != nil {
+		keep = secretRotator.keepVersions
+	}
+
+	ids := []int{}
+
+	err = s._db.Select(&ids, "SELECT `id` FROM `secret_version` WHERE `secret_id` = ? ORDER BY `id` DESC", s.Id)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) > keep {
+		_, err = s._db.Exec("DELETE FROM `secret_version` WHERE `id` IN (" + concatIntList(ids[keep:]) + ")")
+		if err != nil {
+			return err
+		}
+	}
+
+	s.Secret = encrypted
+	s.scheduleRotation()
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Rotation
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func (s *Secret) GetGenerator() *SecretGenerator {
+	if s.Generator == nil {
+		return nil
+	}
+
+	generator, err := decodeSecretGenerator(*s.Generator)
+	if err != nil {
+		return nil
+	}
+
+	return generator
+}
+
+// setRotationPolicy stores the generator and the rotation interval (0 disables scheduled
+// rotations). The next rotation is only rescheduled if the interval changed.
+func (s *Secret) setRotationPolicy(generator *SecretGenerator, days int) error {
+	if days > 0 && generator == nil {
+		return errors.New("Automatic rotation requires a generator.")
+	}
+
+	s.Generator = nil
+	if generator != nil {
+		encoded := generator.Encode()
+		s.Generator = &encoded
+	}
+
+	if days <= 0 {
+		s.RotationDays = nil
+		s.RotateAt = nil
+		return nil
+	}
+
+	if s.RotationDays == nil || *s.RotationDays != days || s.RotateAt == nil {
+		s.RotationDays = &days
+		s.scheduleRotation()
+	}
+
+	return nil
+}
+
+func (s *Secret) scheduleRotation() {
+	if s.RotationDays == nil {
+		return
+	}
+
+	next := time.Now().AddDate(0, 0, *s.RotationDays).Format("2006-01-02 15:04:05")
+	s.RotateAt = &next
+}
+
+// Rotate replaces the value with a newly generated one. userId is nil for scheduled rotations.
+func (s *Secret) Rotate(userId *int) error {
+	generator := s.GetGenerator()
+	if generator == nil {
+		return errors.New("The secret has no generator and cannot be rotated.")
+	}
+
+	value, err := generator.Generate()
+	if err != nil {
+		return errors.New("Could not generate a new value: " + err.Error())
+	}
+
+	encrypted, err := Encrypt(value)
+	if err != nil {
+		return errors.New("Could not encrypt secret: " + err.Error())
+	}
+
+	err = s.replaceValue(encrypted, userId)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	s.RotatedAt = &now
+
+	if userId != nil {
+		s.UpdatedBy = userId
+	}
+
+	return s.Save()
+}
+
+// owner is the user scheduled rotations are attributed to: whoever last changed the secret.
+func (s *Secret) owner() int {
+	if s.UpdatedBy != nil {
+		return *s.UpdatedBy
+	}
+
+	return s.CreatedBy
+}
+
+// SecretRotator regularly rotates all secrets whose rotation is due.
+type SecretRotator struct {
+	interval     time.Duration
+	keepVersions int
+}
+
+func NewSecretRotator(c *configuration) (*SecretRotator, error) {
+	r := &SecretRotator{
+		interval:     1 * time.Hour,
+		keepVersions: defaultSecretVersions,
+	}
+
+	if c.Rotation.CheckInterval != "" {
+		interval, err := time.ParseDuration(c.Rotation.CheckInterval)
+		if err != nil {
+			return nil, errors.New("Invalid rotation check interval configured: " + err.Error())
+		}
+
+		r.interval = interval
+	}
+
+	if c.Rotation.KeepVersions < 0 {
+		return nil, errors.New("The number of secret versions to keep cannot be negative.")
+	}
+
+	if c.Rotation.KeepVersions > 0 {
+		r.keepVersions = c.Rotation.KeepVersions
+	}
+
+	return r, nil
+}
+
+func (r *SecretRotator) Run(database *sqlx.DB) {
+	for {
+		rotated, err := r.RotateDue(database)
+		if err != nil {
+			log.Println("Warning: Rotating secrets failed: " + err.Error())
+		} else if rotated > 0 {
+			log.Printf("Rotated %d secret(s).", rotated)
+		}
+
+		<-time.After(r.interval)
+	}
+}
+
+// RotateDue rotates all due secrets in a single transaction and returns how many were rotated.
+// Secrets whose generator is broken are skipped (and logged) so they do not block the others.
+func (r *SecretRotator) RotateDue(database *sqlx.DB) (int, error) {
+	tx, err := database.Beginx()
+	if err != nil {
+		return 0, err
+	}
+
+	secrets := make([]Secret, 0)
+
+	err = tx.Select(&secrets, "SELECT "+secretColumns+" FROM `secret` WHERE `generator` IS NOT NULL AND `rotate_at` IS NOT NULL AND `rotate_at` <= NOW() ORDER BY `id` FOR UPDATE")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	auditLog := NewAuditLog(tx, nil)
+	rotated := 0
+
+	for i := range secrets {
+		secret := &secrets[i]
+		secret._db = tx
+
+		if secret.GetGenerator() == nil {
+			log.Printf("Warning: The secret '%s' cannot be rotated, its generator is invalid.", secret.Slug)
+			continue
+		}
+
+		err = secret.Rotate(nil)
+		if err != nil {
+			eventBus.Discard(tx)
+			tx.Rollback()
+			return 0, err
+		}
+
+		auditLog.LogSecretRotated(secret.Id, secret.owner(), true)
+
+		secretId := secret.Id
+		notifyOwners(secret, notificationItem{
+			Action:     "secret-rotated",
+			Time:       time.Now().Format("2006-01-02 15:04:05"),
+			Actor:      "Raziel",
+			SecretId:   &secretId,
+			SecretName: secret.Name,
+		}, secret.owner(), tx)
+
+		rotated++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		eventBus.Discard(tx)
+		return 0, err
+	}
+
+	eventBus.Flush(tx)
+
+	return rotated, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// HTTP Handlers
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func secretsRotateAction(params martini.Params, req *http.Request, user *User, db *sqlx.Tx) response {
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return renderError(400, "Invalid ID given.")
+	}
+
+	secret := findSecret(id, false, db)
+	if secret == nil {
+		return renderError(404, "Secret could not be found.")
+	}
+
+	if secret.GetGenerator() == nil {
+		return renderError(400, "The secret has no generator and cannot be rotated.")
+	}
+
+	err = secret.Rotate(&user.Id)
+	if err != nil {
+		panic(err)
+	}
+
+	auditLog := NewAuditLog(db, req)
+	auditLog.LogSecretRotated(secret.Id, user.Id, false)
+
+	return redirect(302, "/secrets/"+strconv.Itoa(secret.Id))
+}
@@ -19,9 +19,17 @@ type Secret struct {
 	CreatedBy int     `db:"created_by"`
 	UpdatedBy *int    `db:"updated_by"`
 
+	// rotation policy; secrets with a generator can be rotated, the interval is optional
+	Generator    *string `db:"generator"`
+	RotationDays *int    `db:"rotation_days"`
+	RotateAt     *string `db:"rotate_at"`
+	RotatedAt    *string `db:"rotated_at"`
+
 	_db *sqlx.Tx
 }
 
+const secretColumns = "`id`, `slug`, `name`, `created_at`, `created_by`, `updated_at`, `updated_by`, `generator`, `rotation_days`, `rotate_at`, `rotated_at`"
+
 func findAllSecrets(loadSecrets bool, db *sqlx.Tx) []Secret {
 	list := make([]Secret, 0)
 	secretCol := ""
@@ -30,7 +38,7 @@ func findAllSecrets(loadSecrets bool, db *sqlx.Tx) []Secret {
 		secretCol = ", `secret`"
 	}
 
-	db.Select(&list, "SELECT `id`, `slug`, `name`, `created_at`, `created_by`, `updated_at`, `updated_by`"+secretCol+" FROM `secret` WHERE 1 ORDER BY name")
+	db.Select(&list, "SELECT "+secretColumns+secretCol+" FROM `secret` ORDER BY name")
 
 	for i := range list {
 		list[i]._db = db
@@ -49,7 +57,7 @@ func findSecret(id int, loadSecret bool, db *sqlx.Tx) *Secret {
 		secretCol = ", `secret`"
 	}
 
-	db.Get(secret, "SELECT `id`, `slug`, `name`, `created_at`, `created_by`, `updated_at`, `updated_by`"+secretCol+" FROM `secret` WHERE `id` = ?", id)
+	db.Get(secret, "SELECT "+secretColumns+secretCol+" FROM `secret` WHERE `id` = ?", id)
 	if secret.Id == 0 {
 		return nil
 	}
@@ -72,7 +80,7 @@ func findSecretBySlug(slug string, loadSecret bool, db *sqlx.Tx) *Secret {
 		secretCol = ", `secret`"
 	}
 
-	db.Get(secret, "SELECT `id`, `slug`, `name`, `created_at`, `created_by`, `updated_at`, `updated_by`"+secretCol+" FROM `secret` WHERE `slug` = ?", validated)
+	db.Get(secret, "SELECT "+secretColumns+secretCol+" FROM `secret` WHERE `slug` = ?", validated)
 	if secret.Id == 0 {
 		return nil
 	}
@@ -83,8 +91,8 @@ func findSecretBySlug(slug string, loadSecret bool, db *sqlx.Tx) *Secret {
 func (s *Secret) Save() error {
 	if s.Id <= 0 {
 		result, err := s._db.Exec(
-			"INSERT INTO `secret` (`name`, `slug`, `secret`, `created_at`, `updated_at`, `created_by`, `updated_by`) VALUES (?,?,?,NOW(),NULL,?,NULL)",
-			s.Name, s.Slug, s.Secret, s.CreatedBy,
+			"INSERT INTO `secret` (`name`, `slug`, `secret`, `created_at`, `updated_at`, `created_by`, `updated_by`, `generator`, `rotation_days`, `rotate_at`, `rotated_at`) VALUES (?,?,?,NOW(),NULL,?,NULL,?,?,?,?)",
+			s.Name, s.Slug, s.Secret, s.CreatedBy, s.Generator, s.RotationDays, s.RotateAt, s.RotatedAt,
 		)
 
 		if err != nil {
@@ -103,13 +111,13 @@ func (s *Secret) Save() error {
 		// if the secret wasn't fetched, don't attempt to update it
 		if s.Secret == nil {
 			_, err = s._db.Exec(
-				"UPDATE `secret` SET `name` = ?, `slug` = ?, `updated_at` = NOW(), `updated_by` = ? WHERE `id` = ?",
-				s.Name, s.Slug, s.UpdatedBy, s.Id,
+				"UPDATE `secret` SET `name` = ?, `slug` = ?, `updated_at` = NOW(), `updated_by` = ?, `generator` = ?, `rotation_days` = ?, `rotate_at` = ?, `rotated_at` = ? WHERE `id` = ?",
+				s.Name, s.Slug, s.UpdatedBy, s.Generator, s.RotationDays, s.RotateAt, s.RotatedAt, s.Id,
 			)
 		} else {
 			_, err = s._db.Exec(
-				"UPDATE `secret` SET `name` = ?, `slug` = ?, `secret` = ?, `updated_at` = NOW(), `updated_by` = ? WHERE `id` = ?",
-				s.Name, s.Slug, s.Secret, s.UpdatedBy, s.Id,
+				"UPDATE `secret` SET `name` = ?, `slug` = ?, `secret` = ?, `updated_at` = NOW(), `updated_by` = ?, `generator` = ?, `rotation_days` = ?, `rotate_at` = ?, `rotated_at` = ? WHERE `id` = ?",
+				s.Name, s.Slug, s.Secret, s.UpdatedBy, s.Generator, s.RotationDays, s.RotateAt, s.RotatedAt, s.Id,
 			)
 		}
 
@@ -118,6 +126,16 @@ func (s *Secret) Save() error {
 		}
 	}
 
+	// keep the certificate metadata in sync with the body
+	if s.Secret != nil {
+		body, err := Decrypt(s.Secret)
+		if err != nil {
+			return err
+		}
+
+		return refreshCertificate(s.Id, body, s._db)
+	}
+
 	return nil
 }
 
@@ -148,22 +166,192 @@ type secretListData struct {
 	Secrets []Secret
 }
 
+type authorityFormData struct {
+	Enabled      bool
+	Ttl          string
+	AllowedNames string
+	Wildcards    bool
+	Ssh          bool
+}
+
+type dynamicFormData struct {
+	Enabled    bool
+	Ttl        string
+	Creation   string
+	Revocation string
+}
+
 type secretFormData struct {
 	layoutData
 
-	Secret     int
-	Name       string
-	NameError  string
-	Slug       string
-	SlugError  string
-	BodyError  string
-	OtherError string
+	Secret             int
+	Name               string
+	NameError          string
+	Slug               string
+	SlugError          string
+	BodyError          string
+	Generator          SecretGenerator
+	GeneratorTypes     []string
+	GeneratorLabels    map[string]string
+	GeneratorError     string
+	Rotation           string
+	RotationError      string
+	RotatedAt          *string
+	RotateAt           *string
+	Versions           []SecretVersion
+	Certificate        *SecretCertificate
+	Authority          authorityFormData
+	AuthorityError     string
+	IssuedCertificates []IssuedCertificate
+	Dynamic            dynamicFormData
+	DynamicError       string
+	Leases             []Lease
+	Shares             []Share
+	ShareConsumers     []Consumer
+	OtherError         string
+	Subscription       subscriptionPanel
+}
+
+func newSecretFormData(title string, user *User, session *Session) *secretFormData {
+	return &secretFormData{
+		layoutData:      NewLayoutData(title, "secrets", user, session.CsrfToken),
+		GeneratorTypes:  generatorTypes,
+		GeneratorLabels: generatorLabels,
+	}
 }
 
 func (data *secretFormData) fromSecret(s *Secret) {
 	data.Secret = s.Id
 	data.Name = s.Name
 	data.Slug = s.Slug
+	data.RotatedAt = s.RotatedAt
+	data.RotateAt = s.RotateAt
+	data.Certificate = s.GetCertificate()
+
+	if ca := s.GetCertificateAuthority(); ca != nil {
+		data.Authority = authorityFormData{ca.Kind == AuthorityX509, ca.Ttl, ca.AllowedNames, ca.AllowWildcards, ca.Kind == AuthoritySsh}
+		data.IssuedCertificates = findIssuedCertificates(s.Id, 25, s._db)
+	}
+
+	if dc := s.GetDynamicCredential(); dc != nil {
+		data.Dynamic = dynamicFormData{true, dc.Ttl, dc.Creation, dc.Revocation}
+		data.Leases = findLeases(s.Id, 25, s._db)
+	}
+
+	if !data.Dynamic.Enabled {
+		data.Shares = findShares(s.Id, 25, s._db)
+		data.ShareConsumers = findSecretConsumers(s.Id, s._db)
+	}
+
+	if generator := s.GetGenerator(); generator != nil {
+		data.Generator = *generator
+	}
+
+	if s.RotationDays != nil {
+		data.Rotation = strconv.Itoa(*s.RotationDays)
+	}
+}
+
+// readRotationPolicy takes the generator and rotation interval from the form. It returns false if
+// they are invalid, in which case the errors have been set on the form data.
+func (data *secretFormData) readRotationPolicy(req *http.Request) (*SecretGenerator, int, bool) {
+	data.Generator = SecretGenerator{
+		Type:    req.FormValue("generator"),
+		Charset: req.FormValue("generator_charset"),
+		Curve:   req.FormValue("generator_curve"),
+	}
+	data.Generator.Length, _ = strconv.Atoi(strings.TrimSpace(req.FormValue("generator_length")))
+	data.Generator.Bits, _ = strconv.Atoi(req.FormValue("generator_bits"))
+	data.Rotation = strings.TrimSpace(req.FormValue("rotation"))
+
+	generator, err := parseSecretGenerator(req)
+	if err != nil {
+		data.GeneratorError = err.Error()
+		return nil, 0, false
+	}
+
+	days := 0
+
+	if len(data.Rotation) > 0 {
+		days, err = strconv.Atoi(data.Rotation)
+		if err != nil || days < 0 || days > 3650 {
+			data.RotationError = "The rotation interval must be a number of days between 0 and 3650."
+			return nil, 0, false
+		}
+	}
+
+	if days > 0 && generator == nil {
+		data.RotationError = "Automatic rotation requires a generator."
+		return nil, 0, false
+	}
+
+	return generator, days, true
+}
+
+// readAuthorityPolicy takes the CA policy from the form; nil means the secret is no CA. The body
+// is checked separately, as it is not always part of the form.
+func (data *secretFormData) readAuthorityPolicy(req *http.Request, generator *SecretGenerator) (*CertificateAuthority, bool) {
+	data.Authority = authorityFormData{
+		Enabled:      req.FormValue("ca") == "1",
+		Ttl:          strings.TrimSpace(req.FormValue("ca_ttl")),
+		AllowedNames: strings.TrimSpace(req.FormValue("ca_names")),
+		Wildcards:    req.FormValue("ca_wildcards") == "1",
+		Ssh:          req.FormValue("ssh_ca") == "1",
+	}
+
+	if !data.Authority.Enabled && !data.Authority.Ssh {
+		return nil, true
+	}
+
+	if generator != nil {
+		data.AuthorityError = "A certificate authority cannot have a generator."
+		return nil, false
+	}
+
+	if data.Authority.Ssh {
+		if data.Authority.Enabled {
+			data.AuthorityError = "A secret cannot be an X.509 and an SSH certificate authority at the same time."
+			return nil, false
+		}
+
+		return &CertificateAuthority{Kind: AuthoritySsh}, true
+	}
+
+	ca, err := newCertificateAuthority(data.Authority.Ttl, data.Authority.AllowedNames, data.Authority.Wildcards)
+	if err != nil {
+		data.AuthorityError = err.Error()
+		return nil, false
+	}
+
+	return ca, true
+}
+
+// readDynamicPolicy takes the dynamic credential policy from the form; nil means the secret is
+// delivered as it is. Like the other special kinds, dynamic secrets cannot be generated.
+func (data *secretFormData) readDynamicPolicy(req *http.Request, generator *SecretGenerator, authority *CertificateAuthority) (*DynamicCredential, bool) {
+	data.Dynamic = dynamicFormData{
+		Enabled:    req.FormValue("dynamic") == "1",
+		Ttl:        strings.TrimSpace(req.FormValue("dynamic_ttl")),
+		Creation:   strings.TrimSpace(req.FormValue("dynamic_creation")),
+		Revocation: strings.TrimSpace(req.FormValue("dynamic_revocation")),
+	}
+
+	if !data.Dynamic.Enabled {
+		return nil, true
+	}
+
+	if generator != nil || authority != nil {
+		data.DynamicError = "Dynamic credentials cannot be combined with a generator or a certificate authority."
+		return nil, false
+	}
+
+	dc, err := newDynamicCredential(data.Dynamic.Ttl, data.Dynamic.Creation, data.Dynamic.Revocation)
+	if err != nil {
+		data.DynamicError = err.Error()
+		return nil, false
+	}
+
+	return dc, true
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -177,13 +365,13 @@ func secretsIndexAction(user *User, session *Session, db *sqlx.Tx) response {
 }
 
 func secretsAddAction(user *User, session *Session) response {
-	data := &secretFormData{layoutData: NewLayoutData("Add Secret", "secrets", user, session.CsrfToken)}
+	data := newSecretFormData("Add Secret", user, session)
 
 	return renderTemplate(200, "secrets/form", data)
 }
 
 func secretsCreateAction(req *http.Request, user *User, session *Session, db *sqlx.Tx) response {
-	data := &secretFormData{layoutData: NewLayoutData("Add Secret", "secrets", user, session.CsrfToken)}
+	data := newSecretFormData("Add Secret", user, session)
 	name := strings.TrimSpace(req.FormValue("name"))
 	slug := strings.TrimSpace(req.FormValue("slug"))
 	body := strings.TrimSpace(req.FormValue("body"))
@@ -191,6 +379,21 @@ func secretsCreateAction(req *http.Request, user *User, session *Session, db *sq
 	data.Name = name
 	data.Slug = slug
 
+	generator, rotationDays, ok := data.readRotationPolicy(req)
+	if !ok {
+		return renderTemplate(400, "secrets/form", data)
+	}
+
+	authority, ok := data.readAuthorityPolicy(req, generator)
+	if !ok {
+		return renderTemplate(400, "secrets/form", data)
+	}
+
+	dynamic, ok := data.readDynamicPolicy(req, generator, authority)
+	if !ok {
+		return renderTemplate(400, "secrets/form", data)
+	}
+
 	if len(name) == 0 {
 		data.NameError = "The name cannot be empty."
 		return renderTemplate(400, "secrets/form", data)
@@ -208,12 +411,43 @@ func secretsCreateAction(req *http.Request, user *User, session *Session, db *sq
 		return renderTemplate(400, "secrets/form", data)
 	}
 
-	if len(body) == 0 {
-		data.BodyError = "The body cannot be empty."
+	value := []byte(body)
+
+	err = checkCertificateBundle(value)
+	if err != nil {
+		data.BodyError = err.Error()
 		return renderTemplate(400, "secrets/form", data)
 	}
 
-	encrypted, err := Encrypt([]byte(body))
+	// an empty body is only allowed if the value can be generated
+	if len(value) == 0 {
+		if generator == nil {
+			data.BodyError = "The body cannot be empty."
+			return renderTemplate(400, "secrets/form", data)
+		}
+
+		value, err = generator.Generate()
+		if err != nil {
+			data.OtherError = "Could not generate the secret: " + err.Error()
+			return renderTemplate(500, "secrets/form", data)
+		}
+	}
+
+	if authority != nil {
+		if err := authority.CheckBody(value); err != nil {
+			data.AuthorityError = err.Error()
+			return renderTemplate(400, "secrets/form", data)
+		}
+	}
+
+	if dynamic != nil {
+		if err := checkTargetDatabase(value); err != nil {
+			data.DynamicError = err.Error()
+			return renderTemplate(400, "secrets/form", data)
+		}
+	}
+
+	encrypted, err := Encrypt(value)
 	if err != nil {
 		data.OtherError = "Could not encrypt secret: " + err.Error()
 		return renderTemplate(500, "secrets/form", data)
@@ -228,11 +462,27 @@ func secretsCreateAction(req *http.Request, user *User, session *Session, db *sq
 		_db:       db,
 	}
 
+	err = secret.setRotationPolicy(generator, rotationDays)
+	if err != nil {
+		data.RotationError = err.Error()
+		return renderTemplate(400, "secrets/form", data)
+	}
+
 	err = secret.Save()
 	if err != nil {
 		panic(err)
 	}
 
+	err = secret.setCertificateAuthority(authority)
+	if err != nil {
+		panic(err)
+	}
+
+	err = secret.setDynamicCredential(dynamic)
+	if err != nil {
+		panic(err)
+	}
+
 	auditLog := NewAuditLog(db, req)
 	auditLog.LogSecretCreated(secret.Id, user.Id)
 
@@ -250,8 +500,10 @@ func secretsEditAction(params martini.Params, user *User, session *Session, db *
 		return renderError(404, "Secret could not be found.")
 	}
 
-	data := &secretFormData{layoutData: NewLayoutData("Edit Secret", "secrets", user, session.CsrfToken)}
+	data := newSecretFormData("Edit Secret", user, session)
 	data.fromSecret(secret)
+	data.Versions = findSecretVersions(secret.Id, db)
+	data.Subscription = newSubscriptionPanel("secret", secret.Id, user, session.CsrfToken, db)
 
 	return renderTemplate(200, "secrets/form", data)
 }
@@ -267,15 +519,31 @@ func secretsUpdateAction(params martini.Params, req *http.Request, user *User, s
 		return renderError(404, "Secret could not be found.")
 	}
 
-	data := &secretFormData{layoutData: NewLayoutData("Edit Secret", "secrets", user, session.CsrfToken)}
+	data := newSecretFormData("Edit Secret", user, session)
 	name := strings.TrimSpace(req.FormValue("name"))
 	slug := strings.TrimSpace(req.FormValue("slug"))
 	body := strings.TrimSpace(req.FormValue("body"))
 
-	data.Secret = secret.Id
+	data.fromSecret(secret)
+	data.Versions = findSecretVersions(secret.Id, db)
 	data.Name = name
 	data.Slug = slug
 
+	generator, rotationDays, ok := data.readRotationPolicy(req)
+	if !ok {
+		return renderTemplate(400, "secrets/form", data)
+	}
+
+	authority, ok := data.readAuthorityPolicy(req, generator)
+	if !ok {
+		return renderTemplate(400, "secrets/form", data)
+	}
+
+	dynamic, ok := data.readDynamicPolicy(req, generator, authority)
+	if !ok {
+		return renderTemplate(400, "secrets/form", data)
+	}
+
 	if len(name) == 0 {
 		data.NameError = "The name cannot be empty."
 		return renderTemplate(400, "secrets/form", data)
@@ -297,6 +565,49 @@ func secretsUpdateAction(params martini.Params, req *http.Request, user *User, s
 	secret.Slug = validated
 	secret.UpdatedBy = &user.Id
 
+	err = secret.setRotationPolicy(generator, rotationDays)
+	if err != nil {
+		data.RotationError = err.Error()
+		return renderTemplate(400, "secrets/form", data)
+	}
+
+	if len(body) > 0 {
+		err = checkCertificateBundle([]byte(body))
+		if err != nil {
+			data.BodyError = err.Error()
+			return renderTemplate(400, "secrets/form", data)
+		}
+	}
+
+	if authority != nil {
+		value := []byte(body)
+
+		if len(value) == 0 {
+			value, err = Decrypt(findSecret(secret.Id, true, db).Secret)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		if err := authority.CheckBody(value); err != nil {
+			data.AuthorityError = err.Error()
+			return renderTemplate(400, "secrets/form", data)
+		}
+	}
+
+	if dynamic != nil && len(body) > 0 {
+		if err := checkTargetDatabase([]byte(body)); err != nil {
+			data.DynamicError = err.Error()
+			return renderTemplate(400, "secrets/form", data)
+		}
+	}
+
+	// the users of active leases could not be dropped anymore
+	if dynamic == nil && secret.GetDynamicCredential() != nil && len(findActiveLeases(secret.Id, db)) > 0 {
+		data.DynamicError = "The secret still has active leases; revoke them first."
+		return renderTemplate(400, "secrets/form", data)
+	}
+
 	if len(body) > 0 {
 		encrypted, err := Encrypt([]byte(body))
 		if err != nil {
@@ -304,7 +615,10 @@ func secretsUpdateAction(params martini.Params, req *http.Request, user *User, s
 			return renderTemplate(500, "secrets/form", data)
 		}
 
-		secret.Secret = encrypted
+		err = secret.replaceValue(encrypted, &user.Id)
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	err = secret.Save()
@@ -312,6 +626,16 @@ func secretsUpdateAction(params martini.Params, req *http.Request, user *User, s
 		panic(err)
 	}
 
+	err = secret.setCertificateAuthority(authority)
+	if err != nil {
+		panic(err)
+	}
+
+	err = secret.setDynamicCredential(dynamic)
+	if err != nil {
+		panic(err)
+	}
+
 	auditLog := NewAuditLog(db, req)
 	auditLog.LogSecretUpdated(secret.Id, user.Id)
 
@@ -329,7 +653,7 @@ func secretsDeleteConfirmAction(params martini.Params, user *User, session *Sess
 		return renderError(404, "Secret could not be found.")
 	}
 
-	data := &secretFormData{layoutData: NewLayoutData("Delete Secret", "secrets", user, session.CsrfToken)}
+	data := newSecretFormData("Delete Secret", user, session)
 	data.fromSecret(secret)
 
 	return renderTemplate(200, "secrets/confirmation", data)
@@ -346,16 +670,32 @@ func secretsDeleteAction(params martini.Params, user *User, req *http.Request, s
 		return renderError(404, "Secret could not be found.")
 	}
 
-	data := &secretFormData{layoutData: NewLayoutData("Delete Secret", "secrets", user, session.CsrfToken)}
+	data := newSecretFormData("Delete Secret", user, session)
 	data.fromSecret(secret)
 
+	// drop the users of all active leases, as they would be forgotten otherwise
+	if dc := secret.GetDynamicCredential(); dc != nil {
+		withBody := findSecret(secret.Id, true, db)
+
+		for _, lease := range findActiveLeases(secret.Id, db) {
+			err = dc.Revoke(withBody, &lease, &user.Id)
+			if err != nil {
+				return renderError(502, "Could not drop the database user "+lease.Username+": "+err.Error())
+			}
+		}
+	}
+
+	// the subscriptions are removed together with the secret
+	notifySubscribers("secret-deleted", secret.Id, -1, user.Id, db)
+	consumerIds := deletionRecipients(secret.Id, db)
+
 	err = secret.Delete()
 	if err != nil {
 		panic(err)
 	}
 
 	auditLog := NewAuditLog(db, req)
-	auditLog.LogSecretDeleted(secret.Id, user.Id)
+	auditLog.LogSecretDeleted(secret, consumerIds, user.Id)
 
 	return redirect(302, "/secrets")
 }
@@ -365,8 +705,13 @@ func setupSecretsCtrl(app *martini.ClassicMartini) {
 		app.Get("", secretsIndexAction)
 		app.Get("/add", secretsAddAction)
 		app.Post("", sessions.RequireCsrfToken, secretsCreateAction)
+		app.Get("/import", secretsImportFormAction)
+		app.Post("/import", sessions.RequireCsrfToken, secretsImportAction)
 		app.Get("/:id", secretsEditAction)
 		app.Put("/:id", sessions.RequireCsrfToken, secretsUpdateAction)
+		app.Post("/:id/rotate", sessions.RequireCsrfToken, secretsRotateAction)
+		app.Post("/:id/issued/:cert/revoke", sessions.RequireCsrfToken, secretsRevokeCertificateAction)
+		app.Post("/:id/leases/:lease/revoke", sessions.RequireCsrfToken, secretsRevokeLeaseAction)
 		app.Delete("/:id", sessions.RequireCsrfToken, secretsDeleteAction)
 		app.Get("/:id/delete", secretsDeleteConfirmAction)
 	}, sessions.RequireLogin)
@@ -29,6 +29,7 @@ func (s *Session) WriteCookie(options cookieOptions, response http.ResponseWrite
 	cookie := http.Cookie{
 		Name:     options.Name,
 		Value:    s.ID,
+		Path:     "/",
 		Expires:  time.Now().Add(options.MaxAge),
 		HttpOnly: options.HttpOnly,
 		Secure:   options.Secure,
@@ -41,6 +42,7 @@ func (s *Session) DeleteCookie(options cookieOptions, response http.ResponseWrit
 	cookie := http.Cookie{
 		Name:   options.Name,
 		Value:  "-",
+		Path:   "/",
 		MaxAge: -1,
 	}
 
@@ -116,6 +118,34 @@ func (m *SessionMiddleware) RequireLogin(user *User, req *http.Request, res http
 	}
 }
 
+// RequireBasicAuth authenticates API requests with the user's login and passphrase and replaces
+// the (anonymous) user resolved from the session cookie.
+func (m *SessionMiddleware) RequireBasicAuth(req *http.Request, res http.ResponseWriter, c martini.Context, db *sqlx.Tx) {
+	login, password, ok := req.BasicAuth()
+
+	var user *User
+
+	if ok {
+		if validated, err := validateSafeString(login, "login"); err == nil {
+			user = authenticateUser(validated, password, req, db)
+		}
+	}
+
+	if user == nil {
+		res.Header().Set("WWW-Authenticate", `Basic realm="Raziel"`)
+		http.Error(res, "Nope.", http.StatusUnauthorized)
+		return
+	}
+
+	c.Map(user)
+}
+
+func (m *SessionMiddleware) RequireAdmin(user *User, res http.ResponseWriter) {
+	if !user.IsAdmin() {
+		http.Error(res, "Nope.", http.StatusForbidden)
+	}
+}
+
 func (m *SessionMiddleware) RequireCsrfToken(session *Session, req *http.Request, res http.ResponseWriter) {
 	if session == nil {
 		http.Error(res, "Nope.", http.StatusUnauthorized)
@@ -181,10 +211,23 @@ func (m *SessionMiddleware) EndSession(session *Session, response http.ResponseW
 	return session, nil
 }
 
+func (m *SessionMiddleware) Count() int {
+	return len(m.sessions)
+}
+
 func (m *SessionMiddleware) destroySession(session *Session) {
 	delete(m.sessions, session.ID)
 }
 
+// EndUserSessions logs the user out everywhere.
+func (m *SessionMiddleware) EndUserSessions(userId int) {
+	for _, sess := range m.sessions {
+		if sess.User == userId {
+			m.destroySession(sess)
+		}
+	}
+}
+
 func (m *SessionMiddleware) cleanup() {
 	for {
 		now := time.Now()
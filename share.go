@@ -0,0 +1,512 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// A share is a one-time link to a secret. The copy kept for it is sealed with a key derived from
+// the link's token, of which only a hash is stored, so the copy can be read neither with the
+// master key nor by anyone with access to the database alone. It is deleted when the link is used
+// or expires, whatever happens first.
+
+var shareSweeper *ShareSweeper
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Share model
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type Share struct {
+	Id         int     `db:"id"`
+	SecretId   int     `db:"secret_id"`
+	ConsumerId *int    `db:"consumer_id"`
+	CreatedAt  string  `db:"created_at"`
+	CreatedBy  int     `db:"created_by"`
+	ExpiresAt  string  `db:"expires_at"`
+	UsedAt     *string `db:"used_at"`
+	ExpiredAt  *string `db:"expired_at"`
+	Payload    []byte  `db:"payload"`
+
+	_db *sqlx.Tx
+}
+
+const shareColumns = "`id`, `secret_id`, `consumer_id`, `created_at`, `created_by`, `expires_at`, `used_at`, `expired_at`"
+
+func hashShareToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func shareKey(token string) *[32]byte {
+	key := sha256.Sum256([]byte("share-key:" + token))
+	return &key
+}
+
+func sealSharePayload(body []byte, token string) ([]byte, error) {
+	nonce := [24]byte{}
+
+	_, err := io.ReadFull(rand.Reader, nonce[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return secretbox.Seal(nonce[:], body, &nonce, shareKey(token)), nil
+}
+
+func openSharePayload(sealed []byte, token string) ([]byte, error) {
+	if len(sealed) < 24 {
+		return nil, errors.New("The shared copy is corrupted.")
+	}
+
+	nonce := [24]byte{}
+	copy(nonce[:], sealed[:24])
+
+	body, ok := secretbox.Open(nil, sealed[24:], &nonce, shareKey(token))
+	if !ok {
+		return nil, errors.New("The shared copy is corrupted.")
+	}
+
+	return body, nil
+}
+
+func findShares(secretId int, limit int, db *sqlx.Tx) []Share {
+	list := make([]Share, 0)
+
+	db.Select(&list, "SELECT "+shareColumns+" FROM `share` WHERE `secret_id` = ? ORDER BY `id` DESC LIMIT ?", secretId, limit)
+
+	for i := range list {
+		list[i]._db = db
+	}
+
+	return list
+}
+
+// findShareByToken returns the share for the given token, including used and expired ones, so
+// that attempts to use them can still be logged.
+func findShareByToken(token string, db *sqlx.Tx) *Share {
+	share := &Share{}
+	share._db = db
+
+	db.Get(share, "SELECT "+shareColumns+", `payload` FROM `share` WHERE `token_hash` = ?", hashShareToken(token))
+	if share.Id == 0 {
+		return nil
+	}
+
+	return share
+}
+
+// findExpiredShares returns the unused shares whose copies still have to be deleted.
+func findExpiredShares(db *sqlx.Tx) []Share {
+	list := make([]Share, 0)
+
+	db.Select(&list, "SELECT "+shareColumns+" FROM `share` WHERE `used_at` IS NULL AND `expired_at` IS NULL AND `expires_at` <= NOW() ORDER BY `id`")
+
+	for i := range list {
+		list[i]._db = db
+	}
+
+	return list
+}
+
+// shareableBody returns what a share of the secret contains; this is the same as what consumers
+// receive. The secret must have been loaded with its body.
+func shareableBody(secret *Secret) ([]byte, error) {
+	if secret.GetDynamicCredential() != nil {
+		return nil, errors.New("Dynamic secrets cannot be shared, as every consumer gets a database user of its own.")
+	}
+
+	body, err := Decrypt(secret.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if ca := secret.GetCertificateAuthority(); ca != nil {
+		body = ca.PublicPart(body)
+	}
+
+	return body, nil
+}
+
+// createShare stores a sealed copy of the body and returns the share and its token, which is not
+// stored in plain text.
+func createShare(secretId int, consumer *Consumer, body []byte, ttl time.Duration, creator *User, db *sqlx.Tx) (*Share, string, error) {
+	token, err := safeRandomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	payload, err := sealSharePayload(body, token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	share := &Share{
+		SecretId:  secretId,
+		CreatedAt: databaseNow(db),
+		CreatedBy: creator.Id,
+		ExpiresAt: time.Now().Add(ttl).Format("2006-01-02 15:04:05"),
+		_db:       db,
+	}
+
+	if consumer != nil {
+		share.ConsumerId = &consumer.Id
+	}
+
+	result, err := db.Exec(
+		"INSERT INTO `share` (`token_hash`, `secret_id`, `consumer_id`, `payload`, `created_at`, `created_by`, `expires_at`) VALUES (?,?,?,?,?,?,?)",
+		hashShareToken(token), share.SecretId, share.ConsumerId, payload, share.CreatedAt, share.CreatedBy, share.ExpiresAt,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, "", err
+	}
+
+	share.Id = int(id)
+
+	return share, token, nil
+}
+
+// Usable is true as long as the share has been neither used nor expired.
+func (s *Share) Usable() bool {
+	return s.UsedAt == nil && s.ExpiredAt == nil && !s.Expired()
+}
+
+func (s *Share) Expired() bool {
+	if s.ExpiredAt != nil {
+		return true
+	}
+
+	expiresAt, err := time.ParseInLocation("2006-01-02 15:04:05", s.ExpiresAt, time.Local)
+
+	return err != nil || expiresAt.Before(time.Now())
+}
+
+// Use opens the copy and deletes it. Only one of several concurrent requests can succeed, the
+// others get an error.
+func (s *Share) Use(token string) ([]byte, error) {
+	body, err := openSharePayload(s.Payload, token)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s._db.Exec("UPDATE `share` SET `payload` = NULL, `used_at` = NOW() WHERE `id` = ? AND `used_at` IS NULL AND `expired_at` IS NULL", s.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if affected != 1 {
+		return nil, errors.New("The share has already been used.")
+	}
+
+	return body, nil
+}
+
+// Expire deletes the copy of an unused share.
+func (s *Share) Expire() error {
+	_, err := s._db.Exec("UPDATE `share` SET `payload` = NULL, `expired_at` = NOW() WHERE `id` = ? AND `used_at` IS NULL", s.Id)
+	return err
+}
+
+func (s *Share) GetConsumer() *Consumer {
+	if s.ConsumerId == nil {
+		return nil
+	}
+
+	return findConsumer(*s.ConsumerId, s._db)
+}
+
+func (s *Share) GetCreator() *User {
+	return findUser(s.CreatedBy, false, s._db)
+}
+
+func (s *Share) consumerId() int {
+	if s.ConsumerId == nil {
+		return -1
+	}
+
+	return *s.ConsumerId
+}
+
+// shareContext is stored in the audit log for every share and in the access log for every
+// attempt to use one.
+type shareContext struct {
+	Id        int    `json:"id"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// findSecretConsumers returns the consumers a secret is assigned to.
+func findSecretConsumers(secretId int, db *sqlx.Tx) []Consumer {
+	list := make([]Consumer, 0)
+	db.Select(&list, "SELECT `id`, `name`, `created_at`, `updated_at`, `created_by`, `updated_by`, `enabled`, `deleted`, `info_token` FROM `consumer` WHERE `deleted` = 0 AND `id` IN (SELECT `consumer_id` FROM `consumer_secret` WHERE `secret_id` = ?) ORDER BY `name`", secretId)
+
+	for i := range list {
+		list[i]._db = db
+	}
+
+	return list
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Sweeper
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// ShareSweeper deletes the copies of expired shares and knows how long shares may live.
+type ShareSweeper struct {
+	interval time.Duration
+	maxTtl   time.Duration
+}
+
+func NewShareSweeper(c *configuration) (*ShareSweeper, error) {
+	s := &ShareSweeper{
+		interval: 5 * time.Minute,
+		maxTtl:   7 * 24 * time.Hour,
+	}
+
+	if c.Shares.ExpireInterval != "" {
+		interval, err := time.ParseDuration(c.Shares.ExpireInterval)
+		if err != nil {
+			return nil, errors.New("Invalid share expiry interval configured: " + err.Error())
+		}
+
+		s.interval = interval
+	}
+
+	if c.Shares.MaxTtl != "" {
+		maxTtl, err := time.ParseDuration(c.Shares.MaxTtl)
+		if err != nil || maxTtl < time.Minute {
+			return nil, errors.New("Invalid maximum share TTL configured, it must be at least one minute.")
+		}
+
+		s.maxTtl = maxTtl
+	}
+
+	return s, nil
+}
+
+func (s *ShareSweeper) Run(database *sqlx.DB) {
+	for {
+		expired, err := s.Sweep(database)
+		if err != nil {
+			log.Println("Warning: Expiring share links failed: " + err.Error())
+		} else if expired > 0 {
+			log.Printf("Expired %d unused share link(s).", expired)
+		}
+
+		<-time.After(s.interval)
+	}
+}
+
+// Sweep deletes the copies of all shares that expired unused and returns how many there were.
+// The expiry is attributed to the user that created the share.
+func (s *ShareSweeper) Sweep(database *sqlx.DB) (int, error) {
+	tx, err := database.Beginx()
+	if err != nil {
+		return 0, err
+	}
+
+	auditLog := NewAuditLog(tx, nil)
+	expired := 0
+
+	for _, share := range findExpiredShares(tx) {
+		err = share.Expire()
+		if err != nil {
+			eventBus.Discard(tx)
+			tx.Rollback()
+			return 0, err
+		}
+
+		auditLog.LogShareExpired(share.SecretId, share.consumerId(), share.CreatedBy, share.Id)
+		expired++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		eventBus.Discard(tx)
+		return 0, err
+	}
+
+	eventBus.Flush(tx)
+
+	return expired, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// HTTP Handlers
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type shareCreatedData struct {
+	layoutData
+
+	Secret    int
+	Name      string
+	Consumer  string
+	Url       string
+	ExpiresAt string
+}
+
+type sharePageData struct {
+	Token string
+	Body  string
+}
+
+func secretsShareAction(params martini.Params, req *http.Request, user *User, session *Session, db *sqlx.Tx) response {
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return renderError(400, "Invalid ID given.")
+	}
+
+	secret := findSecret(id, true, db)
+	if secret == nil {
+		return renderError(404, "Secret could not be found.")
+	}
+
+	ttl, err := time.ParseDuration(strings.TrimSpace(req.FormValue("ttl")))
+	if err != nil || ttl < time.Minute {
+		return renderError(400, "The TTL must be a duration like 1h or 30m, at least one minute.")
+	}
+
+	if ttl > shareSweeper.maxTtl {
+		return renderError(400, "The TTL must not exceed "+shareSweeper.maxTtl.String()+".")
+	}
+
+	var consumer *Consumer
+
+	if consumerId, _ := strconv.Atoi(req.FormValue("consumer")); consumerId > 0 {
+		consumer = findConsumer(consumerId, db)
+
+		if consumer == nil || consumer.Deleted || !consumer.HasSecret(secret.Id) {
+			return renderError(400, "The secret is not assigned to the selected consumer.")
+		}
+	}
+
+	body, err := shareableBody(secret)
+	if err != nil {
+		return renderError(400, err.Error())
+	}
+
+	share, token, err := createShare(secret.Id, consumer, body, ttl, user, db)
+	if err != nil {
+		panic(err)
+	}
+
+	auditLog := NewAuditLog(db, req)
+	auditLog.LogSecretShared(secret.Id, share.consumerId(), user.Id, share.Id, share.ExpiresAt)
+
+	data := &shareCreatedData{
+		layoutData: NewLayoutData("Share Secret", "secrets", user, session.CsrfToken),
+		Secret:     secret.Id,
+		Name:       secret.Name,
+		Url:        strings.TrimSuffix(config.Server.BaseUrl, "/") + "/share/" + token,
+		ExpiresAt:  share.ExpiresAt,
+	}
+
+	if consumer != nil {
+		data.Consumer = consumer.Name
+	}
+
+	return renderTemplate(200, "secrets/shared", data)
+}
+
+// wantsHtml is true for browsers, which get a page instead of the plain secret, so that link
+// previews and prefetching cannot use up a share.
+func wantsHtml(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// shareNotFound is the response for unknown, used and expired shares alike, so that the
+// response does not tell which tokens ever existed.
+func shareNotFound(share *Share, reason string, req *http.Request, db *sqlx.Tx) response {
+	accessLog := NewAccessLog(db)
+
+	if share == nil {
+		accessLog.LogNotFound(nil, nil, req)
+	} else {
+		secret := findSecret(share.SecretId, false, db)
+		ctx := map[string]interface{}{"share": shareContext{Id: share.Id, Error: reason}}
+
+		accessLog.LogAccess(share.GetConsumer(), secret, req, 404, ctx)
+	}
+
+	return newResponse(404, "Not Found.")
+}
+
+func shareLandingAction(params martini.Params, req *http.Request, db *sqlx.Tx) response {
+	if !wantsHtml(req) {
+		return shareUseAction(params, req, db)
+	}
+
+	share := findShareByToken(params["token"], db)
+
+	switch {
+	case share == nil:
+		return shareNotFound(nil, "", req, db)
+	case share.UsedAt != nil:
+		return shareNotFound(share, "used", req, db)
+	case !share.Usable():
+		return shareNotFound(share, "expired", req, db)
+	}
+
+	return renderTemplate(200, "share", sharePageData{Token: params["token"]})
+}
+
+func shareUseAction(params martini.Params, req *http.Request, db *sqlx.Tx) response {
+	token := params["token"]
+	share := findShareByToken(token, db)
+
+	switch {
+	case share == nil:
+		return shareNotFound(nil, "", req, db)
+	case share.UsedAt != nil:
+		return shareNotFound(share, "used", req, db)
+	case !share.Usable():
+		return shareNotFound(share, "expired", req, db)
+	}
+
+	body, err := share.Use(token)
+	if err != nil {
+		return shareNotFound(share, "used", req, db)
+	}
+
+	consumer := share.GetConsumer()
+	secret := findSecret(share.SecretId, false, db)
+	ctx := map[string]interface{}{"share": shareContext{Id: share.Id}}
+
+	NewAccessLog(db).LogAccess(consumer, secret, req, 200, ctx)
+	NewAuditLog(db, req).LogShareUsed(share.SecretId, share.consumerId(), share.CreatedBy, share.Id)
+
+	if wantsHtml(req) {
+		return renderTemplate(200, "share", sharePageData{Body: string(body)})
+	}
+
+	return response{200, string(body), "text/plain"}
+}
+
+func setupShareCtrl(app *martini.ClassicMartini) {
+	app.Post("/secrets/:id/share", sessions.RequireLogin, sessions.RequireCsrfToken, secretsShareAction)
+
+	// public
+	app.Get("/share/:token", shareLandingAction)
+	app.Post("/share/:token", shareUseAction)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestHashShareToken(t *testing.T) {
+	// SHA-256 test vector from FIPS 180-2
+	if hash := hashShareToken("abc"); hash != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Errorf("Unexpected hash %s.", hash)
+	}
+
+	if hashShareToken("token") != hashShareToken("token") || hashShareToken("token") == hashShareToken("token2") {
+		t.Error("The hash is not deterministic or not unique.")
+	}
+}
+
+func TestSealSharePayload(t *testing.T) {
+	body := []byte("hunter2")
+
+	sealed, err := sealSharePayload(body, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(sealed, body) {
+		t.Error("The payload contains the body in plain text.")
+	}
+
+	again, _ := sealSharePayload(body, "token")
+	if bytes.Equal(sealed, again) {
+		t.Error("Sealing twice resulted in the same payload; the nonce is not random.")
+	}
+
+	opened, err := openSharePayload(sealed, "token")
+	if err != nil || !bytes.Equal(opened, body) {
+		t.Errorf("The payload could not be opened: %q (%v)", opened, err)
+	}
+
+	if _, err := openSharePayload(sealed, "other token"); err == nil {
+		t.Error("The payload could be opened with another token.")
+	}
+
+	sealed[len(sealed)-1] ^= 1
+
+	if _, err := openSharePayload(sealed, "token"); err == nil {
+		t.Error("A modified payload could be opened.")
+	}
+
+	if _, err := openSharePayload(sealed[:10], "token"); err == nil {
+		t.Error("A truncated payload could be opened.")
+	}
+}
+
+func TestShareUse(t *testing.T) {
+	tx := newTestTx(t)
+
+	user := createTestUser(t, "admin", tx)
+	secret := createTestSecret(t, "password", "hunter2", user, tx)
+
+	share, token, err := createShare(secret.Id, nil, []byte("hunter2"), time.Hour, user, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := ""
+	tx.Get(&stored, "SELECT `token_hash` FROM `share` WHERE `id` = ?", share.Id)
+
+	if stored != hashShareToken(token) {
+		t.Error("The token was not stored as a hash.")
+	}
+
+	if findShareByToken("wrong"+token, tx) != nil {
+		t.Error("A share was found for a wrong token.")
+	}
+
+	found := findShareByToken(token, tx)
+	if found == nil || !found.Usable() {
+		t.Fatal("The new share could not be found or is not usable.")
+	}
+
+	body, err := found.Use(token)
+	if err != nil || string(body) != "hunter2" {
+		t.Fatalf("Using the share failed: %q (%v)", body, err)
+	}
+
+	found = findShareByToken(token, tx)
+	if found.Usable() || found.Payload != nil {
+		t.Error("The copy was not deleted after it has been used.")
+	}
+
+	// a concurrent request that loaded the share before it was used
+	share.Payload, _ = sealSharePayload([]byte("hunter2"), token)
+
+	if _, err := share.Use(token); err == nil {
+		t.Error("The share could be used twice.")
+	}
+}
+
+func TestShareSweep(t *testing.T) {
+	db := newTestDatabase(t)
+
+	tx, _ := db.Beginx()
+	user := createTestUser(t, "admin", tx)
+	secret := createTestSecret(t, "password", "hunter2", user, tx)
+
+	expired, _, err := createShare(secret.Id, nil, []byte("hunter2"), -time.Minute, user, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, token, err := createShare(secret.Id, nil, []byte("hunter2"), time.Hour, user, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx.Commit()
+
+	sweeper, err := NewShareSweeper(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := sweeper.Sweep(db)
+	if err != nil || count != 1 {
+		t.Fatalf("Expected one expired share, got %d (%v).", count, err)
+	}
+
+	if count, err := sweeper.Sweep(db); err != nil || count != 0 {
+		t.Errorf("The expired share was expired again (%v).", err)
+	}
+
+	tx, _ = db.Beginx()
+	defer tx.Rollback()
+
+	shares := findShares(secret.Id, 10, tx)
+	if len(shares) != 2 {
+		t.Fatalf("Expected two shares, found %d.", len(shares))
+	}
+
+	for _, share := range shares {
+		if (share.Id == expired.Id) != (share.ExpiredAt != nil) {
+			t.Errorf("Share #%d was expired by mistake or not at all.", share.Id)
+		}
+	}
+
+	if share := findShareByToken(token, tx); share == nil || !share.Usable() || share.Payload == nil {
+		t.Error("The unexpired share is not usable anymore.")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/ssh"
+)
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// SSH certificate authority
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// loadSshSigner takes the CA key from a secret's body, which can be an OpenSSH or PEM private key
+// (optionally followed by the public key, like the generated SSH keys are).
+func loadSshSigner(body []byte) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(body)
+	if err != nil {
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			return nil, errors.New("The SSH private key must not be encrypted.")
+		}
+
+		return nil, errors.New("The secret does not contain an SSH private key: " + err.Error())
+	}
+
+	return signer, nil
+}
+
+// sshCertificatePolicy returns the consumer's SSH certificate restriction, if it is enabled.
+func (c *Consumer) sshCertificatePolicy() *sshCertificateContext {
+	for _, restriction := range c.GetRestrictions(true) {
+		if !restriction.Enabled || restriction.Type != "ssh_certificate" {
+			continue
+		}
+
+		if ctx, ok := restriction.UnpackContext().(*sshCertificateContext); ok {
+			return ctx
+		}
+	}
+
+	return nil
+}
+
+// sshCertificateRequest is what a consumer asks for: a public key and, optionally, a subset of
+// the allowed principals and a shorter validity.
+type sshCertificateRequest struct {
+	key        ssh.PublicKey
+	principals []string
+	validity   time.Duration
+}
+
+func parseSshCertificateRequest(req *http.Request, policy *sshCertificateContext) (*sshCertificateRequest, error) {
+	result := &sshCertificateRequest{validity: policy.MaxValidity()}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(req.FormValue("public_key"))))
+	if err != nil {
+		return nil, errors.New("The public key must be given in authorized_keys format.")
+	}
+
+	if _, ok := key.(*ssh.Certificate); ok {
+		return nil, errors.New("Certificates cannot be signed again.")
+	}
+
+	result.key = key
+
+	for _, principal := range strings.FieldsFunc(req.FormValue("principals"), func(r rune) bool { return r == ',' || r == ' ' || r == '\n' }) {
+		if !policy.AllowsPrincipal(principal) {
+			return nil, errors.New("The principal '" + principal + "' is not allowed for this consumer.")
+		}
+
+		result.principals = append(result.principals, principal)
+	}
+
+	if len(result.principals) == 0 {
+		result.principals = policy.PrincipalList()
+	}
+
+	if validity := strings.TrimSpace(req.FormValue("ttl")); validity != "" {
+		duration, err := time.ParseDuration(validity)
+		if err != nil || duration <= 0 {
+			return nil, errors.New("Invalid TTL given.")
+		}
+
+		if duration < result.validity {
+			result.validity = duration
+		}
+	}
+
+	return result, nil
+}
+
+// newSshCertificate prepares the certificate to sign. The key ID is only known once the access has
+// been logged, so it is set by signSshCertificate.
+func newSshCertificate(request *sshCertificateRequest, policy *sshCertificateContext) (*ssh.Certificate, error) {
+	serial := make([]byte, 8)
+
+	_, err := rand.Read(serial)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             request.key,
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: request.principals,
+		ValidAfter:      uint64(now.Add(-1 * time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(request.validity).Unix()),
+	}
+
+	if policy.CertType == "host" {
+		cert.CertType = ssh.HostCert
+	} else {
+		cert.Permissions.Extensions = make(map[string]string)
+
+		for _, extension := range policy.Extensions {
+			cert.Permissions.Extensions[extension] = ""
+		}
+	}
+
+	return cert, nil
+}
+
+// signSshCertificate signs the certificate with a key ID that names the consumer and the access log
+// entry of the request, so a login can be traced back to who obtained the certificate and when.
+func signSshCertificate(cert *ssh.Certificate, secret *Secret, consumer *Consumer, entryId int) ([]byte, error) {
+	body, err := Decrypt(secret.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := loadSshSigner(body)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.KeyId = fmt.Sprintf("raziel consumer=%d (%s) access=%d", consumer.Id, consumer.Name, entryId)
+
+	err = cert.SignCert(rand.Reader, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.MarshalAuthorizedKey(cert), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// HTTP Handlers
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func signSshCertificateAction(params martini.Params, req *http.Request, db *sqlx.Tx) response {
+	accessLog := NewAccessLog(db)
+	consumer, secret, contexts, accessGranted := checkDelivery(params, req, db)
+
+	var ca *CertificateAuthority
+
+	if secret != nil {
+		ca = findCertificateAuthority(secret.Id, db)
+	}
+
+	// only secrets that are SSH certificate authorities can sign keys
+	if consumer == nil || secret == nil || ca == nil || ca.Kind != AuthoritySsh {
+		accessLog.LogNotFound(consumer, secret, req)
+		countDelivery(404, consumer, secret)
+
+		return newResponse(404, "Not Found.")
+	}
+
+	// the secret must be assigned and the consumer needs a policy to sign anything at all
+	policy := consumer.sshCertificatePolicy()
+
+	if !accessGranted || !consumer.HasSecret(secret.Id) || policy == nil {
+		accessLog.LogAccess(consumer, secret, req, 403, contexts)
+		countDelivery(403, consumer, secret)
+
+		return newResponse(403, "Nope.")
+	}
+
+	request, err := parseSshCertificateRequest(req, policy)
+
+	var cert *ssh.Certificate
+
+	if err == nil {
+		cert, err = newSshCertificate(request, policy)
+	}
+
+	if err != nil {
+		contexts["certificate"] = issueContext{Type: "ssh-" + policy.CertType, Error: err.Error()}
+		accessLog.LogAccess(consumer, secret, req, 400, contexts)
+		countDelivery(400, consumer, secret)
+
+		return newResponse(400, err.Error())
+	}
+
+	contexts["certificate"] = issueContext{
+		Type:     "ssh-" + policy.CertType,
+		Serial:   strconv.FormatUint(cert.Serial, 10),
+		NotAfter: time.Unix(int64(cert.ValidBefore), 0).Format("2006-01-02 15:04:05"),
+		Names:    cert.ValidPrincipals,
+	}
+
+	entryId := accessLog.LogAccess(consumer, secret, req, 200, contexts)
+
+	// a failure now rolls back the transaction, and with it the access log entry
+	signed, err := signSshCertificate(cert, findSecret(secret.Id, true, db), consumer, entryId)
+	if err != nil {
+		panic(err)
+	}
+
+	countDelivery(200, consumer, secret)
+
+	return newResponse(200, string(signed))
+}
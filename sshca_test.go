@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestSshKey returns a new key pair, the private key PEM encoded as the CA secrets hold it.
+func newTestSshKey(t *testing.T) (ssh.PublicKey, []byte) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestSignSshCertificate(t *testing.T) {
+	tx := newTestTx(t)
+
+	previous := restrictionHandlers
+	restrictionHandlers = map[string]RestrictionHandler{}
+	addRestrictionHandler(SshCertificateRestriction{})
+	defer func() { restrictionHandlers = previous }()
+
+	caKey, caBody := newTestSshKey(t)
+	userKey, _ := newTestSshKey(t)
+
+	user := createTestUser(t, "admin", tx)
+	deployer := createTestConsumer(t, "deployer", user, tx)
+	unrestricted := createTestConsumer(t, "unrestricted", user, tx)
+	secret := createTestSecret(t, "ssh-ca", string(caBody), user, tx, deployer, unrestricted)
+
+	if err := secret.setCertificateAuthority(&CertificateAuthority{Kind: AuthoritySsh}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := deployer.WriteRestrictions(map[string]consumerRestriction{
+		"ssh_certificate": {Enabled: true, Context: newSshCertificateContext("user", "deploy\nbackup", []string{"permit-pty"}, "8h")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(consumer *Consumer, form url.Values) response {
+		params := martini.Params{"consumer": consumer.GetIdentifier(), "secret": "ssh-ca"}
+		req := newTestRequest("POST", "/ssh/"+params["consumer"]+"/ssh-ca?"+form.Encode())
+
+		return signSshCertificateAction(params, req, tx)
+	}
+
+	authorizedKey := string(ssh.MarshalAuthorizedKey(userKey))
+
+	resp := sign(deployer, url.Values{"public_key": {authorizedKey}, "principals": {"backup"}, "ttl": {"1h"}})
+	if resp.Status != 200 {
+		t.Fatalf("The key was not signed: %+v", resp)
+	}
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.Content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		t.Fatalf("Expected a certificate, got %T.", parsed)
+	}
+
+	checker := &ssh.CertChecker{IsUserAuthority: func(auth ssh.PublicKey) bool {
+		return string(auth.Marshal()) == string(caKey.Marshal())
+	}}
+
+	if err := checker.CheckCert("backup", cert); err != nil {
+		t.Errorf("The certificate is not valid for the requested principal: %v", err)
+	}
+
+	if err := checker.CheckCert("deploy", cert); err == nil {
+		t.Error("The certificate is valid for a principal that was not requested.")
+	}
+
+	if string(cert.Key.Marshal()) != string(userKey.Marshal()) {
+		t.Error("The certificate was issued for another key.")
+	}
+
+	if validity := time.Until(time.Unix(int64(cert.ValidBefore), 0)); validity > time.Hour {
+		t.Errorf("The certificate is valid for %s, although only 1h was requested.", validity)
+	}
+
+	if _, ok := cert.Permissions.Extensions["permit-pty"]; !ok || len(cert.Permissions.Extensions) != 1 {
+		t.Errorf("Expected only the extensions of the policy, got %v.", cert.Permissions.Extensions)
+	}
+
+	// the key ID leads to the access log entry of the request
+	entries := NewAccessLog(tx).Find([]int{}, []int{deployer.Id}, []int{}, 1, 0)
+	if len(entries) != 1 || cert.KeyId != fmt.Sprintf("raziel consumer=%d (deployer) access=%d", deployer.Id, entries[0].Id) {
+		t.Errorf("The key ID %q does not name the access log entry: %+v", cert.KeyId, entries)
+	}
+
+	// without principals, all of the allowed ones are used, and the validity is capped
+	resp = sign(deployer, url.Values{"public_key": {authorizedKey}, "ttl": {"24h"}})
+	if resp.Status != 200 {
+		t.Fatalf("The key was not signed: %+v", resp)
+	}
+
+	parsed, _, _, _, _ = ssh.ParseAuthorizedKey([]byte(resp.Content))
+	cert = parsed.(*ssh.Certificate)
+
+	if strings.Join(cert.ValidPrincipals, ",") != "deploy,backup" {
+		t.Errorf("Expected all allowed principals, got %v.", cert.ValidPrincipals)
+	}
+
+	if validity := time.Until(time.Unix(int64(cert.ValidBefore), 0)); validity > 8*time.Hour {
+		t.Errorf("The certificate is valid for %s, longer than the policy allows.", validity)
+	}
+
+	testcases := []struct {
+		consumer *Consumer
+		form     url.Values
+		status   int
+	}{
+		{deployer, url.Values{"public_key": {authorizedKey}, "principals": {"root"}}, 400},
+		{deployer, url.Values{"public_key": {authorizedKey}, "principals": {"deploy,root"}}, 400},
+		{deployer, url.Values{"public_key": {resp.Content}}, 400},
+		{deployer, url.Values{"public_key": {"ssh-ed25519 garbage"}}, 400},
+		{deployer, url.Values{"public_key": {authorizedKey}, "ttl": {"-1h"}}, 400},
+		{unrestricted, url.Values{"public_key": {authorizedKey}}, 403},
+	}
+
+	for _, testcase := range testcases {
+		if resp := sign(testcase.consumer, testcase.form); resp.Status != testcase.status {
+			t.Errorf("%s %v: expected %d, got %+v.", testcase.consumer.Name, testcase.form, testcase.status, resp)
+		}
+	}
+}
+
+func TestLoadSshSigner(t *testing.T) {
+	_, body := newTestSshKey(t)
+
+	if _, err := loadSshSigner(body); err != nil {
+		t.Errorf("The key was not accepted: %v", err)
+	}
+
+	for _, invalid := range []string{"", "hunter2", "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"} {
+		if _, err := loadSshSigner([]byte(invalid)); err == nil {
+			t.Errorf("%q was accepted as an SSH key.", invalid)
+		}
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestPostgresTranslate(t *testing.T) {
+	testcases := map[string]string{
+		"SELECT `id` FROM `user` WHERE `login` = ? AND `deleted` IS NULL":      `SELECT "id" FROM "user" WHERE "login" = $1 AND "deleted" IS NULL`,
+		"UPDATE `share` SET `used_at` = NOW() WHERE `id` = ?":                  `UPDATE "share" SET "used_at" = LOCALTIMESTAMP(0) WHERE "id" = $1`,
+		"SELECT IFNULL(`a`, ?), `b` FROM `t` WHERE `c` = ?":                    `SELECT COALESCE("a", $1), "b" FROM "t" WHERE "c" = $2`,
+		"SELECT `x` FROM `t` WHERE `y` = 'why? `not`' AND `z` = ?":             `SELECT "x" FROM "t" WHERE "y" = 'why? ` + "`not`" + `' AND "z" = $1`,
+		"SELECT `hash` FROM `audit_log` ORDER BY `id` DESC LIMIT 1 FOR UPDATE": `SELECT "hash" FROM "audit_log" ORDER BY "id" DESC LIMIT 1 FOR UPDATE`,
+
+		"SELECT DATE_FORMAT(`requested_at`, '%Y-%m') AS `month` FROM `access_log`": `SELECT to_char("requested_at", 'YYYY-MM') AS "month" FROM "access_log"`,
+
+		"CREATE TABLE `t` (`id` INT UNSIGNED NOT NULL AUTO_INCREMENT, `flag` TINYINT(1) NOT NULL, `at` DATETIME NULL, `body` MEDIUMBLOB NULL, `text` MEDIUMTEXT NULL, PRIMARY KEY (`id`)) ENGINE = InnoDB": `CREATE TABLE "t" ("id" SERIAL, "flag" SMALLINT NOT NULL, "at" TIMESTAMP NULL, "body" BYTEA NULL, "text" TEXT NULL, PRIMARY KEY ("id"))`,
+
+		"CREATE TABLE `t` (`id` SMALLINT UNSIGNED NOT NULL AUTO_INCREMENT, PRIMARY KEY (`id`))":   `CREATE TABLE "t" ("id" SMALLSERIAL, PRIMARY KEY ("id"))`,
+		"ALTER TABLE `t` ADD COLUMN `kind` VARCHAR(10) NOT NULL DEFAULT 'x509' AFTER `secret_id`": `ALTER TABLE "t" ADD COLUMN "kind" VARCHAR(10) NOT NULL DEFAULT 'x509'`,
+	}
+
+	for query, expected := range testcases {
+		if translated := (postgresDialect{}).Translate(query); translated != expected {
+			t.Errorf("Translating %q\n  resulted in %q,\n  expected    %q.", query, translated, expected)
+		}
+	}
+}
+
+func TestSqliteTranslate(t *testing.T) {
+	testcases := map[string]string{
+		"SELECT `id` FROM `user` WHERE `login` = ?":                                                       "SELECT `id` FROM `user` WHERE `login` = ?",
+		"UPDATE `share` SET `used_at` = NOW() WHERE `id` = ?":                                             "UPDATE `share` SET `used_at` = datetime('now', 'localtime') WHERE `id` = ?",
+		"SELECT `hash` FROM `audit_log` ORDER BY `id` DESC LIMIT 1 FOR UPDATE":                            "SELECT `hash` FROM `audit_log` ORDER BY `id` DESC LIMIT 1",
+		"SELECT DATE_FORMAT(`created_at`, '%Y-%m-%d %H:%i:%s') FROM `audit_log`":                          "SELECT strftime('%Y-%m-%d %H:%M:%S', `created_at`) FROM `audit_log`",
+		"ALTER TABLE `t` ADD COLUMN `kind` VARCHAR(10) NOT NULL AFTER `secret_id`":                        "ALTER TABLE `t` ADD COLUMN `kind` VARCHAR(10) NOT NULL",
+		"CREATE TABLE `t` (`secret_id` INT UNSIGNED NOT NULL, PRIMARY KEY (`secret_id`)) ENGINE = InnoDB": "CREATE TABLE `t` (`secret_id` INT NOT NULL, PRIMARY KEY (`secret_id`))",
+
+		"CREATE TABLE `t` (`id` INT UNSIGNED NOT NULL AUTO_INCREMENT, `name` VARCHAR(10) NOT NULL, PRIMARY KEY (`id`)) ENGINE = InnoDB": "CREATE TABLE `t` (`id` INTEGER PRIMARY KEY AUTOINCREMENT, `name` VARCHAR(10) NOT NULL)",
+	}
+
+	for query, expected := range testcases {
+		if translated := (sqliteDialect{}).Translate(query); translated != expected {
+			t.Errorf("Translating %q\n  resulted in %q,\n  expected    %q.", query, translated, expected)
+		}
+	}
+}
+
+func TestSqliteDsn(t *testing.T) {
+	testcases := map[string]string{
+		"raziel.db":                   "raziel.db?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate",
+		"raziel.db?cache=shared":      "raziel.db?cache=shared&_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate",
+		"raziel.db?_busy_timeout=100": "raziel.db?_busy_timeout=100&_foreign_keys=on&_journal_mode=WAL&_txlock=immediate",
+
+		"raziel.db?_foreign_keys=off&_busy_timeout=1&_journal_mode=DELETE&_txlock=deferred": "raziel.db?_foreign_keys=off&_busy_timeout=1&_journal_mode=DELETE&_txlock=deferred",
+	}
+
+	for path, expected := range testcases {
+		if dsn := sqliteDsn(path); dsn != expected {
+			t.Errorf("Expected %q for %q, got %q.", expected, path, dsn)
+		}
+	}
+}
+
+func TestOpenDatabase(t *testing.T) {
+	if _, _, err := OpenDatabase("oracle://localhost/raziel"); err == nil {
+		t.Error("An unknown database type was accepted.")
+	}
+
+	db, d, err := OpenDatabase("sqlite://" + t.TempDir() + "/raziel.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if d.Name() != "sqlite" {
+		t.Errorf("Expected the SQLite dialect, got %s.", d.Name())
+	}
+
+	enabled := 0
+	db.Get(&enabled, "PRAGMA foreign_keys")
+
+	if enabled != 1 {
+		t.Error("Foreign keys are not enforced.")
+	}
+}
+
+func TestTranslatingDriver(t *testing.T) {
+	tx := newTestTx(t)
+	user := createTestUser(t, "admin", tx)
+
+	// booleans are stored as integers and the new ID is reported
+	consumer := createTestConsumer(t, "web", user, tx)
+	if consumer.Id != 1 {
+		t.Errorf("Expected the consumer to get ID 1, got %d.", consumer.Id)
+	}
+
+	enabled := -1
+	tx.Get(&enabled, "SELECT `enabled` FROM `consumer` WHERE `id` = ?", consumer.Id)
+
+	if enabled != 1 {
+		t.Errorf("Expected the flag to be stored as 1, got %d.", enabled)
+	}
+
+	// timestamps are returned like MySQL does
+	found := findConsumer(consumer.Id, tx)
+	if found == nil || len(found.CreatedAt) != 19 || strings.Contains(found.CreatedAt, "T") {
+		t.Errorf("Unexpected timestamp format: %+v", found)
+	}
+}
+
+func TestSerialColumns(t *testing.T) {
+	db := newTestDatabase(t)
+
+	tables := make([]string, 0)
+	err := db.Select(&tables, "SELECT `name` FROM `sqlite_master` WHERE `type` = 'table' AND `name` NOT LIKE 'sqlite_%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the SQLite schema is maintained separately and must agree with the PostgreSQL one
+	for _, table := range tables {
+		create := ""
+		db.Get(&create, "SELECT `sql` FROM `sqlite_master` WHERE `type` = 'table' AND `name` = ?", table)
+
+		autoIncrement := strings.Contains(create, "AUTOINCREMENT")
+
+		if autoIncrement && serialColumns[table] != "id" {
+			t.Errorf("Inserts into %s would not report the new ID.", table)
+		}
+
+		if !autoIncrement && serialColumns[table] != "" {
+			t.Errorf("Inserts into %s would ask for the non-existing column %s.", table, serialColumns[table])
+		}
+	}
+
+	if len(serialColumns) == 0 {
+		t.Error("No auto-incremented columns were found in the schema.")
+	}
+}
+
+// sqliteSchema describes the tables (with their columns) and indexes of a SQLite database.
+func sqliteSchema(t *testing.T, db *sqlx.DB) map[string][]string {
+	tables := make([]string, 0)
+	schema := make(map[string][]string)
+
+	err := db.Select(&tables, "SELECT `name` FROM `sqlite_master` WHERE `type` = 'table' AND `name` NOT LIKE 'sqlite_%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range tables {
+		columns := make([]struct {
+			Id       int     `db:"cid"`
+			Name     string  `db:"name"`
+			Type     string  `db:"type"`
+			NotNull  bool    `db:"notnull"`
+			Default  *string `db:"dflt_value"`
+			Position int     `db:"pk"`
+		}, 0)
+
+		if err := db.Select(&columns, "PRAGMA table_info(`"+table+"`)"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, column := range columns {
+			description := fmt.Sprintf("%s NOT NULL=%v PK=%d", column.Name, column.NotNull, column.Position)
+
+			if column.Default != nil {
+				description += " DEFAULT " + *column.Default
+			}
+
+			schema[table] = append(schema[table], description)
+		}
+
+		indexes := make([]string, 0)
+		db.Select(&indexes, "SELECT `name` FROM `sqlite_master` WHERE `type` = 'index' AND `tbl_name` = ? AND `sql` IS NOT NULL", table)
+
+		for _, index := range indexes {
+			schema[table] = append(schema[table], "INDEX "+index)
+		}
+
+		sort.Strings(schema[table])
+	}
+
+	return schema
+}
+
+// TestMigrateSqlite upgrades the first schema that supported SQLite to the current one and compares
+// it to a freshly created database.
+func TestMigrateSqlite(t *testing.T) {
+	expected := sqliteSchema(t, newTestDatabase(t))
+
+	db := openTestDatabase(t)
+
+	script, err := ioutil.ReadFile("testdata/schema-1.7.sqlite.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := db.Connx(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, statement := range splitStatements(string(script)) {
+		if _, err := conn.ExecContext(context.Background(), statement); err != nil {
+			t.Fatalf("Could not create the old schema: %v", err)
+		}
+	}
+
+	conn.Close()
+
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if version, _ := databaseVersion(db); version != SchemaVersion() {
+		t.Errorf("Expected schema version %s after migrating, got %s.", SchemaVersion(), version)
+	}
+
+	migrated := sqliteSchema(t, db)
+
+	for table, columns := range expected {
+		if !reflect.DeepEqual(columns, migrated[table]) {
+			t.Errorf("Table %s differs after migrating:\n  fresh:    %v\n  migrated: %v", table, columns, migrated[table])
+		}
+	}
+
+	for table := range migrated {
+		if _, ok := expected[table]; !ok {
+			t.Errorf("Table %s only exists after migrating.", table)
+		}
+	}
+
+	// migrating again is a no-op
+	if err := migrateDatabase(db); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestQueriesOnSqlite runs the finders, background jobs and admin pages against a SQLite
+// database with some data in it. Every query that cannot be prepared fails the test.
+func TestQueriesOnSqlite(t *testing.T) {
+	db := newTestDatabase(t)
+
+	restrictionHandlers = map[string]RestrictionHandler{}
+	addRestrictionHandler(ApiKeyRestriction{})
+	addRestrictionHandler(OriginIpRestriction{})
+	addRestrictionHandler(HitLimitRestriction{})
+	addRestrictionHandler(ThrottleRestriction{})
+
+	var err error
+
+	templateManager, err = NewTemplateManager(resourceFS("templates"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhook := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer webhook.Close()
+
+	tx, _ := db.Beginx()
+
+	admin := createTestUser(t, "admin", tx)
+	email := "jane@example.com"
+	jane := &User{Id: -1, Name: "Jane", LoginName: "jane", Email: &email, Role: RoleUser, Backend: BackendLocal, _db: tx}
+
+	if err := jane.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer := createTestConsumer(t, "web", admin, tx)
+	secret := createTestSecret(t, "password", "hunter2", admin, tx, consumer)
+
+	generator, _ := NewSecretGenerator("password", 20, "", 0, "")
+	rotating := createTestSecret(t, "rotating", "old", admin, tx, consumer)
+
+	if err := rotating.setRotationPolicy(generator, 1); err != nil || rotating.Save() != nil {
+		t.Fatal("Could not set the rotation policy.")
+	}
+
+	tx.Exec("UPDATE `secret` SET `rotate_at` = ? WHERE `id` = ?", time.Now().AddDate(0, 0, -1).Format("2006-01-02 15:04:05"), rotating.Id)
+
+	err = consumer.WriteRestrictions(map[string]consumerRestriction{
+		"origin_ip": {Type: "origin_ip", Context: newOriginIpContext("192.0.2.0/24"), Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptions := []*Subscription{
+		{UserId: admin.Id, Secret: &secret.Id, Mode: NotifyImmediate, Channel: ChannelWebhook, WebhookUrl: &webhook.URL, _db: tx},
+		{UserId: jane.Id, Consumer: &consumer.Id, Mode: NotifyDigest, Channel: ChannelWebhook, WebhookUrl: &webhook.URL, _db: tx},
+	}
+
+	for _, subscription := range subscriptions {
+		if err := subscription.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := newTestRequest("GET", "/")
+	auditLog := NewAuditLog(tx, req)
+	auditLog.LogLogin(admin.Id)
+	auditLog.LogUserCreated(admin.Id, jane.Id)
+	auditLog.LogSecretUpdated(secret.Id, admin.Id)
+	notifySubscribers("secret-updated", secret.Id, consumer.Id, admin.Id, tx)
+
+	accessLog := NewAccessLog(tx)
+	for _, status := range []int{200, 403, 403, 404} {
+		accessLog.LogAccess(consumer, secret, req, status, nil)
+	}
+
+	if _, _, err := createShare(secret.Id, consumer, []byte("hunter2"), -time.Minute, admin, tx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// alerts
+	config.Alerts.DeniedBurst.Threshold = 2
+	config.Alerts.DeniedBurst.Window = "1h"
+	config.Alerts.NotFoundBurst.Threshold = 1
+	config.Alerts.NotFoundBurst.Window = "1h"
+	config.Alerts.NewOriginIp = true
+
+	rules, err := NewAlertRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, _ = db.Beginx()
+	for _, entry := range NewAccessLog(tx).FindAll(10, 0) {
+		entry := entry
+		rules.Evaluate(&entry, tx)
+	}
+	tx.Commit()
+
+	// background jobs
+	rotator, _ := NewSecretRotator(config)
+	if rotated, err := rotator.RotateDue(db); err != nil || rotated != 1 {
+		t.Errorf("Expected one rotated secret, got %d (%v).", rotated, err)
+	}
+
+	monitor, _ := NewCertificateMonitor(config)
+	if err := monitor.Scan(db); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := monitor.Warn(db); err != nil {
+		t.Error(err)
+	}
+
+	reaper, _ := NewLeaseReaper(config)
+	if _, err := reaper.Reap(db); err != nil {
+		t.Error(err)
+	}
+
+	sweeper, _ := NewShareSweeper(config)
+	if expired, err := sweeper.Sweep(db); err != nil || expired != 1 {
+		t.Errorf("Expected one expired share, got %d (%v).", expired, err)
+	}
+
+	queue, _ := NewNotificationQueue(config)
+	if err := queue.buildDigests(db); err != nil {
+		t.Error(err)
+	}
+
+	if err := queue.process(db); err != nil {
+		t.Error(err)
+	}
+
+	if err := writeCheckpointsOnce(db); err != nil {
+		t.Error(err)
+	}
+
+	// finders and pages
+	tx, _ = db.Beginx()
+	defer tx.Rollback()
+
+	session := &Session{CsrfToken: "csrf"}
+	admin = findUser(admin.Id, false, tx)
+
+	if len(findAllUsers(false, tx)) != 2 || findUserByLogin("jane", true, tx) == nil || findUserByEmail(email, tx) == nil {
+		t.Error("The users could not be found.")
+	}
+
+	if len(findUsersByBackend(BackendLocal, tx)) != 2 || findUserByOidcSubject("subject", tx) != nil {
+		t.Error("The users could not be found by their backend.")
+	}
+
+	if len(findAllSecrets(true, tx)) != 2 || findSecretBySlug("password", true, tx) == nil || len(findSecretVersions(rotating.Id, tx)) != 1 {
+		t.Error("The secrets could not be found.")
+	}
+
+	if len(findAllConsumers(tx)) != 1 || !findConsumer(consumer.Id, tx).HasSecret(secret.Id) || len(findRestrictionsByConsumer(consumer.Id, true, tx)) != 1 {
+		t.Error("The consumers could not be found.")
+	}
+
+	if len(findOpenAlerts("2000-01-01", 10, tx)) == 0 {
+		t.Error("No alerts were raised.")
+	}
+
+	if len(findSubscriptionsByUser(admin.Id, tx)) != 1 || findSubscriber(jane.Id, 0, consumer.Id, tx) == nil {
+		t.Error("The subscriptions could not be found.")
+	}
+
+	auditLog = NewAuditLog(tx, req)
+	ids := []int{1}
+
+	if auditLog.Count(nil, nil, nil, nil, []string{"user-login"}) != 1 || len(auditLog.Find(nil, nil, nil, ids, []string{"user-login"}, 10, 0)) != 1 {
+		t.Error("The audit log could not be filtered.")
+	}
+
+	auditLog.Find(ids, ids, ids, ids, []string{"user-login"}, 10, 0)
+
+	accessLog = NewAccessLog(tx)
+
+	if accessLog.Count(ids, ids, []int{403}) != 2 || len(accessLog.Find(ids, ids, []int{403}, 10, 0)) != 2 {
+		t.Error("The access log could not be filtered.")
+	}
+
+	changes := changesSince(consumer.Id, 0, tx)
+	versions := currentVersions(consumer.Id, tx)
+
+	if len(changes.Changes) != 2 || len(versions.Changes) != 2 {
+		t.Errorf("Unexpected changes %+v and versions %+v.", changes, versions)
+	}
+
+	findShares(secret.Id, 10, tx)
+	findLeases(secret.Id, 10, tx)
+	findActiveLeases(secret.Id, tx)
+	findIssuedCertificates(secret.Id, 10, tx)
+	findRevokedCertificates(secret.Id, tx)
+	findExpiringCertificates(30, 10, tx)
+	findConsumerKey(consumer.Id, tx)
+
+	// removals name their secret, which might be gone
+	auditLog.LogSecretUnassigned(secret, consumer.Id, admin.Id)
+	auditLog.LogSecretDeleted(&Secret{Name: "gone", Slug: "gone"}, []int{consumer.Id}, admin.Id)
+	deletionRecipients(secret.Id, tx)
+
+	params := func(id int) martini.Params {
+		return martini.Params{"id": strconv.Itoa(id)}
+	}
+
+	pages := map[string]func() response{
+		"dashboard":       func() response { return dashboardAction(admin, req, session, tx) },
+		"users":           func() response { return usersIndexAction(admin, session, tx) },
+		"user":            func() response { return usersEditAction(params(jane.Id), admin, session, tx) },
+		"delete user":     func() response { return usersDeleteConfirmAction(params(jane.Id), admin, session, tx) },
+		"secrets":         func() response { return secretsIndexAction(admin, session, tx) },
+		"secret":          func() response { return secretsEditAction(params(secret.Id), admin, session, tx) },
+		"delete secret":   func() response { return secretsDeleteConfirmAction(params(secret.Id), admin, session, tx) },
+		"consumers":       func() response { return consumersIndexAction(admin, session, tx) },
+		"consumer":        func() response { return consumersEditAction(params(consumer.Id), admin, session, tx) },
+		"delete consumer": func() response { return consumersDeleteConfirmAction(params(consumer.Id), admin, session, tx) },
+		"consumer urls":   func() response { return consumersUrlsAction(params(consumer.Id), admin, req, session, tx) },
+		"audit log": func() response {
+			return auditLogIndexAction(admin, newTestRequest("GET", "/auditlog?action=login"), session, tx)
+		},
+		"removals": func() response {
+			return auditLogIndexAction(admin, newTestRequest("GET", "/auditlog?action=secret-unassigned&action=secret-deleted"), session, tx)
+		},
+		"access log": func() response {
+			return accessLogIndexAction(admin, newTestRequest("GET", "/accesslog?status=403"), session, tx)
+		},
+		"access log volume": func() response { return accessLogVolumeAction(admin, session, tx) },
+		"log verification":  func() response { return logVerificationAction(admin, session, tx) },
+		"profile":           func() response { return profileAction(admin, session, tx) },
+		"import":            func() response { return secretsImportFormAction(admin, session, tx) },
+	}
+
+	for name, page := range pages {
+		if resp := page(); resp.Status != 200 {
+			t.Errorf("The %s page returned %d.", name, resp.Status)
+		}
+	}
+
+	if result := verifyAuditLog(tx); !result.Okay() {
+		t.Errorf("The audit log is broken: %s", result.Problem)
+	}
+
+	if result := verifyAccessLog(tx); !result.Okay() {
+		t.Errorf("The access log is broken: %s", result.Problem)
+	}
+
+	// deleting
+	for _, err := range []error{findSubscription(subscriptions[0].Id, tx).Delete(), findUser(jane.Id, false, tx).Delete(), findConsumer(consumer.Id, tx).Delete(), findSecret(secret.Id, false, tx).Delete()} {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
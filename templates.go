@@ -4,8 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
-	"log"
-	"path/filepath"
+	"io/fs"
+	"path"
 	"strings"
 	"time"
 
@@ -13,7 +13,7 @@ import (
 )
 
 type TemplateManager struct {
-	rootDir   string
+	files     fs.FS
 	bufpool   *bpool.BufferPool
 	templates map[string]*template.Template
 	functions template.FuncMap
@@ -31,11 +31,13 @@ func NewLayoutData(title string, active string, user *User, csrfToken string) la
 	return layoutData{title, active, user, csrfToken, config.Server.BaseUrl}
 }
 
-func NewTemplateManager(rootDir string) *TemplateManager {
+// NewTemplateManager parses all templates in the given file system. The manager is returned even
+// if some templates are broken, together with their errors.
+func NewTemplateManager(files fs.FS) (*TemplateManager, error) {
 	tm := &TemplateManager{}
 
 	tm.bufpool = bpool.NewBufferPool(64)
-	tm.rootDir = rootDir
+	tm.files = files
 	tm.functions = template.FuncMap{
 		"time": func(value string) template.HTML {
 			t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
@@ -64,57 +66,113 @@ func NewTemplateManager(rootDir string) *TemplateManager {
 		},
 	}
 
-	tm.Init()
+	err := tm.Init()
 
-	return tm
+	return tm, err
 }
 
-func (tm *TemplateManager) Init() {
+// TemplateErrors collects the parse errors of all broken template files.
+type TemplateErrors []error
+
+func (e TemplateErrors) Error() string {
+	messages := make([]string, len(e))
+
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+// Init (re-)parses all templates. Broken files do not prevent the other templates from being
+// loaded; their errors are returned as TemplateErrors. If a template was loaded successfully
+// before, the old version is kept.
+func (tm *TemplateManager) Init() error {
+	previous := tm.templates
+	errs := make(TemplateErrors, 0)
+
 	tm.templates = make(map[string]*template.Template)
 
-	// load auxiliary templates
-	includes, err := filepath.Glob(tm.rootDir + "/includes/*.html")
+	// load auxiliary templates, skipping broken ones so they do not break every page
+	candidates, err := fs.Glob(tm.files, "includes/*.html")
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	includes := make([]string, 0, len(candidates))
+
+	for _, include := range candidates {
+		_, err := template.New(include).Funcs(tm.functions).ParseFS(tm.files, include)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", include, err))
+			continue
+		}
+
+		includes = append(includes, include)
 	}
 
-	templates, err := filepath.Glob(tm.rootDir + "/*/*.html")
+	templates, err := fs.Glob(tm.files, "*/*.html")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	// Generate our templates map from our layouts/ and includes/ directories
 	for _, tpl := range templates {
-		directory := filepath.Base(filepath.Dir(tpl))
+		directory := path.Base(path.Dir(tpl))
 
 		if directory == "includes" {
 			continue
 		}
 
-		identifier := directory + "/" + strings.TrimSuffix(filepath.Base(tpl), ".html")
-		files := append(includes, tpl)
+		identifier := directory + "/" + strings.TrimSuffix(path.Base(tpl), ".html")
+		files := append(append([]string{}, includes...), tpl)
 
-		tm.Add(identifier, files)
+		err := tm.Add(identifier, files)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", tpl, err))
+
+			if old, ok := previous[identifier]; ok {
+				tm.templates[identifier] = old
+			}
+		}
 	}
 
 	// load un-namespaces files (do not inherit the includes)
-	raws, err := filepath.Glob(tm.rootDir + "/*.html")
+	raws, err := fs.Glob(tm.files, "*.html")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	// Generate our templates map from our layouts/ and includes/ directories
 	for _, tpl := range raws {
-		identifier := strings.TrimSuffix(filepath.Base(tpl), ".html")
+		identifier := strings.TrimSuffix(path.Base(tpl), ".html")
+
+		err := tm.Add(identifier, []string{tpl})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", tpl, err))
+
+			if old, ok := previous[identifier]; ok {
+				tm.templates[identifier] = old
+			}
+		}
+	}
 
-		tm.Add(identifier, []string{tpl})
+	if len(errs) > 0 {
+		return errs
 	}
+
+	return nil
 }
 
-func (tm *TemplateManager) Add(identifier string, templates []string) {
-	tpl := template.New(identifier)
+func (tm *TemplateManager) Add(identifier string, templates []string) error {
+	tpl, err := template.New(identifier).Funcs(tm.functions).ParseFS(tm.files, templates...)
+	if err != nil {
+		return err
+	}
+
+	tm.templates[identifier] = tpl
 
-	tm.templates[identifier] = template.Must(tpl.Funcs(tm.functions).ParseFiles(templates...))
+	return nil
 }
 
 func (tm *TemplateManager) Has(templateName string) bool {
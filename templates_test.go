@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedTemplates(t *testing.T) {
+	files := resourceFS("templates")
+
+	tm, err := NewTemplateManager(files)
+	if err != nil {
+		t.Fatalf("The embedded templates are broken: %v", err)
+	}
+
+	templates, _ := fs.Glob(files, "*/*.html")
+	raws, _ := fs.Glob(files, "*.html")
+
+	if len(templates) == 0 || len(raws) == 0 {
+		t.Fatal("No templates have been embedded.")
+	}
+
+	for _, tpl := range append(templates, raws...) {
+		identifier := strings.TrimSuffix(tpl, ".html")
+
+		if !strings.HasPrefix(tpl, "includes/") && !tm.Has(identifier) {
+			t.Errorf("Template '%s' has not been loaded.", identifier)
+		}
+	}
+
+	config = &configuration{}
+
+	html, err := tm.Render("error", map[string]string{"Error": "Something <broke>.", "PageTitle": "Aw snap!"})
+	if err != nil || !strings.Contains(html, "Something &lt;broke&gt;.") {
+		t.Errorf("The error page could not be rendered: %v", err)
+	}
+
+	if _, err := tm.Render("secrets/missing", nil); err == nil {
+		t.Error("A missing template was rendered.")
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	files := fstest.MapFS{
+		"includes/layout.html": {Data: []byte(`{{define "root"}}<main>{{template "content" .}}</main>{{end}}`)},
+		"includes/broken.html": {Data: []byte(`{{define "broken"}}{{if}}{{end}}`)},
+		"pages/good.html":      {Data: []byte(`{{define "content"}}{{shorten . 6}}{{end}}`)},
+		"pages/bad.html":       {Data: []byte(`{{define "content"}}{{.Missing{{end}}`)},
+		"plain.html":           {Data: []byte(`{{define "root"}}plain{{end}}`)},
+	}
+
+	tm, err := NewTemplateManager(files)
+
+	var errs TemplateErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("Expected two template errors, got %v.", err)
+	}
+
+	if !strings.HasPrefix(errs[0].Error(), "includes/broken.html: ") || !strings.HasPrefix(errs[1].Error(), "pages/bad.html: ") {
+		t.Errorf("The errors do not name the broken files: %v", errs)
+	}
+
+	// a broken include or page does not take the other pages down
+	if html, err := tm.Render("pages/good", "abcdefghij"); err != nil || html != "<main>abc…hij</main>" {
+		t.Errorf("The good page was not rendered: %q (%v)", html, err)
+	}
+
+	if html, err := tm.Render("plain", nil); err != nil || html != "plain" {
+		t.Errorf("The plain page was not rendered: %q (%v)", html, err)
+	}
+
+	if tm.Has("pages/bad") {
+		t.Error("The broken page has been loaded.")
+	}
+
+	// breaking a page that worked before keeps the old version until it is fixed
+	files["pages/good.html"] = &fstest.MapFile{Data: []byte(`{{define "content"}}{{end`)}
+
+	if err := tm.Init(); err == nil || !strings.Contains(err.Error(), "pages/good.html: ") {
+		t.Errorf("The broken page was not reported: %v", err)
+	}
+
+	if html, _ := tm.Render("pages/good", "abc"); html != "<main>abc</main>" {
+		t.Errorf("The previous version was not kept: %q", html)
+	}
+}
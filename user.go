@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"net/http"
+	"net/mail"
 	"strconv"
 	"strings"
 
@@ -9,17 +11,59 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+const (
+	BackendLocal = "local"
+	BackendLdap  = "ldap"
+	BackendOidc  = "oidc"
+)
+
 type User struct {
 	Id          int     `db:"id"`
 	LoginName   string  `db:"login"`
 	Password    *string `db:"password"`
 	Name        string  `db:"name"`
+	Role        string  `db:"role"`
+	Backend     string  `db:"backend"`
+	ExternalId  *string `db:"external_id"`
+	Email       *string `db:"email"`
+	OidcSubject *string `db:"oidc_subject"`
 	LastLoginAt *string `db:"last_login_at"`
 	Deleted     *string `db:"deleted"`
 
 	_db *sqlx.Tx
 }
 
+// validateEmail normalizes an optional e-mail address and makes sure that no other user uses
+// it, as it is used to link single sign-on identities to existing accounts.
+func validateEmail(email string, userId int, db *sqlx.Tx) (*string, error) {
+	if len(email) == 0 {
+		return nil, nil
+	}
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return nil, errors.New("This is not a valid e-mail address.")
+	}
+
+	normalized := strings.ToLower(email)
+
+	existing := findUserByEmail(normalized, db)
+	if existing != nil && existing.Id != userId {
+		return nil, errors.New("This e-mail address is already in use.")
+	}
+
+	return &normalized, nil
+}
+
+func isValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleUser
+}
+
 func findAllUsers(loadPasswords bool, db *sqlx.Tx) []User {
 	list := make([]User, 0)
 	passwordCol := ""
@@ -28,7 +72,7 @@ func findAllUsers(loadPasswords bool, db *sqlx.Tx) []User {
 		passwordCol = ", `password`"
 	}
 
-	db.Select(&list, "SELECT `id`, `login`, `name`, `last_login_at`, `deleted`"+passwordCol+" FROM `user` WHERE `deleted` IS NULL ORDER BY `name`, `login`")
+	db.Select(&list, "SELECT `id`, `login`, `name`, `role`, `backend`, `external_id`, `email`, `oidc_subject`, `last_login_at`, `deleted`"+passwordCol+" FROM `user` WHERE `deleted` IS NULL ORDER BY `name`, `login`")
 
 	for i := range list {
 		list[i]._db = db
@@ -47,7 +91,7 @@ func findUser(id int, loadPassword bool, db *sqlx.Tx) *User {
 		passwordCol = ", `password`"
 	}
 
-	db.Get(user, "SELECT `id`, `login`, `name`, `last_login_at`, `deleted`"+passwordCol+" FROM `user` WHERE `id` = ?", id)
+	db.Get(user, "SELECT `id`, `login`, `name`, `role`, `backend`, `external_id`, `email`, `oidc_subject`, `last_login_at`, `deleted`"+passwordCol+" FROM `user` WHERE `id` = ?", id)
 	if user.Id == 0 {
 		return nil
 	}
@@ -70,7 +114,7 @@ func findUserByLogin(login string, loadPassword bool, db *sqlx.Tx) *User {
 		passwordCol = ", `password`"
 	}
 
-	db.Get(user, "SELECT `id`, `login`, `name`, `last_login_at`, `deleted`"+passwordCol+" FROM `user` WHERE `login` = ? AND `deleted` IS NULL", validated)
+	db.Get(user, "SELECT `id`, `login`, `name`, `role`, `backend`, `external_id`, `email`, `oidc_subject`, `last_login_at`, `deleted`"+passwordCol+" FROM `user` WHERE `login` = ? AND `deleted` IS NULL", validated)
 	if user.Id == 0 {
 		return nil
 	}
@@ -78,11 +122,48 @@ func findUserByLogin(login string, loadPassword bool, db *sqlx.Tx) *User {
 	return user
 }
 
+// findUserByOidcSubject also returns deleted users, so that their subject is not provisioned again.
+func findUserByOidcSubject(subject string, db *sqlx.Tx) *User {
+	user := &User{}
+	user._db = db
+
+	db.Get(user, "SELECT `id`, `login`, `name`, `role`, `backend`, `external_id`, `email`, `oidc_subject`, `last_login_at`, `deleted` FROM `user` WHERE `oidc_subject` = ?", subject)
+	if user.Id == 0 {
+		return nil
+	}
+
+	return user
+}
+
+func findUserByEmail(email string, db *sqlx.Tx) *User {
+	user := &User{}
+	user._db = db
+
+	db.Get(user, "SELECT `id`, `login`, `name`, `role`, `backend`, `external_id`, `email`, `oidc_subject`, `last_login_at`, `deleted` FROM `user` WHERE `email` = ? AND `deleted` IS NULL", strings.ToLower(email))
+	if user.Id == 0 {
+		return nil
+	}
+
+	return user
+}
+
+func findUsersByBackend(backend string, db *sqlx.Tx) []User {
+	list := make([]User, 0)
+
+	db.Select(&list, "SELECT `id`, `login`, `name`, `role`, `backend`, `external_id`, `email`, `oidc_subject`, `last_login_at`, `deleted` FROM `user` WHERE `backend` = ? AND `deleted` IS NULL ORDER BY `login`", backend)
+
+	for i := range list {
+		list[i]._db = db
+	}
+
+	return list
+}
+
 func (u *User) Save() error {
 	if u.Id <= 0 {
 		result, err := u._db.Exec(
-			"INSERT INTO `user` (`name`, `login`, `password`, `last_login_at`, `deleted`) VALUES (?,?,?,NULL,?)",
-			u.Name, u.LoginName, u.Password, u.Deleted,
+			"INSERT INTO `user` (`name`, `login`, `password`, `role`, `backend`, `external_id`, `email`, `oidc_subject`, `last_login_at`, `deleted`) VALUES (?,?,?,?,?,?,?,?,NULL,?)",
+			u.Name, u.LoginName, u.Password, u.Role, u.Backend, u.ExternalId, u.Email, u.OidcSubject, u.Deleted,
 		)
 
 		if err != nil {
@@ -102,13 +183,13 @@ func (u *User) Save() error {
 		// deleted=0 is to guarantee that we do not modify deleted users
 		if u.Password == nil {
 			_, err = u._db.Exec(
-				"UPDATE `user` SET `name` = ?, `login` = ?, `last_login_at` = ?, `deleted` = ? WHERE `id` = ? AND `deleted` IS NULL",
-				u.Name, u.LoginName, u.LastLoginAt, u.Deleted, u.Id,
+				"UPDATE `user` SET `name` = ?, `login` = ?, `role` = ?, `external_id` = ?, `email` = ?, `oidc_subject` = ?, `last_login_at` = ?, `deleted` = ? WHERE `id` = ? AND `deleted` IS NULL",
+				u.Name, u.LoginName, u.Role, u.ExternalId, u.Email, u.OidcSubject, u.LastLoginAt, u.Deleted, u.Id,
 			)
 		} else {
 			_, err = u._db.Exec(
-				"UPDATE `user` SET `name` = ?, `login` = ?, `last_login_at` = ?, `password` = ?, `deleted` = ? WHERE `id` = ? AND `deleted` IS NULL",
-				u.Name, u.LoginName, u.LastLoginAt, u.Password, u.Deleted, u.Id,
+				"UPDATE `user` SET `name` = ?, `login` = ?, `role` = ?, `external_id` = ?, `email` = ?, `oidc_subject` = ?, `last_login_at` = ?, `password` = ?, `deleted` = ? WHERE `id` = ? AND `deleted` IS NULL",
+				u.Name, u.LoginName, u.Role, u.ExternalId, u.Email, u.OidcSubject, u.LastLoginAt, u.Password, u.Deleted, u.Id,
 			)
 		}
 
@@ -134,6 +215,16 @@ func (u *User) TouchOnLogin() error {
 	return err
 }
 
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// IsExternal returns true if the account is managed by an external directory and hence cannot
+// be edited from within Raziel. SSO users are not, as the IdP does not tell us about roles.
+func (u *User) IsExternal() bool {
+	return u.Backend == BackendLdap
+}
+
 // interface for sessionauth.User
 
 // Return whether this user is logged in or not
@@ -185,6 +276,11 @@ type userFormData struct {
 	LoginName     string
 	LoginError    string
 	PasswordError string
+	Email         string
+	EmailError    string
+	Role          string
+	RoleError     string
+	Backend       string
 	LastLoginAt   string
 	Deleted       string
 	OtherError    string
@@ -194,6 +290,13 @@ func (data *userFormData) fromUser(u *User) {
 	data.User = u.Id
 	data.Name = u.Name
 	data.LoginName = u.LoginName
+	data.Role = u.Role
+	data.Backend = u.Backend
+	data.Email = ""
+
+	if u.Email != nil {
+		data.Email = *u.Email
+	}
 	data.LastLoginAt = ""
 	data.Deleted = ""
 
@@ -210,7 +313,7 @@ func usersIndexAction(user *User, session *Session, db *sqlx.Tx) response {
 	data := &userListData{NewLayoutData("Users", "users", user, session.CsrfToken), make([]User, 0)}
 
 	// find users (do not even select the user itself, we don't need it)
-	db.Select(&data.Users, "SELECT `id`, `login`, `name`, `last_login_at`, `deleted` FROM `user` WHERE `deleted` IS NULL ORDER BY `name`")
+	db.Select(&data.Users, "SELECT `id`, `login`, `name`, `role`, `backend`, `external_id`, `email`, `oidc_subject`, `last_login_at`, `deleted` FROM `user` WHERE `deleted` IS NULL ORDER BY `name`")
 
 	for i := range data.Users {
 		data.Users[i]._db = db
@@ -221,6 +324,8 @@ func usersIndexAction(user *User, session *Session, db *sqlx.Tx) response {
 
 func usersAddAction(user *User, session *Session) response {
 	data := &userFormData{layoutData: NewLayoutData("Add User", "users", user, session.CsrfToken)}
+	data.Role = RoleUser
+	data.Backend = BackendLocal
 
 	return renderTemplate(200, "users/form", data)
 }
@@ -230,9 +335,14 @@ func usersCreateAction(req *http.Request, user *User, session *Session, db *sqlx
 	name := strings.TrimSpace(req.FormValue("name"))
 	login := strings.TrimSpace(req.FormValue("login"))
 	password := strings.TrimSpace(req.FormValue("password"))
+	email := strings.TrimSpace(req.FormValue("email"))
+	role := req.FormValue("role")
 
 	data.Name = name
 	data.LoginName = login
+	data.Email = email
+	data.Role = role
+	data.Backend = BackendLocal
 
 	if len(name) == 0 {
 		data.NameError = "The name cannot be empty."
@@ -245,14 +355,26 @@ func usersCreateAction(req *http.Request, user *User, session *Session, db *sqlx
 		return renderTemplate(400, "users/form", data)
 	}
 
+	validatedEmail, err := validateEmail(email, 0, db)
+	if err != nil {
+		data.EmailError = err.Error()
+		return renderTemplate(400, "users/form", data)
+	}
+
+	if !isValidRole(role) {
+		data.RoleError = "Please choose a valid role."
+		return renderTemplate(400, "users/form", data)
+	}
+
 	s := findUserByLogin(validated, false, db)
 	if s != nil {
 		data.LoginError = "This login is already in use."
 		return renderTemplate(400, "users/form", data)
 	}
 
-	if len(password) < 4 {
-		data.PasswordError = "The passphrase must be at least 4 characters long."
+	err = passwordPolicy.Check(password, validated, nil, db)
+	if err != nil {
+		data.PasswordError = err.Error()
 		return renderTemplate(400, "users/form", data)
 	}
 
@@ -262,6 +384,9 @@ func usersCreateAction(req *http.Request, user *User, session *Session, db *sqlx
 		Name:      name,
 		LoginName: validated,
 		Password:  &hashed,
+		Email:     validatedEmail,
+		Role:      role,
+		Backend:   BackendLocal,
 		_db:       db,
 	}
 
@@ -270,6 +395,11 @@ func usersCreateAction(req *http.Request, user *User, session *Session, db *sqlx
 		panic(err)
 	}
 
+	err = newUser.RememberPassword()
+	if err != nil {
+		panic(err)
+	}
+
 	auditLog := NewAuditLog(db, req)
 	auditLog.LogUserCreated(user.Id, newUser.Id)
 
@@ -312,16 +442,27 @@ func usersUpdateAction(params martini.Params, req *http.Request, currentUser *Us
 	name := strings.TrimSpace(req.FormValue("name"))
 	login := strings.TrimSpace(req.FormValue("login"))
 	password := strings.TrimSpace(req.FormValue("password"))
+	email := strings.TrimSpace(req.FormValue("email"))
+	role := req.FormValue("role")
 
 	data.User = subject.Id
 	data.Name = name
 	data.LoginName = login
+	data.Email = email
+	data.Role = role
+	data.Backend = subject.Backend
 
 	if subject.Deleted != nil {
 		data.OtherError = "This user has been deleted and cannot be edited anymore."
 		return renderTemplate(409, "users/form", data)
 	}
 
+	if subject.IsExternal() {
+		data.fromUser(subject)
+		data.OtherError = "This user is managed by an external directory and cannot be edited here."
+		return renderTemplate(409, "users/form", data)
+	}
+
 	if len(name) == 0 {
 		data.NameError = "The name cannot be empty."
 		return renderTemplate(400, "users/form", data)
@@ -333,6 +474,17 @@ func usersUpdateAction(params martini.Params, req *http.Request, currentUser *Us
 		return renderTemplate(400, "users/form", data)
 	}
 
+	validatedEmail, err := validateEmail(email, subject.Id, db)
+	if err != nil {
+		data.EmailError = err.Error()
+		return renderTemplate(400, "users/form", data)
+	}
+
+	if !isValidRole(role) {
+		data.RoleError = "Please choose a valid role."
+		return renderTemplate(400, "users/form", data)
+	}
+
 	existing := findUserByLogin(validated, false, db)
 	if existing != nil && existing.Id != subject.Id {
 		data.LoginError = "This login is already in use."
@@ -341,8 +493,16 @@ func usersUpdateAction(params martini.Params, req *http.Request, currentUser *Us
 
 	subject.Name = name
 	subject.LoginName = validated
+	subject.Email = validatedEmail
+	subject.Role = role
 
 	if len(password) > 0 {
+		err = passwordPolicy.Check(password, validated, subject, db)
+		if err != nil {
+			data.PasswordError = err.Error()
+			return renderTemplate(400, "users/form", data)
+		}
+
 		hashed := string(HashBcrypt(password))
 		subject.Password = &hashed
 	}
@@ -352,6 +512,13 @@ func usersUpdateAction(params martini.Params, req *http.Request, currentUser *Us
 		panic(err)
 	}
 
+	if len(password) > 0 {
+		err = subject.RememberPassword()
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	auditLog := NewAuditLog(db, req)
 	auditLog.LogUserUpdated(currentUser.Id, subject.Id)
 
@@ -425,5 +592,5 @@ func setupUsersCtrl(app *martini.ClassicMartini) {
 		app.Put("/:id", sessions.RequireCsrfToken, usersUpdateAction)
 		app.Delete("/:id", sessions.RequireCsrfToken, usersDeleteAction)
 		app.Get("/:id/delete", usersDeleteConfirmAction)
-	}, sessions.RequireLogin)
+	}, sessions.RequireLogin, sessions.RequireAdmin)
 }
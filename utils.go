@@ -18,8 +18,9 @@ func matches(regex string, target string) bool {
 }
 
 type response struct {
-	Status  int
-	Content string
+	Status      int
+	Content     string
+	ContentType string
 }
 
 type countResultSet struct {
@@ -27,7 +28,7 @@ type countResultSet struct {
 }
 
 func newResponse(status int, content string) response {
-	return response{status, content}
+	return response{status, content, ""}
 }
 
 func renderTemplate(status int, tpl string, data interface{}) response {
@@ -39,6 +40,15 @@ func renderTemplate(status int, tpl string, data interface{}) response {
 	return newResponse(status, page)
 }
 
+func renderJSON(status int, data interface{}) response {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+
+	return response{status, string(encoded), "application/json"}
+}
+
 func renderError(status int, message string) response {
 	data := make(map[string]string)
 	data["Error"] = message